@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"endorsement-distribution/internal/store"
+)
+
+// keygen implements the keygen subcommand: it prints, one per line, the
+// lookup keys synthesized for a CoSERV query without running the server.
+func keygen(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	tenant := fs.String("tenant", "0", "tenant ID the keys are synthesized for")
+	query := fs.String("query", "", "base64url-encoded CoSERV query")
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if *query == "" {
+		fmt.Fprintln(stderr, "keygen: --query is required")
+		fs.Usage()
+		return 2
+	}
+
+	keys, err := store.GenerateKey(*tenant, *query)
+	if err != nil {
+		fmt.Fprintf(stderr, "keygen: failed to generate keys: %v\n", err)
+		return 1
+	}
+
+	for _, key := range keys {
+		fmt.Fprintln(stdout, key)
+	}
+
+	return 0
+}
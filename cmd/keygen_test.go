@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/veraison/corim/comid"
+	"github.com/veraison/corim/coserv"
+	"github.com/veraison/services/scheme/common/arm"
+
+	"endorsement-distribution/internal/store"
+)
+
+// refValQuery returns a base64url reference value query for the class of
+// comid.TestImplID
+func refValQuery(t *testing.T) string {
+	t.Helper()
+
+	selector := coserv.NewEnvironmentSelector().AddClass(*comid.NewClassImplID(comid.TestImplID))
+	q, err := coserv.NewQuery(coserv.ArtifactTypeReferenceValues, *selector)
+	if err != nil {
+		t.Fatalf("NewQuery: %v", err)
+	}
+
+	c, err := coserv.NewCoserv("tag:arm.com,2023:cca_platform#1.0.0", *q)
+	if err != nil {
+		t.Fatalf("NewCoserv: %v", err)
+	}
+
+	s, err := c.ToBase64Url()
+	if err != nil {
+		t.Fatalf("ToBase64Url: %v", err)
+	}
+
+	return s
+}
+
+func TestKeygen(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := keygen([]string{"--tenant", "acme", "--query", refValQuery(t)}, &stdout, &stderr); code != 0 {
+		t.Fatalf("keygen = %d, stderr: %s", code, stderr.String())
+	}
+
+	want := arm.RefValLookupKey(store.SchemeName, "acme", comid.TestImplID.String()) + "\n"
+	if got := stdout.String(); got != want {
+		t.Errorf("keygen printed %q, want %q", got, want)
+	}
+}
+
+func TestKeygenErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		wantCode int
+		wantErr  string
+	}{
+		{"no query", []string{"--tenant", "acme"}, 2, "--query is required"},
+		{"unknown flag", []string{"--tenants", "acme"}, 2, "flag provided but not defined"},
+		{"malformed query", []string{"--query", "not*base64!"}, 1, "failed to generate keys"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if code := keygen(tt.args, &stdout, &stderr); code != tt.wantCode {
+				t.Errorf("keygen = %d, want %d", code, tt.wantCode)
+			}
+			if !strings.Contains(stderr.String(), tt.wantErr) {
+				t.Errorf("stderr = %q, want it to contain %q", stderr.String(), tt.wantErr)
+			}
+			if stdout.Len() != 0 {
+				t.Errorf("stdout = %q, want nothing printed", stdout.String())
+			}
+		})
+	}
+}
@@ -2,84 +2,441 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
-	"github.com/gin-gonic/gin"
-	"github.com/spf13/viper"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 
 	"endorsement-distribution/internal/api"
 	"endorsement-distribution/internal/config"
 	"endorsement-distribution/internal/store"
+	"endorsement-distribution/internal/tracing"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "keygen":
+			os.Exit(keygen(os.Args[2:], os.Stdout, os.Stderr))
+		case "serve":
+		default:
+			fmt.Printf("Unknown subcommand %q (expected serve or keygen)\n", os.Args[1])
+			os.Exit(2)
+		}
+	}
+
+	os.Exit(serve())
+}
+
+// serve runs the HTTP servers, and the gRPC one if enabled, until it receives SIGINT or SIGTERM, and
+// returns the exit code. Past the creation of the store, failures return
+// rather than exit, so that the deferred close of the store (which writes
+// the memory snapshot) and trace flush still run.
+func serve() int {
 	// Load configuration
 	cfg, err := config.Load()
 	if err != nil {
 		fmt.Printf("Failed to load config: %v\n", err)
-		os.Exit(1)
+		return 1
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Printf("Invalid config:\n%v\n", err)
+		return 1
 	}
 
 	// Initialize logger
-	logger, err := zap.NewProduction()
+	logger, err := newLogger(cfg.Logging)
 	if err != nil {
 		fmt.Printf("Failed to create logger: %v\n", err)
-		os.Exit(1)
+		return 1
 	}
 	defer logger.Sync()
 
 	sugar := logger.Sugar()
 	sugar.Info("Starting endorsement-distribution service")
 
+	// Export traces, if configured
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing)
+	if err != nil {
+		sugar.Errorw("Failed to set up tracing", "error", err)
+		return 1
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			sugar.Warnw("Failed to flush traces", "error", err)
+		}
+	}()
+
 	// Initialize database store
-	dbStore, err := store.NewPostgresStore(cfg.Database)
+	dbStore, err := newStore(cfg.Database, sugar)
 	if err != nil {
-		sugar.Fatalw("Failed to initialize database store", "error", err)
+		sugar.Errorw("Failed to initialize database store", "error", err)
+		return 1
+	}
+	// Once wrapped below, the store is closed through its wrappers, which
+	// close what they wrap
+	closer := dbStore
+	defer func() {
+		if err := closer.Close(); err != nil {
+			sugar.Errorw("Failed to close database store", "error", err)
+		}
+	}()
+
+	// Start the integrity scan of stored rows, if enabled
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+
+	var reconciler *store.Reconciler
+	if cfg.Reconciler.Enabled {
+		if pg, ok := dbStore.(*store.PostgresStore); ok {
+			reconciler = store.NewReconciler(pg, cfg.Reconciler, sugar)
+			go reconciler.Run(jobsCtx)
+		} else {
+			sugar.Warnw("Integrity scan is only supported by the postgres driver", "driver", cfg.Database.Driver)
+		}
+	}
+
+	// Compare lookups against the shadow database, if enabled. The cache
+	// goes in front, so that only the lookups reaching the database are
+	// repeated.
+	distStore := dbStore
+	var shadowStore *store.ShadowStore
+	if cfg.Shadow.Enabled {
+		shadowDB, err := newStore(cfg.Shadow.Database, sugar)
+		if err != nil {
+			sugar.Errorw("Failed to initialize shadow store", "error", err)
+			return 1
+		}
+		shadowStore = store.NewShadowStore(dbStore, shadowDB, sugar)
+		distStore, closer = shadowStore, shadowStore
+	}
+
+	// Serve repeated lookups from memory, if enabled. The reconciler keeps
+	// working on the database directly.
+	if cfg.Database.Cache.Enabled {
+		distStore = store.NewCachingStore(distStore, cfg.Database.Cache.MaxEntries, cfg.Database.Cache.TTL,
+			cfg.API.NoStoreProfiles)
+		closer = distStore
 	}
-	defer dbStore.Close()
 
 	// Initialize endorsement distributor
-	distributor := store.NewEndorsementDistributor(dbStore, sugar)
+	distributor := store.NewEndorsementDistributor(distStore, cfg.Distributor, sugar)
+
+	// Keep the supported profiles in step with their remote source, if any
+	if cfg.Distributor.SupportedProfilesSource.URL != "" {
+		go store.NewProfileRefresher(distributor, cfg.Distributor.SupportedProfilesSource, sugar).Run(jobsCtx)
+	}
 
 	// Initialize API handler
-	handler := api.NewHandler(distributor, sugar)
+	handler := api.NewHandler(distributor, cfg.API, sugar)
+	if reconciler != nil {
+		handler.WithReconciler(reconciler)
+	}
+	if shadowStore != nil {
+		handler.WithShadowStore(shadowStore)
+	}
+
+	if cfg.API.WellKnownSigningKey != "" {
+		key, err := api.LoadSigningKey(cfg.API.WellKnownSigningKey)
+		if err != nil {
+			sugar.Errorw("Failed to load well-known signing key", "error", err)
+			return 1
+		}
+		if err := handler.SignWellKnown(key); err != nil {
+			sugar.Errorw("Failed to sign well-known document", "error", err)
+			return 1
+		}
+	}
 
-	// Setup router
+	// Setup routers: admin endpoints are only reachable through listeners
+	// flagged as admin ones
 	router := api.NewRouter(handler)
+	adminRouter := api.NewAdminRouter(handler)
+
+	// Load the certificate up front, so that a bad one fails startup rather
+	// than each listener
+	var tlsConfig *tls.Config
+	if cfg.Server.TLSEnabled() {
+		cert, err := tls.LoadX509KeyPair(cfg.Server.TLSCertFile, cfg.Server.TLSKeyFile)
+		if err != nil {
+			sugar.Errorw("Failed to load TLS certificate", "error", err)
+			return 1
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
 
-	// Create HTTP server
-	srv := &http.Server{
-		Addr:    fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port),
-		Handler: router,
+	// Create and start an HTTP server per listener
+	servers, err := listenAll(cfg.Server, router, adminRouter, tlsConfig)
+	if err != nil {
+		sugar.Errorw("Failed to listen", "error", err)
+		return 1
 	}
 
-	// Start server in a goroutine
-	go func() {
-		sugar.Infow("Starting HTTP server", "host", cfg.Server.Host, "port", cfg.Server.Port)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			sugar.Fatalw("Failed to start server", "error", err)
+	// And the gRPC server, if enabled
+	var grpcSrv *grpcServer
+	if cfg.Server.GRPCPort != 0 {
+		grpcSrv, err = listenGRPC(cfg.Server, handler, tlsConfig)
+		if err != nil {
+			for _, s := range servers {
+				s.ln.Close()
+			}
+			sugar.Errorw("Failed to listen", "error", err)
+			return 1
 		}
-	}()
+	}
 
-	// Wait for interrupt signal to gracefully shutdown the server
+	failed := serveAll(servers, sugar)
+	var grpcFailed <-chan struct{}
+	if grpcSrv != nil {
+		grpcFailed = grpcSrv.serve(sugar)
+	}
+
+	// Wait for interrupt signal to gracefully shutdown the servers
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
+
+	code := 0
+	select {
+	case <-quit:
+	case <-failed:
+		code = 1
+	case <-grpcFailed:
+		code = 1
+	}
 	sugar.Info("Shutting down server...")
 
-	// Give outstanding requests a deadline for completion
+	// Give outstanding requests a deadline for completion, shared by all
+	// servers so that shutting down several doesn't take several times as long
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	if err := srv.Shutdown(ctx); err != nil {
-		sugar.Fatalw("Server forced to shutdown", "error", err)
+	toShutdown := httpServers(servers)
+	if grpcSrv != nil {
+		toShutdown = append(toShutdown, grpcSrv)
+	}
+	if err := shutdownAll(ctx, toShutdown); err != nil {
+		sugar.Errorw("Server forced to shutdown", "error", err)
+		code = 1
+	}
+
+	// Handlers may have returned while their store operations carry on (an
+	// ingestion outliving a timed-out request, say): wait for those before
+	// the deferred close of the store. The store is closed even if they
+	// don't finish in time, for the snapshot to be written.
+	if err := distributor.Drain(ctx); err != nil {
+		sugar.Errorw("Store operations did not finish in time", "error", err)
+		code = 1
 	}
 
 	sugar.Info("Server exited")
-} 
\ No newline at end of file
+	return code
+}
+
+// newLogger builds the logger described by cfg, on top of the production
+// defaults: sampling, and stack traces from the error level up
+func newLogger(cfg config.LoggingConfig) (*zap.Logger, error) {
+	zc := zap.NewProductionConfig()
+
+	if cfg.Level != "" {
+		level, err := zapcore.ParseLevel(cfg.Level)
+		if err != nil {
+			return nil, err
+		}
+		zc.Level = zap.NewAtomicLevelAt(level)
+	}
+
+	if cfg.Format == "console" {
+		zc.Encoding = "console"
+		zc.EncoderConfig = zap.NewDevelopmentEncoderConfig()
+	}
+
+	return zc.Build()
+}
+
+// newStore creates the store selected by the configured driver
+func newStore(cfg config.DatabaseConfig, logger *zap.SugaredLogger) (store.Store, error) {
+	switch cfg.Driver {
+	case "memory":
+		logger.Infow("Using in-memory store", "snapshot", cfg.Memory.SnapshotPath)
+		return store.NewMemoryStore(cfg)
+	default:
+		return store.NewPostgresStore(cfg, logger)
+	}
+}
+
+// server is an HTTP server with the listener it serves
+type server struct {
+	*http.Server
+	cfg config.ListenerConfig
+	ln  net.Listener
+}
+
+// listenAll creates a server per configured listener, serving the admin
+// router on the listeners flagged as admin ones and the public router on the
+// others, and binds their addresses. Should one fail to bind, those already
+// bound are closed.
+func listenAll(cfg config.ServerConfig, router, adminRouter http.Handler, tlsConfig *tls.Config) ([]server, error) {
+	lc := net.ListenConfig{KeepAlive: cfg.KeepAlive}
+
+	var servers []server
+	for _, l := range cfg.AllListeners() {
+		srv := &http.Server{
+			Addr:           fmt.Sprintf("%s:%d", l.Host, l.Port),
+			Handler:        router,
+			MaxHeaderBytes: cfg.MaxHeaderBytes,
+			ReadTimeout:    cfg.ReadTimeout,
+			WriteTimeout:   cfg.WriteTimeout,
+			IdleTimeout:    cfg.IdleTimeout,
+			TLSConfig:      tlsConfig,
+		}
+		if l.Admin {
+			srv.Handler = adminRouter
+		}
+
+		ln, err := lc.Listen(context.Background(), "tcp", srv.Addr)
+		if err != nil {
+			for _, s := range servers {
+				s.ln.Close()
+			}
+			return nil, fmt.Errorf("listener %q: %w", l.Name, err)
+		}
+		servers = append(servers, server{Server: srv, cfg: l, ln: ln})
+	}
+
+	return servers, nil
+}
+
+// serveAll starts serving on every server. The returned channel receives
+// once per server failing, so that a failure can stop the others, as a
+// signal would.
+func serveAll(servers []server, logger *zap.SugaredLogger) <-chan struct{} {
+	failed := make(chan struct{}, len(servers))
+
+	for _, s := range servers {
+		go func(s server) {
+			logger.Infow("Starting HTTP server", "listener", s.cfg.Name, "host", s.cfg.Host, "port", s.cfg.Port,
+				"admin", s.cfg.Admin, "tls", s.TLSConfig != nil)
+
+			var err error
+			if s.TLSConfig != nil {
+				err = s.ServeTLS(s.ln, "", "")
+			} else {
+				err = s.Serve(s.ln)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				logger.Errorw("Failed to start server", "listener", s.cfg.Name, "error", err)
+				failed <- struct{}{}
+			}
+		}(s)
+	}
+
+	return failed
+}
+
+// grpcServer is the gRPC server with the listener it serves
+type grpcServer struct {
+	*grpc.Server
+	cfg config.ServerConfig
+	ln  net.Listener
+}
+
+// listenGRPC creates the gRPC server of handler, over TLS if tlsConfig is
+// set, and binds its port
+func listenGRPC(cfg config.ServerConfig, handler *api.Handler, tlsConfig *tls.Config) (*grpcServer, error) {
+	var opts []grpc.ServerOption
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	if cfg.MaxHeaderBytes > 0 {
+		opts = append(opts, grpc.MaxHeaderListSize(uint32(cfg.MaxHeaderBytes)))
+	}
+
+	lc := net.ListenConfig{KeepAlive: cfg.KeepAlive}
+	ln, err := lc.Listen(context.Background(), "tcp", fmt.Sprintf("%s:%d", cfg.Host, cfg.GRPCPort))
+	if err != nil {
+		return nil, fmt.Errorf("gRPC port: %w", err)
+	}
+
+	return &grpcServer{Server: handler.NewGRPCServer(opts...), cfg: cfg, ln: ln}, nil
+}
+
+// serve starts serving in the background. The returned channel receives if
+// the server fails.
+func (s *grpcServer) serve(logger *zap.SugaredLogger) <-chan struct{} {
+	failed := make(chan struct{}, 1)
+
+	go func() {
+		logger.Infow("Starting gRPC server", "host", s.cfg.Host, "port", s.cfg.GRPCPort, "tls", s.cfg.TLSEnabled())
+
+		// Serve returns nil once stopped
+		if err := s.Serve(s.ln); err != nil {
+			logger.Errorw("Failed to start gRPC server", "error", err)
+			failed <- struct{}{}
+		}
+	}()
+
+	return failed
+}
+
+// Shutdown stops the server from accepting connections and waits for the
+// calls in flight to finish, like http.Server.Shutdown. Those still running
+// when ctx is done are cut short.
+func (s *grpcServer) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.Stop()
+		return ctx.Err()
+	}
+}
+
+// shutdowner is a server shutdownAll can shut down
+type shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// httpServers returns the HTTP servers of servers
+func httpServers(servers []server) []shutdowner {
+	srvs := make([]shutdowner, len(servers))
+	for i, s := range servers {
+		srvs[i] = s.Server
+	}
+	return srvs
+}
+
+// shutdownAll gracefully shuts the servers down concurrently
+func shutdownAll(ctx context.Context, servers []shutdowner) error {
+	errs := make([]error, len(servers))
+
+	var wg sync.WaitGroup
+	for i, srv := range servers {
+		wg.Add(1)
+		go func(i int, srv shutdowner) {
+			defer wg.Done()
+			errs[i] = srv.Shutdown(ctx)
+		}(i, srv)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/veraison/corim/comid"
+	"github.com/veraison/corim/coserv"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+
+	"endorsement-distribution/internal/api"
+	"endorsement-distribution/internal/config"
+	"endorsement-distribution/internal/store"
+)
+
+func TestListeners(t *testing.T) {
+	ms, err := store.NewMemoryStore(config.DatabaseConfig{})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	logger := zap.NewNop().Sugar()
+	handler := api.NewHandler(store.NewEndorsementDistributor(ms, config.DistributorConfig{}, logger),
+		config.APIConfig{Admin: config.AdminConfig{Token: "secret"}}, logger)
+
+	servers, err := listenAll(config.ServerConfig{Listeners: []config.ListenerConfig{
+		{Name: "public", Host: "127.0.0.1"},
+		{Name: "admin", Host: "127.0.0.1", Admin: true},
+	}}, api.NewRouter(handler), api.NewAdminRouter(handler), nil)
+	if err != nil {
+		t.Fatalf("listenAll: %v", err)
+	}
+	failed := serveAll(servers, logger)
+
+	get := func(s server, path string) int {
+		req, err := http.NewRequest(http.MethodGet, "http://"+s.ln.Addr().String()+path, nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s on the %s listener: %v", path, s.cfg.Name, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	public, admin := servers[0], servers[1]
+	tests := []struct {
+		s    server
+		path string
+		want int
+	}{
+		{public, "/healthz", http.StatusOK},
+		{public, "/admin/stats", http.StatusNotFound},
+		{admin, "/admin/stats", http.StatusOK},
+		{admin, "/healthz", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		if got := get(tt.s, tt.path); got != tt.want {
+			t.Errorf("GET %s on the %s listener = %d, want %d", tt.path, tt.s.cfg.Name, got, tt.want)
+		}
+	}
+
+	if err := shutdownAll(context.Background(), httpServers(servers)); err != nil {
+		t.Fatalf("shutdownAll: %v", err)
+	}
+	select {
+	case <-failed:
+		t.Error("a server reported a failure on shutdown")
+	default:
+	}
+	for _, s := range servers {
+		if resp, err := http.Get("http://" + s.ln.Addr().String() + "/healthz"); err == nil {
+			resp.Body.Close()
+			t.Errorf("the %s listener still serving after shutdown", s.cfg.Name)
+		}
+	}
+}
+
+func TestGRPCServer(t *testing.T) {
+	ms, err := store.NewMemoryStore(config.DatabaseConfig{})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	logger := zap.NewNop().Sugar()
+	handler := api.NewHandler(store.NewEndorsementDistributor(ms,
+		config.DistributorConfig{ResultEncoding: store.ResultEncodingRaw}, logger), config.APIConfig{}, logger)
+
+	q, err := coserv.NewQuery(coserv.ArtifactTypeReferenceValues,
+		*coserv.NewEnvironmentSelector().AddClass(*comid.NewClassImplID(comid.TestImplID)))
+	if err != nil {
+		t.Fatalf("NewQuery: %v", err)
+	}
+	c, err := coserv.NewCoserv("tag:arm.com,2023:cca_platform#1.0.0", *q)
+	if err != nil {
+		t.Fatalf("NewCoserv: %v", err)
+	}
+	query, err := c.ToCBOR()
+	if err != nil {
+		t.Fatalf("ToCBOR: %v", err)
+	}
+
+	keys, err := store.GenerateKey("acme", base64.RawURLEncoding.EncodeToString(query))
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	for _, key := range keys {
+		if err := ms.Set(context.Background(), key, [][]byte{[]byte("artifact")}); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+
+	// Port 0 binds any free port
+	s, err := listenGRPC(config.ServerConfig{Host: "127.0.0.1"}, handler, nil)
+	if err != nil {
+		t.Fatalf("listenGRPC: %v", err)
+	}
+	failed := s.serve(logger)
+
+	conn, err := grpc.NewClient(s.ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer conn.Close()
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), api.TenantHeader, "acme")
+	var result []byte
+	if err := conn.Invoke(ctx, api.GetEndorsementsMethod, &query, &result, grpc.ForceCodec(api.GRPCCodec{})); err != nil {
+		t.Fatalf("GetEndorsements: %v", err)
+	}
+	if len(result) == 0 {
+		t.Error("GetEndorsements returned an empty result")
+	}
+
+	if err := shutdownAll(context.Background(), []shutdowner{s}); err != nil {
+		t.Fatalf("shutdownAll: %v", err)
+	}
+	select {
+	case <-failed:
+		t.Error("the gRPC server reported a failure on shutdown")
+	default:
+	}
+	if c, err := net.Dial("tcp", s.ln.Addr().String()); err == nil {
+		c.Close()
+		t.Error("the gRPC port still open after shutdown")
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	servers, err := listenAll(config.ServerConfig{
+		Listeners:      []config.ListenerConfig{{Name: "default", Host: "127.0.0.1"}},
+		MaxHeaderBytes: 1 << 10,
+	}, ok, ok, nil)
+	if err != nil {
+		t.Fatalf("listenAll: %v", err)
+	}
+	serveAll(servers, zap.NewNop().Sugar())
+	defer shutdownAll(context.Background(), httpServers(servers))
+
+	get := func(headerBytes int) int {
+		req, err := http.NewRequest(http.MethodGet, "http://"+servers[0].ln.Addr().String()+"/", nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		req.Header.Set("X-Padding", strings.Repeat("a", headerBytes))
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET with %d header bytes: %v", headerBytes, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if got := get(100); got != http.StatusOK {
+		t.Errorf("GET with small headers = %d, want 200", got)
+	}
+	// net/http allows some slack over MaxHeaderBytes for buffering
+	if got := get(16 << 10); got != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("GET with oversized headers = %d, want 431", got)
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       config.LoggingConfig
+		wantErr   bool
+		wantDebug bool
+		wantInfo  bool
+	}{
+		{"default", config.LoggingConfig{}, false, false, true},
+		{"debug", config.LoggingConfig{Level: "debug"}, false, true, true},
+		{"warn", config.LoggingConfig{Level: "warn", Format: "json"}, false, false, false},
+		{"console", config.LoggingConfig{Level: "debug", Format: "console"}, false, true, true},
+		{"invalid level", config.LoggingConfig{Level: "verbose"}, true, false, false},
+	}
+
+	for _, tt := range tests {
+		logger, err := newLogger(tt.cfg)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: newLogger = nil error, want one", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: newLogger: %v", tt.name, err)
+		}
+
+		if got := logger.Core().Enabled(zap.DebugLevel); got != tt.wantDebug {
+			t.Errorf("%s: debug enabled = %v, want %v", tt.name, got, tt.wantDebug)
+		}
+		if got := logger.Core().Enabled(zap.InfoLevel); got != tt.wantInfo {
+			t.Errorf("%s: info enabled = %v, want %v", tt.name, got, tt.wantInfo)
+		}
+	}
+}
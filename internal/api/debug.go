@@ -0,0 +1,71 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"endorsement-distribution/internal/store"
+
+	"github.com/gin-gonic/gin"
+	"github.com/veraison/corim/comid"
+	"github.com/veraison/corim/coserv"
+)
+
+// debugQuery is the JSON view of a parsed CoSERV query
+type debugQuery struct {
+	Profile             string              `json:"profile"`
+	ArtifactType        string              `json:"artifactType"`
+	EnvironmentSelector debugEnvironmentSet `json:"environmentSelector"`
+}
+
+// debugEnvironmentSet is the JSON view of an environment selector
+type debugEnvironmentSet struct {
+	Classes   *[]comid.Class    `json:"classes,omitempty"`
+	Instances *[]comid.Instance `json:"instances,omitempty"`
+	Groups    *[]comid.Group    `json:"groups,omitempty"`
+}
+
+// DebugQuery decodes a base64url-encoded CoSERV query and returns what was
+// parsed from it as JSON, for producers to check that their query encodes
+// what they intended
+func (o *Handler) DebugQuery(c *gin.Context) {
+	raw, err := queryParam(c)
+	if err != nil {
+		o.reportError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	q, err := store.ParseQuery(raw)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, store.ErrInvalidQuery) {
+			// Well-formed CBOR that isn't a valid CoSERV query
+			status = http.StatusUnprocessableEntity
+		}
+		o.reportError(c, status, err)
+		return
+	}
+
+	profile, err := q.Profile.Get()
+	if err != nil {
+		o.reportError(c, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, newDebugQuery(profile, q.Query))
+}
+
+// newDebugQuery builds the JSON view of a query carrying profile
+func newDebugQuery(profile string, q coserv.Query) debugQuery {
+	s := q.EnvironmentSelector
+
+	return debugQuery{
+		Profile:      profile,
+		ArtifactType: artifactTypeLabel(q.ArtifactType),
+		EnvironmentSelector: debugEnvironmentSet{
+			Classes:   s.Classes,
+			Instances: s.Instances,
+			Groups:    s.Groups,
+		},
+	}
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	"endorsement-distribution/internal/config"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+func TestDebugQuery(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{DebugEndpoints: true}, config.DistributorConfig{})
+	debug := func(query string) *httptest.ResponseRecorder {
+		return env.do(httptest.NewRequest(http.MethodGet, path.Join(edApiPath, "debug/query", query), nil))
+	}
+
+	rec := debug(taQuery(t))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET = %d: %s", rec.Code, rec.Body)
+	}
+
+	var got struct {
+		Profile             string `json:"profile"`
+		ArtifactType        string `json:"artifactType"`
+		EnvironmentSelector struct {
+			Classes   []json.RawMessage `json:"classes"`
+			Instances []json.RawMessage `json:"instances"`
+		} `json:"environmentSelector"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding the parsed query: %v", err)
+	}
+	if got.Profile != ccaProfile || got.ArtifactType != "trust-anchors" {
+		t.Errorf("parsed profile %q, artifact type %q; want %q, trust-anchors", got.Profile, got.ArtifactType, ccaProfile)
+	}
+	if len(got.EnvironmentSelector.Instances) != 1 || got.EnvironmentSelector.Classes != nil {
+		t.Errorf("parsed selector %s, want the one instance", rec.Body)
+	}
+
+	notCoserv, err := cbor.Marshal(map[string]int{"a": 1})
+	if err != nil {
+		t.Fatalf("cbor.Marshal: %v", err)
+	}
+	if rec := debug("not*base64"); rec.Code != http.StatusBadRequest {
+		t.Errorf("GET of a query that isn't base64url = %d, want 400", rec.Code)
+	}
+	if rec := debug(base64.RawURLEncoding.EncodeToString(notCoserv)); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("GET of CBOR that isn't CoSERV = %d, want 422", rec.Code)
+	}
+}
+
+func TestDebugQueryDisabled(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{}, config.DistributorConfig{})
+
+	rec := env.do(httptest.NewRequest(http.MethodGet, path.Join(edApiPath, "debug/query", refValQuery(t)), nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET with debug endpoints off = %d, want 404", rec.Code)
+	}
+}
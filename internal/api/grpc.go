@@ -0,0 +1,184 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"endorsement-distribution/internal/store"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// The gRPC service has a single method, GetEndorsements, answering a CoSERV
+// query for a tenant with the same CBOR result GET /coserv does. Its
+// messages are raw bytes, framed by GRPCCodec, so that it needs no generated
+// code: the request is the CoSERV query in CBOR, as in the body of POST
+// /coserv, and the response the CoSERV result. The tenant is named by
+// the x-tenant-id metadata or, when API keys are configured, resolved from
+// the authorization metadata, as for HTTP requests.
+const (
+	GRPCServiceName       = "endorsement_distribution.v1.EndorsementDistribution"
+	GetEndorsementsMethod = "/" + GRPCServiceName + "/GetEndorsements"
+)
+
+// GRPCCodec passes the messages of the gRPC service as they are. Clients
+// select it with grpc.ForceCodec, the server does by default.
+type GRPCCodec struct{}
+
+// Marshal returns v, a []byte or *[]byte, as is
+func (GRPCCodec) Marshal(v any) ([]byte, error) {
+	switch b := v.(type) {
+	case []byte:
+		return b, nil
+	case *[]byte:
+		return *b, nil
+	default:
+		return nil, fmt.Errorf("gRPC message is a %T, not bytes", v)
+	}
+}
+
+// Unmarshal copies data into v, a *[]byte
+func (GRPCCodec) Unmarshal(data []byte, v any) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("gRPC message is a %T, not *[]byte", v)
+	}
+
+	*b = append((*b)[:0], data...)
+	return nil
+}
+
+// Name is the content subtype of the messages, application/grpc+bytes
+func (GRPCCodec) Name() string {
+	return "bytes"
+}
+
+// grpcService describes the service to grpc.Server, as generated code would
+var grpcService = grpc.ServiceDesc{
+	ServiceName: GRPCServiceName,
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "GetEndorsements", Handler: getEndorsementsHandler},
+	},
+}
+
+// NewGRPCServer returns a gRPC server offering the service on top of the
+// distributor of o. The messages are framed by GRPCCodec whatever the
+// content subtype a client asks for.
+func (o *Handler) NewGRPCServer(opts ...grpc.ServerOption) *grpc.Server {
+	srv := grpc.NewServer(append([]grpc.ServerOption{grpc.ForceServerCodec(GRPCCodec{})}, opts...)...)
+	srv.RegisterService(&grpcService, o)
+	return srv
+}
+
+// getEndorsementsHandler decodes a GetEndorsements request and passes it to
+// the Handler through the server's interceptor, if any
+func getEndorsementsHandler(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+	var query []byte
+	if err := dec(&query); err != nil {
+		return nil, err
+	}
+
+	call := func(ctx context.Context, req any) (any, error) {
+		return srv.(*Handler).grpcGetEndorsements(ctx, *req.(*[]byte))
+	}
+	if interceptor == nil {
+		return call(ctx, &query)
+	}
+
+	return interceptor(ctx, &query, &grpc.UnaryServerInfo{Server: srv, FullMethod: GetEndorsementsMethod}, call)
+}
+
+// grpcGetEndorsements answers a GetEndorsements call for the CBOR query
+func (o *Handler) grpcGetEndorsements(ctx context.Context, query []byte) (*[]byte, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	tenantID, err := o.grpcTenant(md)
+	if err != nil {
+		return nil, err
+	}
+	if len(query) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "missing query")
+	}
+
+	opts := store.QueryOptions{}
+	if ids := md.Get(RequestIDHeader); len(ids) == 1 && validRequestID(ids[0]) {
+		opts.RequestID = ids[0]
+	}
+
+	coservQuery := base64.RawURLEncoding.EncodeToString(query)
+	logger := o.Logger
+	if opts.RequestID != "" {
+		logger = logger.With("requestID", opts.RequestID)
+	}
+	logger.Infow("Processing gRPC CoSERV request", "tenant", tenantID, "query", coservQuery)
+
+	result, err := o.EndorsementDistributor.GetEndorsements(ctx, tenantID, coservQuery, EdApiMediaType, opts)
+	if err != nil {
+		code := grpcCode(err)
+		logger.Errorw("gRPC error", "code", code, "error", err)
+		return nil, status.Error(code, err.Error())
+	}
+
+	return &result, nil
+}
+
+// grpcTenant returns the tenant of a call, from its metadata as
+// requestTenant does from the headers of an HTTP request
+func (o *Handler) grpcTenant(md metadata.MD) (string, error) {
+	named := ""
+	if values := md.Get(TenantHeader); len(values) > 0 {
+		named = values[0]
+	}
+
+	if len(o.Config.APIKeys) > 0 {
+		authorization := ""
+		if values := md.Get("authorization"); len(values) > 0 {
+			authorization = values[0]
+		}
+
+		tenant := o.apiKeyTenant(authorization)
+		if tenant == "" {
+			return "", status.Error(codes.Unauthenticated, "missing or invalid API key")
+		}
+		if named != "" && named != tenant {
+			return "", status.Errorf(codes.PermissionDenied, "the API key is not valid for tenant %q", named)
+		}
+		return tenant, nil
+	}
+
+	if err := checkTenant(strings.ToLower(TenantHeader)+" metadata", named); err != nil {
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return named, nil
+}
+
+// grpcCode is the gRPC counterpart of the HTTP status a query error is
+// answered with
+func grpcCode(err error) codes.Code {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return codes.DeadlineExceeded
+	}
+
+	switch queryErrorStatus(err) {
+	case http.StatusNotFound, http.StatusGone:
+		return codes.NotFound
+	case http.StatusBadRequest, http.StatusNotAcceptable:
+		return codes.InvalidArgument
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	default:
+		return codes.Internal
+	}
+}
@@ -0,0 +1,136 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"testing"
+
+	"endorsement-distribution/internal/config"
+
+	"github.com/veraison/corim/comid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// grpcClient serves the gRPC service of env in-process and returns a client
+// connection to it
+func (o *testEnv) grpcClient(t *testing.T) *grpc.ClientConn {
+	t.Helper()
+
+	ln := bufconn.Listen(1 << 20)
+	srv := o.handler.NewGRPCServer()
+	go srv.Serve(ln)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return ln.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+// getEndorsements calls GetEndorsements for the base64url query, with the
+// metadata given as key/value pairs
+func getEndorsements(t *testing.T, conn *grpc.ClientConn, query string, kv ...string) ([]byte, error) {
+	t.Helper()
+
+	req, err := base64.RawURLEncoding.DecodeString(query)
+	if err != nil {
+		t.Fatalf("decoding the query: %v", err)
+	}
+
+	ctx := metadata.NewOutgoingContext(context.Background(), metadata.Pairs(kv...))
+
+	var result []byte
+	err = conn.Invoke(ctx, GetEndorsementsMethod, &req, &result, grpc.ForceCodec(GRPCCodec{}))
+	return result, err
+}
+
+func TestGRPCGetEndorsements(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{}, config.DistributorConfig{})
+	query := refValQuery(t)
+	env.put(t, query, []byte("artifact"))
+	conn := env.grpcClient(t)
+
+	rec := env.get(query, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET: status = %d, body %s", rec.Code, rec.Body)
+	}
+
+	got, err := getEndorsements(t, conn, query, TenantHeader, testTenant)
+	if err != nil {
+		t.Fatalf("GetEndorsements: %v", err)
+	}
+	if !bytes.Equal(got, rec.Body.Bytes()) {
+		t.Errorf("GetEndorsements = %x, want the bytes of GET, %x", got, rec.Body.Bytes())
+	}
+}
+
+func TestGRPCGetEndorsementsErrors(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{}, config.DistributorConfig{})
+	stored := refValQuery(t)
+	env.put(t, stored, []byte("artifact"))
+	conn := env.grpcClient(t)
+
+	tests := []struct {
+		name  string
+		query string
+		md    []string
+		want  codes.Code
+	}{
+		{"no tenant", stored, nil, codes.InvalidArgument},
+		{"invalid tenant", stored, []string{TenantHeader, "acme/other"}, codes.InvalidArgument},
+		{"empty query", "", []string{TenantHeader, testTenant}, codes.InvalidArgument},
+		{"not CBOR", base64.RawURLEncoding.EncodeToString([]byte{0xff}), []string{TenantHeader, testTenant}, codes.InvalidArgument},
+		{"nothing stored", refValQuery(t, comid.ImplID{2}), []string{TenantHeader, testTenant}, codes.NotFound},
+		{"another tenant", stored, []string{TenantHeader, "other"}, codes.NotFound},
+	}
+
+	for _, tt := range tests {
+		_, err := getEndorsements(t, conn, tt.query, tt.md...)
+		if got := status.Code(err); got != tt.want {
+			t.Errorf("%s: GetEndorsements = %v, want code %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestGRPCAPIKeys(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{APIKeys: []config.APIKeyConfig{
+		{Key: "key-a", Tenant: testTenant},
+		{Key: "key-b", Tenant: "other"},
+	}}, config.DistributorConfig{})
+	query := refValQuery(t)
+	env.put(t, query, []byte("artifact"))
+	conn := env.grpcClient(t)
+
+	tests := []struct {
+		name string
+		md   []string
+		want codes.Code
+	}{
+		{"no key", []string{TenantHeader, testTenant}, codes.Unauthenticated},
+		{"unknown key", []string{"authorization", "Bearer key-c"}, codes.Unauthenticated},
+		{"tenant from the key", []string{"authorization", "Bearer key-a"}, codes.OK},
+		{"tenant matching the key", []string{"authorization", "Bearer key-a", TenantHeader, testTenant}, codes.OK},
+		{"tenant not matching the key", []string{"authorization", "Bearer key-a", TenantHeader, "other"}, codes.PermissionDenied},
+		{"another tenant's key", []string{"authorization", "Bearer key-b"}, codes.NotFound},
+	}
+
+	for _, tt := range tests {
+		_, err := getEndorsements(t, conn, query, tt.md...)
+		if got := status.Code(err); got != tt.want {
+			t.Errorf("%s: GetEndorsements = %v, want code %v", tt.name, err, tt.want)
+		}
+	}
+}
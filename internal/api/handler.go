@@ -1,114 +1,910 @@
 package api
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
+	"endorsement-distribution/internal/config"
 	"endorsement-distribution/internal/store"
 
 	"github.com/gin-gonic/gin"
+	"github.com/veraison/corim/coserv"
 	"go.uber.org/zap"
 )
 
 const (
-	tenantID       = "0"
 	EdApiMediaType = "application/coserv+cbor"
+
+	// CoservJSONMediaType is the alternate output format: the same result as
+	// JSON, for debugging tools that don't speak CBOR
+	CoservJSONMediaType = "application/coserv+json"
+
+	// TenantHeader carries the tenant a request is made for. Unless API
+	// keys are configured it is trusted as is, so it must be set (and any
+	// client-supplied copy replaced) by the authenticating proxy in front of
+	// the service.
+	TenantHeader = "X-Tenant-ID"
+
+	serviceName    = "endorsement-distribution"
+	serviceVersion = "1.0.0"
 )
 
+// supportedMediaTypes are the output formats of CoSERV results, preferred
+// first
+var supportedMediaTypes = []string{EdApiMediaType, CoservJSONMediaType}
+
+// Error codes carried in the "code" member of problem responses. Clients may
+// match on them, so an existing code must never change meaning.
+const (
+	ErrCodeInternal      = "ED-000-INTERNAL"
+	ErrCodeBadQuery      = "ED-001-BAD-QUERY"
+	ErrCodeNotFound      = "ED-002-NOT-FOUND"
+	ErrCodeNotAcceptable = "ED-003-NOT-ACCEPTABLE"
+	ErrCodeUnauthorized  = "ED-004-UNAUTHORIZED"
+	ErrCodeForbidden     = "ED-005-FORBIDDEN"
+	ErrCodeGone          = "ED-006-GONE"
+	ErrCodeUnsupported   = "ED-007-UNSUPPORTED-MEDIA-TYPE"
+	ErrCodeConflict      = "ED-008-CONFLICT"
+	ErrCodeRateLimited   = "ED-009-RATE-LIMITED"
+
+	// ErrCodeUnavailable is for the store being unreachable or the service
+	// draining for shutdown: the same request may succeed later
+	ErrCodeUnavailable           = "ED-010-UNAVAILABLE"
+	ErrCodeUnsupportedProfile    = "ED-011-UNSUPPORTED-PROFILE"
+	ErrCodeUnsupportedArtifact   = "ED-012-UNSUPPORTED-ARTIFACT-TYPE"
+	ErrCodeQueryTooBroad         = "ED-013-QUERY-TOO-BROAD"
+	ErrCodeTooLarge              = "ED-014-TOO-LARGE"
+	ErrCodeInvalidQuery          = "ED-015-INVALID-QUERY"
+	ErrCodeProfileMismatch       = "ED-016-PROFILE-MISMATCH"
+	ErrCodeMalformedEndorsements = "ED-017-MALFORMED-CORIM"
+)
+
+// maxQueryBodyBytes caps the size of a CoSERV query sent as a request body
+const maxQueryBodyBytes = 1 << 20
+
+// CorimMediaType is the media type of the unsigned CoRIMs accepted for
+// ingestion
+const CorimMediaType = "application/corim-unsigned+cbor"
+
+// maxCorimBodyBytes caps the size of a CoRIM sent for ingestion
+const maxCorimBodyBytes = 16 << 20
+
 type Handler struct {
-	Logger                *zap.SugaredLogger
+	Logger                 *zap.SugaredLogger
 	EndorsementDistributor *store.EndorsementDistributor
+	Config                 config.APIConfig
+
+	// signedWellKnown is the COSE_Sign1 of the well-known document, set by
+	// SignWellKnown
+	signedWellKnown []byte
+
+	// reconciler is the integrity scan controlled through the admin
+	// endpoints, if one runs
+	reconciler *store.Reconciler
+
+	// shadow is the store comparing lookups against a shadow database, if
+	// one is configured, for its mismatches to be exported as metrics
+	shadow *store.ShadowStore
 }
 
-func NewHandler(endorsementDistributor *store.EndorsementDistributor, logger *zap.SugaredLogger) *Handler {
+func NewHandler(endorsementDistributor *store.EndorsementDistributor, cfg config.APIConfig, logger *zap.SugaredLogger) *Handler {
 	return &Handler{
 		EndorsementDistributor: endorsementDistributor,
-		Logger:                logger,
+		Config:                 cfg,
+		Logger:                 logger,
 	}
 }
 
-// GetEdApiWellKnownInfo handles the well-known endpoint
-func (o *Handler) GetEdApiWellKnownInfo(c *gin.Context) {
-	// Simple well-known response
+// WithReconciler lets the admin endpoints report on and pause r, and
+// exports the malformed rows it finds as a metric. It must be called before
+// the routers are created.
+func (o *Handler) WithReconciler(r *store.Reconciler) *Handler {
+	o.reconciler = r
+	return o
+}
+
+// WithShadowStore exports the mismatches and skipped reads of s as metrics.
+// It must be called before the routers are created.
+func (o *Handler) WithShadowStore(s *store.ShadowStore) *Handler {
+	o.shadow = s
+	return o
+}
+
+// GetIndex handles the root path, pointing people who hit the base URL at
+// the endpoints worth knowing about
+func (o *Handler) GetIndex(c *gin.Context) {
 	response := map[string]interface{}{
-		"version": "1.0.0",
-		"status":  "SERVICE_STATUS_READY",
-		"endpoints": map[string]string{
-			"coservRequest": "/endorsement-distribution/v1/coserv/:query",
+		"service": serviceName,
+		"version": serviceVersion,
+		"links": map[string]string{
+			"wellKnown": wellKnownPath,
+			"healthz":   healthzPath,
+			"readyz":    readyzPath,
 		},
-		"supportedMediaTypes": []string{EdApiMediaType},
 	}
 
 	c.JSON(http.StatusOK, response)
 }
 
-// CoservRequest handles the main endorsement distribution endpoint
-func (o *Handler) CoservRequest(c *gin.Context) {
-	// Check Accept header
-	offered := c.NegotiateFormat(EdApiMediaType)
-	if offered != EdApiMediaType {
-		o.reportProblem(c, http.StatusNotAcceptable,
-			fmt.Sprintf("the only supported output format is %s", EdApiMediaType))
+// unavailableRetryAfter is the Retry-After of a 503. Unlike a 429 there is no
+// telling when the store will be back or the replacement of a draining
+// instance ready, so it is long enough not to have clients hammer a
+// struggling service.
+const unavailableRetryAfter = 30 * time.Second
+
+// readyzTimeout bounds the store check of Readyz, so that a hung database
+// fails the probe instead of blocking it
+const readyzTimeout = 2 * time.Second
+
+// Healthz is the liveness probe: answering at all is proof of life
+func (o *Handler) Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Readyz is the readiness probe: the service is ready when its store is. It
+// also reports the status of the store decorators, such as the cache.
+func (o *Handler) Readyz(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), readyzTimeout)
+	defer cancel()
+
+	if err := o.EndorsementDistributor.Ping(ctx); err != nil {
+		o.requestLogger(c).Warnw("Readiness check failed", "error", err)
+		o.reportError(c, http.StatusServiceUnavailable, err, "store unavailable")
 		return
 	}
 
+	response := map[string]interface{}{"status": "ready"}
+	for name, status := range o.EndorsementDistributor.StoreStatus() {
+		response[name] = status
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// GetEdApiWellKnownInfo handles the well-known endpoint
+func (o *Handler) GetEdApiWellKnownInfo(c *gin.Context) {
+	c.JSON(http.StatusOK, wellKnownInfo())
+}
+
+// GetAdminStats reports how many keys are stored, in total and per tenant
+func (o *Handler) GetAdminStats(c *gin.Context) {
+	stats, err := o.EndorsementDistributor.Stats(c.Request.Context())
+	if err != nil {
+		o.reportError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, stats)
+}
+
+// DeleteAdminTenant removes everything stored for a tenant, for offboarding
+func (o *Handler) DeleteAdminTenant(c *gin.Context) {
+	tenantID := c.Param("tenant")
+
+	n, err := o.EndorsementDistributor.DeleteTenant(c.Request.Context(), tenantID)
+	if err != nil {
+		o.reportError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	o.requestLogger(c).Infow("Deleted tenant endorsements", "tenant", tenantID, "keys", n)
+
+	c.JSON(http.StatusOK, map[string]int64{"deletedKeys": n})
+}
+
+// GetAdminReconciler reports whether the integrity scan is paused, and what
+// its last completed run found
+func (o *Handler) GetAdminReconciler(c *gin.Context) {
+	if o.reconciler == nil {
+		o.reportProblem(c, http.StatusNotFound, "the integrity scan is not enabled")
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"paused":    o.reconciler.Paused(),
+		"malformed": o.reconciler.Malformed(),
+	})
+}
+
+// PauseAdminReconciler pauses the integrity scan at the end of its current
+// batch
+func (o *Handler) PauseAdminReconciler(c *gin.Context) {
+	if o.reconciler == nil {
+		o.reportProblem(c, http.StatusNotFound, "the integrity scan is not enabled")
+		return
+	}
+
+	o.reconciler.Pause()
+	c.Status(http.StatusNoContent)
+}
+
+// ResumeAdminReconciler lets a paused integrity scan carry on
+func (o *Handler) ResumeAdminReconciler(c *gin.Context) {
+	if o.reconciler == nil {
+		o.reportProblem(c, http.StatusNotFound, "the integrity scan is not enabled")
+		return
+	}
+
+	o.reconciler.Resume()
+	c.Status(http.StatusNoContent)
+}
+
+// CoservRequest handles the main endorsement distribution endpoint, taking
+// the base64url-encoded query from the path
+func (o *Handler) CoservRequest(c *gin.Context) {
 	// Get query parameter
-	coservQuery := c.Param("query")
+	coservQuery, err := queryParam(c)
+	if err != nil {
+		o.reportError(c, http.StatusBadRequest, err)
+		return
+	}
 	if coservQuery == "" {
 		o.reportProblem(c, http.StatusBadRequest, "missing query parameter")
 		return
 	}
 
-	// Extract profile from Accept header if present
-	acceptHeader := c.GetHeader("Accept")
+	o.serveCoserv(c, coservQuery)
+}
+
+// maxQueryUnescapes bounds how many layers of percent-encoding are undone
+const maxQueryUnescapes = 2
+
+// queryParam returns the query path parameter with any percent-encoding
+// undone. Base64url never contains '%', so one left in the parameter was put
+// there by a client or proxy that escaped the path, possibly twice over.
+func queryParam(c *gin.Context) (string, error) {
+	q := c.Param("query")
+	for i := 0; i < maxQueryUnescapes && strings.Contains(q, "%"); i++ {
+		unescaped, err := url.PathUnescape(q)
+		if err != nil {
+			return "", fmt.Errorf("malformed percent-encoding in query: %w", err)
+		}
+		q = unescaped
+	}
+
+	return q, nil
+}
+
+// CoservPostRequest handles CoSERV queries sent as the request body, for
+// queries too large to fit in a URL. The result is the same as for the
+// query sent in the path.
+func (o *Handler) CoservPostRequest(c *gin.Context) {
+	if ct := c.ContentType(); ct != EdApiMediaType {
+		o.reportProblem(c, http.StatusUnsupportedMediaType,
+			fmt.Sprintf("unsupported content type %q: the query must be sent as %s", ct, EdApiMediaType))
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxQueryBodyBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			o.reportProblem(c, http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("query body exceeds %d bytes", maxQueryBodyBytes))
+			return
+		}
+		o.reportProblem(c, http.StatusBadRequest, fmt.Sprintf("reading query body: %v", err))
+		return
+	}
+
+	if len(body) == 0 {
+		o.reportProblem(c, http.StatusBadRequest, "missing query body")
+		return
+	}
+
+	o.serveCoserv(c, base64.RawURLEncoding.EncodeToString(body))
+}
+
+// IngestEndorsements handles the ingestion endpoint, storing the reference
+// values and trust anchors of an unsigned CoRIM for the request's tenant.
+// With "If-None-Match: *" nothing is overwritten: the request fails with 409
+// if any of the keys already holds artifacts. Re-ingesting what is already
+// stored writes nothing, and is answered with a summary of status
+// "unchanged". A "ttl" query parameter, a Go duration, sets how long the
+// artifacts are served, overriding the default of their artifact type.
+func (o *Handler) IngestEndorsements(c *gin.Context) {
+	tenantID, err := requestTenant(c)
+	if err != nil {
+		o.reportError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	opts := store.IngestOptions{RequestID: c.GetString(requestIDKey)}
+	switch inm := c.GetHeader("If-None-Match"); strings.TrimSpace(inm) {
+	case "":
+	case "*":
+		opts.CreateOnly = true
+	default:
+		o.reportProblem(c, http.StatusBadRequest,
+			fmt.Sprintf("unsupported If-None-Match %q: only * is supported", inm))
+		return
+	}
+
+	if ttl, ok := c.GetQuery("ttl"); ok {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			o.reportProblem(c, http.StatusBadRequest,
+				fmt.Sprintf("invalid ttl %q: must be a positive duration, e.g. 24h", ttl))
+			return
+		}
+		opts.TTL = d
+	}
+
+	if ct := c.ContentType(); ct != CorimMediaType {
+		o.reportProblem(c, http.StatusUnsupportedMediaType,
+			fmt.Sprintf("unsupported content type %q: endorsements must be sent as %s", ct, CorimMediaType))
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxCorimBodyBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			o.reportProblem(c, http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("CoRIM exceeds %d bytes", maxCorimBodyBytes))
+			return
+		}
+		o.reportProblem(c, http.StatusBadRequest, fmt.Sprintf("reading CoRIM: %v", err))
+		return
+	}
+
+	summary, err := o.EndorsementDistributor.Ingest(c.Request.Context(), tenantID, body, opts)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, store.ErrMalformedCorim):
+			status = http.StatusBadRequest
+		case errors.Is(err, store.ErrExists):
+			status = http.StatusConflict
+		case errors.Is(err, store.ErrArtifactsTooLarge):
+			status = http.StatusRequestEntityTooLarge
+		case errors.Is(err, store.ErrDraining):
+			status = http.StatusServiceUnavailable
+		}
+
+		o.reportError(c, status, err)
+		return
+	}
+
+	if opts.CreateOnly {
+		c.JSON(http.StatusCreated, summary)
+		return
+	}
+
+	c.JSON(http.StatusOK, summary)
+}
+
+// queryErrorStatus maps an error answering a CoSERV query to the status to
+// respond with
+func queryErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, store.ErrNoArtifacts):
+		return http.StatusNotFound
+	case errors.Is(err, store.ErrGone):
+		return http.StatusGone
+	case errors.Is(err, store.ErrProfileMismatch), errors.Is(err, store.ErrStoredProfileMismatch):
+		return http.StatusNotAcceptable
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded), errors.Is(err, store.ErrDraining):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, store.ErrMalformedQuery), errors.Is(err, store.ErrInvalidOption),
+		errors.Is(err, store.ErrUnsupportedArtifactType), errors.Is(err, store.ErrUnsupportedProfile),
+		errors.Is(err, store.ErrQueryTooBroad):
+		return http.StatusBadRequest
+	default:
+		// The store failing, or stored data that can't be decoded: nothing
+		// a client can fix
+		return http.StatusInternalServerError
+	}
+}
+
+// CoservHeadRequest answers whether endorsements are stored for a CoSERV
+// query, with 200 or 404 and no body, sparing clients the transfer of
+// artifacts they only want to probe for
+func (o *Handler) CoservHeadRequest(c *gin.Context) {
+	coservQuery, err := queryParam(c)
+	if err != nil || coservQuery == "" {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	offered := c.NegotiateFormat(supportedMediaTypes...)
+	if offered == "" {
+		c.Header("Accept", strings.Join(supportedMediaTypes, ", "))
+		c.Status(http.StatusNotAcceptable)
+		return
+	}
+
+	tenantID, err := requestTenant(c)
+	if err != nil {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	params, err := o.acceptParams(c.GetHeader("Accept"), offered)
+	if err != nil {
+		c.Status(http.StatusNotAcceptable)
+		return
+	}
+
 	mediaType := EdApiMediaType
-	if strings.Contains(acceptHeader, "profile=") {
-		// Extract profile from Accept header
-		// Format: application/coserv+cbor; profile="tag:arm.com,2023:cca_platform#1.0.0"
-		parts := strings.Split(acceptHeader, ";")
-		for _, part := range parts {
-			part = strings.TrimSpace(part)
-			if strings.HasPrefix(part, "profile=") {
-				profile := strings.Trim(part[8:], `"`)
-				mediaType = fmt.Sprintf(`%s; profile=%q`, EdApiMediaType, profile)
-				break
-			}
+	if profile, ok := params["profile"]; ok {
+		mediaType = mime.FormatMediaType(EdApiMediaType, map[string]string{"profile": profile})
+	}
+
+	opts := store.QueryOptions{RequestID: c.GetString(requestIDKey)}
+	exists, err := o.EndorsementDistributor.EndorsementsExist(c.Request.Context(), tenantID, coservQuery, mediaType, opts)
+	if err != nil {
+		o.requestLogger(c).Debugw("CoSERV existence check failed", "tenant", tenantID, "error", err)
+		c.Status(queryErrorStatus(err))
+		return
+	}
+
+	c.Header("Vary", "Accept, X-Tenant-ID")
+	if !exists {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	c.Header("Content-Type", offered)
+	c.Status(http.StatusOK)
+}
+
+// serveCoserv answers a base64url-encoded CoSERV query, however it was sent
+func (o *Handler) serveCoserv(c *gin.Context, coservQuery string) {
+	// Check Accept header: CBOR unless JSON comes first
+	offered := c.NegotiateFormat(supportedMediaTypes...)
+	if offered == "" {
+		// List the alternatives, for clients to pick one and retry
+		c.Header("Accept", strings.Join(supportedMediaTypes, ", "))
+		o.reportProblemWith(c, http.StatusNotAcceptable, nil,
+			map[string]interface{}{"supportedMediaTypes": supportedMediaTypes},
+			fmt.Sprintf("the supported output formats are %s", strings.Join(supportedMediaTypes, " and ")))
+		return
+	}
+
+	tenantID, err := requestTenant(c)
+	if err != nil {
+		o.reportError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	// Label the request metrics with the artifact type asked for
+	if q, err := store.ParseQuery(coservQuery); err == nil {
+		c.Set(artifactTypeKey, artifactTypeLabel(q.Query.ArtifactType))
+	}
+
+	// The path segment or body is the only source of the query; a second
+	// copy in the query string, or repeats of the other parameters, would be
+	// ambiguous
+	if msg := ambiguousParams(c.Request.URL.Query()); msg != "" {
+		o.reportProblem(c, http.StatusBadRequest, msg)
+		return
+	}
+
+	// digestOnly=true asks for the digest of the result instead of the result
+	digestOnly := false
+	if v := c.Query("digestOnly"); v != "" {
+		var err error
+		if digestOnly, err = strconv.ParseBool(v); err != nil {
+			o.reportProblem(c, http.StatusBadRequest,
+				fmt.Sprintf("invalid digestOnly value %q: must be a boolean", v))
+			return
 		}
 	}
 
-	o.Logger.Infow("Processing CoSERV request", "query", coservQuery, "mediaType", mediaType)
+	// Otherwise, an RFC 7240 "Prefer: return=..." picks the representation:
+	// minimal is the digest, representation is the full result
+	preferred := ""
+	if c.Query("digestOnly") == "" {
+		preferred = preferredReturn(c.Request.Header.Values("Prefer"))
+		digestOnly = preferred == "minimal"
+	}
+
+	// hashAlg restricts reference values to those with digests of that kind
+	opts := store.QueryOptions{
+		HashAlgorithm: c.Query("hashAlg"),
+		RequestID:     c.GetString(requestIDKey),
+	}
+
+	// offset and limit select a page of the result
+	for _, p := range []struct {
+		name string
+		dst  *int
+	}{{"offset", &opts.Offset}, {"limit", &opts.Limit}} {
+		v := c.Query(p.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			o.reportProblem(c, http.StatusBadRequest,
+				fmt.Sprintf("invalid %s value %q: must be a non-negative integer", p.name, v))
+			return
+		}
+		*p.dst = n
+	}
+
+	// Extract the media type parameters (profile in particular) from the
+	// Accept header, if present
+	params, err := o.acceptParams(c.GetHeader("Accept"), offered)
+	if err != nil {
+		o.reportError(c, http.StatusNotAcceptable, err)
+		return
+	}
+
+	mediaType := EdApiMediaType
+	if profile, ok := params["profile"]; ok {
+		mediaType = mime.FormatMediaType(EdApiMediaType, map[string]string{"profile": profile})
+	}
+
+	o.requestLogger(c).Infow("Processing CoSERV request", "tenant", tenantID, "query", coservQuery, "mediaType", mediaType)
 
 	// Get endorsements
-	res, err := o.EndorsementDistributor.GetEndorsements(tenantID, coservQuery, mediaType)
+	result, err := o.EndorsementDistributor.GetEndorsementsResult(c.Request.Context(), tenantID, coservQuery, mediaType, opts)
 	if err != nil {
-		status := http.StatusBadRequest
-		if errors.Is(err, errors.New("no artifacts found")) {
-			status = http.StatusNotFound
+		if errors.Is(err, store.ErrMalformedQuery) && !errors.Is(err, store.ErrInvalidQuery) {
+			o.reportError(c, http.StatusBadRequest, err,
+				"the query must be base64url-encoded CBOR (application/coserv+cbor)")
+			return
 		}
 
-		o.reportProblem(c, status, err.Error())
+		o.reportError(c, queryErrorStatus(err), err)
+		return
+	}
+
+	_, span := tracer.Start(c.Request.Context(), "encode_result")
+	var res []byte
+	if offered == CoservJSONMediaType {
+		res, err = encodeResultJSON(result)
+	} else {
+		res, err = result.Encode()
+	}
+	span.End()
+	if err != nil {
+		o.reportError(c, http.StatusInternalServerError, err, "failed to encode result")
+		return
+	}
+
+	// Tell clients how complete the result is
+	c.Header("X-Environments-Requested", strconv.Itoa(result.Requested))
+	c.Header("X-Environments-Matched", strconv.Itoa(len(result.Groups)))
+
+	if opts.Offset > 0 || opts.Limit > 0 {
+		c.Header("X-Total-Artifacts", strconv.Itoa(result.Total))
+		c.Header("Link", pageLinks(c.Request.URL, opts, result.NextOffset))
+	}
+
+	if cc := o.cacheControl(coservQuery); cc != "" {
+		c.Header("Cache-Control", cc)
+	}
+
+	c.Header("Vary", "Accept, Prefer, "+TenantHeader)
+	if preferred != "" {
+		c.Header("Preference-Applied", "return="+preferred)
+	}
+
+	if digestOnly {
+		writeDigest(c, res)
 		return
 	}
 
 	// Return the result
-	c.Data(http.StatusOK, EdApiMediaType, res)
+	c.Data(http.StatusOK, offered, res)
+}
+
+// cacheControl returns the Cache-Control directives configured for the
+// artifact type of a query, or "" if none are. Results for the profiles in
+// NoStoreProfiles are always marked no-store.
+func (o *Handler) cacheControl(coservQuery string) string {
+	q, err := store.ParseQuery(coservQuery)
+	if err != nil {
+		return ""
+	}
+
+	if profile, err := q.Profile.Get(); err == nil && slices.Contains(o.Config.NoStoreProfiles, profile) {
+		return "no-store"
+	}
+
+	var cfg config.CacheControlConfig
+	switch q.Query.ArtifactType {
+	case coserv.ArtifactTypeReferenceValues:
+		cfg = o.Config.ReferenceValuesCache
+	case coserv.ArtifactTypeTrustAnchors:
+		cfg = o.Config.TrustAnchorsCache
+	default:
+		return ""
+	}
+
+	if cfg.MaxAge <= 0 {
+		return ""
+	}
+
+	cc := fmt.Sprintf("max-age=%d", int(cfg.MaxAge.Seconds()))
+	if cfg.StaleWhileRevalidate > 0 {
+		cc += fmt.Sprintf(", stale-while-revalidate=%d", int(cfg.StaleWhileRevalidate.Seconds()))
+	}
+
+	return cc
+}
+
+// acceptParams returns the parameters of the media range in an Accept header
+// naming mediaType, the output format negotiated, e.g. the profile of
+//
+//	application/coserv+cbor; profile="tag:arm.com,2023:cca_platform#1.0.0"
+//
+// Known parameters are validated. Unknown ones are ignored, unless
+// configured to be rejected.
+func (o *Handler) acceptParams(accept, mediaType string) (map[string]string, error) {
+	for _, mediaRange := range splitAccept(accept) {
+		if strings.TrimSpace(mediaRange) == "" {
+			continue
+		}
+
+		mt, params, err := mime.ParseMediaType(mediaRange)
+		if err != nil {
+			return nil, fmt.Errorf("malformed Accept media range %q: %w", strings.TrimSpace(mediaRange), err)
+		}
+
+		if mt != mediaType {
+			continue
+		}
+
+		for name, value := range params {
+			switch name {
+			case "profile":
+				if value == "" {
+					return nil, errors.New("empty profile parameter in Accept")
+				}
+			case "q":
+				if q, err := strconv.ParseFloat(value, 64); err != nil || q < 0 || q > 1 {
+					return nil, fmt.Errorf("invalid q parameter %q in Accept", value)
+				}
+			default:
+				if o.Config.RejectUnknownMediaTypeParams {
+					return nil, fmt.Errorf("unsupported %s parameter %q in Accept", mediaType, name)
+				}
+			}
+		}
+
+		return params, nil
+	}
+
+	return map[string]string{}, nil
+}
+
+// splitAccept splits an Accept header into its media ranges. Commas inside
+// quoted parameter values, as in the profile of the acceptParams example,
+// don't separate ranges.
+func splitAccept(accept string) []string {
+	var (
+		ranges  []string
+		start   int
+		quoted  bool
+		escaped bool
+	)
+	for i := 0; i < len(accept); i++ {
+		switch ch := accept[i]; {
+		case escaped:
+			escaped = false
+		case quoted && ch == '\\':
+			escaped = true
+		case ch == '"':
+			quoted = !quoted
+		case ch == ',' && !quoted:
+			ranges = append(ranges, accept[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(ranges, accept[start:])
+}
+
+// maxTenantIDLength bounds the tenant IDs accepted in TenantHeader
+const maxTenantIDLength = 64
+
+// requestTenant returns the tenant the request's API key resolved to, if
+// API keys are configured, or else the one named by its TenantHeader.
+// Tenant IDs become a segment of the lookup keys, so they are limited to
+// letters, digits, '.', '_' and '-'.
+func requestTenant(c *gin.Context) (string, error) {
+	if tenant := c.GetString(tenantKey); tenant != "" {
+		return tenant, nil
+	}
+
+	tenant := c.GetHeader(TenantHeader)
+	if err := checkTenant(TenantHeader+" header", tenant); err != nil {
+		return "", err
+	}
+
+	return tenant, nil
+}
+
+// checkTenant checks a tenant ID named by a client in source, TenantHeader
+// or its gRPC metadata counterpart
+func checkTenant(source, tenant string) error {
+	if tenant == "" {
+		return fmt.Errorf("missing %s", source)
+	}
+
+	if len(tenant) > maxTenantIDLength {
+		return fmt.Errorf("%s longer than %d characters", source, maxTenantIDLength)
+	}
+
+	for _, r := range tenant {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+		default:
+			return fmt.Errorf("invalid %s %q: only letters, digits, '.', '_' and '-' are allowed",
+				source, tenant)
+		}
+	}
+
+	return nil
+}
+
+// singleValuedParams are the query-string parameters that may appear at most
+// once on a coserv request
+var singleValuedParams = []string{"digestOnly", "hashAlg", "offset", "limit"}
+
+// ambiguousParams describes the first query-string parameter that would make
+// the request ambiguous, or returns "" if there is none
+func ambiguousParams(params url.Values) string {
+	if _, ok := params["query"]; ok {
+		return "the query must not be given as a query-string parameter"
+	}
+
+	for _, name := range singleValuedParams {
+		if n := len(params[name]); n > 1 {
+			return fmt.Sprintf("%s given %d times: it must be given at most once", name, n)
+		}
+	}
+
+	return ""
+}
+
+// preferredReturn extracts the value of the "return" preference from Prefer
+// header values, if it is one we support ("minimal" or "representation")
+func preferredReturn(prefer []string) string {
+	for _, header := range prefer {
+		for _, pref := range strings.Split(header, ",") {
+			// Preference parameters, if any, follow a semicolon
+			pref, _, _ = strings.Cut(pref, ";")
+
+			name, value, _ := strings.Cut(strings.TrimSpace(pref), "=")
+			if !strings.EqualFold(strings.TrimSpace(name), "return") {
+				continue
+			}
+
+			switch value = strings.Trim(strings.TrimSpace(value), `"`); value {
+			case "minimal", "representation":
+				return value
+			}
+		}
+	}
+
+	return ""
+}
+
+// writeDigest responds with the SHA-256 digest of the result body that would
+// otherwise have been returned, so that clients holding a cached copy can
+// check whether it is still current without downloading it again
+func writeDigest(c *gin.Context, body []byte) {
+	digest := sha256.Sum256(body)
+
+	c.JSON(http.StatusOK, map[string]string{
+		"algorithm": "sha-256",
+		"digest":    hex.EncodeToString(digest[:]),
+	})
 }
 
 // reportProblem reports an error using RFC7807 problem format
 func (o *Handler) reportProblem(c *gin.Context, status int, details ...string) {
+	o.reportProblemWith(c, status, nil, nil, details...)
+}
+
+// reportError reports err like reportProblem, with err as the last detail
+// and the error code of err
+func (o *Handler) reportError(c *gin.Context, status int, err error, details ...string) {
+	o.reportProblemWith(c, status, err, nil, append(details, err.Error())...)
+}
+
+// reportProblemWith reports an error like reportProblem, coded after err if
+// there is one, adding the extension members in extra to the problem
+func (o *Handler) reportProblemWith(c *gin.Context, status int, err error, extra map[string]interface{}, details ...string) {
 	problem := map[string]interface{}{
 		"status": status,
 		"title":  http.StatusText(status),
+		"code":   errorCode(err, status),
+	}
+	for k, v := range extra {
+		problem[k] = v
 	}
 
 	if len(details) > 0 {
 		problem["detail"] = strings.Join(details, ", ")
 	}
 
-	o.Logger.Errorw("API error", "status", status, "details", details)
+	o.requestLogger(c).Errorw("API error", "status", status, "details", details)
 
+	// A 429 has already been told exactly when to retry by the rate limiter
+	if status == http.StatusServiceUnavailable && c.Writer.Header().Get("Retry-After") == "" {
+		c.Header("Retry-After", strconv.Itoa(int(unavailableRetryAfter.Seconds())))
+	}
 	c.Header("Content-Type", "application/problem+json")
 	c.AbortWithStatusJSON(status, problem)
-} 
\ No newline at end of file
+}
+
+// errorCode is the single place where problems are mapped to error codes:
+// after the error that caused them, or after their status for the problems
+// the handlers detect themselves (missing headers, authentication, rate
+// limiting, media types)
+func errorCode(err error, status int) string {
+	switch {
+	case err == nil:
+	case errors.Is(err, store.ErrInvalidQuery):
+		return ErrCodeInvalidQuery
+	case errors.Is(err, store.ErrMalformedQuery), errors.Is(err, store.ErrInvalidOption):
+		return ErrCodeBadQuery
+	case errors.Is(err, store.ErrUnsupportedProfile):
+		return ErrCodeUnsupportedProfile
+	case errors.Is(err, store.ErrUnsupportedArtifactType):
+		return ErrCodeUnsupportedArtifact
+	case errors.Is(err, store.ErrQueryTooBroad):
+		return ErrCodeQueryTooBroad
+	case errors.Is(err, store.ErrNoArtifacts):
+		return ErrCodeNotFound
+	case errors.Is(err, store.ErrGone):
+		return ErrCodeGone
+	case errors.Is(err, store.ErrProfileMismatch), errors.Is(err, store.ErrStoredProfileMismatch):
+		return ErrCodeProfileMismatch
+	case errors.Is(err, store.ErrExists):
+		return ErrCodeConflict
+	case errors.Is(err, store.ErrArtifactsTooLarge):
+		return ErrCodeTooLarge
+	case errors.Is(err, store.ErrMalformedCorim):
+		return ErrCodeMalformedEndorsements
+	case errors.Is(err, store.ErrDraining), errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return ErrCodeUnavailable
+	}
+
+	switch status {
+	case http.StatusBadRequest:
+		return ErrCodeBadQuery
+	case http.StatusRequestEntityTooLarge:
+		return ErrCodeTooLarge
+	case http.StatusUnprocessableEntity:
+		return ErrCodeInvalidQuery
+	case http.StatusNotFound:
+		return ErrCodeNotFound
+	case http.StatusNotAcceptable:
+		return ErrCodeNotAcceptable
+	case http.StatusUnauthorized:
+		return ErrCodeUnauthorized
+	case http.StatusForbidden:
+		return ErrCodeForbidden
+	case http.StatusGone:
+		return ErrCodeGone
+	case http.StatusUnsupportedMediaType:
+		return ErrCodeUnsupported
+	case http.StatusConflict:
+		return ErrCodeConflict
+	case http.StatusTooManyRequests:
+		return ErrCodeRateLimited
+	case http.StatusServiceUnavailable:
+		return ErrCodeUnavailable
+	default:
+		return ErrCodeInternal
+	}
+}
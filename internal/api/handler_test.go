@@ -0,0 +1,1421 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"endorsement-distribution/internal/config"
+	"endorsement-distribution/internal/store"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/veraison/corim/comid"
+	"github.com/veraison/corim/coserv"
+	"github.com/veraison/swid"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+const (
+	ccaProfile = "tag:arm.com,2023:cca_platform#1.0.0"
+	testTenant = "acme"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// testEnv is a handler backed by a memory store, with the public router in
+// front of it
+type testEnv struct {
+	handler *Handler
+	store   *store.MemoryStore
+	router  *gin.Engine
+}
+
+// newTestEnv creates a test environment. Results are raw-encoded unless
+// dcfg says otherwise, so that any bytes can be stored as artifacts.
+func newTestEnv(t *testing.T, cfg config.APIConfig, dcfg config.DistributorConfig) *testEnv {
+	t.Helper()
+
+	ms, err := store.NewMemoryStore(config.DatabaseConfig{})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+
+	if dcfg.ResultEncoding == "" {
+		dcfg.ResultEncoding = store.ResultEncodingRaw
+	}
+
+	logger := zap.NewNop().Sugar()
+	handler := NewHandler(store.NewEndorsementDistributor(ms, dcfg, logger), cfg, logger)
+
+	return &testEnv{handler: handler, store: ms, router: NewRouter(handler)}
+}
+
+// do sends req to the router and returns the recorded response
+func (o *testEnv) do(req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	o.router.ServeHTTP(rec, req)
+	return rec
+}
+
+// get sends a GET for the CoSERV query on behalf of testTenant
+func (o *testEnv) get(query string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, edApiPath+"/coserv/"+query, nil)
+	req.Header.Set(TenantHeader, testTenant)
+	for name, values := range header {
+		req.Header.Del(name)
+		for _, v := range values {
+			req.Header.Add(name, v)
+		}
+	}
+	return o.do(req)
+}
+
+// put stores artifacts under the lookup keys of query for testTenant
+func (o *testEnv) put(t *testing.T, query string, artifacts ...[]byte) {
+	t.Helper()
+
+	keys, err := store.GenerateKey(testTenant, query)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	for _, key := range keys {
+		if err := o.store.Set(context.Background(), key, artifacts); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+}
+
+// encodeQuery returns the base64url encoding of a CoSERV query of profile
+// for the artifacts of type at matching selector
+func encodeQuery(t *testing.T, profile string, at coserv.ArtifactType, selector *coserv.EnvironmentSelector) string {
+	t.Helper()
+
+	q, err := coserv.NewQuery(at, *selector)
+	if err != nil {
+		t.Fatalf("NewQuery: %v", err)
+	}
+
+	c, err := coserv.NewCoserv(profile, *q)
+	if err != nil {
+		t.Fatalf("NewCoserv: %v", err)
+	}
+
+	s, err := c.ToBase64Url()
+	if err != nil {
+		t.Fatalf("ToBase64Url: %v", err)
+	}
+
+	return s
+}
+
+// refValQuery returns a reference value query for the classes of implIDs,
+// or of comid.TestImplID if none are given
+func refValQuery(t *testing.T, implIDs ...comid.ImplID) string {
+	t.Helper()
+
+	if len(implIDs) == 0 {
+		implIDs = []comid.ImplID{comid.TestImplID}
+	}
+
+	selector := coserv.NewEnvironmentSelector()
+	for _, id := range implIDs {
+		selector.AddClass(*comid.NewClassImplID(id))
+	}
+
+	return encodeQuery(t, ccaProfile, coserv.ArtifactTypeReferenceValues, selector)
+}
+
+// taQuery returns a trust anchor query for the instance of comid.TestUEID
+func taQuery(t *testing.T) string {
+	t.Helper()
+
+	instance, err := comid.NewUEIDInstance(comid.TestUEID)
+	if err != nil {
+		t.Fatalf("NewUEIDInstance: %v", err)
+	}
+
+	return encodeQuery(t, ccaProfile, coserv.ArtifactTypeTrustAnchors, coserv.NewEnvironmentSelector().AddInstance(*instance))
+}
+
+// problem decodes the problem+json body of rec
+func problem(t *testing.T, rec *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+
+	var p map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil {
+		t.Fatalf("decoding problem %q: %v", rec.Body.String(), err)
+	}
+
+	return p
+}
+
+// wantProblem checks that rec is a problem of the given status and code
+func wantProblem(t *testing.T, rec *httptest.ResponseRecorder, status int, code string) {
+	t.Helper()
+
+	if rec.Code != status {
+		t.Fatalf("status = %d, want %d (body %s)", rec.Code, status, rec.Body.String())
+	}
+	if got := problem(t, rec)["code"]; got != code {
+		t.Errorf("code = %v, want %s (body %s)", got, code, rec.Body.String())
+	}
+}
+
+func TestAcceptParams(t *testing.T) {
+	tests := []struct {
+		name   string
+		accept string
+		want   map[string]string
+	}{
+		{
+			name:   "no parameters",
+			accept: EdApiMediaType,
+			want:   map[string]string{},
+		},
+		{
+			name:   "comma inside a quoted profile",
+			accept: EdApiMediaType + `; profile="` + ccaProfile + `"`,
+			want:   map[string]string{"profile": ccaProfile},
+		},
+		{
+			name:   "several parameters",
+			accept: EdApiMediaType + `; profile="` + ccaProfile + `"; q=0.8; charset=utf-8`,
+			want:   map[string]string{"profile": ccaProfile, "q": "0.8", "charset": "utf-8"},
+		},
+		{
+			name:   "several media ranges",
+			accept: `application/json; q=0.5, ` + EdApiMediaType + `; profile="` + ccaProfile + `"; q=0.9, */*; q=0.1`,
+			want:   map[string]string{"profile": ccaProfile, "q": "0.9"},
+		},
+		{
+			name:   "media range for another type first",
+			accept: CoservJSONMediaType + `; profile="a,b", ` + EdApiMediaType + `; profile="c,d"`,
+			want:   map[string]string{"profile": "c,d"},
+		},
+		{
+			name:   "escaped quote in a quoted value",
+			accept: EdApiMediaType + `; profile="a\"b,c"`,
+			want:   map[string]string{"profile": `a"b,c`},
+		},
+	}
+
+	o := &Handler{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := o.acceptParams(tt.accept, EdApiMediaType)
+			if err != nil {
+				t.Fatalf("acceptParams(%q): %v", tt.accept, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("acceptParams(%q) = %v, want %v", tt.accept, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAcceptParamsInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		accept string
+		cfg    config.APIConfig
+	}{
+		{"empty profile", EdApiMediaType + `; profile=""`, config.APIConfig{}},
+		{"q out of range", EdApiMediaType + `; q=2`, config.APIConfig{}},
+		{"unterminated quote", EdApiMediaType + `; profile="` + ccaProfile, config.APIConfig{}},
+		{
+			"unknown parameter rejected",
+			EdApiMediaType + `; profile="` + ccaProfile + `"; version=2`,
+			config.APIConfig{RejectUnknownMediaTypeParams: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &Handler{Config: tt.cfg}
+			if _, err := o.acceptParams(tt.accept, EdApiMediaType); err == nil {
+				t.Errorf("acceptParams(%q) succeeded, want an error", tt.accept)
+			}
+		})
+	}
+}
+
+func TestAcceptParamsIgnoresUnknown(t *testing.T) {
+	o := &Handler{}
+
+	got, err := o.acceptParams(EdApiMediaType+`; version=2`, EdApiMediaType)
+	if err != nil {
+		t.Fatalf("acceptParams: %v", err)
+	}
+	if got["version"] != "2" {
+		t.Errorf("acceptParams = %v, want the unknown parameter passed through", got)
+	}
+}
+
+func TestSplitAccept(t *testing.T) {
+	accept := `a/b; p="x,y", c/d`
+	want := []string{`a/b; p="x,y"`, ` c/d`}
+
+	if got := splitAccept(accept); !reflect.DeepEqual(got, want) {
+		t.Errorf("splitAccept(%q) = %q, want %q", accept, got, want)
+	}
+}
+
+func TestCoservRequestQuotedProfile(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{}, config.DistributorConfig{})
+	query := refValQuery(t)
+	env.put(t, query, []byte("artifact"))
+
+	rec := env.get(query, http.Header{"Accept": {EdApiMediaType + `; profile="` + ccaProfile + `"`}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 (body %s)", rec.Code, rec.Body.String())
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		want   string
+	}{
+		{store.ErrMalformedQuery, http.StatusBadRequest, ErrCodeBadQuery},
+		{store.ErrInvalidQuery, http.StatusBadRequest, ErrCodeInvalidQuery},
+		{store.ErrUnsupportedProfile, http.StatusBadRequest, ErrCodeUnsupportedProfile},
+		{store.ErrUnsupportedArtifactType, http.StatusBadRequest, ErrCodeUnsupportedArtifact},
+		{store.ErrQueryTooBroad, http.StatusBadRequest, ErrCodeQueryTooBroad},
+		{store.ErrNoArtifacts, http.StatusNotFound, ErrCodeNotFound},
+		{store.ErrGone, http.StatusGone, ErrCodeGone},
+		{store.ErrProfileMismatch, http.StatusNotAcceptable, ErrCodeProfileMismatch},
+		{store.ErrStoredProfileMismatch, http.StatusNotAcceptable, ErrCodeProfileMismatch},
+		{store.ErrExists, http.StatusConflict, ErrCodeConflict},
+		{store.ErrArtifactsTooLarge, http.StatusRequestEntityTooLarge, ErrCodeTooLarge},
+		{store.ErrMalformedCorim, http.StatusBadRequest, ErrCodeMalformedEndorsements},
+		{store.ErrDraining, http.StatusServiceUnavailable, ErrCodeUnavailable},
+		{context.DeadlineExceeded, http.StatusServiceUnavailable, ErrCodeUnavailable},
+		{fmt.Errorf("failed to get artifacts: %w", store.ErrNoArtifacts), http.StatusNotFound, ErrCodeNotFound},
+		{errors.New("connection refused"), http.StatusInternalServerError, ErrCodeInternal},
+		{errors.New("connection refused"), http.StatusServiceUnavailable, ErrCodeUnavailable},
+		{nil, http.StatusUnauthorized, ErrCodeUnauthorized},
+		{nil, http.StatusTooManyRequests, ErrCodeRateLimited},
+		{nil, http.StatusUnsupportedMediaType, ErrCodeUnsupported},
+	}
+
+	for _, tt := range tests {
+		if got := errorCode(tt.err, tt.status); got != tt.want {
+			t.Errorf("errorCode(%v, %d) = %s, want %s", tt.err, tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestCoservRequestErrorCodes(t *testing.T) {
+	query := refValQuery(t)
+	otherImplID := comid.ImplID{1, 2, 3}
+
+	tests := []struct {
+		name   string
+		dcfg   config.DistributorConfig
+		query  string
+		header http.Header
+		status int
+		code   string
+	}{
+		{
+			name:   "malformed query",
+			query:  "not-cbor",
+			status: http.StatusBadRequest,
+			code:   ErrCodeBadQuery,
+		},
+		{
+			name:   "nothing stored",
+			query:  refValQuery(t, otherImplID),
+			status: http.StatusNotFound,
+			code:   ErrCodeNotFound,
+		},
+		{
+			name:   "unsupported profile",
+			dcfg:   config.DistributorConfig{SupportedProfiles: []string{"tag:example.com,2024:other"}},
+			query:  query,
+			status: http.StatusBadRequest,
+			code:   ErrCodeUnsupportedProfile,
+		},
+		{
+			name: "unsupported artifact type",
+			query: encodeQuery(t, ccaProfile, coserv.ArtifactTypeEndorsedValues,
+				coserv.NewEnvironmentSelector().AddClass(*comid.NewClassImplID(comid.TestImplID))),
+			status: http.StatusBadRequest,
+			code:   ErrCodeUnsupportedArtifact,
+		},
+		{
+			name:   "too many keys",
+			dcfg:   config.DistributorConfig{MaxKeysPerQuery: 1},
+			query:  refValQuery(t, comid.TestImplID, otherImplID),
+			status: http.StatusBadRequest,
+			code:   ErrCodeQueryTooBroad,
+		},
+		{
+			name:   "profile mismatch",
+			dcfg:   config.DistributorConfig{StrictProfileMatch: true},
+			query:  query,
+			header: http.Header{"Accept": {EdApiMediaType + `; profile="tag:example.com,2024:other"`}},
+			status: http.StatusNotAcceptable,
+			code:   ErrCodeProfileMismatch,
+		},
+		{
+			name:   "unsupported output format",
+			query:  query,
+			header: http.Header{"Accept": {"text/html"}},
+			status: http.StatusNotAcceptable,
+			code:   ErrCodeNotAcceptable,
+		},
+		{
+			name:   "missing tenant",
+			query:  query,
+			header: http.Header{TenantHeader: {""}},
+			status: http.StatusBadRequest,
+			code:   ErrCodeBadQuery,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t, config.APIConfig{}, tt.dcfg)
+			env.put(t, query, []byte("artifact"))
+
+			wantProblem(t, env.get(tt.query, tt.header), tt.status, tt.code)
+		})
+	}
+}
+
+func TestDrainingErrorCode(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{}, config.DistributorConfig{})
+	query := refValQuery(t)
+	env.put(t, query, []byte("artifact"))
+
+	if err := env.handler.EndorsementDistributor.Drain(context.Background()); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+
+	for name, rec := range map[string]*httptest.ResponseRecorder{
+		"coserv": env.get(query, nil),
+		"readyz": env.do(httptest.NewRequest(http.MethodGet, readyzPath, nil)),
+	} {
+		wantProblem(t, rec, http.StatusServiceUnavailable, ErrCodeUnavailable)
+		wantUnavailableRetryAfter(t, name, rec)
+	}
+}
+
+// wantUnavailableRetryAfter checks that the 503 rec tells the client to back
+// off for unavailableRetryAfter
+func wantUnavailableRetryAfter(t *testing.T, name string, rec *httptest.ResponseRecorder) {
+	t.Helper()
+
+	if got, want := rec.Header().Get("Retry-After"), strconv.Itoa(int(unavailableRetryAfter.Seconds())); got != want {
+		t.Errorf("%s: Retry-After = %q, want %s", name, got, want)
+	}
+}
+
+func TestStoreUnavailableRetryAfter(t *testing.T) {
+	ms, err := store.NewMemoryStore(config.DatabaseConfig{})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+
+	logger := zap.NewNop().Sugar()
+	fs := failingStore{Store: ms, err: fmt.Errorf("failed to query database: %w", context.DeadlineExceeded)}
+	handler := NewHandler(store.NewEndorsementDistributor(fs, config.DistributorConfig{}, logger), config.APIConfig{}, logger)
+	env := &testEnv{handler: handler, store: ms, router: NewRouter(handler)}
+
+	rec := env.get(refValQuery(t), nil)
+	wantProblem(t, rec, http.StatusServiceUnavailable, ErrCodeUnavailable)
+	wantUnavailableRetryAfter(t, "coserv", rec)
+}
+
+func TestNoRetryAfterOnOtherErrors(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{}, config.DistributorConfig{})
+
+	rec := env.get(refValQuery(t), nil)
+	wantProblem(t, rec, http.StatusNotFound, ErrCodeNotFound)
+	if got := rec.Header().Get("Retry-After"); got != "" {
+		t.Errorf("Retry-After = %q on a 404", got)
+	}
+}
+
+// failingStore is a store whose lookups and pings fail with err
+type failingStore struct {
+	store.Store
+	err error
+}
+
+func (o failingStore) Get(ctx context.Context, keys []string) ([]store.KeyedArtifacts, error) {
+	return nil, o.err
+}
+
+func (o failingStore) Exists(ctx context.Context, keys []string) (bool, error) {
+	return false, o.err
+}
+
+func (o failingStore) Ping(ctx context.Context) error {
+	return o.err
+}
+
+func TestProbes(t *testing.T) {
+	ms, err := store.NewMemoryStore(config.DatabaseConfig{})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	logger := zap.NewNop().Sugar()
+
+	for _, tt := range []struct {
+		name       string
+		store      store.Store
+		wantReadyz int
+	}{
+		{"store up", ms, http.StatusOK},
+		{"store down", failingStore{Store: ms, err: errors.New("connection refused")}, http.StatusServiceUnavailable},
+	} {
+		handler := NewHandler(store.NewEndorsementDistributor(tt.store, config.DistributorConfig{}, logger), config.APIConfig{}, logger)
+		env := &testEnv{handler: handler, store: ms, router: NewRouter(handler)}
+
+		// Liveness doesn't depend on the store
+		if rec := env.do(httptest.NewRequest(http.MethodGet, healthzPath, nil)); rec.Code != http.StatusOK {
+			t.Errorf("%s: GET %s = %d, want 200", tt.name, healthzPath, rec.Code)
+		}
+
+		rec := env.do(httptest.NewRequest(http.MethodGet, readyzPath, nil))
+		if rec.Code != tt.wantReadyz {
+			t.Errorf("%s: GET %s = %d, want %d", tt.name, readyzPath, rec.Code, tt.wantReadyz)
+		}
+		if tt.wantReadyz != http.StatusOK {
+			wantProblem(t, rec, tt.wantReadyz, ErrCodeUnavailable)
+		}
+	}
+}
+
+// blockingStore is a store whose lookups wait for their context to end,
+// and report how it ended
+type blockingStore struct {
+	store.Store
+	started chan struct{}
+	ended   chan error
+}
+
+func (o blockingStore) Get(ctx context.Context, keys []string) ([]store.KeyedArtifacts, error) {
+	close(o.started)
+	<-ctx.Done()
+	o.ended <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+func TestRequestCancellationReachesStore(t *testing.T) {
+	ms, err := store.NewMemoryStore(config.DatabaseConfig{})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+
+	logger := zap.NewNop().Sugar()
+	bs := blockingStore{Store: ms, started: make(chan struct{}), ended: make(chan error, 1)}
+	handler := NewHandler(store.NewEndorsementDistributor(bs, config.DistributorConfig{}, logger), config.APIConfig{}, logger)
+	env := &testEnv{handler: handler, store: ms, router: NewRouter(handler)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, edApiPath+"/coserv/"+refValQuery(t), nil).WithContext(ctx)
+	req.Header.Set(TenantHeader, testTenant)
+
+	done := make(chan struct{})
+	go func() {
+		env.do(req)
+		close(done)
+	}()
+
+	<-bs.started
+	cancel()
+
+	select {
+	case err := <-bs.ended:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("store lookup ended with %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("store lookup not cancelled with the request")
+	}
+	<-done
+}
+
+// existsOnlyStore is a store whose Exists works but whose Get fails
+type existsOnlyStore struct {
+	store.Store
+}
+
+func (o existsOnlyStore) Get(ctx context.Context, keys []string) ([]store.KeyedArtifacts, error) {
+	return nil, errors.New("Get called")
+}
+
+func TestHeadRequest(t *testing.T) {
+	ms, err := store.NewMemoryStore(config.DatabaseConfig{})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+
+	logger := zap.NewNop().Sugar()
+	handler := NewHandler(store.NewEndorsementDistributor(existsOnlyStore{Store: ms}, config.DistributorConfig{}, logger),
+		config.APIConfig{}, logger)
+	env := &testEnv{handler: handler, store: ms, router: NewRouter(handler)}
+
+	query := refValQuery(t)
+	env.put(t, query, []byte("artifact"))
+
+	for _, tt := range []struct {
+		name  string
+		query string
+		want  int
+	}{
+		{"stored", query, http.StatusOK},
+		{"not stored", refValQuery(t, comid.ImplID{1}), http.StatusNotFound},
+	} {
+		req := httptest.NewRequest(http.MethodHead, edApiPath+"/coserv/"+tt.query, nil)
+		req.Header.Set(TenantHeader, testTenant)
+		rec := env.do(req)
+
+		if rec.Code != tt.want {
+			t.Errorf("%s: HEAD = %d, want %d", tt.name, rec.Code, tt.want)
+		}
+		if rec.Body.Len() != 0 {
+			t.Errorf("%s: HEAD has a %d byte body, want none", tt.name, rec.Body.Len())
+		}
+	}
+}
+
+func TestGoneVsNotFound(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		ttl         time.Duration
+		wantDeleted int
+	}{
+		{"tombstones kept", time.Hour, http.StatusGone},
+		{"tombstones off", 0, http.StatusNotFound},
+	} {
+		ms, err := store.NewMemoryStore(config.DatabaseConfig{Memory: config.MemoryConfig{TombstoneTTL: tt.ttl}})
+		if err != nil {
+			t.Fatalf("NewMemoryStore: %v", err)
+		}
+
+		logger := zap.NewNop().Sugar()
+		handler := NewHandler(store.NewEndorsementDistributor(ms, config.DistributorConfig{ResultEncoding: store.ResultEncodingRaw}, logger),
+			config.APIConfig{}, logger)
+		env := &testEnv{handler: handler, store: ms, router: NewRouter(handler)}
+
+		deleted := refValQuery(t)
+		env.put(t, deleted, []byte("artifact"))
+		keys, err := store.GenerateKey(testTenant, deleted)
+		if err != nil {
+			t.Fatalf("GenerateKey: %v", err)
+		}
+		for _, key := range keys {
+			if err := ms.Delete(key); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+		}
+
+		if rec := env.get(deleted, nil); rec.Code != tt.wantDeleted {
+			t.Errorf("%s: GET of a deleted key = %d, want %d", tt.name, rec.Code, tt.wantDeleted)
+		}
+		if rec := env.get(refValQuery(t, comid.ImplID{1}), nil); rec.Code != http.StatusNotFound {
+			t.Errorf("%s: GET of a key never stored = %d, want 404", tt.name, rec.Code)
+		}
+	}
+}
+
+func TestStoreFailureIsInternal(t *testing.T) {
+	ms, err := store.NewMemoryStore(config.DatabaseConfig{})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+
+	logger := zap.NewNop().Sugar()
+	fs := failingStore{Store: ms, err: errors.New("failed to query database: connection refused")}
+	handler := NewHandler(store.NewEndorsementDistributor(fs, config.DistributorConfig{}, logger), config.APIConfig{}, logger)
+	env := &testEnv{handler: handler, store: ms, router: NewRouter(handler)}
+
+	query := refValQuery(t)
+	wantProblem(t, env.get(query, nil), http.StatusInternalServerError, ErrCodeInternal)
+
+	req := httptest.NewRequest(http.MethodHead, edApiPath+"/coserv/"+query, nil)
+	req.Header.Set(TenantHeader, testTenant)
+	if rec := env.do(req); rec.Code != http.StatusInternalServerError {
+		t.Errorf("HEAD status = %d, want 500", rec.Code)
+	}
+}
+
+func TestQueryErrorStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{store.ErrMalformedQuery, http.StatusBadRequest},
+		{store.ErrInvalidQuery, http.StatusBadRequest},
+		{store.ErrInvalidOption, http.StatusBadRequest},
+		{store.ErrUnsupportedProfile, http.StatusBadRequest},
+		{store.ErrUnsupportedArtifactType, http.StatusBadRequest},
+		{store.ErrQueryTooBroad, http.StatusBadRequest},
+		{store.ErrNoArtifacts, http.StatusNotFound},
+		{store.ErrGone, http.StatusGone},
+		{store.ErrStoredProfileMismatch, http.StatusNotAcceptable},
+		{store.ErrDraining, http.StatusServiceUnavailable},
+		{store.ErrUnsupportedValueFormat, http.StatusInternalServerError},
+		{errors.New("failed to query database"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		if got := queryErrorStatus(tt.err); got != tt.want {
+			t.Errorf("queryErrorStatus(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestUnknownHashAlgorithm(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{}, config.DistributorConfig{})
+	query := refValQuery(t)
+	env.put(t, query, []byte("artifact"))
+
+	req := httptest.NewRequest(http.MethodGet, edApiPath+"/coserv/"+query+"?hashAlg=md6", nil)
+	req.Header.Set(TenantHeader, testTenant)
+	wantProblem(t, env.do(req), http.StatusBadRequest, ErrCodeBadQuery)
+}
+
+// adminRequest sends an admin request carrying the token "secret" to router
+func adminRequest(router *gin.Engine, method, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, adminPath+path, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAPIKeys(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{APIKeys: []config.APIKeyConfig{
+		{Key: "key-a", Tenant: testTenant},
+		{Key: "key-b", Tenant: "other"},
+	}}, config.DistributorConfig{})
+	query := refValQuery(t)
+	env.put(t, query, []byte("artifact"))
+
+	tests := []struct {
+		name   string
+		key    string
+		tenant string
+		want   int
+	}{
+		{"no key", "", testTenant, http.StatusUnauthorized},
+		{"unknown key", "key-c", testTenant, http.StatusUnauthorized},
+		{"tenant from the key", "key-a", "", http.StatusOK},
+		{"tenant matching the key", "key-a", testTenant, http.StatusOK},
+		{"tenant not matching the key", "key-a", "other", http.StatusForbidden},
+		{"another tenant's key", "key-b", "", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, edApiPath+"/coserv/"+query, nil)
+		if tt.key != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.key)
+		}
+		if tt.tenant != "" {
+			req.Header.Set(TenantHeader, tt.tenant)
+		}
+
+		if rec := env.do(req); rec.Code != tt.want {
+			t.Errorf("%s: GET = %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+
+	// Ingestion takes a key too
+	req := httptest.NewRequest(http.MethodPut, edApiPath+"/endorsements", strings.NewReader("corim"))
+	req.Header.Set(TenantHeader, testTenant)
+	if rec := env.do(req); rec.Code != http.StatusUnauthorized {
+		t.Errorf("PUT without a key = %d, want 401", rec.Code)
+	}
+}
+
+func TestAdminRoutesNotOnPublicRouter(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{Admin: config.AdminConfig{Token: "secret"}}, config.DistributorConfig{})
+	env.put(t, refValQuery(t), []byte("artifact"))
+
+	routes := []struct{ method, path string }{
+		{http.MethodGet, "/stats"},
+		{http.MethodDelete, "/tenants/" + testTenant},
+		{http.MethodGet, "/reconciler"},
+		{http.MethodPost, "/reconciler/pause"},
+		{http.MethodPost, "/reconciler/resume"},
+	}
+
+	for _, r := range routes {
+		if rec := adminRequest(env.router, r.method, r.path); rec.Code != http.StatusNotFound {
+			t.Errorf("%s %s on the public router = %d, want 404", r.method, adminPath+r.path, rec.Code)
+		}
+	}
+
+	if n, err := env.store.Count(context.Background()); err != nil || n != 1 {
+		t.Errorf("store holds %d keys (%v) after the public router was sent a tenant delete, want 1", n, err)
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	tests := []struct {
+		name          string
+		token         string
+		authorization string
+		want          int
+	}{
+		{"valid", "secret", "Bearer secret", http.StatusOK},
+		{"missing", "secret", "", http.StatusUnauthorized},
+		{"wrong", "secret", "Bearer other", http.StatusUnauthorized},
+		{"not bearer", "secret", "secret", http.StatusUnauthorized},
+		{"none configured", "", "Bearer ", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		env := newTestEnv(t, config.APIConfig{Admin: config.AdminConfig{Token: tt.token}}, config.DistributorConfig{})
+
+		req := httptest.NewRequest(http.MethodGet, adminPath+"/stats", nil)
+		if tt.authorization != "" {
+			req.Header.Set("Authorization", tt.authorization)
+		}
+		rec := httptest.NewRecorder()
+		NewAdminRouter(env.handler).ServeHTTP(rec, req)
+
+		if rec.Code != tt.want {
+			t.Errorf("%s: GET /admin/stats = %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestAdminAllowedSources(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{Admin: config.AdminConfig{
+		Token:        "secret",
+		AllowedCIDRs: []string{"10.0.0.0/8", "::1/128"},
+	}}, config.DistributorConfig{})
+	admin := NewAdminRouter(env.handler)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		want       int
+	}{
+		{"allowed", "10.1.2.3:4000", "", http.StatusOK},
+		{"allowed IPv6", "[::1]:4000", "", http.StatusOK},
+		{"allowed IPv4-mapped", "[::ffff:10.1.2.3]:4000", "", http.StatusOK},
+		{"disallowed", "192.0.2.1:4000", "", http.StatusForbidden},
+		{"disallowed, forwarded for an allowed one", "192.0.2.1:4000", "10.1.2.3", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, adminPath+"/stats", nil)
+		req.RemoteAddr = tt.remoteAddr
+		req.Header.Set("Authorization", "Bearer secret")
+		if tt.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, req)
+
+		if rec.Code != tt.want {
+			t.Errorf("%s: GET /admin/stats from %s = %d, want %d", tt.name, tt.remoteAddr, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestAdminStats(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{Admin: config.AdminConfig{Token: "secret"}}, config.DistributorConfig{})
+	admin := NewAdminRouter(env.handler)
+	env.put(t, refValQuery(t), []byte("artifact"))
+	env.put(t, taQuery(t), []byte("artifact"))
+
+	rec := adminRequest(admin, http.MethodGet, "/stats")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /stats = %d: %s", rec.Code, rec.Body)
+	}
+
+	var stats store.Stats
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("decoding the stats: %v", err)
+	}
+	if stats.TotalKeys != 2 || stats.Tenants[testTenant] != 2 {
+		t.Errorf("stats = %+v, want 2 keys, all of %s", stats, testTenant)
+	}
+}
+
+func TestAdminDeleteTenant(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{Admin: config.AdminConfig{Token: "secret"}}, config.DistributorConfig{})
+	admin := NewAdminRouter(env.handler)
+
+	query := refValQuery(t)
+	env.put(t, query, []byte("artifact"))
+	env.put(t, taQuery(t), []byte("artifact"))
+
+	// A tenant whose name starts with the deleted one's is left alone
+	keys, err := store.GenerateKey(testTenant+"corp", query)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	for _, key := range keys {
+		if err := env.store.Set(context.Background(), key, [][]byte{[]byte("artifact")}); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+
+	rec := adminRequest(admin, http.MethodDelete, "/tenants/"+testTenant)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("DELETE /tenants/%s = %d: %s", testTenant, rec.Code, rec.Body)
+	}
+	var got map[string]int64
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding the response: %v", err)
+	}
+	if got["deletedKeys"] != 2 {
+		t.Errorf("deletedKeys = %d, want 2", got["deletedKeys"])
+	}
+
+	if rec := env.get(query, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("GET for the deleted tenant = %d, want 404", rec.Code)
+	}
+	if n, err := env.store.Count(context.Background()); err != nil || n != int64(len(keys)) {
+		t.Errorf("store holds %d keys (%v), want the other tenant's %d", n, err, len(keys))
+	}
+}
+
+func TestAdminReconcilerPause(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{Admin: config.AdminConfig{Token: "secret"}}, config.DistributorConfig{})
+	r := store.NewReconciler(nil, config.ReconcilerConfig{}, zap.NewNop().Sugar())
+	admin := NewAdminRouter(env.handler.WithReconciler(r))
+	send := func(method, path string) *httptest.ResponseRecorder {
+		return adminRequest(admin, method, path)
+	}
+	paused := func() bool {
+		rec := send(http.MethodGet, "/reconciler")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET /reconciler = %d: %s", rec.Code, rec.Body)
+		}
+		var status struct {
+			Paused bool `json:"paused"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+			t.Fatalf("decoding the reconciler status: %v", err)
+		}
+		return status.Paused
+	}
+
+	if paused() {
+		t.Fatal("reconciler reported paused before any pause")
+	}
+
+	if rec := send(http.MethodPost, "/reconciler/pause"); rec.Code != http.StatusNoContent {
+		t.Fatalf("POST /reconciler/pause = %d, want 204", rec.Code)
+	}
+	if !paused() || !r.Paused() {
+		t.Error("reconciler not paused after POST /reconciler/pause")
+	}
+
+	if rec := send(http.MethodPost, "/reconciler/resume"); rec.Code != http.StatusNoContent {
+		t.Fatalf("POST /reconciler/resume = %d, want 204", rec.Code)
+	}
+	if paused() || r.Paused() {
+		t.Error("reconciler still paused after POST /reconciler/resume")
+	}
+}
+
+func TestDigestOnly(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{}, config.DistributorConfig{})
+	query := refValQuery(t)
+	env.put(t, query, []byte("artifact"))
+
+	full := env.get(query, nil)
+	if full.Code != http.StatusOK {
+		t.Fatalf("GET = %d: %s", full.Code, full.Body)
+	}
+	sum := sha256.Sum256(full.Body.Bytes())
+
+	req := httptest.NewRequest(http.MethodGet, edApiPath+"/coserv/"+query+"?digestOnly=true", nil)
+	req.Header.Set(TenantHeader, testTenant)
+	rec := env.do(req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET ?digestOnly=true = %d: %s", rec.Code, rec.Body)
+	}
+
+	var got map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding the digest: %v", err)
+	}
+	if got["algorithm"] != "sha-256" || got["digest"] != hex.EncodeToString(sum[:]) {
+		t.Errorf("digest = %v, want the sha-256 of the full body, %x", got, sum)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, edApiPath+"/coserv/"+query+"?digestOnly=maybe", nil)
+	req.Header.Set(TenantHeader, testTenant)
+	wantProblem(t, env.do(req), http.StatusBadRequest, ErrCodeBadQuery)
+}
+
+func TestPrefer(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{}, config.DistributorConfig{})
+	query := refValQuery(t)
+	env.put(t, query, []byte("artifact"))
+
+	full := env.get(query, nil)
+	if full.Code != http.StatusOK {
+		t.Fatalf("GET = %d: %s", full.Code, full.Body)
+	}
+
+	tests := []struct {
+		name        string
+		rawQuery    string
+		prefer      string
+		wantMinimal bool
+		wantApplied string
+	}{
+		{"none", "", "", false, ""},
+		{"minimal", "", "return=minimal", true, "return=minimal"},
+		{"representation", "", "return=representation", false, "return=representation"},
+		{"among others, with parameters", "", `respond-async, return="minimal"; x=y`, true, "return=minimal"},
+		{"unsupported", "", "return=headers", false, ""},
+		{"overridden by digestOnly", "?digestOnly=false", "return=minimal", false, ""},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, edApiPath+"/coserv/"+query+tt.rawQuery, nil)
+		req.Header.Set(TenantHeader, testTenant)
+		if tt.prefer != "" {
+			req.Header.Set("Prefer", tt.prefer)
+		}
+		rec := env.do(req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: GET = %d: %s", tt.name, rec.Code, rec.Body)
+		}
+
+		if vary := rec.Header().Get("Vary"); !strings.Contains(vary, "Prefer") {
+			t.Errorf("%s: Vary = %q, want it to list Prefer", tt.name, vary)
+		}
+		if got := rec.Header().Get("Preference-Applied"); got != tt.wantApplied {
+			t.Errorf("%s: Preference-Applied = %q, want %q", tt.name, got, tt.wantApplied)
+		}
+
+		minimal := rec.Header().Get("Content-Type") != full.Header().Get("Content-Type")
+		if minimal != tt.wantMinimal {
+			t.Errorf("%s: got the digest %v, want %v", tt.name, minimal, tt.wantMinimal)
+		}
+		if !minimal && !bytes.Equal(rec.Body.Bytes(), full.Body.Bytes()) {
+			t.Errorf("%s: body differs from the full result", tt.name)
+		}
+	}
+}
+
+func TestDuplicateParams(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{}, config.DistributorConfig{})
+	query := refValQuery(t)
+	env.put(t, query, []byte("artifact"))
+
+	for _, rawQuery := range []string{
+		"query=" + query,
+		"query=" + query + "&query=" + query,
+		"digestOnly=true&digestOnly=false",
+		"hashAlg=sha-256&hashAlg=sha-384",
+		"offset=0&offset=1",
+		"limit=1&limit=2",
+	} {
+		req := httptest.NewRequest(http.MethodGet, edApiPath+"/coserv/"+query+"?"+rawQuery, nil)
+		req.Header.Set(TenantHeader, testTenant)
+		wantProblem(t, env.do(req), http.StatusBadRequest, ErrCodeBadQuery)
+	}
+
+	// Parameters given once are fine
+	req := httptest.NewRequest(http.MethodGet, edApiPath+"/coserv/"+query+"?digestOnly=false&limit=1", nil)
+	req.Header.Set(TenantHeader, testTenant)
+	if rec := env.do(req); rec.Code != http.StatusOK {
+		t.Errorf("GET with each parameter once = %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestMinResponseLatency(t *testing.T) {
+	const minLatency = 50 * time.Millisecond
+
+	env := newTestEnv(t, config.APIConfig{MinResponseLatency: minLatency}, config.DistributorConfig{})
+	query := refValQuery(t)
+	env.put(t, query, []byte("artifact"))
+
+	for _, tt := range []struct {
+		name  string
+		query string
+		want  int
+	}{
+		{"hit", query, http.StatusOK},
+		{"miss", refValQuery(t, comid.ImplID{1}), http.StatusNotFound},
+	} {
+		start := time.Now()
+		rec := env.get(tt.query, nil)
+		elapsed := time.Since(start)
+
+		if rec.Code != tt.want {
+			t.Fatalf("%s: GET = %d, want %d", tt.name, rec.Code, tt.want)
+		}
+		if elapsed < minLatency {
+			t.Errorf("%s: answered in %v, want at least %v", tt.name, elapsed, minLatency)
+		}
+	}
+
+	// A client going away isn't kept waiting for the padding
+	env = newTestEnv(t, config.APIConfig{MinResponseLatency: time.Hour}, config.DistributorConfig{})
+	env.put(t, query, []byte("artifact"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodGet, edApiPath+"/coserv/"+query, nil).WithContext(ctx)
+	req.Header.Set(TenantHeader, testTenant)
+
+	done := make(chan struct{})
+	go func() {
+		env.do(req)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("response to a cancelled request still held back for the padding")
+	}
+}
+
+func TestIndex(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{}, config.DistributorConfig{})
+
+	rec := env.do(httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET / = %d: %s", rec.Code, rec.Body)
+	}
+
+	var index struct {
+		Service string            `json:"service"`
+		Version string            `json:"version"`
+		Links   map[string]string `json:"links"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &index); err != nil {
+		t.Fatalf("decoding the index: %v", err)
+	}
+	if index.Service != serviceName || index.Version == "" {
+		t.Errorf("index names %q version %q, want %q and a version", index.Service, index.Version, serviceName)
+	}
+
+	// Every link leads somewhere
+	for name, link := range index.Links {
+		if rec := env.do(httptest.NewRequest(http.MethodGet, link, nil)); rec.Code != http.StatusOK {
+			t.Errorf("GET %s (the %s link) = %d, want 200", link, name, rec.Code)
+		}
+	}
+	if len(index.Links) == 0 {
+		t.Error("index has no links")
+	}
+}
+
+func TestEnvironmentCountHeaders(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{}, config.DistributorConfig{})
+	env.put(t, refValQuery(t), []byte("artifact"))
+
+	rec := env.get(refValQuery(t, comid.TestImplID, comid.ImplID{1}), nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET = %d: %s", rec.Code, rec.Body)
+	}
+
+	if got := rec.Header().Get("X-Environments-Requested"); got != "2" {
+		t.Errorf("X-Environments-Requested = %q, want 2", got)
+	}
+	if got := rec.Header().Get("X-Environments-Matched"); got != "1" {
+		t.Errorf("X-Environments-Matched = %q, want 1", got)
+	}
+}
+
+func TestPagination(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{}, config.DistributorConfig{})
+	query := refValQuery(t)
+	env.put(t, query, []byte("a"), []byte("b"), []byte("c"), []byte("d"), []byte("e"))
+
+	base := edApiPath + "/coserv/" + query
+	tests := []struct {
+		rawQuery  string
+		wantCount int
+	}{
+		{"?limit=2", 2},
+		{"?limit=2&offset=2", 2},
+		{"?limit=2&offset=4", 1},
+		{"?offset=3", 2},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, base+tt.rawQuery, nil)
+		req.Header.Set(TenantHeader, testTenant)
+		rec := env.do(req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d: %s", tt.rawQuery, rec.Code, rec.Body)
+		}
+
+		var artifacts [][]byte
+		if err := cbor.Unmarshal(rec.Body.Bytes(), &artifacts); err != nil {
+			t.Fatalf("GET %s: decoding the result: %v", tt.rawQuery, err)
+		}
+		if len(artifacts) != tt.wantCount {
+			t.Errorf("GET %s: %d artifacts, want %d", tt.rawQuery, len(artifacts), tt.wantCount)
+		}
+
+		if got := rec.Header().Get("X-Total-Artifacts"); got != "5" {
+			t.Errorf("GET %s: X-Total-Artifacts = %q, want 5", tt.rawQuery, got)
+		}
+	}
+
+	// Without paging there are no paging headers
+	rec := env.get(query, nil)
+	if got := rec.Header().Get("X-Total-Artifacts"); got != "" {
+		t.Errorf("unpaged GET: X-Total-Artifacts = %q, want none", got)
+	}
+
+	for _, rawQuery := range []string{"?limit=-1", "?offset=x"} {
+		req := httptest.NewRequest(http.MethodGet, base+rawQuery, nil)
+		req.Header.Set(TenantHeader, testTenant)
+		wantProblem(t, env.do(req), http.StatusBadRequest, ErrCodeBadQuery)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	ms, err := store.NewMemoryStore(config.DatabaseConfig{})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	core, logs := observer.New(zap.InfoLevel)
+	logger := zap.New(core).Sugar()
+	handler := NewHandler(store.NewEndorsementDistributor(ms, config.DistributorConfig{}, logger), config.APIConfig{}, logger)
+	env := &testEnv{handler: handler, store: ms, router: NewRouter(handler)}
+
+	tests := []struct {
+		name   string
+		sent   string
+		echoed bool
+	}{
+		{"propagated", "req-123", true},
+		{"missing", "", false},
+		{"too long", strings.Repeat("a", maxRequestIDLength+1), false},
+		{"unprintable", "req 123\n", false},
+	}
+
+	for _, tt := range tests {
+		logs.TakeAll()
+
+		req := httptest.NewRequest(http.MethodGet, healthzPath, nil)
+		if tt.sent != "" {
+			req.Header.Set(RequestIDHeader, tt.sent)
+		}
+		id := env.do(req).Header().Get(RequestIDHeader)
+
+		if tt.echoed && id != tt.sent {
+			t.Errorf("%s: %s = %q, want %q echoed", tt.name, RequestIDHeader, id, tt.sent)
+		}
+		if !tt.echoed && (id == tt.sent || !validRequestID(id)) {
+			t.Errorf("%s: %s = %q, want a generated ID", tt.name, RequestIDHeader, id)
+		}
+
+		// The access log line carries the same ID
+		served := logs.FilterMessage("Request served").All()
+		if len(served) != 1 || served[0].ContextMap()["requestID"] != id {
+			t.Errorf("%s: access log %v, want one line with requestID %q", tt.name, served, id)
+		}
+	}
+}
+
+func TestEmptyQueryPath(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{}, config.DistributorConfig{})
+
+	for _, p := range []string{edApiPath + "/coserv", edApiPath + "/coserv/"} {
+		req := httptest.NewRequest(http.MethodGet, p, nil)
+		req.Header.Set(TenantHeader, testTenant)
+		rec := env.do(req)
+
+		wantProblem(t, rec, http.StatusBadRequest, ErrCodeBadQuery)
+		if detail, _ := problem(t, rec)["detail"].(string); !strings.Contains(detail, "missing query") {
+			t.Errorf("GET %s: detail %q, want it to say the query is missing", p, detail)
+		}
+	}
+}
+
+// referenceValue returns the CBOR reference value of comid.TestImplID with
+// one sha-256 measurement digest
+func referenceValue(t *testing.T) []byte {
+	t.Helper()
+
+	m := comid.MustNewUintMeasurement(uint64(1))
+	m.Val = comid.Mval{Digests: &comid.Digests{{HashAlgID: swid.Sha256, HashValue: bytes.Repeat([]byte{1}, 32)}}}
+
+	rv, err := cbor.Marshal(comid.ValueTriple{
+		Environment:  comid.Environment{Class: comid.NewClassImplID(comid.TestImplID)},
+		Measurements: *comid.NewMeasurements().Add(m),
+	})
+	if err != nil {
+		t.Fatalf("cbor.Marshal: %v", err)
+	}
+
+	return rv
+}
+
+func TestCoservJSON(t *testing.T) {
+	query := refValQuery(t)
+	rv := referenceValue(t)
+	jsonAccept := http.Header{"Accept": {CoservJSONMediaType}}
+
+	// The CoSERV encoding carries the decoded triples
+	env := newTestEnv(t, config.APIConfig{}, config.DistributorConfig{ResultEncoding: store.ResultEncodingCoserv})
+	env.put(t, query, rv)
+
+	rec := env.get(query, jsonAccept)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET = %d: %s", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("Content-Type"); got != CoservJSONMediaType {
+		t.Errorf("Content-Type = %q, want %q", got, CoservJSONMediaType)
+	}
+
+	var got struct {
+		Profile string `json:"profile"`
+		Query   struct {
+			ArtifactType string `json:"artifactType"`
+		} `json:"query"`
+		Results struct {
+			ReferenceValues []json.RawMessage `json:"referenceValues"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding the JSON result: %v", err)
+	}
+	if got.Profile != ccaProfile || got.Query.ArtifactType != "reference-values" || len(got.Results.ReferenceValues) != 1 {
+		t.Errorf("JSON result %s, want the profile, query and one reference value", rec.Body)
+	}
+
+	// CBOR stays the default
+	if rec := env.get(query, nil); rec.Header().Get("Content-Type") != EdApiMediaType {
+		t.Errorf("Content-Type without Accept = %q, want %q", rec.Header().Get("Content-Type"), EdApiMediaType)
+	}
+
+	// The raw encoding only carries the artifacts
+	env = newTestEnv(t, config.APIConfig{}, config.DistributorConfig{})
+	env.put(t, query, rv)
+
+	var raw struct {
+		Artifacts [][]byte `json:"artifacts"`
+	}
+	if err := json.Unmarshal(env.get(query, jsonAccept).Body.Bytes(), &raw); err != nil {
+		t.Fatalf("decoding the raw JSON result: %v", err)
+	}
+	if len(raw.Artifacts) != 1 || !bytes.Equal(raw.Artifacts[0], rv) {
+		t.Errorf("raw JSON result holds %d artifacts, want the stored one", len(raw.Artifacts))
+	}
+}
+
+func TestNotAcceptableListsMediaTypes(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{}, config.DistributorConfig{})
+	query := refValQuery(t)
+	env.put(t, query, []byte("artifact"))
+
+	rec := env.get(query, http.Header{"Accept": {"text/html, application/xml;q=0.9"}})
+	wantProblem(t, rec, http.StatusNotAcceptable, ErrCodeNotAcceptable)
+
+	if got, want := rec.Header().Get("Accept"), strings.Join(supportedMediaTypes, ", "); got != want {
+		t.Errorf("Accept = %q, want %q", got, want)
+	}
+
+	listed, _ := problem(t, rec)["supportedMediaTypes"].([]interface{})
+	var got []string
+	for _, mt := range listed {
+		s, _ := mt.(string)
+		got = append(got, s)
+	}
+	if !reflect.DeepEqual(got, supportedMediaTypes) {
+		t.Errorf("problem lists %q, want %q", got, supportedMediaTypes)
+	}
+	if detail, _ := problem(t, rec)["detail"].(string); !strings.Contains(detail, CoservJSONMediaType) {
+		t.Errorf("detail %q, want it to name the supported formats", detail)
+	}
+}
+
+func TestPercentEncodedQuery(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{}, config.DistributorConfig{})
+	query := refValQuery(t)
+	env.put(t, query, []byte("artifact"))
+
+	// escape percent-encodes every byte of s, as an over-eager client would.
+	// The router undoes one layer, the handler up to maxQueryUnescapes more.
+	escape := func(s string) string {
+		var b strings.Builder
+		for i := 0; i < len(s); i++ {
+			fmt.Fprintf(&b, "%%%02X", s[i])
+		}
+		return b.String()
+	}
+
+	tests := []struct {
+		name string
+		path string
+		want int
+	}{
+		{"escaped once", escape(query), http.StatusOK},
+		{"escaped twice", escape(escape(query)), http.StatusOK},
+		{"escaped three times", escape(escape(escape(query))), http.StatusOK},
+		{"escaped four times", escape(escape(escape(escape(query)))), http.StatusBadRequest},
+		{"malformed escape", "%25zz" + query, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, edApiPath+"/coserv/"+tt.path, nil)
+		req.Header.Set(TenantHeader, testTenant)
+		if rec := env.do(req); rec.Code != tt.want {
+			t.Errorf("%s: GET = %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{
+		ReferenceValuesCache: config.CacheControlConfig{MaxAge: 5 * time.Minute, StaleWhileRevalidate: time.Hour},
+		TrustAnchorsCache:    config.CacheControlConfig{MaxAge: time.Minute},
+		NoStoreProfiles:      []string{"tag:example.com,2024:secret"},
+	}, config.DistributorConfig{})
+
+	secretQuery := encodeQuery(t, "tag:example.com,2024:secret", coserv.ArtifactTypeReferenceValues,
+		coserv.NewEnvironmentSelector().AddClass(*comid.NewClassImplID(comid.TestImplID)))
+
+	for _, tt := range []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"reference values", refValQuery(t), "max-age=300, stale-while-revalidate=3600"},
+		{"trust anchors", taQuery(t), "max-age=60"},
+		{"no-store profile", secretQuery, "no-store"},
+	} {
+		if got := env.handler.cacheControl(tt.query); got != tt.want {
+			t.Errorf("%s: Cache-Control = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// And the directive reaches the response
+	query := refValQuery(t)
+	env.put(t, query, []byte("artifact"))
+	rec := env.get(query, nil)
+	if got := rec.Header().Get("Cache-Control"); got != "max-age=300, stale-while-revalidate=3600" {
+		t.Errorf("response Cache-Control = %q, want the reference value directives", got)
+	}
+}
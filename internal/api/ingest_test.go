@@ -0,0 +1,120 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"endorsement-distribution/internal/clock"
+	"endorsement-distribution/internal/config"
+	"endorsement-distribution/internal/store"
+
+	"github.com/veraison/corim/comid"
+	"github.com/veraison/corim/corim"
+	"go.uber.org/zap"
+)
+
+// testCorim returns an unsigned CoRIM holding a reference value for the
+// class of comid.TestImplID, with the given security version
+func testCorim(t *testing.T, svn uint64) []byte {
+	t.Helper()
+
+	m, err := comid.NewUintMeasurement(uint64(1))
+	if err != nil {
+		t.Fatalf("NewUintMeasurement: %v", err)
+	}
+	m.SetSVN(svn)
+
+	rv := comid.ValueTriple{
+		Environment:  comid.Environment{Class: comid.NewClassImplID(comid.TestImplID)},
+		Measurements: *comid.NewMeasurements().Add(m),
+	}
+	c := comid.NewComid().SetTagIdentity("test-tag", 0).AddReferenceValue(&rv)
+	uc := corim.NewUnsignedCorim().SetID("test-corim").AddComid(c)
+
+	data, err := uc.ToCBOR()
+	if err != nil {
+		t.Fatalf("encoding the test CoRIM: %v", err)
+	}
+
+	return data
+}
+
+// ingest PUTs data to the ingestion endpoint on behalf of testTenant
+func (o *testEnv) ingest(data []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPut, path.Join(edApiPath, "endorsements"), bytes.NewReader(data))
+	req.Header.Set(TenantHeader, testTenant)
+	req.Header.Set("Content-Type", CorimMediaType)
+	return o.do(req)
+}
+
+func TestIngestReportsUnchanged(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{}, config.DistributorConfig{})
+
+	for i, want := range []string{store.IngestUpdated, store.IngestUnchanged} {
+		rec := env.ingest(testCorim(t, 1))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("ingestion %d: status = %d, body %s", i, rec.Code, rec.Body)
+		}
+
+		var summary store.IngestSummary
+		if err := json.Unmarshal(rec.Body.Bytes(), &summary); err != nil {
+			t.Fatalf("ingestion %d: decoding summary: %v", i, err)
+		}
+		if summary.Status != want {
+			t.Errorf("ingestion %d: status %q, want %q", i, summary.Status, want)
+		}
+	}
+}
+
+func TestIngestTooLarge(t *testing.T) {
+	ms, err := store.NewMemoryStore(config.DatabaseConfig{MaxSetBytes: 16})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	logger := zap.NewNop().Sugar()
+	handler := NewHandler(store.NewEndorsementDistributor(ms, config.DistributorConfig{}, logger), config.APIConfig{}, logger)
+	env := &testEnv{handler: handler, store: ms, router: NewRouter(handler)}
+
+	wantProblem(t, env.ingest(testCorim(t, 1)), http.StatusRequestEntityTooLarge, ErrCodeTooLarge)
+}
+
+func TestIngestTTL(t *testing.T) {
+	c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	ms, err := store.NewMemoryStore(config.DatabaseConfig{})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	ms.WithClock(c)
+	logger := zap.NewNop().Sugar()
+	ed := store.NewEndorsementDistributor(ms, config.DistributorConfig{ResultEncoding: store.ResultEncodingRaw}, logger).WithClock(c)
+	handler := NewHandler(ed, config.APIConfig{}, logger)
+	env := &testEnv{handler: handler, store: ms, router: NewRouter(handler)}
+
+	ingest := func(ttl string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, path.Join(edApiPath, "endorsements")+"?ttl="+ttl, bytes.NewReader(testCorim(t, 1)))
+		req.Header.Set(TenantHeader, testTenant)
+		req.Header.Set("Content-Type", CorimMediaType)
+		return env.do(req)
+	}
+
+	for _, ttl := range []string{"soon", "0s", "-1h"} {
+		wantProblem(t, ingest(ttl), http.StatusBadRequest, ErrCodeBadQuery)
+	}
+
+	if rec := ingest("1h"); rec.Code != http.StatusOK {
+		t.Fatalf("ingestion: status = %d, body %s", rec.Code, rec.Body)
+	}
+
+	c.Advance(time.Hour - time.Second)
+	if rec := env.get(refValQuery(t), nil); rec.Code != http.StatusOK {
+		t.Fatalf("before the TTL: status = %d, want 200 (body %s)", rec.Code, rec.Body)
+	}
+
+	c.Advance(time.Second)
+	wantProblem(t, env.get(refValQuery(t), nil), http.StatusNotFound, ErrCodeNotFound)
+}
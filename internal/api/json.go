@@ -0,0 +1,48 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"endorsement-distribution/internal/store"
+
+	"github.com/veraison/corim/comid"
+)
+
+// resultJSON is the JSON view of a result, served as CoservJSONMediaType.
+// Results in the raw encoding only carry their artifacts.
+type resultJSON struct {
+	Profile   string         `json:"profile,omitempty"`
+	Query     *debugQuery    `json:"query,omitempty"`
+	Results   *resultSetJSON `json:"results,omitempty"`
+	Artifacts [][]byte       `json:"artifacts,omitempty"`
+}
+
+// resultSetJSON is the JSON view of a CoSERV result set
+type resultSetJSON struct {
+	ReferenceValues *[]comid.ValueTriple `json:"referenceValues,omitempty"`
+	AttestationKeys *[]comid.KeyTriple   `json:"attestationKeys,omitempty"`
+}
+
+// encodeResultJSON serializes a result to JSON
+func encodeResultJSON(r *store.Result) ([]byte, error) {
+	if r.Coserv == nil {
+		return json.Marshal(resultJSON{Artifacts: r.Artifacts})
+	}
+
+	profile, err := r.Coserv.Profile.Get()
+	if err != nil {
+		return nil, fmt.Errorf("getting result profile: %w", err)
+	}
+
+	query := newDebugQuery(profile, r.Coserv.Query)
+	out := resultJSON{Profile: profile, Query: &query}
+	if rs := r.Coserv.Results; rs != nil {
+		out.Results = &resultSetJSON{
+			ReferenceValues: rs.ReferenceValues,
+			AttestationKeys: rs.AttestationKeys,
+		}
+	}
+
+	return json.Marshal(out)
+}
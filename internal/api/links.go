@@ -0,0 +1,37 @@
+package api
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"endorsement-distribution/internal/store"
+)
+
+// pageLinks returns RFC 8288 links to the first page of a paginated
+// request, to the previous page unless it is the first, and to the next
+// page unless nextOffset is 0
+func pageLinks(u *url.URL, opts store.QueryOptions, nextOffset int) string {
+	link := func(offset int, rel string) string {
+		q := u.Query()
+		q.Set("offset", strconv.Itoa(offset))
+		page := url.URL{Path: u.Path, RawQuery: q.Encode()}
+		return fmt.Sprintf("<%s>; rel=%q", page.String(), rel)
+	}
+
+	links := []string{link(0, "first")}
+	if opts.Offset > 0 {
+		// Without a limit there's no page size to step back by
+		prev := 0
+		if opts.Limit > 0 {
+			prev = max(opts.Offset-opts.Limit, 0)
+		}
+		links = append(links, link(prev, "prev"))
+	}
+	if nextOffset > 0 {
+		links = append(links, link(nextOffset, "next"))
+	}
+
+	return strings.Join(links, ", ")
+}
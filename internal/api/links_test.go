@@ -0,0 +1,118 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"endorsement-distribution/internal/config"
+	"endorsement-distribution/internal/store"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+func TestPageLinks(t *testing.T) {
+	const path = "/endorsement-distribution/v1/coserv/q"
+
+	tests := []struct {
+		name       string
+		rawQuery   string
+		opts       store.QueryOptions
+		nextOffset int
+		want       []string
+	}{
+		{"first page", "limit=2", store.QueryOptions{Limit: 2}, 2, []string{
+			`<` + path + `?limit=2&offset=0>; rel="first"`,
+			`<` + path + `?limit=2&offset=2>; rel="next"`,
+		}},
+		{"middle page", "limit=2&offset=2", store.QueryOptions{Limit: 2, Offset: 2}, 4, []string{
+			`<` + path + `?limit=2&offset=0>; rel="first"`,
+			`<` + path + `?limit=2&offset=0>; rel="prev"`,
+			`<` + path + `?limit=2&offset=4>; rel="next"`,
+		}},
+		{"last page", "limit=2&offset=4", store.QueryOptions{Limit: 2, Offset: 4}, 0, []string{
+			`<` + path + `?limit=2&offset=0>; rel="first"`,
+			`<` + path + `?limit=2&offset=2>; rel="prev"`,
+		}},
+		{"offset within the first page", "limit=3&offset=1", store.QueryOptions{Limit: 3, Offset: 1}, 4, []string{
+			`<` + path + `?limit=3&offset=0>; rel="first"`,
+			`<` + path + `?limit=3&offset=0>; rel="prev"`,
+			`<` + path + `?limit=3&offset=4>; rel="next"`,
+		}},
+		{"offset without a limit", "offset=3", store.QueryOptions{Offset: 3}, 0, []string{
+			`<` + path + `?offset=0>; rel="first"`,
+			`<` + path + `?offset=0>; rel="prev"`,
+		}},
+		{"other parameters kept", "hashAlg=sha-256&limit=1", store.QueryOptions{Limit: 1}, 1, []string{
+			`<` + path + `?hashAlg=sha-256&limit=1&offset=0>; rel="first"`,
+			`<` + path + `?hashAlg=sha-256&limit=1&offset=1>; rel="next"`,
+		}},
+	}
+
+	for _, tt := range tests {
+		u := &url.URL{Path: path, RawQuery: tt.rawQuery}
+		if got, want := pageLinks(u, tt.opts, tt.nextOffset), strings.Join(tt.want, ", "); got != want {
+			t.Errorf("%s: pageLinks = %s, want %s", tt.name, got, want)
+		}
+	}
+}
+
+// nextLink matches the target of the rel="next" link of a Link header
+var nextLink = regexp.MustCompile(`<([^>]*)>; rel="next"`)
+
+func TestPaginationLinks(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{}, config.DistributorConfig{})
+	query := refValQuery(t)
+	env.put(t, query, []byte("a"), []byte("b"), []byte("c"), []byte("d"), []byte("e"))
+
+	// Following the next links from the first page walks the whole result
+	var (
+		pages []string
+		got   []string
+	)
+	for next := edApiPath + "/coserv/" + query + "?limit=2"; next != ""; {
+		pages = append(pages, next)
+		if len(pages) > 5 {
+			t.Fatalf("next links don't come to an end: %q", pages)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, next, nil)
+		req.Header.Set(TenantHeader, testTenant)
+		rec := env.do(req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d: %s", next, rec.Code, rec.Body)
+		}
+
+		var artifacts [][]byte
+		if err := cbor.Unmarshal(rec.Body.Bytes(), &artifacts); err != nil {
+			t.Fatalf("GET %s: decoding the result: %v", next, err)
+		}
+		for _, artifact := range artifacts {
+			got = append(got, string(artifact))
+		}
+
+		link := rec.Header().Get("Link")
+		if !strings.Contains(link, `rel="first"`) {
+			t.Errorf("GET %s: Link = %s, want a first link", next, link)
+		}
+		next = ""
+		if m := nextLink.FindStringSubmatch(link); m != nil {
+			next = m[1]
+		}
+	}
+
+	if len(pages) != 3 {
+		t.Errorf("walked pages %q, want 3 pages of 2", pages)
+	}
+	if want := "a b c d e"; strings.Join(got, " ") != want {
+		t.Errorf("artifacts %q over the pages, want %s", got, want)
+	}
+
+	// Without paging there are no links
+	if rec := env.get(query, nil); rec.Header().Get("Link") != "" {
+		t.Errorf("unpaged GET: Link = %q, want none", rec.Header().Get("Link"))
+	}
+}
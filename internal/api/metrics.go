@@ -0,0 +1,146 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/veraison/corim/coserv"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const metricsPath = "/metrics"
+
+// artifactTypeKey is the gin context key CoservRequest records the artifact
+// type of the query under, for the metrics middleware to label with
+const artifactTypeKey = "artifactType"
+
+// metrics holds the Prometheus collectors of a router. Each router gets a
+// registry of its own rather than using the global one, so that several can
+// coexist in one process.
+type metrics struct {
+	registry        *prometheus.Registry
+	requestDuration *prometheus.HistogramVec
+}
+
+// newMetrics creates and registers the service collectors
+func newMetrics(handler *Handler) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "endorsement_distribution_request_duration_seconds",
+			Help:    "Duration of CoSERV requests, by artifact type and status code.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"artifact_type", "code"}),
+	}
+
+	m.registry.MustRegister(
+		m.requestDuration,
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "endorsement_distribution_store_get_failures_total",
+			Help: "Store lookups that failed, not counting those that found nothing.",
+		}, func() float64 {
+			return float64(handler.EndorsementDistributor.StoreGetFailures())
+		}),
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+
+	if _, ok := handler.EndorsementDistributor.CacheStats(); ok {
+		m.registry.MustRegister(
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Name: "endorsement_distribution_cache_hits_total",
+				Help: "Lookup keys served from the store cache.",
+			}, func() float64 {
+				stats, _ := handler.EndorsementDistributor.CacheStats()
+				return float64(stats.Hits)
+			}),
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Name: "endorsement_distribution_cache_misses_total",
+				Help: "Lookup keys the store cache had to look up in the database.",
+			}, func() float64 {
+				stats, _ := handler.EndorsementDistributor.CacheStats()
+				return float64(stats.Misses)
+			}),
+		)
+	}
+
+	if r := handler.reconciler; r != nil {
+		m.registry.MustRegister(
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name: "endorsement_distribution_reconciler_malformed_rows",
+				Help: "Stored rows the last completed integrity scan couldn't decode.",
+			}, func() float64 {
+				return float64(r.Malformed())
+			}),
+		)
+	}
+
+	if s := handler.shadow; s != nil {
+		m.registry.MustRegister(
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Name: "endorsement_distribution_shadow_mismatches_total",
+				Help: "Shadow store lookups that disagreed with the primary store.",
+			}, func() float64 {
+				return float64(s.Mismatches())
+			}),
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Name: "endorsement_distribution_shadow_skipped_total",
+				Help: "Shadow store lookups skipped because too many were in flight or the request was cancelled.",
+			}, func() float64 {
+				return float64(s.Skipped())
+			}),
+		)
+	}
+
+	return m
+}
+
+// instrument records the duration and outcome of the requests it wraps. A
+// request traced and sampled has its trace ID attached to the duration as an
+// exemplar, to go from a slow bucket to a trace of a request that fell in it.
+func (o *metrics) instrument(c *gin.Context) {
+	start := time.Now()
+
+	c.Next()
+
+	artifactType := c.GetString(artifactTypeKey)
+	if artifactType == "" {
+		artifactType = "unknown"
+	}
+
+	observer := o.requestDuration.WithLabelValues(artifactType, strconv.Itoa(c.Writer.Status()))
+	elapsed := time.Since(start).Seconds()
+
+	if sc := trace.SpanContextFromContext(c.Request.Context()); sc.IsSampled() {
+		observer.(prometheus.ExemplarObserver).ObserveWithExemplar(elapsed,
+			prometheus.Labels{"trace_id": sc.TraceID().String()})
+		return
+	}
+
+	observer.Observe(elapsed)
+}
+
+// handler serves the collected metrics, in the OpenMetrics format to the
+// scrapers that ask for it (the only format exemplars are exposed in), and
+// in the Prometheus text format otherwise
+func (o *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(o.registry, promhttp.HandlerOpts{EnableOpenMetrics: true})
+}
+
+// artifactTypeLabel names an artifact type for use as a metric label
+func artifactTypeLabel(t coserv.ArtifactType) string {
+	switch t {
+	case coserv.ArtifactTypeEndorsedValues:
+		return "endorsed-values"
+	case coserv.ArtifactTypeTrustAnchors:
+		return "trust-anchors"
+	case coserv.ArtifactTypeReferenceValues:
+		return "reference-values"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,225 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"endorsement-distribution/internal/config"
+	"endorsement-distribution/internal/store"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap"
+)
+
+// newCachingTestEnv is newTestEnv with a CachingStore in front of the
+// memory store
+func newCachingTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+
+	ms, err := store.NewMemoryStore(config.DatabaseConfig{})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+
+	logger := zap.NewNop().Sugar()
+	cs := store.NewCachingStore(ms, 10, 0, nil)
+	dcfg := config.DistributorConfig{ResultEncoding: store.ResultEncodingRaw}
+	handler := NewHandler(store.NewEndorsementDistributor(cs, dcfg, logger), config.APIConfig{}, logger)
+
+	return &testEnv{handler: handler, store: ms, router: NewRouter(handler)}
+}
+
+func TestCacheMetrics(t *testing.T) {
+	env := newCachingTestEnv(t)
+	query := refValQuery(t)
+	env.put(t, query, []byte("artifact"))
+
+	for i := 0; i < 2; i++ {
+		if rec := env.get(query, nil); rec.Code != http.StatusOK {
+			t.Fatalf("GET %d: status = %d", i, rec.Code)
+		}
+	}
+
+	rec := env.do(httptest.NewRequest(http.MethodGet, metricsPath, nil))
+	for _, want := range []string{
+		"endorsement_distribution_cache_hits_total 1",
+		"endorsement_distribution_cache_misses_total 1",
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics lack %q", want)
+		}
+	}
+
+	rec = env.do(httptest.NewRequest(http.MethodGet, readyzPath, nil))
+	var ready struct {
+		Cache *store.CacheStatus `json:"cache"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &ready); err != nil {
+		t.Fatalf("decoding readyz: %v", err)
+	}
+	want := store.CacheStatus{CacheStats: store.CacheStats{Hits: 1, Misses: 1}, HitRatio: 0.5}
+	if ready.Cache == nil || *ready.Cache != want {
+		t.Errorf("readyz cache = %+v, want 1 hit and 1 miss", ready.Cache)
+	}
+}
+
+func TestNoCacheMetricsWithoutCache(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{}, config.DistributorConfig{})
+
+	rec := env.do(httptest.NewRequest(http.MethodGet, metricsPath, nil))
+	if strings.Contains(rec.Body.String(), "endorsement_distribution_cache_hits_total") {
+		t.Errorf("cache metrics exported without a cache")
+	}
+}
+
+func TestShadowMismatchMetric(t *testing.T) {
+	primary, err := store.NewMemoryStore(config.DatabaseConfig{})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	shadow, err := store.NewMemoryStore(config.DatabaseConfig{})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+
+	logger := zap.NewNop().Sugar()
+	ss := store.NewShadowStore(primary, shadow, logger)
+	dcfg := config.DistributorConfig{ResultEncoding: store.ResultEncodingRaw}
+	handler := NewHandler(store.NewEndorsementDistributor(ss, dcfg, logger), config.APIConfig{}, logger).
+		WithShadowStore(ss)
+	env := &testEnv{handler: handler, store: primary, router: NewRouter(handler)}
+
+	query := refValQuery(t)
+	env.put(t, query, []byte("primary"))
+	keys, err := store.GenerateKey(testTenant, query)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	for _, key := range keys {
+		if err := shadow.Set(context.Background(), key, [][]byte{[]byte("shadow")}); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+
+	rec := env.get(query, nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "primary") {
+		t.Errorf("GET = %d %q, want the primary's artifact", rec.Code, rec.Body.String())
+	}
+
+	// Close waits for the comparison
+	if err := ss.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	rec = env.do(httptest.NewRequest(http.MethodGet, metricsPath, nil))
+	if want := "endorsement_distribution_shadow_mismatches_total 1"; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("metrics lack %q", want)
+	}
+
+	rec = env.do(httptest.NewRequest(http.MethodGet, readyzPath, nil))
+	var ready struct {
+		Shadow *store.ShadowStatus `json:"shadow"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &ready); err != nil {
+		t.Fatalf("decoding readyz: %v", err)
+	}
+	if ready.Shadow == nil || ready.Shadow.Mismatches != 1 {
+		t.Errorf("readyz shadow = %+v, want 1 mismatch", ready.Shadow)
+	}
+}
+
+func TestReconcilerMetric(t *testing.T) {
+	const metric = "endorsement_distribution_reconciler_malformed_rows"
+
+	env := newTestEnv(t, config.APIConfig{}, config.DistributorConfig{})
+	if rec := scrape(env, ""); strings.Contains(rec.Body.String(), metric) {
+		t.Errorf("%s exported without an integrity scan", metric)
+	}
+
+	env.handler.WithReconciler(store.NewReconciler(nil, config.ReconcilerConfig{}, zap.NewNop().Sugar()))
+	env.router = NewRouter(env.handler)
+	if rec := scrape(env, ""); !strings.Contains(rec.Body.String(), metric+" 0") {
+		t.Errorf("metrics lack %s with a reconciler attached:\n%s", metric, rec.Body)
+	}
+}
+
+// tracingOnce guards withTracing: the tracers of the package are bound to the
+// first provider set, so it can't be swapped per test
+var tracingOnce sync.Once
+
+// spans records the spans ended under the provider withTracing installs
+var spans = tracetest.NewSpanRecorder()
+
+// withTracing installs the W3C propagator and a tracer provider sampling the
+// requests whose traceparent asks it to, and nothing else
+func withTracing() {
+	tracingOnce.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(
+			sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.NeverSample())),
+			sdktrace.WithSpanProcessor(spans)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+}
+
+// scrape fetches the metrics of env in the format negotiated by accept
+func scrape(env *testEnv, accept string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, metricsPath, nil)
+	req.Header.Set("Accept", accept)
+	return env.do(req)
+}
+
+const openMetricsAccept = "application/openmetrics-text; version=1.0.0"
+
+func TestLatencyExemplar(t *testing.T) {
+	withTracing()
+
+	env := newTestEnv(t, config.APIConfig{}, config.DistributorConfig{})
+	query := refValQuery(t)
+	env.put(t, query, []byte("artifact"))
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	rec := env.get(query, http.Header{"Traceparent": {"00-" + traceID + "-00f067aa0ba902b7-01"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET: status = %d", rec.Code)
+	}
+
+	rec = scrape(env, openMetricsAccept)
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/openmetrics-text") {
+		t.Errorf("Content-Type = %q, want OpenMetrics", ct)
+	}
+	if want := `# {trace_id="` + traceID + `"}`; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("OpenMetrics exposition lacks the exemplar %s:\n%s", want, rec.Body)
+	}
+
+	// Without asking for OpenMetrics, scrapers get the text format, which
+	// has no exemplars
+	rec = scrape(env, "")
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type = %q, want the text format", ct)
+	}
+}
+
+func TestNoExemplarWithoutTrace(t *testing.T) {
+	withTracing()
+
+	env := newTestEnv(t, config.APIConfig{}, config.DistributorConfig{})
+	query := refValQuery(t)
+	env.put(t, query, []byte("artifact"))
+
+	if rec := env.get(query, nil); rec.Code != http.StatusOK {
+		t.Fatalf("GET: status = %d", rec.Code)
+	}
+
+	rec := scrape(env, openMetricsAccept)
+	if strings.Contains(rec.Body.String(), "trace_id") {
+		t.Errorf("exemplar attached to an untraced request:\n%s", rec.Body)
+	}
+}
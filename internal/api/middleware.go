@@ -0,0 +1,243 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	mathrand "math/rand/v2"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// RequestIDHeader carries the ID correlating the log lines of a request
+const RequestIDHeader = "X-Request-ID"
+
+// requestIDKey is the gin context key the request ID is stored under
+const requestIDKey = "requestID"
+
+// maxRequestIDLength bounds the request IDs accepted from clients
+const maxRequestIDLength = 128
+
+// requestID propagates the client's X-Request-ID, or generates one if it is
+// missing or unusable, stores it in the context and echoes it back
+func requestID(c *gin.Context) {
+	id := c.GetHeader(RequestIDHeader)
+	if !validRequestID(id) {
+		var b [16]byte
+		_, _ = rand.Read(b[:])
+		id = hex.EncodeToString(b[:])
+	}
+
+	c.Set(requestIDKey, id)
+	c.Header(RequestIDHeader, id)
+
+	c.Next()
+}
+
+// validRequestID reports whether a client-supplied request ID is short and
+// printable enough to be logged as is
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, r := range id {
+		if r < 0x21 || r > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
+
+// accessLog logs each request once it is served, with its request ID
+func (o *Handler) accessLog(c *gin.Context) {
+	start := time.Now()
+
+	c.Next()
+
+	o.requestLogger(c).Infow("Request served",
+		"method", c.Request.Method,
+		"path", c.Request.URL.Path,
+		"status", c.Writer.Status(),
+		"duration", time.Since(start),
+		"client", c.ClientIP())
+}
+
+// requestLogger returns the handler's logger, tagged with the request ID
+func (o *Handler) requestLogger(c *gin.Context) *zap.SugaredLogger {
+	if id := c.GetString(requestIDKey); id != "" {
+		return o.Logger.With("requestID", id)
+	}
+	return o.Logger
+}
+
+// requireAdminToken rejects requests that don't present token as a bearer
+// token. If no token is configured, every request is rejected: the admin
+// endpoints are never left open by omission.
+func (o *Handler) requireAdminToken(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		got, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if token == "" || !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			o.reportProblem(c, http.StatusUnauthorized, "missing or invalid admin token")
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// tenantKey is the gin context key the tenant resolved from an API key is
+// stored under
+const tenantKey = "tenant"
+
+// requireAPIKey resolves the tenant of a request from the API key it
+// presents as a bearer token, rejecting unknown or missing keys with 401
+// and requests whose TenantHeader names another tenant with 403. With no
+// keys configured, every request is let through and the tenant is taken
+// from TenantHeader as set by the proxy in front of the service.
+func (o *Handler) requireAPIKey() gin.HandlerFunc {
+	if len(o.Config.APIKeys) == 0 {
+		return func(c *gin.Context) { c.Next() }
+	}
+
+	return func(c *gin.Context) {
+		tenant := o.apiKeyTenant(c.GetHeader("Authorization"))
+		if tenant == "" {
+			o.reportProblem(c, http.StatusUnauthorized, "missing or invalid API key")
+			return
+		}
+
+		if h := c.GetHeader(TenantHeader); h != "" && h != tenant {
+			o.reportProblem(c, http.StatusForbidden,
+				fmt.Sprintf("the API key is not valid for tenant %q", h))
+			return
+		}
+
+		c.Set(tenantKey, tenant)
+		c.Next()
+	}
+}
+
+// apiKeyTenant returns the tenant of the API key presented as a bearer token
+// in authorization, or "" if it is missing or not a configured key
+func (o *Handler) apiKeyTenant(authorization string) string {
+	got, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok {
+		return ""
+	}
+
+	// Compare against every key, so that timing doesn't tell how much of a
+	// key was right
+	tenant := ""
+	for _, k := range o.Config.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(got), []byte(k.Key)) == 1 {
+			tenant = k.Tenant
+		}
+	}
+
+	return tenant
+}
+
+// allowSources rejects requests whose peer address is outside all of the
+// given CIDRs; an empty list allows every source. It looks at the address
+// of the connection only, never at X-Forwarded-For, which clients control.
+func (o *Handler) allowSources(cidrs []string) gin.HandlerFunc {
+	var prefixes []netip.Prefix
+	for _, cidr := range cidrs {
+		p, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			o.Logger.Warnw("Ignoring invalid admin allowed CIDR", "cidr", cidr, "error", err)
+			continue
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+
+	return func(c *gin.Context) {
+		if len(cidrs) == 0 {
+			c.Next()
+			return
+		}
+
+		addr, err := netip.ParseAddr(c.RemoteIP())
+		if err == nil {
+			addr = addr.Unmap()
+			for _, p := range prefixes {
+				if p.Contains(addr) {
+					c.Next()
+					return
+				}
+			}
+		}
+
+		o.reportProblem(c, http.StatusForbidden, "source address not allowed")
+	}
+}
+
+// padResponse holds back the response until at least minLatency (plus a random
+// jitter of up to jitter) has passed since the request arrived, so that
+// timing doesn't tell a cheap miss from a hit that had results to decode
+func padResponse(minLatency, jitter time.Duration) gin.HandlerFunc {
+	if minLatency <= 0 && jitter <= 0 {
+		return func(c *gin.Context) { c.Next() }
+	}
+
+	return func(c *gin.Context) {
+		deadline := time.Now().Add(minLatency)
+		if jitter > 0 {
+			deadline = deadline.Add(mathrand.N(jitter))
+		}
+
+		c.Writer = &paddedWriter{ResponseWriter: c.Writer, c: c, deadline: deadline}
+		c.Next()
+	}
+}
+
+// paddedWriter waits for its deadline before anything reaches the client
+type paddedWriter struct {
+	gin.ResponseWriter
+	c        *gin.Context
+	deadline time.Time
+	waited   bool
+}
+
+func (o *paddedWriter) wait() {
+	if o.waited {
+		return
+	}
+	o.waited = true
+
+	t := time.NewTimer(time.Until(o.deadline))
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+	case <-o.c.Request.Context().Done():
+	}
+}
+
+func (o *paddedWriter) WriteHeader(code int) {
+	o.wait()
+	o.ResponseWriter.WriteHeader(code)
+}
+
+func (o *paddedWriter) WriteHeaderNow() {
+	o.wait()
+	o.ResponseWriter.WriteHeaderNow()
+}
+
+func (o *paddedWriter) Write(data []byte) (int, error) {
+	o.wait()
+	return o.ResponseWriter.Write(data)
+}
+
+func (o *paddedWriter) WriteString(s string) (int, error) {
+	o.wait()
+	return o.ResponseWriter.WriteString(s)
+}
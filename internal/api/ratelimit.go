@@ -0,0 +1,90 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"endorsement-distribution/internal/config"
+
+	"github.com/gin-gonic/gin"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"golang.org/x/time/rate"
+)
+
+// maxRateLimitClients is how many buckets are kept. Past it the least
+// recently seen client's is dropped, so the bucket of a client quiet for
+// that long starts full again.
+const maxRateLimitClients = 10000
+
+// rateLimit throttles requests with a token bucket per authenticated tenant,
+// or per client address for unauthenticated requests, answering 429 with
+// Retry-After once it is empty. TenantHeader is not used: without an API key
+// it is whatever the client says, and a client varying it would get a fresh
+// bucket each time. Tenants with a limit of their own get it in place of the
+// default. It lets everything through when no rate is configured.
+func (o *Handler) rateLimit() gin.HandlerFunc {
+	cfg := o.Config.RateLimit
+
+	tenantLimits := make(map[string]config.TenantRateLimitConfig, len(cfg.Tenants))
+	for _, t := range cfg.Tenants {
+		tenantLimits[t.Tenant] = t
+	}
+
+	if cfg.RequestsPerSecond <= 0 && len(tenantLimits) == 0 {
+		return func(c *gin.Context) { c.Next() }
+	}
+
+	// Only fails for a non-positive size
+	clients, err := lru.New[string, *rate.Limiter](maxRateLimitClients)
+	if err != nil {
+		panic(err)
+	}
+
+	limiterFor := func(key string, rps float64, burst int) *rate.Limiter {
+		if l, ok := clients.Get(key); ok {
+			return l
+		}
+
+		l := rate.NewLimiter(rate.Limit(rps), burst)
+		if prev, ok, _ := clients.PeekOrAdd(key, l); ok {
+			// Another request for the same client got there first
+			return prev
+		}
+
+		return l
+	}
+
+	return func(c *gin.Context) {
+		key := "ip:" + c.ClientIP()
+		rps, burst := cfg.RequestsPerSecond, cfg.Burst
+		if tenant := c.GetString(tenantKey); tenant != "" {
+			key = "tenant:" + tenant
+			if t, ok := tenantLimits[tenant]; ok {
+				rps, burst = t.RequestsPerSecond, t.Burst
+			}
+		}
+
+		if rps <= 0 {
+			c.Next()
+			return
+		}
+
+		now := time.Now()
+		r := limiterFor(key, rps, burst).ReserveN(now, 1)
+		if delay := r.DelayFrom(now); !r.OK() || delay > 0 {
+			r.CancelAt(now)
+
+			retryAfter := 1
+			if r.OK() {
+				retryAfter = int(math.Ceil(delay.Seconds()))
+			}
+			c.Header("Retry-After", strconv.Itoa(retryAfter))
+			o.reportProblem(c, http.StatusTooManyRequests, "rate limit exceeded, retry later")
+			return
+		}
+
+		c.Next()
+	}
+}
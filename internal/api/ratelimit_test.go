@@ -0,0 +1,188 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"endorsement-distribution/internal/config"
+)
+
+// rateLimitedGet sends a GET for query from remoteAddr, with the headers
+// given
+func rateLimitedGet(env *testEnv, query, remoteAddr string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, edApiPath+"/coserv/"+query, nil)
+	req.RemoteAddr = remoteAddr
+	req.Header.Set(TenantHeader, testTenant)
+	for name, values := range header {
+		req.Header.Del(name)
+		for _, v := range values {
+			req.Header.Add(name, v)
+		}
+	}
+	return env.do(req)
+}
+
+// wantRateLimited checks that rec is a 429 with a sane Retry-After
+func wantRateLimited(t *testing.T, rec *httptest.ResponseRecorder) {
+	t.Helper()
+
+	wantProblem(t, rec, http.StatusTooManyRequests, ErrCodeRateLimited)
+
+	retryAfter, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+	if err != nil || retryAfter < 1 {
+		t.Errorf("Retry-After = %q, want a positive number of seconds", rec.Header().Get("Retry-After"))
+	}
+}
+
+func TestRateLimitAfterBurst(t *testing.T) {
+	const burst = 3
+
+	env := newTestEnv(t, config.APIConfig{
+		RateLimit: config.RateLimitConfig{RequestsPerSecond: 0.1, Burst: burst},
+	}, config.DistributorConfig{})
+	query := refValQuery(t)
+	env.put(t, query, []byte("artifact"))
+
+	for i := 0; i < burst; i++ {
+		if rec := rateLimitedGet(env, query, "192.0.2.1:1234", nil); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want 200", i, rec.Code)
+		}
+	}
+
+	rec := rateLimitedGet(env, query, "192.0.2.1:1234", nil)
+	wantRateLimited(t, rec)
+
+	// At 0.1 requests per second the next token is 10 seconds away
+	if got := rec.Header().Get("Retry-After"); got != "10" {
+		t.Errorf("Retry-After = %s, want 10", got)
+	}
+
+	// Another client has a bucket of its own
+	if rec := rateLimitedGet(env, query, "192.0.2.2:1234", nil); rec.Code != http.StatusOK {
+		t.Errorf("other client: status = %d, want 200", rec.Code)
+	}
+}
+
+func TestRateLimitIgnoresClientHeaders(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{
+		RateLimit: config.RateLimitConfig{RequestsPerSecond: 0.1, Burst: 1},
+	}, config.DistributorConfig{})
+	query := refValQuery(t)
+
+	rateLimitedGet(env, query, "192.0.2.1:1234", nil)
+
+	// Neither a different tenant header nor a forged X-Forwarded-For buys
+	// a fresh bucket
+	wantRateLimited(t, rateLimitedGet(env, query, "192.0.2.1:1234", http.Header{TenantHeader: {"other"}}))
+	wantRateLimited(t, rateLimitedGet(env, query, "192.0.2.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.7"}}))
+}
+
+func TestRateLimitTrustedProxy(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{
+		RateLimit:      config.RateLimitConfig{RequestsPerSecond: 0.1, Burst: 1},
+		TrustedProxies: []string{"192.0.2.0/24"},
+	}, config.DistributorConfig{})
+	query := refValQuery(t)
+
+	rateLimitedGet(env, query, "192.0.2.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.7"}})
+
+	// Behind a trusted proxy, the forwarded address is the client
+	if rec := rateLimitedGet(env, query, "192.0.2.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.8"}}); rec.Code == http.StatusTooManyRequests {
+		t.Errorf("second client behind the proxy was rate limited")
+	}
+	wantRateLimited(t, rateLimitedGet(env, query, "192.0.2.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.7"}}))
+}
+
+func TestRateLimitPerAPIKeyTenant(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{
+		RateLimit: config.RateLimitConfig{RequestsPerSecond: 0.1, Burst: 1},
+		APIKeys: []config.APIKeyConfig{
+			{Key: "key-a", Tenant: testTenant},
+			{Key: "key-b", Tenant: "other"},
+		},
+	}, config.DistributorConfig{})
+	query := refValQuery(t)
+
+	keyA := http.Header{"Authorization": {"Bearer key-a"}, TenantHeader: {""}}
+	keyB := http.Header{"Authorization": {"Bearer key-b"}, TenantHeader: {""}}
+
+	rateLimitedGet(env, query, "192.0.2.1:1234", keyA)
+	wantRateLimited(t, rateLimitedGet(env, query, "192.0.2.9:1234", keyA))
+
+	// The same address, authenticated as another tenant
+	if rec := rateLimitedGet(env, query, "192.0.2.1:1234", keyB); rec.Code == http.StatusTooManyRequests {
+		t.Errorf("tenant other was throttled by tenant %s", testTenant)
+	}
+}
+
+func TestRateLimitDisabled(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{}, config.DistributorConfig{})
+	query := refValQuery(t)
+
+	for i := 0; i < 50; i++ {
+		if rec := rateLimitedGet(env, query, "192.0.2.1:1234", nil); rec.Code == http.StatusTooManyRequests {
+			t.Fatalf("request %d rate limited with no rate configured", i)
+		}
+	}
+}
+
+func TestRateLimitTenantOverride(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{
+		RateLimit: config.RateLimitConfig{
+			RequestsPerSecond: 0.1,
+			Burst:             3,
+			Tenants: []config.TenantRateLimitConfig{
+				{Tenant: testTenant, RequestsPerSecond: 0.1, Burst: 1},
+				{Tenant: "unlimited"},
+			},
+		},
+		APIKeys: []config.APIKeyConfig{
+			{Key: "key-a", Tenant: testTenant},
+			{Key: "key-b", Tenant: "other"},
+			{Key: "key-c", Tenant: "unlimited"},
+		},
+	}, config.DistributorConfig{})
+	query := refValQuery(t)
+
+	bearer := func(key string) http.Header {
+		return http.Header{"Authorization": {"Bearer " + key}, TenantHeader: {""}}
+	}
+
+	// acme has a burst of 1 of its own
+	rateLimitedGet(env, query, "192.0.2.1:1234", bearer("key-a"))
+	wantRateLimited(t, rateLimitedGet(env, query, "192.0.2.1:1234", bearer("key-a")))
+
+	// while other still gets the default burst of 3
+	for i := 0; i < 3; i++ {
+		if rec := rateLimitedGet(env, query, "192.0.2.1:1234", bearer("key-b")); rec.Code == http.StatusTooManyRequests {
+			t.Fatalf("tenant other: request %d rate limited", i)
+		}
+	}
+	wantRateLimited(t, rateLimitedGet(env, query, "192.0.2.1:1234", bearer("key-b")))
+
+	for i := 0; i < 20; i++ {
+		if rec := rateLimitedGet(env, query, "192.0.2.1:1234", bearer("key-c")); rec.Code == http.StatusTooManyRequests {
+			t.Fatalf("unlimited tenant: request %d rate limited", i)
+		}
+	}
+}
+
+func TestRateLimitOnlyTenantOverrides(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{
+		RateLimit: config.RateLimitConfig{
+			Tenants: []config.TenantRateLimitConfig{
+				{Tenant: testTenant, RequestsPerSecond: 0.1, Burst: 1},
+			},
+		},
+		APIKeys: []config.APIKeyConfig{{Key: "key-a", Tenant: testTenant}},
+	}, config.DistributorConfig{})
+	query := refValQuery(t)
+
+	keyA := http.Header{"Authorization": {"Bearer key-a"}, TenantHeader: {""}}
+
+	// A limit for one tenant applies even with no default rate
+	rateLimitedGet(env, query, "192.0.2.1:1234", keyA)
+	wantRateLimited(t, rateLimitedGet(env, query, "192.0.2.1:1234", keyA))
+}
@@ -7,22 +7,115 @@ import (
 )
 
 const (
-	edApiPath = "/endorsement-distribution/v1"
+	edApiPath     = "/endorsement-distribution/v1"
+	adminPath     = "/admin"
+	wellKnownPath = "/.well-known/veraison/endorsement-distribution"
+	healthzPath   = "/healthz"
+	readyzPath    = "/readyz"
 )
 
-func NewRouter(handler *Handler) *gin.Engine {
+// newEngine creates an engine believing X-Forwarded-For only from the
+// configured trusted proxies
+func newEngine(handler *Handler) *gin.Engine {
 	router := gin.New()
 
+	// Validated with the config
+	if err := router.SetTrustedProxies(handler.Config.TrustedProxies); err != nil {
+		handler.Logger.Warnw("Ignoring invalid trusted proxies", "error", err)
+		_ = router.SetTrustedProxies(nil)
+	}
+
+	return router
+}
+
+// NewRouter creates the router for the public API. It never carries admin
+// routes: those live on the router returned by NewAdminRouter.
+func NewRouter(handler *Handler) *gin.Engine {
+	router := newEngine(handler)
+
 	// Add middleware
-	router.Use(gin.Logger())
+	router.Use(requestID)
+	router.Use(handler.trace)
+	router.Use(handler.accessLog)
 	router.Use(gin.Recovery())
 
-	// Well-known endpoint
-	router.GET("/.well-known/veraison/endorsement-distribution", handler.GetEdApiWellKnownInfo)
+	// Landing page and well-known endpoint
+	router.GET("/", handler.GetIndex)
+	router.GET(wellKnownPath, handler.GetEdApiWellKnownInfo)
+	router.GET(wellKnownPath+".cose", handler.GetEdApiWellKnownSigned)
+
+	// Liveness and readiness probes, outside the versioned API
+	router.GET(healthzPath, handler.Healthz)
+	router.GET(readyzPath, handler.Readyz)
+
+	// Prometheus metrics
+	metrics := newMetrics(handler)
+	router.GET(metricsPath, gin.WrapH(metrics.handler()))
+
+	// Main CoSERV endpoint. The path without a query, with or without the
+	// trailing slash, is routed to the same handler so that it gets the
+	// handler's 400 rather than a 404 from the router.
+	authenticate := handler.requireAPIKey()
+	rateLimit := handler.rateLimit()
+	coservBase := path.Join(edApiPath, "coserv")
+	for _, p := range []string{coservBase + "/:query", coservBase + "/", coservBase} {
+		router.GET(p,
+			metrics.instrument,
+			authenticate,
+			rateLimit,
+			padResponse(handler.Config.MinResponseLatency, handler.Config.ResponseJitter),
+			handler.CoservRequest)
+	}
+
+	// Existence checks, answered without fetching the artifacts
+	router.HEAD(coservBase+"/:query",
+		metrics.instrument,
+		authenticate,
+		rateLimit,
+		handler.CoservHeadRequest)
+
+	// The same, with the query in the body for queries too long for a URL
+	router.POST(coservBase,
+		metrics.instrument,
+		authenticate,
+		rateLimit,
+		padResponse(handler.Config.MinResponseLatency, handler.Config.ResponseJitter),
+		handler.CoservPostRequest)
+
+	router.GET(path.Join(edApiPath, "capabilities"), handler.GetCapabilities)
+
+	// Encoding checks for query producers, only when enabled
+	if handler.Config.DebugEndpoints {
+		router.GET(path.Join(edApiPath, "debug/query/:query"), handler.DebugQuery)
+	}
+
+	// Ingestion of endorsements, for the same tenant the reads are made for
+	router.PUT(path.Join(edApiPath, "endorsements"), authenticate, rateLimit, handler.IngestEndorsements)
+
+	return router
+}
+
+// NewAdminRouter creates the router for the operator-facing endpoints. It
+// is meant to be served on a listener of its own, typically bound to an
+// internal interface, and requires the configured admin token and, if any
+// are configured, a source address in the allowed CIDRs.
+func NewAdminRouter(handler *Handler) *gin.Engine {
+	router := newEngine(handler)
+
+	// Add middleware
+	router.Use(requestID)
+	router.Use(handler.trace)
+	router.Use(handler.accessLog)
+	router.Use(gin.Recovery())
 
-	// Main CoSERV endpoint
-	coservEndpoint := path.Join(edApiPath, "coserv/:query")
-	router.GET(coservEndpoint, handler.CoservRequest)
+	admin := router.Group(adminPath,
+		handler.allowSources(handler.Config.Admin.AllowedCIDRs),
+		handler.requireAdminToken(handler.Config.Admin.Token))
+	admin.GET("/stats", handler.GetAdminStats)
+	admin.DELETE("/tenants/:tenant", handler.DeleteAdminTenant)
+	admin.GET("/reconciler", handler.GetAdminReconciler)
+	admin.POST("/reconciler/pause", handler.PauseAdminReconciler)
+	admin.POST("/reconciler/resume", handler.ResumeAdminReconciler)
 
 	return router
-} 
\ No newline at end of file
+}
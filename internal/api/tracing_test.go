@@ -0,0 +1,62 @@
+package api
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+
+	"endorsement-distribution/internal/config"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func TestTraceSpans(t *testing.T) {
+	withTracing()
+
+	env := newTestEnv(t, config.APIConfig{}, config.DistributorConfig{})
+	query := refValQuery(t)
+	env.put(t, query, []byte("artifact"))
+
+	const (
+		traceID = "0af7651916cd43dd8448eb211c80319c"
+		spanID  = "b7ad6b7169203331"
+	)
+	rec := env.get(query, http.Header{"Traceparent": {"00-" + traceID + "-" + spanID + "-01"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET = %d: %s", rec.Code, rec.Body)
+	}
+
+	// Other tests share the recorder: keep this request's spans
+	var traced []sdktrace.ReadOnlySpan
+	for _, s := range spans.Ended() {
+		if s.SpanContext().TraceID().String() == traceID {
+			traced = append(traced, s)
+		}
+	}
+
+	var names []string
+	var server sdktrace.ReadOnlySpan
+	for _, s := range traced {
+		names = append(names, s.Name())
+		if s.Parent().SpanID().String() == spanID {
+			server = s
+		}
+	}
+
+	for _, want := range []string{"synthesize_keys", "store_get", "encode_result"} {
+		if !slices.Contains(names, want) {
+			t.Errorf("spans %q, want a %s span in the request's trace", names, want)
+		}
+	}
+
+	if server == nil {
+		t.Fatalf("spans %q, want one continuing the client's span", names)
+	}
+	if want := "GET " + edApiPath + "/coserv/:query"; server.Name() != want {
+		t.Errorf("server span named %q, want %q", server.Name(), want)
+	}
+	if !slices.Contains(server.Attributes(), attribute.Int("http.response.status_code", http.StatusOK)) {
+		t.Errorf("server span attributes %v, want the response status", server.Attributes())
+	}
+}
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/veraison/go-cose"
+)
+
+// signedWellKnownMediaType is the media type of the signed well-known
+// document: a COSE_Sign1 whose payload is the JSON document
+const signedWellKnownMediaType = `application/cose; cose-type="cose-sign1"`
+
+// wellKnownInfo is the document served at the well-known endpoint
+func wellKnownInfo() map[string]interface{} {
+	return map[string]interface{}{
+		"version": serviceVersion,
+		"status":  "SERVICE_STATUS_READY",
+		"endpoints": map[string]string{
+			"coservRequest":      "/endorsement-distribution/v1/coserv/:query",
+			"coservPostRequest":  "/endorsement-distribution/v1/coserv",
+			"ingestEndorsements": "/endorsement-distribution/v1/endorsements",
+			"capabilities":       "/endorsement-distribution/v1/capabilities",
+		},
+		"supportedMediaTypes": supportedMediaTypes,
+	}
+}
+
+// GetCapabilities handles the capabilities endpoint: a detailed account of
+// what this service answers, built from its configuration
+func (o *Handler) GetCapabilities(c *gin.Context) {
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"version":             serviceVersion,
+		"supportedMediaTypes": supportedMediaTypes,
+		"ingestMediaTypes":    []string{CorimMediaType},
+		"distributor":         o.EndorsementDistributor.Capabilities(),
+		"limits": map[string]int{
+			"maxQueryBodyBytes": maxQueryBodyBytes,
+			"maxCorimBodyBytes": maxCorimBodyBytes,
+		},
+		"signedWellKnown": o.signedWellKnown != nil,
+		"encryption":      false,
+		"debugEndpoints":  o.Config.DebugEndpoints,
+	})
+}
+
+// LoadSigningKey reads a PEM-encoded ECDSA or Ed25519 private key, in PKCS#8
+// or (for ECDSA) SEC 1 form
+func LoadSigningKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in %s", path)
+	}
+
+	var key any
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q in %s", block.Type, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing private key in %s: %w", path, err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("private key in %s can't sign", path)
+	}
+
+	return signer, nil
+}
+
+// coseAlgorithm picks the COSE signature algorithm matching a key, pairing
+// each curve with its hash as RFC 8152 recommends
+func coseAlgorithm(key crypto.Signer) (cose.Algorithm, error) {
+	switch pub := key.Public().(type) {
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			return cose.AlgorithmES256, nil
+		case elliptic.P384():
+			return cose.AlgorithmES384, nil
+		case elliptic.P521():
+			return cose.AlgorithmES512, nil
+		}
+		return 0, fmt.Errorf("unsupported ECDSA curve %s", pub.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return cose.AlgorithmEd25519, nil
+	default:
+		return 0, errors.New("unsupported signing key type: must be ECDSA or Ed25519")
+	}
+}
+
+// SignWellKnown signs the well-known document with key and serves the
+// result from then on. The document doesn't change while the service runs,
+// so it is signed once here rather than on every request.
+func (o *Handler) SignWellKnown(key crypto.Signer) error {
+	alg, err := coseAlgorithm(key)
+	if err != nil {
+		return err
+	}
+
+	signer, err := cose.NewSigner(alg, key)
+	if err != nil {
+		return fmt.Errorf("creating signer: %w", err)
+	}
+
+	payload, err := json.Marshal(wellKnownInfo())
+	if err != nil {
+		return fmt.Errorf("marshaling well-known document: %w", err)
+	}
+
+	headers := cose.Headers{
+		Protected: cose.ProtectedHeader{
+			cose.HeaderLabelAlgorithm:   alg,
+			cose.HeaderLabelContentType: "application/json",
+		},
+	}
+
+	signed, err := cose.Sign1(rand.Reader, signer, headers, payload, nil)
+	if err != nil {
+		return fmt.Errorf("signing well-known document: %w", err)
+	}
+
+	o.signedWellKnown = signed
+
+	return nil
+}
+
+// GetEdApiWellKnownSigned handles the signed well-known endpoint
+func (o *Handler) GetEdApiWellKnownSigned(c *gin.Context) {
+	if o.signedWellKnown == nil {
+		o.reportProblem(c, http.StatusNotFound, "the well-known document is not signed by this service")
+		return
+	}
+
+	c.Data(http.StatusOK, signedWellKnownMediaType, o.signedWellKnown)
+}
@@ -0,0 +1,198 @@
+package api
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"endorsement-distribution/internal/config"
+
+	"github.com/veraison/go-cose"
+)
+
+func TestSignWellKnown(t *testing.T) {
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	payload, err := json.Marshal(wellKnownInfo())
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		key  crypto.Signer
+		alg  cose.Algorithm
+	}{
+		{"ECDSA P-256", p256, cose.AlgorithmES256},
+		{"Ed25519", edKey, cose.AlgorithmEd25519},
+	} {
+		env := newTestEnv(t, config.APIConfig{}, config.DistributorConfig{})
+		if err := env.handler.SignWellKnown(tt.key); err != nil {
+			t.Fatalf("%s: SignWellKnown: %v", tt.name, err)
+		}
+
+		rec := env.do(httptest.NewRequest(http.MethodGet, wellKnownPath+".cose", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: GET = %d: %s", tt.name, rec.Code, rec.Body)
+		}
+		if got := rec.Header().Get("Content-Type"); got != signedWellKnownMediaType {
+			t.Errorf("%s: Content-Type = %q, want %q", tt.name, got, signedWellKnownMediaType)
+		}
+
+		var msg cose.Sign1Message
+		if err := msg.UnmarshalCBOR(rec.Body.Bytes()); err != nil {
+			t.Fatalf("%s: decoding the COSE_Sign1: %v", tt.name, err)
+		}
+
+		verifier, err := cose.NewVerifier(tt.alg, tt.key.Public())
+		if err != nil {
+			t.Fatalf("%s: NewVerifier: %v", tt.name, err)
+		}
+		if err := msg.Verify(nil, verifier); err != nil {
+			t.Errorf("%s: signature doesn't verify with the public key: %v", tt.name, err)
+		}
+		if !bytes.Equal(msg.Payload, payload) {
+			t.Errorf("%s: signed payload %s, want the well-known document %s", tt.name, msg.Payload, payload)
+		}
+
+		// Signed once, served as is
+		if again := env.do(httptest.NewRequest(http.MethodGet, wellKnownPath+".cose", nil)); !bytes.Equal(again.Body.Bytes(), rec.Body.Bytes()) {
+			t.Errorf("%s: signed document changed between requests", tt.name)
+		}
+	}
+}
+
+func TestSignWellKnownUnsigned(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{}, config.DistributorConfig{})
+
+	rec := env.do(httptest.NewRequest(http.MethodGet, wellKnownPath+".cose", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET of the unsigned document = %d, want 404", rec.Code)
+	}
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey: %v", err)
+	}
+	sec1, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey: %v", err)
+	}
+	rsaPKCS8, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey: %v", err)
+	}
+
+	write := func(name string, data []byte) string {
+		path := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		return path
+	}
+	encode := func(typ string, der []byte) []byte {
+		return pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	}
+
+	for _, tt := range []struct {
+		blockType string
+		der       []byte
+	}{
+		{"PRIVATE KEY", pkcs8},
+		{"EC PRIVATE KEY", sec1},
+	} {
+		key, err := LoadSigningKey(write("key.pem", encode(tt.blockType, tt.der)))
+		if err != nil {
+			t.Fatalf("%s: LoadSigningKey: %v", tt.blockType, err)
+		}
+		if !ecKey.PublicKey.Equal(key.Public()) {
+			t.Errorf("%s: loaded a different key", tt.blockType)
+		}
+	}
+
+	for _, tt := range []struct {
+		name string
+		path string
+	}{
+		{"missing", filepath.Join(t.TempDir(), "missing.pem")},
+		{"not PEM", write("key.pem", []byte("not a key"))},
+		{"unsupported block", write("key.pem", encode("CERTIFICATE", sec1))},
+		{"corrupt", write("key.pem", encode("PRIVATE KEY", []byte("corrupt")))},
+	} {
+		if _, err := LoadSigningKey(tt.path); err == nil {
+			t.Errorf("%s: LoadSigningKey succeeded, want an error", tt.name)
+		}
+	}
+
+	// RSA keys load but can't be used to sign the document
+	key, err := LoadSigningKey(write("key.pem", encode("PRIVATE KEY", rsaPKCS8)))
+	if err != nil {
+		t.Fatalf("RSA: LoadSigningKey: %v", err)
+	}
+	env := newTestEnv(t, config.APIConfig{}, config.DistributorConfig{})
+	if err := env.handler.SignWellKnown(key); err == nil {
+		t.Error("SignWellKnown with an RSA key succeeded, want an error")
+	}
+}
+
+func TestGetCapabilities(t *testing.T) {
+	env := newTestEnv(t, config.APIConfig{DebugEndpoints: true}, config.DistributorConfig{DefaultProfile: ccaProfile})
+
+	rec := env.do(httptest.NewRequest(http.MethodGet, edApiPath+"/capabilities", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET = %d: %s", rec.Code, rec.Body)
+	}
+
+	var got struct {
+		Version     string `json:"version"`
+		Distributor struct {
+			DefaultProfile string `json:"defaultProfile"`
+		} `json:"distributor"`
+		Limits          map[string]int `json:"limits"`
+		SignedWellKnown bool           `json:"signedWellKnown"`
+		DebugEndpoints  bool           `json:"debugEndpoints"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding the capabilities: %v", err)
+	}
+
+	if got.Version != serviceVersion || got.Distributor.DefaultProfile != ccaProfile {
+		t.Errorf("capabilities %s, want version %s and default profile %s", rec.Body, serviceVersion, ccaProfile)
+	}
+	if got.Limits["maxQueryBodyBytes"] != maxQueryBodyBytes || got.Limits["maxCorimBodyBytes"] != maxCorimBodyBytes {
+		t.Errorf("limits = %v, want the body size limits", got.Limits)
+	}
+	if got.SignedWellKnown || !got.DebugEndpoints {
+		t.Errorf("signedWellKnown %v, debugEndpoints %v; want them as configured", got.SignedWellKnown, got.DebugEndpoints)
+	}
+}
@@ -0,0 +1,95 @@
+// Package clock abstracts the passing of time so that time-dependent
+// features (expiry, refresh, rate limiting, periodic jobs) can be driven
+// deterministically
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and waits for it to pass
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// Real is the Clock backed by the system time
+type Real struct{}
+
+// Now returns the current system time
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+// After waits for d to elapse and then sends the current time
+func (Real) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Fake is a Clock that only moves when told to. It is meant for tests.
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	deadline time.Time
+	ch       chan time.Time
+}
+
+// NewFake creates a fake clock reading t
+func NewFake(t time.Time) *Fake {
+	return &Fake{now: t}
+}
+
+// Now returns the fake current time
+func (o *Fake) Now() time.Time {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.now
+}
+
+// After returns a channel that receives the fake time once the clock has
+// been advanced by at least d
+func (o *Fake) After(d time.Duration) <-chan time.Time {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+
+	if d <= 0 {
+		ch <- o.now
+		return ch
+	}
+
+	o.waiters = append(o.waiters, fakeWaiter{deadline: o.now.Add(d), ch: ch})
+
+	return ch
+}
+
+// Advance moves the clock forward by d, firing the After channels whose
+// deadline has been reached, earliest first
+func (o *Fake) Advance(d time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.now = o.now.Add(d)
+
+	sort.SliceStable(o.waiters, func(i, j int) bool {
+		return o.waiters[i].deadline.Before(o.waiters[j].deadline)
+	})
+
+	pending := o.waiters[:0]
+	for _, w := range o.waiters {
+		if w.deadline.After(o.now) {
+			pending = append(pending, w)
+			continue
+		}
+		w.ch <- o.now
+	}
+	o.waiters = pending
+}
@@ -0,0 +1,57 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+// fired reports whether ch has received, and what
+func fired(ch <-chan time.Time) (time.Time, bool) {
+	select {
+	case t := <-ch:
+		return t, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func TestFakeAfter(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewFake(start)
+
+	long := c.After(10 * time.Second)
+	short := c.After(5 * time.Second)
+
+	c.Advance(4 * time.Second)
+	if _, ok := fired(short); ok {
+		t.Fatal("After(5s) fired 4s in")
+	}
+
+	c.Advance(time.Second)
+	if at, ok := fired(short); !ok || !at.Equal(start.Add(5*time.Second)) {
+		t.Errorf("After(5s) at 5s = %v, %v; want the fake time 5s in", at, ok)
+	}
+	if _, ok := fired(long); ok {
+		t.Fatal("After(10s) fired 5s in")
+	}
+
+	// Advancing past the deadline fires it too, with the time reached
+	c.Advance(7 * time.Second)
+	if at, ok := fired(long); !ok || !at.Equal(start.Add(12*time.Second)) {
+		t.Errorf("After(10s) at 12s = %v, %v; want the fake time 12s in", at, ok)
+	}
+	if got := c.Now(); !got.Equal(start.Add(12 * time.Second)) {
+		t.Errorf("Now = %v, want %v", got, start.Add(12*time.Second))
+	}
+}
+
+func TestFakeAfterNonPositive(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewFake(start)
+
+	for _, d := range []time.Duration{0, -time.Second} {
+		if at, ok := fired(c.After(d)); !ok || !at.Equal(start) {
+			t.Errorf("After(%v) = %v, %v; want it to fire right away", d, at, ok)
+		}
+	}
+}
@@ -1,52 +1,477 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"net/netip"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
 
+	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/viper"
 )
 
 type Config struct {
-	Server   ServerConfig   `mapstructure:"server"`
-	Database DatabaseConfig `mapstructure:"database"`
-	Logging  LoggingConfig  `mapstructure:"logging"`
+	Server      ServerConfig      `mapstructure:"server"`
+	Database    DatabaseConfig    `mapstructure:"database"`
+	Logging     LoggingConfig     `mapstructure:"logging"`
+	Distributor DistributorConfig `mapstructure:"distributor"`
+	Reconciler  ReconcilerConfig  `mapstructure:"reconciler"`
+	Shadow      ShadowConfig      `mapstructure:"shadow"`
+	API         APIConfig         `mapstructure:"api"`
+	Tracing     TracingConfig     `mapstructure:"tracing"`
+}
+
+type TracingConfig struct {
+	// Endpoint is the host:port of the OTLP/HTTP collector spans are
+	// exported to. Tracing is off when it is empty.
+	Endpoint string `mapstructure:"endpoint"`
+	// Insecure exports over plain HTTP instead of HTTPS
+	Insecure bool `mapstructure:"insecure"`
+	// SampleRatio is the fraction of new traces sampled; traces continued
+	// from a traceparent header follow the caller's decision
+	SampleRatio float64 `mapstructure:"sample_ratio"`
 }
 
 type ServerConfig struct {
 	Host string `mapstructure:"host"`
 	Port int    `mapstructure:"port"`
+
+	// Listeners, when set, replaces Host and Port with a list of addresses
+	// (e.g. one per interface or port) the service is served on
+	Listeners []ListenerConfig `mapstructure:"listeners"`
+
+	// GRPCPort, if set, is the port on Host the gRPC service is served on,
+	// over TLS if the listeners are (0 disables)
+	GRPCPort int `mapstructure:"grpc_port"`
+
+	// KeepAlive is the TCP keep-alive period of accepted connections: 0
+	// uses the Go default and a negative value disables keep-alives
+	KeepAlive time.Duration `mapstructure:"keep_alive"`
+	// MaxHeaderBytes caps the size of request headers; larger requests are
+	// rejected with 431
+	MaxHeaderBytes int `mapstructure:"max_header_bytes"`
+
+	// ReadTimeout, WriteTimeout and IdleTimeout bound the time spent
+	// reading a request, writing its response, and waiting for the next
+	// request on a kept-alive connection (0 disables)
+	ReadTimeout  time.Duration `mapstructure:"read_timeout"`
+	WriteTimeout time.Duration `mapstructure:"write_timeout"`
+	IdleTimeout  time.Duration `mapstructure:"idle_timeout"`
+
+	// TLSCertFile and TLSKeyFile, when set, serve every listener over TLS
+	// with this PEM certificate (chain) and private key. They must be set
+	// together.
+	TLSCertFile string `mapstructure:"tls_cert_file"`
+	TLSKeyFile  string `mapstructure:"tls_key_file"`
+}
+
+// TLSEnabled reports whether the listeners are served over TLS
+func (o ServerConfig) TLSEnabled() bool {
+	return o.TLSCertFile != ""
+}
+
+type ListenerConfig struct {
+	// Name identifies the listener in logs
+	Name string `mapstructure:"name"`
+	Host string `mapstructure:"host"`
+	Port int    `mapstructure:"port"`
+
+	// Admin makes the listener serve the admin endpoints instead of the
+	// public API
+	Admin bool `mapstructure:"admin"`
+}
+
+// AllListeners returns the configured listeners, or a single default one
+// built from Host and Port if none are configured
+func (o ServerConfig) AllListeners() []ListenerConfig {
+	if len(o.Listeners) > 0 {
+		return o.Listeners
+	}
+
+	return []ListenerConfig{{Name: "default", Host: o.Host, Port: o.Port}}
 }
 
 type DatabaseConfig struct {
-	Host     string `mapstructure:"host"`
-	Port     int    `mapstructure:"port"`
-	Name     string `mapstructure:"name"`
-	User     string `mapstructure:"user"`
-	Password string `mapstructure:"password"`
-	SSLMode  string `mapstructure:"sslmode"`
+	// Driver selects the store: "postgres", or "memory" for tests and local
+	// runs (see Memory)
+	Driver string `mapstructure:"driver"`
+
+	Host     string       `mapstructure:"host"`
+	Port     int          `mapstructure:"port"`
+	Name     string       `mapstructure:"name"`
+	User     string       `mapstructure:"user"`
+	Password string       `mapstructure:"password"`
+	SSLMode  string       `mapstructure:"sslmode"`
+	Memory   MemoryConfig `mapstructure:"memory"`
+
+	// MaxValueBytes is the largest stored value Get will decode (0 disables)
+	MaxValueBytes int `mapstructure:"max_value_bytes"`
+
+	// MaxSetBytes is the largest total size of the artifacts stored under a
+	// single key (0 disables)
+	MaxSetBytes int `mapstructure:"max_set_bytes"`
+
+	// MaxConcurrentWrites caps the write transactions open at once, so that
+	// bulk ingestion leaves pool connections for reads (0 disables)
+	MaxConcurrentWrites int `mapstructure:"max_concurrent_writes"`
+
+	// MaxConns, MinConns and MaxConnLifetime tune the connection pool (0
+	// keeps the pgx default)
+	MaxConns        int           `mapstructure:"max_conns"`
+	MinConns        int           `mapstructure:"min_conns"`
+	MaxConnLifetime time.Duration `mapstructure:"max_conn_lifetime"`
+
+	Cache StoreCacheConfig `mapstructure:"cache"`
+}
+
+type StoreCacheConfig struct {
+	// Enabled serves repeated lookups from an in-process LRU cache instead
+	// of the store
+	Enabled bool `mapstructure:"enabled"`
+	// MaxEntries is the number of keys the cache holds
+	MaxEntries int `mapstructure:"max_entries"`
+	// TTL is how long a key is cached. Writes through this instance
+	// invalidate it straight away; writes from elsewhere are seen once it
+	// expires.
+	TTL time.Duration `mapstructure:"ttl"`
+}
+
+type MemoryConfig struct {
+	// Index keeps a sorted index of keys to speed up prefix scans
+	Index bool `mapstructure:"index"`
+
+	// SnapshotPath is a file the store is saved to on shutdown and reloaded
+	// from on startup. Leave empty to keep data in memory only.
+	SnapshotPath string `mapstructure:"snapshot_path"`
+
+	// TombstoneTTL is how long a deleted key is remembered, so that lookups
+	// of it fail with 410 Gone rather than 404 (0 disables)
+	TombstoneTTL time.Duration `mapstructure:"tombstone_ttl"`
+}
+
+type DistributorConfig struct {
+	// ProfileSchemes lists, per profile, the schemes whose keys a query is
+	// resolved against. Profiles not listed use the default scheme only.
+	ProfileSchemes []ProfileSchemesConfig `mapstructure:"profile_schemes"`
+
+	// ResultEncoding is how artifacts are framed in results: "coserv" puts
+	// them in a CoSERV result set, "raw" returns them as a CBOR array
+	ResultEncoding string `mapstructure:"result_encoding"`
+
+	// TrustAnchorResultEncoding overrides ResultEncoding for trust anchors
+	TrustAnchorResultEncoding string `mapstructure:"trust_anchor_result_encoding"`
+
+	// StrictProfileMatch rejects queries whose profile differs from the one
+	// requested in the Accept header; when false the mismatch is only logged
+	StrictProfileMatch bool `mapstructure:"strict_profile_match"`
+
+	// StoredProfileMismatch is what happens to artifacts stored under a
+	// profile other than the query's: "error" fails the query, "filter"
+	// leaves them out of the result. Artifacts stored without a profile are
+	// always served.
+	StoredProfileMismatch string `mapstructure:"stored_profile_mismatch"`
+
+	// UnknownQueryFields is what happens to query fields this server doesn't
+	// know: "ignore" them (forward compatible) or "reject" the query
+	UnknownQueryFields string `mapstructure:"unknown_query_fields"`
+
+	// EgressStrip lists measurement fields removed from reference values
+	// before they are returned, for some tenants or profiles
+	EgressStrip []EgressStripConfig `mapstructure:"egress_strip"`
+
+	// StatsCacheTTL is how long store statistics are reused before being
+	// recomputed
+	StatsCacheTTL time.Duration `mapstructure:"stats_cache_ttl"`
+
+	// MaxKeysPerQuery caps the lookup keys a query may resolve to, over all
+	// its environments and schemes (0 disables)
+	MaxKeysPerQuery int `mapstructure:"max_keys_per_query"`
+
+	// DefaultProfile is the profile results are tagged with when neither
+	// the query nor the stored artifacts carry one
+	DefaultProfile string `mapstructure:"default_profile"`
+
+	// SupportedProfiles, when set, are the only profiles queries may carry
+	// or ask for in Accept; others are rejected with 400
+	SupportedProfiles []string `mapstructure:"supported_profiles"`
+
+	// SupportedProfilesSource, if its URL is set, is where the supported
+	// profiles are fetched from, periodically, to replace SupportedProfiles
+	SupportedProfilesSource ProfileSourceConfig `mapstructure:"supported_profiles_source"`
+
+	// InvalidArtifacts is what ingestion does with a triple that doesn't
+	// decode as a valid artifact of its type: "reject" fails the whole
+	// ingestion, "skip" leaves that artifact out and stores the rest
+	InvalidArtifacts string `mapstructure:"invalid_artifacts"`
+
+	// IngestTTLs are how long ingested artifacts are served, per artifact
+	// type, when the ingestion doesn't say (0 serves them until replaced)
+	IngestTTLs IngestTTLConfig `mapstructure:"ingest_ttls"`
+}
+
+// IngestTTLConfig holds a TTL per artifact type. A key holding both types is
+// given the shorter of the two that are set.
+type IngestTTLConfig struct {
+	ReferenceValues time.Duration `mapstructure:"reference_values"`
+	TrustAnchors    time.Duration `mapstructure:"trust_anchors"`
+}
+
+// ProfileSourceConfig is a URL serving the supported profiles as a JSON
+// array of strings. When a fetch fails the last list fetched, or the
+// configured one, stays in use.
+type ProfileSourceConfig struct {
+	URL string `mapstructure:"url"`
+
+	// RefreshInterval is how often the list is fetched again
+	RefreshInterval time.Duration `mapstructure:"refresh_interval"`
+
+	// Timeout bounds each fetch
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+type EgressStripConfig struct {
+	// Profile and Tenant select the queries the rule applies to; an empty
+	// value matches any
+	Profile string `mapstructure:"profile"`
+	Tenant  string `mapstructure:"tenant"`
+
+	// Fields are CoRIM measurement value names, e.g. "serial-number"
+	Fields []string `mapstructure:"fields"`
+}
+
+type ProfileSchemesConfig struct {
+	Profile string   `mapstructure:"profile"`
+	Schemes []string `mapstructure:"schemes"`
+}
+
+type APIConfig struct {
+	// Cache-Control directives sent with results, per artifact type
+	ReferenceValuesCache CacheControlConfig `mapstructure:"reference_values_cache"`
+	TrustAnchorsCache    CacheControlConfig `mapstructure:"trust_anchors_cache"`
+
+	// NoStoreProfiles lists profiles whose results must never be cached:
+	// they are sent with Cache-Control: no-store whatever the settings above,
+	// and kept out of the store cache (database.cache)
+	NoStoreProfiles []string `mapstructure:"no_store_profiles"`
+
+	// RejectUnknownMediaTypeParams turns Accept parameters other than
+	// profile and q into a 406 instead of ignoring them
+	RejectUnknownMediaTypeParams bool `mapstructure:"reject_unknown_media_type_params"`
+
+	// WellKnownSigningKey is a PEM file holding an ECDSA or Ed25519 private
+	// key. When set, a COSE-signed copy of the well-known document is served.
+	WellKnownSigningKey string `mapstructure:"well_known_signing_key"`
+
+	Admin AdminConfig `mapstructure:"admin"`
+
+	// MinResponseLatency pads coserv responses so that none is sent before
+	// this much time has passed, hiding the difference between a hit and a
+	// miss (0 disables)
+	MinResponseLatency time.Duration `mapstructure:"min_response_latency"`
+	// ResponseJitter adds a random extra delay of up to this much on top of
+	// MinResponseLatency
+	ResponseJitter time.Duration `mapstructure:"response_jitter"`
+
+	// DebugEndpoints serves the endpoints under /endorsement-distribution/v1/debug,
+	// which help query producers check their encoding. Off by default.
+	DebugEndpoints bool `mapstructure:"debug_endpoints"`
+
+	RateLimit RateLimitConfig `mapstructure:"rate_limit"`
+
+	// TrustedProxies are the addresses or CIDRs of the proxies whose
+	// X-Forwarded-For is believed when telling the client address, e.g. to
+	// rate limit it. With none, the address of the connection is used.
+	TrustedProxies []string `mapstructure:"trusted_proxies"`
+
+	// APIKeys, when set, require queries and ingestions to present one of
+	// these keys as a bearer token, and serve them for the key's tenant
+	// whatever X-Tenant-ID says
+	APIKeys []APIKeyConfig `mapstructure:"api_keys"`
+}
+
+type APIKeyConfig struct {
+	Key    string `mapstructure:"key"`
+	Tenant string `mapstructure:"tenant"`
+}
+
+type RateLimitConfig struct {
+	// RequestsPerSecond is the sustained rate of queries and ingestions
+	// allowed per tenant authenticated by API key, or per client address for
+	// unauthenticated requests (0 disables)
+	RequestsPerSecond float64 `mapstructure:"requests_per_second"`
+	// Burst is how many requests may be made at once above that rate
+	Burst int `mapstructure:"burst"`
+
+	// Tenants override the rate and burst above for the tenants listed,
+	// e.g. for those with a different SLA
+	Tenants []TenantRateLimitConfig `mapstructure:"tenants"`
+}
+
+type TenantRateLimitConfig struct {
+	Tenant string `mapstructure:"tenant"`
+	// RequestsPerSecond is the tenant's sustained rate (0 leaves it unlimited)
+	RequestsPerSecond float64 `mapstructure:"requests_per_second"`
+	Burst             int     `mapstructure:"burst"`
+}
+
+type AdminConfig struct {
+	// Token is the bearer token admin requests must present. The admin
+	// endpoints reject every request while it is unset.
+	Token string `mapstructure:"token"`
+
+	// AllowedCIDRs, when set, restricts the admin endpoints to clients
+	// connecting from these networks (e.g. "10.0.0.0/8"), on top of the
+	// token check
+	AllowedCIDRs []string `mapstructure:"allowed_cidrs"`
+}
+
+type CacheControlConfig struct {
+	// MaxAge is sent as max-age; no Cache-Control header is sent when 0
+	MaxAge time.Duration `mapstructure:"max_age"`
+	// StaleWhileRevalidate is sent as stale-while-revalidate when non-zero
+	StaleWhileRevalidate time.Duration `mapstructure:"stale_while_revalidate"`
+}
+
+type ReconcilerConfig struct {
+	// Enabled turns on the periodic integrity scan of stored rows
+	Enabled   bool          `mapstructure:"enabled"`
+	Interval  time.Duration `mapstructure:"interval"`
+	BatchSize int           `mapstructure:"batch_size"`
+
+	// BatchDelay is the pause between batches, leaving the database to
+	// client queries in between (0 disables)
+	BatchDelay time.Duration `mapstructure:"batch_delay"`
+
+	// Parallelism is the number of workers a scan is split between, each
+	// taking a range of the table
+	Parallelism int `mapstructure:"parallelism"`
+}
+
+// ShadowConfig describes a second database that lookups are repeated
+// against in the background, to check that it agrees with the main one
+// before migrating to it. Nothing is served from it or written to it.
+type ShadowConfig struct {
+	Enabled  bool           `mapstructure:"enabled"`
+	Database DatabaseConfig `mapstructure:"database"`
 }
 
 type LoggingConfig struct {
+	// Level is the minimum level logged: debug, info, warn or error
 	Level string `mapstructure:"level"`
+
+	// Format is json, for log collectors, or console, for people reading
+	// the logs in development
+	Format string `mapstructure:"format"`
 }
 
+// Prefixes of the environment variables overriding config keys
+const (
+	envPrefix       = "ED"
+	legacyEnvPrefix = "ENDORSEMENT"
+)
+
 func Load() (*Config, error) {
 	v := viper.New()
 
 	// Set defaults
 	v.SetDefault("server.host", "0.0.0.0")
 	v.SetDefault("server.port", 8080)
+	v.SetDefault("server.grpc_port", 0)
+	v.SetDefault("server.keep_alive", 0)
+	v.SetDefault("server.max_header_bytes", 1<<20)
+	v.SetDefault("server.read_timeout", 15*time.Second)
+	// Leaves room for api.min_response_latency and a slow store
+	v.SetDefault("server.write_timeout", 30*time.Second)
+	v.SetDefault("server.idle_timeout", 2*time.Minute)
+	v.SetDefault("server.tls_cert_file", "")
+	v.SetDefault("server.tls_key_file", "")
+	v.SetDefault("database.driver", "postgres")
 	v.SetDefault("database.host", "localhost")
 	v.SetDefault("database.port", 5432)
 	v.SetDefault("database.name", "endorsements")
 	v.SetDefault("database.user", "postgres")
 	v.SetDefault("database.password", "")
 	v.SetDefault("database.sslmode", "disable")
+	v.SetDefault("database.memory.index", false)
+	v.SetDefault("database.memory.snapshot_path", "")
+	v.SetDefault("database.memory.tombstone_ttl", 0)
+	v.SetDefault("database.max_value_bytes", 16<<20)
+	// base64 and JSON framing inflate artifacts by a third, so this keeps a
+	// full key comfortably below max_value_bytes
+	v.SetDefault("database.max_set_bytes", 8<<20)
+	v.SetDefault("database.max_concurrent_writes", 0)
+	v.SetDefault("database.max_conns", 0)
+	v.SetDefault("database.min_conns", 0)
+	v.SetDefault("database.max_conn_lifetime", 0)
+	v.SetDefault("database.cache.enabled", false)
+	v.SetDefault("database.cache.max_entries", 10000)
+	v.SetDefault("database.cache.ttl", time.Minute)
 	v.SetDefault("logging.level", "info")
+	v.SetDefault("logging.format", "json")
+	v.SetDefault("distributor.result_encoding", "coserv")
+	v.SetDefault("distributor.trust_anchor_result_encoding", "")
+	v.SetDefault("distributor.strict_profile_match", true)
+	v.SetDefault("distributor.stored_profile_mismatch", "error")
+	v.SetDefault("distributor.unknown_query_fields", "ignore")
+	v.SetDefault("distributor.stats_cache_ttl", 10*time.Second)
+	v.SetDefault("distributor.max_keys_per_query", 0)
+	v.SetDefault("distributor.default_profile", "tag:arm.com,2023:cca_platform#1.0.0")
+	v.SetDefault("distributor.supported_profiles", []string{})
+	v.SetDefault("distributor.invalid_artifacts", "reject")
+	v.SetDefault("distributor.ingest_ttls.reference_values", 0)
+	v.SetDefault("distributor.ingest_ttls.trust_anchors", 0)
+	v.SetDefault("distributor.supported_profiles_source.url", "")
+	v.SetDefault("distributor.supported_profiles_source.refresh_interval", 5*time.Minute)
+	v.SetDefault("distributor.supported_profiles_source.timeout", 10*time.Second)
+	v.SetDefault("api.reference_values_cache.max_age", 0)
+	v.SetDefault("api.reference_values_cache.stale_while_revalidate", 0)
+	v.SetDefault("api.trust_anchors_cache.max_age", 0)
+	v.SetDefault("api.trust_anchors_cache.stale_while_revalidate", 0)
+	v.SetDefault("api.no_store_profiles", []string{})
+	v.SetDefault("api.reject_unknown_media_type_params", false)
+	v.SetDefault("api.well_known_signing_key", "")
+	v.SetDefault("api.admin.token", "")
+	v.SetDefault("api.admin.allowed_cidrs", []string{})
+	v.SetDefault("api.min_response_latency", 0)
+	v.SetDefault("api.response_jitter", 0)
+	v.SetDefault("api.debug_endpoints", false)
+	v.SetDefault("api.rate_limit.requests_per_second", 0)
+	v.SetDefault("api.rate_limit.burst", 20)
+	v.SetDefault("api.trusted_proxies", []string{})
+	v.SetDefault("reconciler.enabled", false)
+	v.SetDefault("reconciler.interval", time.Hour)
+	v.SetDefault("reconciler.batch_size", 500)
+	v.SetDefault("reconciler.batch_delay", 0)
+	v.SetDefault("reconciler.parallelism", 1)
+	v.SetDefault("shadow.enabled", false)
+	v.SetDefault("shadow.database.driver", "postgres")
+	v.SetDefault("shadow.database.host", "")
+	v.SetDefault("shadow.database.port", 5432)
+	v.SetDefault("shadow.database.name", "")
+	v.SetDefault("shadow.database.user", "")
+	v.SetDefault("shadow.database.password", "")
+	v.SetDefault("shadow.database.sslmode", "disable")
+	v.SetDefault("tracing.endpoint", "")
+	v.SetDefault("tracing.insecure", false)
+	v.SetDefault("tracing.sample_ratio", 1.0)
 
-	// Read from environment variables
-	v.SetEnvPrefix("ENDORSEMENT")
+	// Read from environment variables: every key above can be overridden as
+	// ED_ followed by the key in upper case, dots turned to underscores
+	// (ED_DATABASE_HOST for database.host). The ENDORSEMENT_ prefix of
+	// earlier releases is still read, when the ED_ variable isn't set.
+	v.SetEnvPrefix(envPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	v.AutomaticEnv()
+	for _, key := range v.AllKeys() {
+		name := strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+		if err := v.BindEnv(key, envPrefix+"_"+name, legacyEnvPrefix+"_"+name); err != nil {
+			return nil, fmt.Errorf("failed to bind %s to the environment: %w", key, err)
+		}
+	}
 
 	// Read from config file if it exists
 	v.SetConfigName("config")
@@ -61,9 +486,206 @@ func Load() (*Config, error) {
 	}
 
 	var cfg Config
-	if err := v.Unmarshal(&cfg); err != nil {
+	hooks := mapstructure.ComposeDecodeHookFunc(mapstructure.StringToTimeDurationHookFunc(), splitListHook)
+	if err := v.Unmarshal(&cfg, viper.DecodeHook(hooks)); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
 	}
 
 	return &cfg, nil
-} 
\ No newline at end of file
+}
+
+// validate checks the driver and connection settings of a database, named
+// what in the errors returned
+func (o DatabaseConfig) validate(what string) []error {
+	var errs []error
+
+	switch o.Driver {
+	case "", "postgres":
+		for _, f := range []struct{ name, value string }{
+			{"host", o.Host},
+			{"name", o.Name},
+			{"user", o.User},
+			{"password", o.Password},
+		} {
+			if f.value == "" {
+				errs = append(errs, fmt.Errorf("missing %s %s", what, f.name))
+			}
+		}
+		if o.Port < 1 || o.Port > 65535 {
+			errs = append(errs, fmt.Errorf("invalid %s port %d: must be between 1 and 65535", what, o.Port))
+		}
+	case "memory":
+	default:
+		errs = append(errs, fmt.Errorf("invalid %s driver %q: must be postgres or memory", what, o.Driver))
+	}
+
+	return errs
+}
+
+// splitListHook decodes a string into a list by splitting it on whitespace,
+// for list keys set from the environment, where every value is a string
+// (ED_API_NO_STORE_PROFILES="tag:a.com,2024:x tag:b.com,2024:y"). Commas
+// can't separate the items, as the tag URIs of profiles hold some. Lists of
+// tables, such as api.api_keys, can only be set in the config file.
+func splitListHook(from, to reflect.Type, data interface{}) (interface{}, error) {
+	if from.Kind() != reflect.String || to.Kind() != reflect.Slice {
+		return data, nil
+	}
+
+	return strings.Fields(reflect.ValueOf(data).String()), nil
+}
+
+// Validate checks the configuration for missing and inconsistent settings,
+// reporting all the problems found rather than just the first
+func (o *Config) Validate() error {
+	var errs []error
+
+	for _, l := range o.Server.AllListeners() {
+		if l.Port < 1 || l.Port > 65535 {
+			errs = append(errs, fmt.Errorf("invalid port %d for listener %q: must be between 1 and 65535", l.Port, l.Name))
+		}
+		if o.Server.GRPCPort != 0 && l.Port == o.Server.GRPCPort {
+			errs = append(errs, fmt.Errorf("invalid gRPC port %d: already used by listener %q", l.Port, l.Name))
+		}
+	}
+	if o.Server.GRPCPort < 0 || o.Server.GRPCPort > 65535 {
+		errs = append(errs, fmt.Errorf("invalid gRPC port %d: must be between 1 and 65535, or 0 to disable", o.Server.GRPCPort))
+	}
+
+	errs = append(errs, o.Database.validate("database")...)
+	if o.Shadow.Enabled {
+		errs = append(errs, o.Shadow.Database.validate("shadow database")...)
+	}
+
+	for _, enc := range []string{o.Distributor.ResultEncoding, o.Distributor.TrustAnchorResultEncoding} {
+		switch enc {
+		case "", "coserv", "raw":
+		default:
+			errs = append(errs, fmt.Errorf("invalid result encoding %q: must be coserv or raw", enc))
+		}
+	}
+
+	if (o.Server.TLSCertFile == "") != (o.Server.TLSKeyFile == "") {
+		errs = append(errs, fmt.Errorf("invalid TLS config: tls_cert_file and tls_key_file must be set together"))
+	}
+
+	if o.Database.MaxConns < 0 || o.Database.MinConns < 0 {
+		errs = append(errs, fmt.Errorf("invalid database pool size: max_conns and min_conns can't be negative"))
+	}
+	if o.Database.MaxConns > 0 && o.Database.MinConns > o.Database.MaxConns {
+		errs = append(errs, fmt.Errorf("invalid database pool size: min_conns %d exceeds max_conns %d",
+			o.Database.MinConns, o.Database.MaxConns))
+	}
+
+	switch o.Logging.Level {
+	case "", "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, fmt.Errorf("invalid logging level %q: must be debug, info, warn or error", o.Logging.Level))
+	}
+
+	switch o.Logging.Format {
+	case "", "json", "console":
+	default:
+		errs = append(errs, fmt.Errorf("invalid logging format %q: must be json or console", o.Logging.Format))
+	}
+
+	if o.Tracing.SampleRatio < 0 || o.Tracing.SampleRatio > 1 {
+		errs = append(errs, fmt.Errorf("invalid tracing sample ratio %v: must be between 0 and 1", o.Tracing.SampleRatio))
+	}
+
+	if o.Database.Cache.Enabled && o.Database.Cache.MaxEntries <= 0 {
+		errs = append(errs, fmt.Errorf("invalid store cache size %d: max_entries must be positive", o.Database.Cache.MaxEntries))
+	}
+
+	switch o.Distributor.StoredProfileMismatch {
+	case "", "error", "filter":
+	default:
+		errs = append(errs, fmt.Errorf("invalid stored profile mismatch policy %q: must be error or filter",
+			o.Distributor.StoredProfileMismatch))
+	}
+
+	if sp := o.Distributor.SupportedProfiles; len(sp) > 0 && o.Distributor.DefaultProfile != "" &&
+		!slices.Contains(sp, o.Distributor.DefaultProfile) {
+		errs = append(errs, fmt.Errorf("invalid default profile %q: it isn't one of the supported profiles",
+			o.Distributor.DefaultProfile))
+	}
+
+	switch o.Distributor.UnknownQueryFields {
+	case "", "ignore", "reject":
+	default:
+		errs = append(errs, fmt.Errorf("invalid unknown query fields policy %q: must be ignore or reject",
+			o.Distributor.UnknownQueryFields))
+	}
+
+	if src := o.Distributor.SupportedProfilesSource; src.URL != "" {
+		if u, err := url.Parse(src.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid supported profiles source %q: must be an http or https URL", src.URL))
+		}
+		if src.RefreshInterval <= 0 {
+			errs = append(errs, fmt.Errorf("invalid supported profiles refresh interval %v: must be positive", src.RefreshInterval))
+		}
+		if src.Timeout <= 0 {
+			errs = append(errs, fmt.Errorf("invalid supported profiles fetch timeout %v: must be positive", src.Timeout))
+		}
+	}
+
+	switch o.Distributor.InvalidArtifacts {
+	case "", "reject", "skip":
+	default:
+		errs = append(errs, fmt.Errorf("invalid policy %q for invalid artifacts: must be reject or skip",
+			o.Distributor.InvalidArtifacts))
+	}
+
+	if ttl := o.Distributor.IngestTTLs.ReferenceValues; ttl < 0 {
+		errs = append(errs, fmt.Errorf("invalid reference value ingestion TTL %v: must not be negative", ttl))
+	}
+	if ttl := o.Distributor.IngestTTLs.TrustAnchors; ttl < 0 {
+		errs = append(errs, fmt.Errorf("invalid trust anchor ingestion TTL %v: must not be negative", ttl))
+	}
+
+	if o.API.RateLimit.RequestsPerSecond > 0 && o.API.RateLimit.Burst < 1 {
+		errs = append(errs, fmt.Errorf("invalid rate limit burst %d: must be at least 1", o.API.RateLimit.Burst))
+	}
+
+	seenTenants := make(map[string]bool)
+	for i, t := range o.API.RateLimit.Tenants {
+		switch {
+		case t.Tenant == "":
+			errs = append(errs, fmt.Errorf("invalid tenant rate limit %d: tenant must be set", i))
+		case seenTenants[t.Tenant]:
+			errs = append(errs, fmt.Errorf("invalid tenant rate limit %d: tenant %q is configured twice", i, t.Tenant))
+		case t.RequestsPerSecond > 0 && t.Burst < 1:
+			errs = append(errs, fmt.Errorf("invalid rate limit burst %d for tenant %q: must be at least 1", t.Burst, t.Tenant))
+		}
+		seenTenants[t.Tenant] = true
+	}
+
+	seenKeys := make(map[string]bool)
+	for i, k := range o.API.APIKeys {
+		if k.Key == "" || k.Tenant == "" {
+			errs = append(errs, fmt.Errorf("invalid API key %d: key and tenant must both be set", i))
+			continue
+		}
+		if seenKeys[k.Key] {
+			errs = append(errs, fmt.Errorf("invalid API key %d: the same key is configured twice", i))
+			continue
+		}
+		seenKeys[k.Key] = true
+	}
+
+	for _, proxy := range o.API.TrustedProxies {
+		if _, err := netip.ParsePrefix(proxy); err != nil {
+			if _, err := netip.ParseAddr(proxy); err != nil {
+				errs = append(errs, fmt.Errorf("invalid trusted proxy %q: must be an address or CIDR", proxy))
+			}
+		}
+	}
+
+	for _, cidr := range o.API.Admin.AllowedCIDRs {
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid admin allowed CIDR %q: %w", cidr, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,306 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postgresConfig returns a configuration with a complete postgres database
+func postgresConfig() *Config {
+	return &Config{
+		Server: ServerConfig{Port: 8080},
+		Database: DatabaseConfig{
+			Driver:   "postgres",
+			Host:     "localhost",
+			Port:     5432,
+			Name:     "endorsements",
+			User:     "postgres",
+			Password: "password",
+		},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(*Config)
+		wantErrs []string
+	}{
+		{"valid", func(*Config) {}, nil},
+		{"missing host", func(c *Config) { c.Database.Host = "" }, []string{"missing database host"}},
+		{"invalid database port", func(c *Config) { c.Database.Port = 70000 }, []string{"invalid database port 70000"}},
+		{"invalid server port", func(c *Config) { c.Server.Port = 0 }, []string{`invalid port 0 for listener`}},
+		{"missing credentials", func(c *Config) { c.Database.User, c.Database.Password = "", "" },
+			[]string{"missing database user", "missing database password"}},
+		{"memory needs no connection settings", func(c *Config) { c.Database = DatabaseConfig{Driver: "memory"} }, nil},
+		{"unknown driver", func(c *Config) { c.Database.Driver = "mysql" }, []string{`invalid database driver "mysql"`}},
+		{"logging level and format", func(c *Config) { c.Logging = LoggingConfig{Level: "debug", Format: "console"} }, nil},
+		{"invalid logging level", func(c *Config) { c.Logging.Level = "verbose" }, []string{`invalid logging level "verbose"`}},
+		{"invalid logging format", func(c *Config) { c.Logging.Format = "xml" }, []string{`invalid logging format "xml"`}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := postgresConfig()
+			tt.modify(cfg)
+
+			err := cfg.Validate()
+			if len(tt.wantErrs) == 0 {
+				if err != nil {
+					t.Errorf("Validate: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Validate = nil, want errors %q", tt.wantErrs)
+			}
+			for _, want := range tt.wantErrs {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Validate = %v, want an error containing %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	cfg := postgresConfig()
+	cfg.Server.Port = -1
+	cfg.Database.Host = ""
+	cfg.Database.Port = 0
+	cfg.Distributor.ResultEncoding = "xml"
+
+	err := cfg.Validate()
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		t.Fatalf("Validate = %v, want the joined problems", err)
+	}
+	if got := len(joined.Unwrap()); got != 4 {
+		t.Errorf("Validate reported %d problems, want 4: %v", got, err)
+	}
+}
+
+func TestValidateTenantRateLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		tenants []TenantRateLimitConfig
+		wantErr string
+	}{
+		{"valid", []TenantRateLimitConfig{{Tenant: "acme", RequestsPerSecond: 10, Burst: 20}, {Tenant: "unlimited"}}, ""},
+		{"no tenant", []TenantRateLimitConfig{{RequestsPerSecond: 10, Burst: 20}}, "tenant must be set"},
+		{"duplicate", []TenantRateLimitConfig{{Tenant: "acme"}, {Tenant: "acme"}}, `tenant "acme" is configured twice`},
+		{"no burst", []TenantRateLimitConfig{{Tenant: "acme", RequestsPerSecond: 10}}, `burst 0 for tenant "acme"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig(t)
+			cfg.API.RateLimit.Tenants = tt.tenants
+
+			err := cfg.Validate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("Validate: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("Validate = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateInvalidArtifacts(t *testing.T) {
+	for _, policy := range []string{"", "reject", "skip"} {
+		cfg := validConfig(t)
+		cfg.Distributor.InvalidArtifacts = policy
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("Validate with invalid_artifacts %q: %v", policy, err)
+		}
+	}
+
+	cfg := validConfig(t)
+	cfg.Distributor.InvalidArtifacts = "ignore"
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), `invalid policy "ignore" for invalid artifacts`) {
+		t.Errorf("Validate = %v, want the invalid_artifacts policy rejected", err)
+	}
+}
+
+func TestValidateGRPCPort(t *testing.T) {
+	tests := []struct {
+		name    string
+		port    int
+		wantErr string
+	}{
+		{"disabled", 0, ""},
+		{"own port", 9090, ""},
+		{"out of range", 70000, "invalid gRPC port 70000"},
+		{"listener port", 8080, `already used by listener "default"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig(t)
+			cfg.Server.Port = 8080
+			cfg.Server.GRPCPort = tt.port
+
+			err := cfg.Validate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("Validate: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("Validate = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateIngestTTLs(t *testing.T) {
+	tests := []struct {
+		name    string
+		ttls    IngestTTLConfig
+		wantErr string
+	}{
+		{"unset", IngestTTLConfig{}, ""},
+		{"both set", IngestTTLConfig{ReferenceValues: time.Hour, TrustAnchors: 24 * time.Hour}, ""},
+		{"negative reference values", IngestTTLConfig{ReferenceValues: -time.Hour}, "invalid reference value ingestion TTL"},
+		{"negative trust anchors", IngestTTLConfig{TrustAnchors: -time.Hour}, "invalid trust anchor ingestion TTL"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig(t)
+			cfg.Distributor.IngestTTLs = tt.ttls
+
+			err := cfg.Validate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("Validate: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("Validate = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateSupportedProfilesSource(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  ProfileSourceConfig
+		wantErr string
+	}{
+		{"unset", ProfileSourceConfig{}, ""},
+		{"valid", ProfileSourceConfig{URL: "https://config.example.com/profiles", RefreshInterval: time.Minute, Timeout: time.Second}, ""},
+		{"not http", ProfileSourceConfig{URL: "file:///etc/profiles", RefreshInterval: time.Minute, Timeout: time.Second}, "must be an http or https URL"},
+		{"no interval", ProfileSourceConfig{URL: "https://config.example.com/profiles", Timeout: time.Second}, "refresh interval 0s"},
+		{"no timeout", ProfileSourceConfig{URL: "https://config.example.com/profiles", RefreshInterval: time.Minute}, "fetch timeout 0s"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig(t)
+			cfg.Distributor.SupportedProfilesSource = tt.source
+
+			err := cfg.Validate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("Validate: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("Validate = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// validConfig returns a configuration that passes Validate, to break in
+// one way at a time
+func validConfig(t *testing.T) *Config {
+	t.Helper()
+
+	cfg := &Config{
+		Server:   ServerConfig{Port: 8080},
+		Database: DatabaseConfig{Driver: "memory"},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate of the base config: %v", err)
+	}
+
+	return cfg
+}
+
+// chdirConfig makes a temporary directory holding a config.yaml of yaml the
+// working directory for the rest of the test, for Load to read
+func chdirConfig(t *testing.T, yaml string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(yaml), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Getwd: %v", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("Chdir: %v", err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestLoadEnvOverridesFile(t *testing.T) {
+	chdirConfig(t, `
+database:
+  host: "file-host"
+  port: 5433
+server:
+  read_timeout: 5s
+`)
+	t.Setenv("ED_DATABASE_HOST", "env-host")
+	t.Setenv("ED_SERVER_READ_TIMEOUT", "7s")
+	// The legacy prefix is read for keys the ED_ prefix leaves unset
+	t.Setenv("ENDORSEMENT_DATABASE_NAME", "legacy-name")
+	t.Setenv("ENDORSEMENT_DATABASE_HOST", "legacy-host")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	if cfg.Database.Host != "env-host" {
+		t.Errorf("database.host = %q, want the environment's", cfg.Database.Host)
+	}
+	if cfg.Database.Port != 5433 {
+		t.Errorf("database.port = %d, want the file's", cfg.Database.Port)
+	}
+	if cfg.Server.ReadTimeout != 7*time.Second {
+		t.Errorf("server.read_timeout = %v, want the environment's", cfg.Server.ReadTimeout)
+	}
+	if cfg.Database.Name != "legacy-name" {
+		t.Errorf("database.name = %q, want the legacy variable's", cfg.Database.Name)
+	}
+}
+
+func TestLoadListsFromEnv(t *testing.T) {
+	chdirConfig(t, `
+api:
+  no_store_profiles: ["file-profile"]
+`)
+	t.Setenv("ED_API_NO_STORE_PROFILES", " tag:example.com,2024:a\ttag:example.com,2024:b ")
+	t.Setenv("ED_DISTRIBUTOR_SUPPORTED_PROFILES", "")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	want := []string{"tag:example.com,2024:a", "tag:example.com,2024:b"}
+	if !reflect.DeepEqual(cfg.API.NoStoreProfiles, want) {
+		t.Errorf("api.no_store_profiles = %q, want %q", cfg.API.NoStoreProfiles, want)
+	}
+	if len(cfg.Distributor.SupportedProfiles) != 0 {
+		t.Errorf("distributor.supported_profiles = %q, want none", cfg.Distributor.SupportedProfiles)
+	}
+}
@@ -0,0 +1,280 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/expirable"
+)
+
+// CachingStore serves Get and StoredProfile from an LRU cache in front of
+// another store, keyed on the lookup key. Misses fall through to the inner
+// store and populate the cache; writes made through the CachingStore drop
+// the keys they touch. Writes made elsewhere (another instance, or directly
+// against the database) are only picked up once the cached entry expires,
+// so the TTL bounds how stale a result can be. Artifacts stored under one of
+// the no-store profiles are never cached.
+type CachingStore struct {
+	inner    Store
+	values   *expirable.LRU[string, cachedArtifacts]
+	profiles *expirable.LRU[string, string]
+	noStore  []string
+
+	// fillMu orders cache fills against invalidations: a Get only caches
+	// what it read if the generation of the key is still the one it saw
+	// before reading, i.e. no write invalidated the key in the meantime.
+	// Keys share generations by hash, so a write to one may needlessly
+	// stop the fill of another, but never the other way round.
+	fillMu      sync.Mutex
+	generations [cacheGenerations]uint64
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// cacheGenerations is the number of generations keys are spread over
+const cacheGenerations = 256
+
+// cachedArtifacts is what the cache holds for a key: what Get returned for it
+type cachedArtifacts struct {
+	artifacts [][]byte
+	profile   string
+}
+
+// NewCachingStore creates a store caching up to maxEntries keys of inner for
+// ttl each (0 keeps them until evicted), except those stored under one of
+// noStoreProfiles
+func NewCachingStore(inner Store, maxEntries int, ttl time.Duration, noStoreProfiles []string) *CachingStore {
+	return &CachingStore{
+		inner:    inner,
+		values:   expirable.NewLRU[string, cachedArtifacts](maxEntries, nil, ttl),
+		profiles: expirable.NewLRU[string, string](maxEntries, nil, ttl),
+		noStore:  noStoreProfiles,
+	}
+}
+
+// generation returns the index into s.generations of key
+func generation(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % cacheGenerations)
+}
+
+// generationsOf returns the current generation of each of keys
+func (s *CachingStore) generationsOf(keys []string) []uint64 {
+	s.fillMu.Lock()
+	defer s.fillMu.Unlock()
+
+	gens := make([]uint64, len(keys))
+	for i, key := range keys {
+		gens[i] = s.generations[generation(key)]
+	}
+	return gens
+}
+
+// cacheable reports whether artifacts stored under profile may be cached
+func (s *CachingStore) cacheable(profile string) bool {
+	return !slices.Contains(s.noStore, profile)
+}
+
+// Get retrieves artifacts for the given keys, asking the inner store only
+// for those not cached. Keys the inner store has nothing for are not cached,
+// so that they are found as soon as they are ingested. The artifacts
+// returned are copies the caller may modify.
+func (s *CachingStore) Get(ctx context.Context, keys []string) ([]KeyedArtifacts, error) {
+	cached := make(map[string]cachedArtifacts, len(keys))
+	var missing []string
+
+	for _, key := range keys {
+		if entry, ok := s.values.Get(key); ok && s.cacheable(entry.profile) {
+			cached[key] = entry
+		} else {
+			missing = append(missing, key)
+		}
+	}
+
+	s.hits.Add(int64(len(cached)))
+	s.misses.Add(int64(len(missing)))
+
+	if len(missing) > 0 {
+		gens := s.generationsOf(missing)
+
+		found, err := s.inner.Get(ctx, missing)
+		if err != nil && (len(cached) == 0 || !errors.Is(err, ErrNoArtifacts)) {
+			return nil, err
+		}
+
+		s.fill(missing, gens, found)
+
+		for _, ka := range found {
+			cached[ka.Key] = cachedArtifacts{artifacts: ka.Artifacts, profile: ka.Profile}
+		}
+	}
+
+	// Keep the order of keys, as the inner store does
+	out := make([]KeyedArtifacts, 0, len(cached))
+	for _, key := range keys {
+		if entry, ok := cached[key]; ok {
+			out = append(out, KeyedArtifacts{Key: key, Artifacts: copyArtifacts(entry.artifacts), Profile: entry.profile})
+			delete(cached, key)
+		}
+	}
+
+	return out, nil
+}
+
+// fill caches what the inner store found for the missing keys, whose
+// generations were gens before it was asked, leaving out the keys written
+// since and those of a no-store profile
+func (s *CachingStore) fill(missing []string, gens []uint64, found []KeyedArtifacts) {
+	genOf := make(map[string]uint64, len(missing))
+	for i, key := range missing {
+		genOf[key] = gens[i]
+	}
+
+	s.fillMu.Lock()
+	defer s.fillMu.Unlock()
+
+	for _, ka := range found {
+		if !s.cacheable(ka.Profile) || s.generations[generation(ka.Key)] != genOf[ka.Key] {
+			continue
+		}
+		s.values.Add(ka.Key, cachedArtifacts{artifacts: copyArtifacts(ka.Artifacts), profile: ka.Profile})
+	}
+}
+
+// Set stores artifacts in the inner store and drops key from the cache
+func (s *CachingStore) Set(ctx context.Context, key string, artifacts [][]byte) error {
+	defer s.invalidate(key)
+	return s.inner.Set(ctx, key, artifacts)
+}
+
+// SetWithProfile stores artifacts and their profile in the inner store and
+// drops key from the cache, unless the inner store found them unchanged
+func (s *CachingStore) SetWithProfile(ctx context.Context, key, profile, artifactType string, expiresAt time.Time, artifacts [][]byte) (SetOutcome, error) {
+	outcome, err := s.inner.SetWithProfile(ctx, key, profile, artifactType, expiresAt, artifacts)
+	if err != nil || outcome != SetUnchanged {
+		s.invalidate(key)
+	}
+	return outcome, err
+}
+
+// SetIfAbsent stores artifacts in the inner store, unless it already holds
+// any of the keys, and drops the keys from the cache
+func (s *CachingStore) SetIfAbsent(ctx context.Context, profile string, entries []KeyedArtifacts) error {
+	defer func() {
+		for _, e := range entries {
+			s.invalidate(e.Key)
+		}
+	}()
+	return s.inner.SetIfAbsent(ctx, profile, entries)
+}
+
+// Append adds an artifact in the inner store and drops key from the cache
+func (s *CachingStore) Append(ctx context.Context, key string, artifact []byte) error {
+	defer s.invalidate(key)
+	return s.inner.Append(ctx, key, artifact)
+}
+
+// invalidate drops key from the cache. Writers call it after the write, and
+// it moves the key to a new generation, so that a Get that read the old
+// value before the write doesn't cache it once invalidate has run.
+func (s *CachingStore) invalidate(key string) {
+	s.fillMu.Lock()
+	defer s.fillMu.Unlock()
+
+	s.generations[generation(key)]++
+	s.values.Remove(key)
+	s.profiles.Remove(key)
+}
+
+// Exists reports whether any of the keys holds artifacts, answering from the
+// cache if it holds one of them
+func (s *CachingStore) Exists(ctx context.Context, keys []string) (bool, error) {
+	for _, key := range keys {
+		if _, ok := s.values.Peek(key); ok {
+			return true, nil
+		}
+	}
+
+	return s.inner.Exists(ctx, keys)
+}
+
+// StoredProfile returns the profile recorded for key, from the cache if it
+// holds it
+func (s *CachingStore) StoredProfile(ctx context.Context, key string) (string, error) {
+	if profile, ok := s.profiles.Get(key); ok {
+		return profile, nil
+	}
+
+	gens := s.generationsOf([]string{key})
+
+	profile, err := s.inner.StoredProfile(ctx, key)
+	if err != nil {
+		return "", err
+	}
+
+	s.fillMu.Lock()
+	if s.cacheable(profile) && s.generations[generation(key)] == gens[0] {
+		s.profiles.Add(key, profile)
+	}
+	s.fillMu.Unlock()
+
+	return profile, nil
+}
+
+// DeleteByTenant removes a tenant's keys from the inner store and drops
+// those cached
+func (s *CachingStore) DeleteByTenant(ctx context.Context, tenantID string) (int64, error) {
+	defer func() {
+		for _, key := range s.values.Keys() {
+			if tenantOf(key) == tenantID {
+				s.invalidate(key)
+			}
+		}
+		for _, key := range s.profiles.Keys() {
+			if tenantOf(key) == tenantID {
+				s.invalidate(key)
+			}
+		}
+	}()
+	return s.inner.DeleteByTenant(ctx, tenantID)
+}
+
+// Count returns the number of keys in the inner store
+func (s *CachingStore) Count(ctx context.Context) (int64, error) {
+	return s.inner.Count(ctx)
+}
+
+// CountByTenant returns the number of keys per tenant in the inner store
+func (s *CachingStore) CountByTenant(ctx context.Context) (map[string]int64, error) {
+	return s.inner.CountByTenant(ctx)
+}
+
+// Ping checks that the inner store can be reached
+func (s *CachingStore) Ping(ctx context.Context) error {
+	return s.inner.Ping(ctx)
+}
+
+// Hits returns the number of keys served from the cache so far
+func (s *CachingStore) Hits() int64 {
+	return s.hits.Load()
+}
+
+// Misses returns the number of keys looked up in the inner store so far
+func (s *CachingStore) Misses() int64 {
+	return s.misses.Load()
+}
+
+// Close empties the cache and closes the inner store
+func (s *CachingStore) Close() error {
+	s.values.Purge()
+	s.profiles.Purge()
+
+	return s.inner.Close()
+}
@@ -0,0 +1,327 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"endorsement-distribution/internal/config"
+
+	"go.uber.org/zap"
+)
+
+// countingStore counts the Get calls made to it. If blockGet is set, a Get
+// signals on read once it has read from the store, then waits for blockGet
+// to be closed before returning.
+type countingStore struct {
+	Store
+
+	mu       sync.Mutex
+	gets     int
+	read     chan struct{}
+	blockGet chan struct{}
+}
+
+func (s *countingStore) Get(ctx context.Context, keys []string) ([]KeyedArtifacts, error) {
+	s.mu.Lock()
+	s.gets++
+	s.mu.Unlock()
+
+	found, err := s.Store.Get(ctx, keys)
+	if s.blockGet != nil {
+		s.read <- struct{}{}
+		<-s.blockGet
+	}
+	return found, err
+}
+
+func (s *countingStore) getCalls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gets
+}
+
+// newCountingStore returns a memory store behind a countingStore
+func newCountingStore(t *testing.T) (*countingStore, *MemoryStore) {
+	t.Helper()
+
+	ms, err := NewMemoryStore(config.DatabaseConfig{})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+
+	return &countingStore{Store: ms}, ms
+}
+
+func TestCachingStoreSecondGetIsCached(t *testing.T) {
+	inner, ms := newCountingStore(t)
+	cs := NewCachingStore(inner, 10, 0, nil)
+	ctx := context.Background()
+
+	if _, err := ms.SetWithProfile(ctx, "k", testProfile, ArtifactTypeReferenceValues, time.Time{}, [][]byte{[]byte("a")}); err != nil {
+		t.Fatalf("SetWithProfile: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		found, err := cs.Get(ctx, []string{"k"})
+		if err != nil {
+			t.Fatalf("Get %d: %v", i, err)
+		}
+		if len(found) != 1 || !bytes.Equal(found[0].Artifacts[0], []byte("a")) || found[0].Profile != testProfile {
+			t.Fatalf("Get %d = %+v", i, found)
+		}
+	}
+
+	if got := inner.getCalls(); got != 1 {
+		t.Errorf("inner Get called %d times, want 1", got)
+	}
+	if cs.Hits() != 1 || cs.Misses() != 1 {
+		t.Errorf("hits, misses = %d, %d, want 1, 1", cs.Hits(), cs.Misses())
+	}
+}
+
+func TestCachingStoreSetInvalidates(t *testing.T) {
+	inner, _ := newCountingStore(t)
+	cs := NewCachingStore(inner, 10, 0, nil)
+	ctx := context.Background()
+
+	if err := cs.Set(ctx, "k", [][]byte{[]byte("old")}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if _, err := cs.Get(ctx, []string{"k"}); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if err := cs.Set(ctx, "k", [][]byte{[]byte("new")}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	found, err := cs.Get(ctx, []string{"k"})
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got := string(found[0].Artifacts[0]); got != "new" {
+		t.Errorf("Get after Set = %q, want new", got)
+	}
+}
+
+func TestCachingStoreNoStoreProfiles(t *testing.T) {
+	const noStore = "tag:example.com,2024:secret"
+
+	inner, ms := newCountingStore(t)
+	cs := NewCachingStore(inner, 10, 0, []string{noStore})
+	ctx := context.Background()
+
+	if _, err := ms.SetWithProfile(ctx, "k", noStore, ArtifactTypeReferenceValues, time.Time{}, [][]byte{[]byte("a")}); err != nil {
+		t.Fatalf("SetWithProfile: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := cs.Get(ctx, []string{"k"}); err != nil {
+			t.Fatalf("Get %d: %v", i, err)
+		}
+		if _, err := cs.StoredProfile(ctx, "k"); err != nil {
+			t.Fatalf("StoredProfile %d: %v", i, err)
+		}
+	}
+
+	if got := inner.getCalls(); got != 2 {
+		t.Errorf("inner Get called %d times, want every Get to reach it", got)
+	}
+	if cs.values.Len() != 0 || cs.profiles.Len() != 0 {
+		t.Errorf("%d values and %d profiles cached, want none", cs.values.Len(), cs.profiles.Len())
+	}
+}
+
+func TestCachingStoreGetReturnsCopies(t *testing.T) {
+	inner, _ := newCountingStore(t)
+	cs := NewCachingStore(inner, 10, 0, nil)
+	ctx := context.Background()
+
+	if err := cs.Set(ctx, "k", [][]byte{[]byte("a")}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	// Both the Get that fills the cache and one served from it
+	for i := 0; i < 2; i++ {
+		found, err := cs.Get(ctx, []string{"k"})
+		if err != nil {
+			t.Fatalf("Get %d: %v", i, err)
+		}
+		found[0].Artifacts[0][0] = 'x'
+	}
+
+	found, err := cs.Get(ctx, []string{"k"})
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got := string(found[0].Artifacts[0]); got != "a" {
+		t.Errorf("cached artifact = %q after callers modified theirs, want a", got)
+	}
+}
+
+func TestCachingStoreGetRacingSet(t *testing.T) {
+	inner, _ := newCountingStore(t)
+	cs := NewCachingStore(inner, 10, 0, nil)
+	ctx := context.Background()
+
+	if err := cs.Set(ctx, "k", [][]byte{[]byte("old")}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	// A Get reads the old value, then stalls while a Set replaces it
+	inner.read = make(chan struct{})
+	inner.blockGet = make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := cs.Get(ctx, []string{"k"}); err != nil {
+			t.Errorf("racing Get: %v", err)
+		}
+	}()
+
+	select {
+	case <-inner.read:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Get never reached the inner store")
+	}
+	if err := cs.Set(ctx, "k", [][]byte{[]byte("new")}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	close(inner.blockGet)
+	<-done
+
+	inner.blockGet = nil
+	found, err := cs.Get(ctx, []string{"k"})
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got := string(found[0].Artifacts[0]); got != "new" {
+		t.Errorf("Get after the race = %q, want new: the stale read was cached", got)
+	}
+}
+
+func TestDistributorCacheStats(t *testing.T) {
+	ms, err := NewMemoryStore(config.DatabaseConfig{})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+
+	if _, ok := NewEndorsementDistributor(ms, config.DistributorConfig{}, nil).CacheStats(); ok {
+		t.Errorf("CacheStats reported for a store without a cache")
+	}
+
+	cs := NewCachingStore(ms, 10, 0, nil)
+	ctx := context.Background()
+	if err := cs.Set(ctx, "k", [][]byte{[]byte("a")}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := cs.Get(ctx, []string{"k"}); err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+	}
+
+	stats, ok := NewEndorsementDistributor(cs, config.DistributorConfig{}, nil).CacheStats()
+	if !ok || stats != (CacheStats{Hits: 2, Misses: 1}) {
+		t.Errorf("CacheStats = %+v, %v, want 2 hits and 1 miss", stats, ok)
+	}
+}
+
+func TestCachingStoreKeepsUnchangedKeys(t *testing.T) {
+	inner, _ := newCountingStore(t)
+	cs := NewCachingStore(inner, 10, 0, nil)
+	ctx := context.Background()
+
+	artifacts := [][]byte{[]byte("a")}
+	if _, err := cs.SetWithProfile(ctx, "k", testProfile, ArtifactTypeReferenceValues, time.Time{}, artifacts); err != nil {
+		t.Fatalf("SetWithProfile: %v", err)
+	}
+	if _, err := cs.Get(ctx, []string{"k"}); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	// Writing the same again doesn't drop the cached entry
+	outcome, err := cs.SetWithProfile(ctx, "k", testProfile, ArtifactTypeReferenceValues, time.Time{}, artifacts)
+	if err != nil || outcome != SetUnchanged {
+		t.Fatalf("SetWithProfile = %v, %v, want SetUnchanged", outcome, err)
+	}
+	if _, err := cs.Get(ctx, []string{"k"}); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got := inner.getCalls(); got != 1 {
+		t.Errorf("inner Get called %d times, want the unchanged key still cached", got)
+	}
+}
+
+func TestCachingStoreAppendInvalidates(t *testing.T) {
+	inner, _ := newCountingStore(t)
+	cs := NewCachingStore(inner, 10, 0, nil)
+	ctx := context.Background()
+
+	if err := cs.Set(ctx, "k", [][]byte{[]byte("a")}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if _, err := cs.Get(ctx, []string{"k"}); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if err := cs.Append(ctx, "k", []byte("b")); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	found, err := cs.Get(ctx, []string{"k"})
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if len(found[0].Artifacts) != 2 {
+		t.Errorf("Get after Append = %d artifacts, want the appended one too", len(found[0].Artifacts))
+	}
+}
+
+func TestStoreStatus(t *testing.T) {
+	ctx := context.Background()
+	primary, err := NewMemoryStore(config.DatabaseConfig{})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	shadow, err := NewMemoryStore(config.DatabaseConfig{})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+
+	if got := NewEndorsementDistributor(primary, config.DistributorConfig{}, nil).StoreStatus(); len(got) != 0 {
+		t.Errorf("StoreStatus of an undecorated store = %v, want none", got)
+	}
+
+	// The cache in front of the shadow store, as main sets them up
+	ss := NewShadowStore(primary, shadow, zap.NewNop().Sugar())
+	cs := NewCachingStore(ss, 10, 0, nil)
+	ed := NewEndorsementDistributor(cs, config.DistributorConfig{}, nil)
+
+	want := map[string]any{"cache": CacheStatus{}, "shadow": ShadowStatus{}}
+	if got := ed.StoreStatus(); !reflect.DeepEqual(got, want) {
+		t.Errorf("StoreStatus before any lookup = %+v, want %+v", got, want)
+	}
+
+	// The shadow disagreeing on a key, read once from each store then from
+	// the cache
+	if err := primary.Set(ctx, "k", [][]byte{[]byte("a")}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		if _, err := cs.Get(ctx, []string{"k"}); err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+	}
+	ss.wg.Wait()
+
+	want = map[string]any{
+		"cache":  CacheStatus{CacheStats: CacheStats{Hits: 3, Misses: 1}, HitRatio: 0.75},
+		"shadow": ShadowStatus{Mismatches: 1},
+	}
+	if got := ed.StoreStatus(); !reflect.DeepEqual(got, want) {
+		t.Errorf("StoreStatus = %+v, want %+v", got, want)
+	}
+}
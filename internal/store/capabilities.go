@@ -0,0 +1,65 @@
+package store
+
+import (
+	"slices"
+
+	"github.com/veraison/corim/coserv"
+)
+
+// Capabilities describes the queries the distributor answers
+type Capabilities struct {
+	// ArtifactTypes are the artifact types lookup keys can be synthesized
+	// for
+	ArtifactTypes []string `json:"artifactTypes"`
+
+	// Schemes are the schemes keys are looked up in, over all profiles
+	Schemes []string `json:"schemes"`
+
+	// ProfileSchemes are the schemes configured per profile; profiles not
+	// listed use DefaultScheme
+	ProfileSchemes map[string][]string `json:"profileSchemes,omitempty"`
+	DefaultScheme  string              `json:"defaultScheme"`
+
+	// DefaultProfile tags results when neither the query nor the stored
+	// artifacts carry a profile
+	DefaultProfile string `json:"defaultProfile,omitempty"`
+
+	// SupportedProfiles are the only profiles queries may carry, if set
+	SupportedProfiles []string `json:"supportedProfiles,omitempty"`
+
+	// DecodedProfiles are the profiles whose artifacts go through a
+	// registered decoder
+	DecodedProfiles []string `json:"decodedProfiles,omitempty"`
+
+	// MaxKeysPerQuery caps the lookup keys of a query (0 if unlimited)
+	MaxKeysPerQuery int `json:"maxKeysPerQuery"`
+}
+
+// Capabilities reports the queries the distributor answers, as configured
+func (ed *EndorsementDistributor) Capabilities() Capabilities {
+	schemes := []string{SchemeName}
+	for _, s := range ed.schemes {
+		schemes = append(schemes, s...)
+	}
+	slices.Sort(schemes)
+
+	var decoded []string
+	for p := range ed.decoders {
+		decoded = append(decoded, p)
+	}
+	slices.Sort(decoded)
+
+	return Capabilities{
+		ArtifactTypes: []string{
+			coserv.ArtifactTypeReferenceValues.String(),
+			coserv.ArtifactTypeTrustAnchors.String(),
+		},
+		Schemes:           slices.Compact(schemes),
+		ProfileSchemes:    ed.schemes,
+		DefaultScheme:     SchemeName,
+		DefaultProfile:    ed.defaultProfile,
+		SupportedProfiles: ed.SupportedProfiles(),
+		DecodedProfiles:   decoded,
+		MaxKeysPerQuery:   ed.maxKeys,
+	}
+}
@@ -0,0 +1,43 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+
+	"endorsement-distribution/internal/config"
+
+	"go.uber.org/zap"
+)
+
+func TestCapabilities(t *testing.T) {
+	const other = "tag:example.com,2024:other"
+
+	ed := NewEndorsementDistributor(nil, config.DistributorConfig{
+		DefaultProfile:    testProfile,
+		SupportedProfiles: []string{testProfile, other},
+		ProfileSchemes: []config.ProfileSchemesConfig{
+			{Profile: testProfile, Schemes: []string{"ARM_CCA_V1", SchemeName}},
+			{Profile: other, Schemes: []string{"OTHER"}},
+		},
+		MaxKeysPerQuery: 16,
+	}, zap.NewNop().Sugar()).
+		WithArtifactDecoder(other, func(artifact []byte) ([]byte, error) { return artifact, nil })
+
+	want := Capabilities{
+		ArtifactTypes: []string{"reference-values", "trust-anchors"},
+		Schemes:       []string{"ARM_CCA", "ARM_CCA_V1", "OTHER"},
+		ProfileSchemes: map[string][]string{
+			testProfile: {"ARM_CCA_V1", SchemeName},
+			other:       {"OTHER"},
+		},
+		DefaultScheme:     SchemeName,
+		DefaultProfile:    testProfile,
+		SupportedProfiles: []string{testProfile, other},
+		DecodedProfiles:   []string{other},
+		MaxKeysPerQuery:   16,
+	}
+
+	if got := ed.Capabilities(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Capabilities = %+v, want %+v", got, want)
+	}
+}
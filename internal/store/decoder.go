@@ -0,0 +1,44 @@
+package store
+
+import "fmt"
+
+// ArtifactDecoder interprets an artifact as stored for a profile, returning
+// it as it is to be served, or an error if it isn't valid for the profile
+type ArtifactDecoder func(artifact []byte) ([]byte, error)
+
+// WithArtifactDecoder makes the distributor pass the artifacts found for
+// queries carrying profile through d. Profiles without a decoder have their
+// artifacts served as stored.
+func (ed *EndorsementDistributor) WithArtifactDecoder(profile string, d ArtifactDecoder) *EndorsementDistributor {
+	if ed.decoders == nil {
+		ed.decoders = make(map[string]ArtifactDecoder)
+	}
+	ed.decoders[profile] = d
+	return ed
+}
+
+// decodeArtifacts passes the artifacts in each group through the decoder
+// registered for profile, if any
+func (ed *EndorsementDistributor) decodeArtifacts(profile string, groups []KeyedArtifacts) ([]KeyedArtifacts, error) {
+	decode, ok := ed.decoders[profile]
+	if !ok {
+		return groups, nil
+	}
+
+	out := make([]KeyedArtifacts, 0, len(groups))
+	for _, g := range groups {
+		artifacts := make([][]byte, 0, len(g.Artifacts))
+
+		for i, artifact := range g.Artifacts {
+			decoded, err := decode(artifact)
+			if err != nil {
+				return nil, fmt.Errorf("decoding artifact[%d] of %s for profile %q: %w", i, g.Key, profile, err)
+			}
+			artifacts = append(artifacts, decoded)
+		}
+
+		out = append(out, KeyedArtifacts{Key: g.Key, Artifacts: artifacts, Profile: g.Profile})
+	}
+
+	return out, nil
+}
@@ -0,0 +1,70 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"endorsement-distribution/internal/config"
+
+	"github.com/veraison/corim/comid"
+	"github.com/veraison/corim/coserv"
+	"go.uber.org/zap"
+)
+
+func TestArtifactDecoder(t *testing.T) {
+	const other = "tag:example.com,2024:other"
+
+	ms, err := NewMemoryStore(config.DatabaseConfig{})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+
+	// Queries of both profiles synthesize the same keys
+	selector := coserv.NewEnvironmentSelector().AddClass(*comid.NewClassImplID(comid.TestImplID))
+	otherQuery := encodeQuery(t, other, coserv.ArtifactTypeReferenceValues, selector)
+
+	ctx := context.Background()
+	for _, key := range queryKeys(t, "acme", refValQuery(t)) {
+		if err := ms.Set(ctx, key, [][]byte{[]byte("artifact")}); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+
+	errInvalid := errors.New("invalid for the profile")
+	upper := func(artifact []byte) ([]byte, error) { return bytes.ToUpper(artifact), nil }
+	failing := func(artifact []byte) ([]byte, error) { return nil, errInvalid }
+
+	tests := []struct {
+		name    string
+		decoder ArtifactDecoder
+		query   string
+		want    string
+		wantErr error
+	}{
+		{"decoded", upper, refValQuery(t), "ARTIFACT", nil},
+		{"other profile served as stored", upper, otherQuery, "artifact", nil},
+		{"decoder failing", failing, refValQuery(t), "", errInvalid},
+	}
+
+	for _, tt := range tests {
+		ed := NewEndorsementDistributor(ms, config.DistributorConfig{ResultEncoding: "raw"}, zap.NewNop().Sugar()).
+			WithArtifactDecoder(testProfile, tt.decoder)
+
+		result, err := ed.GetEndorsementsResult(ctx, "acme", tt.query, "application/coserv+cbor", QueryOptions{})
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("%s: GetEndorsementsResult = %v, want %v", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: GetEndorsementsResult: %v", tt.name, err)
+		}
+
+		if len(result.Artifacts) != 1 || string(result.Artifacts[0]) != tt.want {
+			t.Errorf("%s: artifacts = %q, want [%q]", tt.name, result.Artifacts, tt.want)
+		}
+	}
+}
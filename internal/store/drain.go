@@ -0,0 +1,71 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrDraining is returned for operations started once the distributor is
+// draining for shutdown
+var ErrDraining = errors.New("shutting down")
+
+// drainer counts the store operations in flight, so that shutdown can wait
+// for them before the store is closed
+type drainer struct {
+	mu       sync.Mutex
+	active   int
+	draining bool
+	idle     chan struct{}
+}
+
+// track registers an operation, unless draining has begun. The returned
+// function must be called when the operation is over.
+func (ed *EndorsementDistributor) track() (func(), error) {
+	d := &ed.drain
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.draining {
+		return nil, ErrDraining
+	}
+	d.active++
+
+	return func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		d.active--
+		if d.draining && d.active == 0 {
+			close(d.idle)
+		}
+	}, nil
+}
+
+// Drain stops new operations from starting and waits until those in flight
+// are over, or ctx is done. Close the store only once it returns nil.
+func (ed *EndorsementDistributor) Drain(ctx context.Context) error {
+	d := &ed.drain
+
+	d.mu.Lock()
+	if !d.draining {
+		d.draining = true
+		d.idle = make(chan struct{})
+		if d.active == 0 {
+			close(d.idle)
+		}
+	}
+	idle := d.idle
+	d.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return fmt.Errorf("%d store operations still in flight: %w", d.active, ctx.Err())
+	}
+}
@@ -0,0 +1,65 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"endorsement-distribution/internal/config"
+
+	"go.uber.org/zap"
+)
+
+func TestDrainWaitsForSlowGet(t *testing.T) {
+	inner, ms := newCountingStore(t)
+	inner.read = make(chan struct{})
+	inner.blockGet = make(chan struct{})
+
+	query := refValQuery(t)
+	ctx := context.Background()
+	for _, key := range queryKeys(t, "acme", query) {
+		if err := ms.Set(ctx, key, [][]byte{[]byte("artifact")}); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+
+	ed := NewEndorsementDistributor(inner, config.DistributorConfig{ResultEncoding: "raw"}, zap.NewNop().Sugar())
+
+	got := make(chan error, 1)
+	go func() {
+		_, err := ed.GetEndorsementsResult(ctx, "acme", query, "application/coserv+cbor", QueryOptions{})
+		got <- err
+	}()
+	<-inner.read
+
+	// The Get is stuck in the store: a Drain with a deadline gives up...
+	short, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := ed.Drain(short); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Drain with a Get in flight = %v, want DeadlineExceeded", err)
+	}
+
+	// ...and one without blocks until the Get is over
+	drained := make(chan error, 1)
+	go func() { drained <- ed.Drain(ctx) }()
+
+	select {
+	case err := <-drained:
+		t.Fatalf("Drain returned %v with a Get in flight", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(inner.blockGet)
+	if err := <-got; err != nil {
+		t.Errorf("GetEndorsementsResult: %v", err)
+	}
+	if err := <-drained; err != nil {
+		t.Errorf("Drain: %v", err)
+	}
+
+	// Nothing new starts once draining
+	if _, err := ed.GetEndorsementsResult(ctx, "acme", query, "application/coserv+cbor", QueryOptions{}); !errors.Is(err, ErrDraining) {
+		t.Errorf("GetEndorsementsResult after Drain = %v, want ErrDraining", err)
+	}
+}
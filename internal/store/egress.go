@@ -0,0 +1,137 @@
+package store
+
+import (
+	"fmt"
+	"slices"
+
+	"endorsement-distribution/internal/config"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/veraison/corim/comid"
+	"github.com/veraison/corim/coserv"
+	"go.uber.org/zap"
+)
+
+// mvalStrippers clear a measurement value field, by its CoRIM name
+var mvalStrippers = map[string]func(*comid.Mval){
+	"version":             func(m *comid.Mval) { m.Ver = nil },
+	"svn":                 func(m *comid.Mval) { m.SVN = nil },
+	"digests":             func(m *comid.Mval) { m.Digests = nil },
+	"flags":               func(m *comid.Mval) { m.Flags = nil },
+	"raw-value":           func(m *comid.Mval) { m.RawValue = nil; m.RawValueMask = nil },
+	"raw-value-mask":      func(m *comid.Mval) { m.RawValueMask = nil },
+	"mac-addr":            func(m *comid.Mval) { m.MACAddr = nil },
+	"ip-addr":             func(m *comid.Mval) { m.IPAddr = nil },
+	"serial-number":       func(m *comid.Mval) { m.SerialNumber = nil },
+	"ueid":                func(m *comid.Mval) { m.UEID = nil },
+	"uuid":                func(m *comid.Mval) { m.UUID = nil },
+	"name":                func(m *comid.Mval) { m.Name = nil },
+	"integrity-registers": func(m *comid.Mval) { m.IntegrityRegisters = nil },
+}
+
+// egressRule removes measurement fields from the reference values returned
+// to the tenant and profile it selects
+type egressRule struct {
+	profile string
+	tenant  string
+	fields  []string
+}
+
+// newEgressRules builds the egress rules from config. Unknown field names
+// are dropped with a warning rather than failing startup.
+func newEgressRules(cfgs []config.EgressStripConfig, logger *zap.SugaredLogger) []egressRule {
+	var rules []egressRule
+
+	for _, cfg := range cfgs {
+		rule := egressRule{profile: cfg.Profile, tenant: cfg.Tenant}
+
+		for _, f := range cfg.Fields {
+			if _, ok := mvalStrippers[f]; !ok {
+				logger.Warnw("Ignoring unknown measurement field in egress strip rule",
+					"field", f, "profile", cfg.Profile, "tenant", cfg.Tenant)
+				continue
+			}
+			rule.fields = append(rule.fields, f)
+		}
+
+		if len(rule.fields) > 0 {
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules
+}
+
+// egressFields returns the measurement fields to strip from the results of
+// a query for the given tenant and profile
+func (ed *EndorsementDistributor) egressFields(tenantID, profile string) []string {
+	var fields []string
+
+	for _, r := range ed.egressRules {
+		if (r.tenant == "" || r.tenant == tenantID) && (r.profile == "" || r.profile == profile) {
+			for _, f := range r.fields {
+				if !slices.Contains(fields, f) {
+					fields = append(fields, f)
+				}
+			}
+		}
+	}
+
+	return fields
+}
+
+// stripFields removes the given measurement fields from the reference
+// values in each group, re-encoding the artifacts it changes. Only
+// reference values carry measurements; other artifact types are returned
+// untouched.
+func stripFields(artifactType coserv.ArtifactType, groups []KeyedArtifacts, fields []string) ([]KeyedArtifacts, error) {
+	if len(fields) == 0 || artifactType != coserv.ArtifactTypeReferenceValues {
+		return groups, nil
+	}
+
+	// The same artifact may appear under several keys: strip it once
+	stripped := make(map[string][]byte)
+
+	out := make([]KeyedArtifacts, 0, len(groups))
+	for _, g := range groups {
+		artifacts := make([][]byte, 0, len(g.Artifacts))
+
+		for i, artifact := range g.Artifacts {
+			s, ok := stripped[string(artifact)]
+			if !ok {
+				var err error
+				if s, err = stripArtifact(artifact, fields); err != nil {
+					return nil, fmt.Errorf("stripping artifact[%d] of %s: %w", i, g.Key, err)
+				}
+				stripped[string(artifact)] = s
+			}
+			artifacts = append(artifacts, s)
+		}
+
+		out = append(out, KeyedArtifacts{Key: g.Key, Artifacts: artifacts, Profile: g.Profile})
+	}
+
+	return out, nil
+}
+
+// stripArtifact removes the given fields from every measurement of a
+// reference value
+func stripArtifact(artifact []byte, fields []string) ([]byte, error) {
+	var rv comid.ValueTriple
+	if err := cbor.Unmarshal(artifact, &rv); err != nil {
+		return nil, fmt.Errorf("decoding reference value: %w", err)
+	}
+
+	for i := range rv.Measurements.Values {
+		for _, f := range fields {
+			mvalStrippers[f](&rv.Measurements.Values[i].Val)
+		}
+	}
+
+	data, err := cbor.Marshal(rv)
+	if err != nil {
+		return nil, fmt.Errorf("encoding reference value: %w", err)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,91 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"endorsement-distribution/internal/config"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/veraison/corim/comid"
+	"github.com/veraison/swid"
+	"go.uber.org/zap"
+)
+
+func TestEgressStrip(t *testing.T) {
+	m := comid.MustNewUintMeasurement(uint64(1))
+	m.Val = comid.Mval{Digests: &comid.Digests{{HashAlgID: swid.Sha256, HashValue: bytes.Repeat([]byte{1}, 32)}}}
+	m.SetSVN(4)
+
+	artifact, err := cbor.Marshal(comid.ValueTriple{
+		Environment:  comid.Environment{Class: comid.NewClassImplID(comid.TestImplID)},
+		Measurements: *comid.NewMeasurements().Add(m),
+	})
+	if err != nil {
+		t.Fatalf("cbor.Marshal: %v", err)
+	}
+
+	ms, err := NewMemoryStore(config.DatabaseConfig{})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	ctx := context.Background()
+	query := refValQuery(t)
+	for _, tenant := range []string{"acme", "other"} {
+		for _, key := range queryKeys(t, tenant, query) {
+			if err := ms.Set(ctx, key, [][]byte{artifact}); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+		}
+	}
+
+	ed := NewEndorsementDistributor(ms, config.DistributorConfig{
+		ResultEncoding: "raw",
+		EgressStrip: []config.EgressStripConfig{
+			{Tenant: "acme", Fields: []string{"digests", "no-such-field"}},
+			{Profile: "tag:example.com,2024:other", Fields: []string{"svn"}},
+		},
+	}, zap.NewNop().Sugar())
+
+	tests := []struct {
+		tenant      string
+		wantDigests bool
+	}{
+		{"acme", false},
+		{"other", true},
+	}
+
+	for _, tt := range tests {
+		result, err := ed.GetEndorsementsResult(ctx, tt.tenant, query, "application/coserv+cbor", QueryOptions{})
+		if err != nil {
+			t.Fatalf("%s: GetEndorsementsResult: %v", tt.tenant, err)
+		}
+		if len(result.Artifacts) != 1 {
+			t.Fatalf("%s: %d artifacts, want 1", tt.tenant, len(result.Artifacts))
+		}
+
+		var rv comid.ValueTriple
+		if err := cbor.Unmarshal(result.Artifacts[0], &rv); err != nil {
+			t.Fatalf("%s: decoding the returned reference value: %v", tt.tenant, err)
+		}
+		val := rv.Measurements.Values[0].Val
+
+		if got := val.Digests != nil; got != tt.wantDigests {
+			t.Errorf("%s: digests returned %v, want %v", tt.tenant, got, tt.wantDigests)
+		}
+		// The rule for another profile doesn't apply
+		if val.SVN == nil {
+			t.Errorf("%s: svn stripped, want it kept", tt.tenant)
+		}
+	}
+
+	// The stored artifact is left as it was
+	got, err := ms.Get(ctx, queryKeys(t, "acme", query))
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if !bytes.Equal(got[0].Artifacts[0], artifact) {
+		t.Error("stored artifact changed by the egress strip")
+	}
+}
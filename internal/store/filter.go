@@ -0,0 +1,93 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/veraison/corim/comid"
+	"github.com/veraison/corim/coserv"
+	"github.com/veraison/swid"
+)
+
+// ErrInvalidOption is returned for query options that can't be applied to
+// the query they come with
+var ErrInvalidOption = errors.New("invalid query option")
+
+// QueryOptions refine how a CoSERV query is answered
+type QueryOptions struct {
+	// HashAlgorithm, when set, restricts reference values to those carrying
+	// at least one digest computed with the named algorithm (e.g. "sha-384")
+	HashAlgorithm string
+
+	// Offset and Limit select a page of the artifacts left once the filters
+	// are applied: Limit of them, skipping the first Offset. Limit 0 returns
+	// all of them.
+	Offset int
+	Limit  int
+
+	// RequestID, if set, is attached to the log lines of the query
+	RequestID string
+}
+
+// paginate returns the page of artifacts selected by offset and limit, and
+// the offset of the next page, or 0 if this is the last one
+func paginate(artifacts [][]byte, offset, limit int) ([][]byte, int) {
+	if offset >= len(artifacts) {
+		return nil, 0
+	}
+	artifacts = artifacts[offset:]
+
+	if limit <= 0 || limit >= len(artifacts) {
+		return artifacts, 0
+	}
+
+	return artifacts[:limit], offset + limit
+}
+
+// filterByHashAlgorithm keeps the reference-value artifacts that have at
+// least one measurement digest computed with the named algorithm
+func filterByHashAlgorithm(artifactType coserv.ArtifactType, artifacts [][]byte, name string) ([][]byte, error) {
+	if artifactType != coserv.ArtifactTypeReferenceValues {
+		return nil, fmt.Errorf("%w: filtering by hash algorithm is only supported for reference values", ErrInvalidOption)
+	}
+
+	algID := swid.AlgIDFromString(name)
+	if algID == 0 {
+		return nil, fmt.Errorf("%w: unknown hash algorithm %q", ErrInvalidOption, name)
+	}
+
+	var filtered [][]byte
+	for i, artifact := range artifacts {
+		var rv comid.ValueTriple
+		if err := cbor.Unmarshal(artifact, &rv); err != nil {
+			return nil, fmt.Errorf("decoding artifact[%d] as reference value: %w", i, err)
+		}
+
+		if hasDigestWith(rv, algID) {
+			filtered = append(filtered, artifact)
+		}
+	}
+
+	if len(filtered) == 0 {
+		return nil, fmt.Errorf("%w with %s digests", ErrNoArtifacts, name)
+	}
+
+	return filtered, nil
+}
+
+func hasDigestWith(rv comid.ValueTriple, algID uint64) bool {
+	for _, m := range rv.Measurements.Values {
+		if m.Val.Digests == nil {
+			continue
+		}
+
+		for _, d := range *m.Val.Digests {
+			if d.HashAlgID == algID {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,88 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/veraison/corim/comid"
+	"github.com/veraison/corim/coserv"
+	"github.com/veraison/swid"
+)
+
+// digestArtifact returns a reference value whose one measurement has a
+// digest of size bytes computed with algorithm algID
+func digestArtifact(t *testing.T, algID uint64, size int) []byte {
+	t.Helper()
+
+	m := comid.MustNewUintMeasurement(uint64(1))
+	m.Val = comid.Mval{Digests: &comid.Digests{{HashAlgID: algID, HashValue: bytes.Repeat([]byte{1}, size)}}}
+
+	artifact, err := cbor.Marshal(comid.ValueTriple{
+		Environment:  comid.Environment{Class: comid.NewClassImplID(comid.TestImplID)},
+		Measurements: *comid.NewMeasurements().Add(m),
+	})
+	if err != nil {
+		t.Fatalf("cbor.Marshal: %v", err)
+	}
+
+	return artifact
+}
+
+func TestFilterByHashAlgorithm(t *testing.T) {
+	sha256 := digestArtifact(t, swid.Sha256, 32)
+	sha384 := digestArtifact(t, swid.Sha384, 48)
+	artifacts := [][]byte{sha256, sha384}
+
+	got, err := filterByHashAlgorithm(coserv.ArtifactTypeReferenceValues, artifacts, "sha-384")
+	if err != nil {
+		t.Fatalf("filterByHashAlgorithm: %v", err)
+	}
+	if len(got) != 1 || !bytes.Equal(got[0], sha384) {
+		t.Errorf("filterByHashAlgorithm(sha-384) kept %d artifacts, want the sha-384 one only", len(got))
+	}
+
+	tests := []struct {
+		name         string
+		artifactType coserv.ArtifactType
+		alg          string
+		want         error
+	}{
+		{"none with that algorithm", coserv.ArtifactTypeReferenceValues, "sha-512", ErrNoArtifacts},
+		{"unknown algorithm", coserv.ArtifactTypeReferenceValues, "md6", ErrInvalidOption},
+		{"trust anchors", coserv.ArtifactTypeTrustAnchors, "sha-256", ErrInvalidOption},
+	}
+
+	for _, tt := range tests {
+		if _, err := filterByHashAlgorithm(tt.artifactType, artifacts, tt.alg); !errors.Is(err, tt.want) {
+			t.Errorf("%s: filterByHashAlgorithm = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	artifacts := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+
+	tests := []struct {
+		offset, limit int
+		want          string
+		wantNext      int
+	}{
+		{0, 0, "abc", 0},
+		{0, 2, "ab", 2},
+		{2, 2, "c", 0},
+		{1, 1, "b", 2},
+		{0, 3, "abc", 0},
+		{3, 1, "", 0},
+		{5, 0, "", 0},
+	}
+
+	for _, tt := range tests {
+		page, next := paginate(artifacts, tt.offset, tt.limit)
+		if got := string(bytes.Join(page, nil)); got != tt.want || next != tt.wantNext {
+			t.Errorf("paginate(offset %d, limit %d) = %q, next %d; want %q, next %d",
+				tt.offset, tt.limit, got, next, tt.want, tt.wantNext)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/veraison/corim/comid"
+	"github.com/veraison/corim/corim"
+	"github.com/veraison/services/scheme/common/arm"
+)
+
+// ErrMalformedCorim is returned by Ingest when the payload isn't an unsigned
+// CoRIM, or holds triples no lookup key can be synthesized for or, unless
+// they are configured to be skipped, that aren't valid artifacts
+var ErrMalformedCorim = errors.New("malformed CoRIM")
+
+// IngestOptions refine how Ingest writes
+type IngestOptions struct {
+	// CreateOnly fails the ingestion with ErrExists, writing nothing, if any
+	// of the keys already holds artifacts, instead of replacing them
+	CreateOnly bool
+
+	// RequestID, if set, is attached to the log lines of the ingestion
+	RequestID string
+
+	// TTL, if set, is how long the ingested artifacts are served, in place
+	// of the distributor's default for their artifact type
+	TTL time.Duration
+}
+
+// IngestSummary reports what Ingest wrote
+type IngestSummary struct {
+	// Status is IngestUnchanged if every key already held what was
+	// ingested, so that nothing was written, and IngestUpdated otherwise
+	Status          string `json:"status"`
+	Keys            int    `json:"keys"`
+	UnchangedKeys   int    `json:"unchangedKeys"`
+	ReferenceValues int    `json:"referenceValues"`
+	TrustAnchors    int    `json:"trustAnchors"`
+
+	// SkippedArtifacts counts the triples left out for not being valid
+	// artifacts of their type
+	SkippedArtifacts int `json:"skippedArtifacts"`
+}
+
+// Statuses of an IngestSummary
+const (
+	IngestUpdated   = "updated"
+	IngestUnchanged = "unchanged"
+)
+
+// Ingest stores the reference values and attestation verification keys of
+// the CoMIDs in an unsigned CoRIM for tenantID. Each triple is stored under
+// the key a CoSERV query for its environment synthesizes, in the first
+// scheme configured for the CoRIM's profile, replacing what was stored
+// there unless opts.CreateOnly is set. The artifacts expire after opts.TTL
+// or, if it isn't set, the TTL configured for their artifact type. Other tags (CoSWID, CoTS) are
+// skipped. Each triple is checked to decode back as a valid artifact of its
+// type, as serving it will need; one that doesn't fails the ingestion, or is
+// left out if the distributor skips invalid artifacts. Nothing is written
+// unless keys can be synthesized for every triple. With opts.CreateOnly the
+// keys are written in one go, all of them or none; otherwise each key is
+// written on its own, so a store failure partway through leaves the keys
+// written before it replaced. Sending the CoRIM again completes the
+// ingestion, finding those keys unchanged.
+func (ed *EndorsementDistributor) Ingest(ctx context.Context, tenantID string, data []byte, opts IngestOptions) (*IngestSummary, error) {
+	done, err := ed.track()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	uc, err := corim.UnmarshalUnsignedCorimFromCBOR(bytes.TrimPrefix(data, corim.UnsignedCorimTag))
+	if err != nil {
+		return nil, fmt.Errorf("%w: decoding unsigned CoRIM: %v", ErrMalformedCorim, err)
+	}
+
+	profile := ""
+	if uc.Profile != nil {
+		if profile, err = uc.Profile.Get(); err != nil {
+			return nil, fmt.Errorf("%w: getting profile: %v", ErrMalformedCorim, err)
+		}
+	}
+	scheme := ed.schemesForProfile(profile)[0]
+	logger := ed.requestLogger(opts.RequestID)
+
+	var (
+		summary IngestSummary
+		keys    []string
+		byKey   = make(map[string][][]byte)
+		types   = make(map[string]string)
+	)
+	add := func(key, artifactType, what string, triple any) error {
+		artifact, err := cbor.Marshal(triple)
+		if err != nil {
+			return fmt.Errorf("encoding triple: %w", err)
+		}
+		if err := validateArtifact(artifactType, artifact); err != nil {
+			if !ed.skipInvalidArtifacts {
+				return fmt.Errorf("%w: %s: %v", ErrMalformedCorim, what, err)
+			}
+			logger.Warnw("Skipping invalid artifact", "artifact", what, "error", err)
+			summary.SkippedArtifacts++
+			return nil
+		}
+		if t, ok := types[key]; !ok {
+			keys = append(keys, key)
+			types[key] = artifactType
+		} else if t != artifactType {
+			// A key holding both reference values and trust anchors has
+			// no single type
+			types[key] = ""
+		}
+		byKey[key] = append(byKey[key], artifact)
+		if artifactType == ArtifactTypeReferenceValues {
+			summary.ReferenceValues++
+		} else {
+			summary.TrustAnchors++
+		}
+		return nil
+	}
+
+	for i, tag := range uc.Tags {
+		if !bytes.HasPrefix(tag, corim.ComidTag) {
+			logger.Debugw("Skipping CoRIM tag that isn't a CoMID", "tag", i)
+			continue
+		}
+
+		c, err := corim.UnmarshalComidFromCBOR(bytes.TrimPrefix(tag, corim.ComidTag), uc.Profile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: decoding CoMID in tag[%d]: %v", ErrMalformedCorim, i, err)
+		}
+
+		if rvs := c.Triples.ReferenceValues; rvs != nil {
+			for j, rv := range rvs.Values {
+				if rv.Environment.Class == nil {
+					return nil, fmt.Errorf("%w: reference value[%d] of tag[%d] has no class", ErrMalformedCorim, j, i)
+				}
+				implID, err := extractImplID(*rv.Environment.Class)
+				if err != nil {
+					return nil, fmt.Errorf("%w: reference value[%d] of tag[%d]: %v", ErrMalformedCorim, j, i, err)
+				}
+				what := fmt.Sprintf("reference value[%d] of tag[%d]", j, i)
+				if err := add(arm.RefValLookupKey(scheme, tenantID, implID), ArtifactTypeReferenceValues, what, rv); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if aks := c.Triples.AttestVerifKeys; aks != nil {
+			for j, ak := range *aks {
+				key, err := trustAnchorKey(scheme, tenantID, ak.Environment)
+				if err != nil {
+					return nil, fmt.Errorf("%w: attestation key[%d] of tag[%d]: %v", ErrMalformedCorim, j, i, err)
+				}
+				what := fmt.Sprintf("attestation key[%d] of tag[%d]", j, i)
+				if err := add(key, ArtifactTypeTrustAnchors, what, ak); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	now := ed.clock.Now()
+	expiresAt := func(key string) time.Time {
+		ttl := opts.TTL
+		if ttl == 0 {
+			ttl = ed.ingestTTL(types[key])
+		}
+		if ttl == 0 {
+			return time.Time{}
+		}
+		return now.Add(ttl)
+	}
+
+	if opts.CreateOnly {
+		entries := make([]KeyedArtifacts, 0, len(keys))
+		for _, key := range keys {
+			entries = append(entries, KeyedArtifacts{
+				Key:          key,
+				Artifacts:    byKey[key],
+				ArtifactType: types[key],
+				ExpiresAt:    expiresAt(key),
+			})
+		}
+		if err := ed.store.SetIfAbsent(ctx, profile, entries); err != nil {
+			return nil, fmt.Errorf("failed to store artifacts: %w", err)
+		}
+	} else {
+		for _, key := range keys {
+			outcome, err := ed.store.SetWithProfile(ctx, key, profile, types[key], expiresAt(key), byKey[key])
+			if err != nil {
+				return nil, fmt.Errorf("failed to store artifacts for %s: %w", key, err)
+			}
+			if outcome == SetUnchanged {
+				summary.UnchangedKeys++
+			}
+		}
+	}
+	summary.Keys = len(keys)
+
+	summary.Status = IngestUpdated
+	if summary.Keys > 0 && summary.UnchangedKeys == summary.Keys {
+		summary.Status = IngestUnchanged
+	}
+
+	logger.Infow("Ingested CoRIM", "tenant", tenantID, "profile", profile, "keys", summary.Keys,
+		"unchanged", summary.UnchangedKeys, "skipped", summary.SkippedArtifacts)
+
+	return &summary, nil
+}
+
+// ingestTTL returns the TTL configured for artifacts of artifactType, 0 if
+// they don't expire. A key holding both types ("") gets the shorter TTL of
+// the two that are set.
+func (ed *EndorsementDistributor) ingestTTL(artifactType string) time.Duration {
+	rv, ta := ed.ingestTTLs.ReferenceValues, ed.ingestTTLs.TrustAnchors
+	switch artifactType {
+	case ArtifactTypeReferenceValues:
+		return rv
+	case ArtifactTypeTrustAnchors:
+		return ta
+	}
+
+	if rv == 0 || (ta != 0 && ta < rv) {
+		return ta
+	}
+	return rv
+}
+
+// validateArtifact checks that artifact decodes, as it will be when served in
+// a CoSERV result, as a triple of artifactType, and that the triple is valid
+func validateArtifact(artifactType string, artifact []byte) error {
+	switch artifactType {
+	case ArtifactTypeReferenceValues:
+		var rv comid.ValueTriple
+		if err := cbor.Unmarshal(artifact, &rv); err != nil {
+			return fmt.Errorf("decoding as reference value: %w", err)
+		}
+		return rv.Valid()
+	case ArtifactTypeTrustAnchors:
+		var ak comid.KeyTriple
+		if err := cbor.Unmarshal(artifact, &ak); err != nil {
+			return fmt.Errorf("decoding as trust anchor: %w", err)
+		}
+		return ak.Valid()
+	default:
+		return fmt.Errorf("unknown artifact type %q", artifactType)
+	}
+}
+
+// trustAnchorKey synthesizes the key of a trust anchor for its environment
+// the way generateKeys does for a query: by instance if there is one, else
+// by class
+func trustAnchorKey(scheme, tenantID string, env comid.Environment) (string, error) {
+	switch {
+	case env.Instance != nil:
+		instID, err := extractInstID(*env.Instance)
+		if err != nil {
+			return "", err
+		}
+		return arm.TaCoservLookupKey(scheme, tenantID, instID), nil
+	case env.Class != nil:
+		implID, err := extractImplID(*env.Class)
+		if err != nil {
+			return "", err
+		}
+		return arm.TaCoservLookupKey(scheme, tenantID, implID), nil
+	default:
+		return "", errors.New("no instance or class in environment")
+	}
+}
@@ -0,0 +1,394 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"endorsement-distribution/internal/clock"
+	"endorsement-distribution/internal/config"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/veraison/corim/comid"
+	"github.com/veraison/corim/corim"
+	"github.com/veraison/corim/coserv"
+	"go.uber.org/zap"
+)
+
+// testCorim returns an unsigned CoRIM holding a reference value for the
+// class of comid.TestImplID, with the given security version
+func testCorim(t *testing.T, svn uint64) []byte {
+	t.Helper()
+
+	m, err := comid.NewUintMeasurement(uint64(1))
+	if err != nil {
+		t.Fatalf("NewUintMeasurement: %v", err)
+	}
+	m.SetSVN(svn)
+
+	rv := comid.ValueTriple{
+		Environment:  comid.Environment{Class: comid.NewClassImplID(comid.TestImplID)},
+		Measurements: *comid.NewMeasurements().Add(m),
+	}
+	c := comid.NewComid().SetTagIdentity("test-tag", 0).AddReferenceValue(&rv)
+	if c == nil {
+		t.Fatal("building the test CoMID failed")
+	}
+
+	uc := corim.NewUnsignedCorim().SetID("test-corim").AddComid(c)
+	if uc == nil {
+		t.Fatal("building the test CoRIM failed")
+	}
+
+	data, err := uc.ToCBOR()
+	if err != nil {
+		t.Fatalf("encoding the test CoRIM: %v", err)
+	}
+
+	return data
+}
+
+// invalidArtifactCorim returns an unsigned CoRIM holding a valid reference
+// value for the class of comid.TestImplID and one, for another class, whose
+// digest is too short for its algorithm. The latter decodes as a CoMID but
+// isn't a valid reference value, so the CoMID is encoded without the
+// validation comid.Comid.ToCBOR does.
+func invalidArtifactCorim(t *testing.T) []byte {
+	t.Helper()
+
+	valid, err := comid.NewUintMeasurement(uint64(1))
+	if err != nil {
+		t.Fatalf("NewUintMeasurement: %v", err)
+	}
+	valid.SetSVN(1)
+
+	invalid, err := comid.NewUintMeasurement(uint64(1))
+	if err != nil {
+		t.Fatalf("NewUintMeasurement: %v", err)
+	}
+	invalid.Val = comid.Mval{Digests: &comid.Digests{{HashAlgID: 1, HashValue: []byte{1, 2, 3}}}}
+
+	c := comid.NewComid().SetTagIdentity("test-tag", 0)
+	c.Triples.ReferenceValues = comid.NewValueTriples().
+		Add(&comid.ValueTriple{
+			Environment:  comid.Environment{Class: comid.NewClassImplID(comid.TestImplID)},
+			Measurements: *comid.NewMeasurements().Add(valid),
+		}).
+		Add(&comid.ValueTriple{
+			Environment:  comid.Environment{Class: comid.NewClassImplID(comid.ImplID{1})},
+			Measurements: *comid.NewMeasurements().Add(invalid),
+		})
+
+	tag, err := cbor.Marshal(c)
+	if err != nil {
+		t.Fatalf("encoding the test CoMID: %v", err)
+	}
+
+	uc := corim.NewUnsignedCorim().SetID("test-corim")
+	uc.Tags = append(uc.Tags, append(append([]byte{}, corim.ComidTag...), tag...))
+
+	data, err := uc.ToCBOR()
+	if err != nil {
+		t.Fatalf("encoding the test CoRIM: %v", err)
+	}
+
+	return data
+}
+
+// mixedCorim returns an unsigned CoRIM holding a reference value for the
+// class of comid.TestImplID and a trust anchor for the instance of
+// comid.TestUEID
+func mixedCorim(t *testing.T) []byte {
+	t.Helper()
+
+	instance, err := comid.NewUEIDInstance(comid.TestUEID)
+	if err != nil {
+		t.Fatalf("NewUEIDInstance: %v", err)
+	}
+	key, err := comid.NewPKIXBase64Key(comid.TestECPubKey)
+	if err != nil {
+		t.Fatalf("NewPKIXBase64Key: %v", err)
+	}
+
+	rv := comid.ValueTriple{
+		Environment:  comid.Environment{Class: comid.NewClassImplID(comid.TestImplID)},
+		Measurements: *comid.NewMeasurements().Add(comid.MustNewUintMeasurement(uint64(1)).SetSVN(1)),
+	}
+	ak := comid.KeyTriple{
+		Environment: comid.Environment{Instance: instance},
+		VerifKeys:   comid.CryptoKeys{key},
+	}
+	c := comid.NewComid().SetTagIdentity("test-tag", 0).AddReferenceValue(&rv).AddAttestVerifKey(&ak)
+	if c == nil {
+		t.Fatal("building the test CoMID failed")
+	}
+
+	data, err := corim.NewUnsignedCorim().SetID("test-corim").AddComid(c).ToCBOR()
+	if err != nil {
+		t.Fatalf("encoding the test CoRIM: %v", err)
+	}
+
+	return data
+}
+
+func TestValidateArtifact(t *testing.T) {
+	rv := comid.ValueTriple{
+		Environment:  comid.Environment{Class: comid.NewClassImplID(comid.TestImplID)},
+		Measurements: *comid.NewMeasurements().Add(comid.MustNewUintMeasurement(uint64(1)).SetSVN(1)),
+	}
+	artifact, err := cbor.Marshal(rv)
+	if err != nil {
+		t.Fatalf("cbor.Marshal: %v", err)
+	}
+
+	if err := validateArtifact(ArtifactTypeReferenceValues, artifact); err != nil {
+		t.Errorf("validateArtifact(reference value) = %v, want nil", err)
+	}
+
+	for name, tt := range map[string]struct {
+		artifactType string
+		artifact     []byte
+	}{
+		"not CBOR":           {ArtifactTypeReferenceValues, []byte{0xff, 0x00}},
+		"not a value triple": {ArtifactTypeReferenceValues, []byte{0x01}},
+		"not a key triple":   {ArtifactTypeTrustAnchors, artifact},
+		"unknown type":       {"unknown", artifact},
+	} {
+		if err := validateArtifact(tt.artifactType, tt.artifact); err == nil {
+			t.Errorf("%s: validateArtifact = nil, want an error", name)
+		}
+	}
+}
+
+func TestIngestInvalidArtifact(t *testing.T) {
+	ctx := context.Background()
+	validKeys := queryKeys(t, "acme", refValQuery(t))
+	invalidSelector := coserv.NewEnvironmentSelector().AddClass(*comid.NewClassImplID(comid.ImplID{1}))
+	invalidKeys := queryKeys(t, "acme", encodeQuery(t, testProfile, coserv.ArtifactTypeReferenceValues, invalidSelector))
+
+	for _, policy := range []string{"reject", "skip"} {
+		t.Run(policy, func(t *testing.T) {
+			ms, err := NewMemoryStore(config.DatabaseConfig{})
+			if err != nil {
+				t.Fatalf("NewMemoryStore: %v", err)
+			}
+			ed := NewEndorsementDistributor(ms, config.DistributorConfig{InvalidArtifacts: policy}, zap.NewNop().Sugar())
+
+			if _, err := ed.Ingest(ctx, "acme", testCorim(t, 1), IngestOptions{}); err != nil {
+				t.Fatalf("Ingest(valid CoRIM): %v", err)
+			}
+
+			summary, err := ed.Ingest(ctx, "acme", invalidArtifactCorim(t), IngestOptions{})
+			if policy == "reject" {
+				if !errors.Is(err, ErrMalformedCorim) {
+					t.Fatalf("Ingest = %v, want ErrMalformedCorim", err)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("Ingest: %v", err)
+				}
+				if summary.Keys != 1 || summary.ReferenceValues != 1 || summary.SkippedArtifacts != 1 {
+					t.Errorf("summary = %+v, want 1 reference value stored and 1 skipped", summary)
+				}
+			}
+
+			// The first ingestion's keys still hold what it stored: the
+			// rejected CoRIM wrote nothing, the skipping one rewrote the
+			// same valid reference value
+			for _, key := range validKeys {
+				got, err := ms.Get(ctx, []string{key})
+				if err != nil {
+					t.Fatalf("Get(%s): %v", key, err)
+				}
+				if len(got) != 1 || len(got[0].Artifacts) != 1 {
+					t.Errorf("Get(%s) = %+v, want the one reference value", key, got)
+				}
+			}
+			for _, key := range invalidKeys {
+				if got, err := ms.Get(ctx, []string{key}); err == nil && len(got) > 0 {
+					t.Errorf("Get(%s) = %+v, want the invalid reference value not stored", key, got)
+				}
+			}
+		})
+	}
+}
+
+// writeCountingStore counts the writes that reach it
+type writeCountingStore struct {
+	Store
+	writes int
+}
+
+func (s *writeCountingStore) SetWithProfile(ctx context.Context, key, profile, artifactType string, expiresAt time.Time, artifacts [][]byte) (SetOutcome, error) {
+	outcome, err := s.Store.SetWithProfile(ctx, key, profile, artifactType, expiresAt, artifacts)
+	if outcome == SetUpdated && err == nil {
+		s.writes++
+	}
+	return outcome, err
+}
+
+func TestIngestUnchanged(t *testing.T) {
+	ms, err := NewMemoryStore(config.DatabaseConfig{})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	s := &writeCountingStore{Store: ms}
+	ed := NewEndorsementDistributor(s, config.DistributorConfig{}, zap.NewNop().Sugar())
+	ctx := context.Background()
+
+	tests := []struct {
+		name          string
+		corim         []byte
+		wantStatus    string
+		wantUnchanged int
+		wantWrites    int
+	}{
+		{"first ingestion", testCorim(t, 1), IngestUpdated, 0, 1},
+		{"same again", testCorim(t, 1), IngestUnchanged, 1, 1},
+		{"changed", testCorim(t, 2), IngestUpdated, 0, 2},
+	}
+
+	for _, tt := range tests {
+		summary, err := ed.Ingest(ctx, "acme", tt.corim, IngestOptions{})
+		if err != nil {
+			t.Fatalf("%s: Ingest: %v", tt.name, err)
+		}
+		if summary.Status != tt.wantStatus || summary.UnchangedKeys != tt.wantUnchanged || summary.Keys != 1 {
+			t.Errorf("%s: summary = %+v, want status %s with %d of 1 keys unchanged",
+				tt.name, summary, tt.wantStatus, tt.wantUnchanged)
+		}
+		if s.writes != tt.wantWrites {
+			t.Errorf("%s: %d writes so far, want %d", tt.name, s.writes, tt.wantWrites)
+		}
+	}
+}
+
+func TestIngestTTLs(t *testing.T) {
+	ctx := context.Background()
+	rvKeys := queryKeys(t, "acme", refValQuery(t))
+	taKeys := queryKeys(t, "acme", taQuery(t))
+	ttls := config.IngestTTLConfig{ReferenceValues: time.Hour, TrustAnchors: 24 * time.Hour}
+
+	type check struct {
+		at     time.Duration
+		rv, ta bool
+	}
+	tests := []struct {
+		name   string
+		opts   IngestOptions
+		checks []check
+	}{
+		{"defaults", IngestOptions{}, []check{
+			{time.Hour - time.Second, true, true},
+			{time.Hour, false, true},
+			{24 * time.Hour, false, false},
+		}},
+		{"defaults, create only", IngestOptions{CreateOnly: true}, []check{
+			{time.Hour - time.Second, true, true},
+			{time.Hour, false, true},
+			{24 * time.Hour, false, false},
+		}},
+		{"submitted TTL", IngestOptions{TTL: 2 * time.Hour}, []check{
+			{time.Hour, true, true},
+			{2 * time.Hour, false, false},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+			ms, err := NewMemoryStore(config.DatabaseConfig{})
+			if err != nil {
+				t.Fatalf("NewMemoryStore: %v", err)
+			}
+			ms.WithClock(c)
+			ed := NewEndorsementDistributor(ms, config.DistributorConfig{IngestTTLs: ttls}, zap.NewNop().Sugar()).WithClock(c)
+
+			if _, err := ed.Ingest(ctx, "acme", mixedCorim(t), tt.opts); err != nil {
+				t.Fatalf("Ingest: %v", err)
+			}
+
+			var elapsed time.Duration
+			for _, ch := range tt.checks {
+				c.Advance(ch.at - elapsed)
+				elapsed = ch.at
+
+				for what, want := range map[string]struct {
+					keys   []string
+					served bool
+				}{"reference value": {rvKeys, ch.rv}, "trust anchor": {taKeys, ch.ta}} {
+					served, err := ms.Exists(ctx, want.keys)
+					if err != nil {
+						t.Fatalf("Exists: %v", err)
+					}
+					if served != want.served {
+						t.Errorf("after %v: %s served = %t, want %t", ch.at, what, served, want.served)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestIngestRenewsExpiry(t *testing.T) {
+	ctx := context.Background()
+	c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	ms, err := NewMemoryStore(config.DatabaseConfig{})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	ms.WithClock(c)
+	cfg := config.DistributorConfig{IngestTTLs: config.IngestTTLConfig{ReferenceValues: time.Hour}}
+	ed := NewEndorsementDistributor(ms, cfg, zap.NewNop().Sugar()).WithClock(c)
+	keys := queryKeys(t, "acme", refValQuery(t))
+
+	if _, err := ed.Ingest(ctx, "acme", testCorim(t, 1), IngestOptions{}); err != nil {
+		t.Fatalf("Ingest: %v", err)
+	}
+	c.Advance(time.Hour)
+	if served, err := ms.Exists(ctx, keys); err != nil || served {
+		t.Fatalf("Exists after the TTL = %t, %v, want false", served, err)
+	}
+
+	// The same artifacts again are unchanged, but served for another TTL
+	summary, err := ed.Ingest(ctx, "acme", testCorim(t, 1), IngestOptions{})
+	if err != nil {
+		t.Fatalf("Ingest again: %v", err)
+	}
+	if summary.Status != IngestUnchanged {
+		t.Errorf("status = %q, want %q", summary.Status, IngestUnchanged)
+	}
+	c.Advance(time.Hour - time.Second)
+	if served, err := ms.Exists(ctx, keys); err != nil || !served {
+		t.Errorf("Exists after ingesting again = %t, %v, want true", served, err)
+	}
+}
+
+func TestIngestTTL(t *testing.T) {
+	tests := []struct {
+		rv, ta time.Duration
+		want   time.Duration
+	}{
+		{0, 0, 0},
+		{time.Hour, 0, time.Hour},
+		{0, time.Hour, time.Hour},
+		{time.Hour, 2 * time.Hour, time.Hour},
+		{2 * time.Hour, time.Hour, time.Hour},
+	}
+
+	for _, tt := range tests {
+		cfg := config.DistributorConfig{IngestTTLs: config.IngestTTLConfig{ReferenceValues: tt.rv, TrustAnchors: tt.ta}}
+		ed := NewEndorsementDistributor(nil, cfg, zap.NewNop().Sugar())
+
+		if got := ed.ingestTTL(ArtifactTypeReferenceValues); got != tt.rv {
+			t.Errorf("%v/%v: reference values TTL = %v, want %v", tt.rv, tt.ta, got, tt.rv)
+		}
+		if got := ed.ingestTTL(ArtifactTypeTrustAnchors); got != tt.ta {
+			t.Errorf("%v/%v: trust anchors TTL = %v, want %v", tt.rv, tt.ta, got, tt.ta)
+		}
+		if got := ed.ingestTTL(""); got != tt.want {
+			t.Errorf("%v/%v: TTL of a key holding both = %v, want %v", tt.rv, tt.ta, got, tt.want)
+		}
+	}
+}
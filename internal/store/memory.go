@@ -0,0 +1,551 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"endorsement-distribution/internal/clock"
+	"endorsement-distribution/internal/config"
+)
+
+// MemoryStore implements Store interface using an in-process map
+type MemoryStore struct {
+	mu   sync.RWMutex
+	data map[string][][]byte
+
+	// profiles holds the profile each key was stored with, if any
+	profiles map[string]string
+
+	// expiries holds when the artifacts of each key that expires stop
+	// being served
+	expiries map[string]time.Time
+
+	// index holds the keys of data in sorted order so that prefix scans do
+	// not have to visit the whole map. It is nil unless enabled in config.
+	index *keyIndex
+
+	// snapshotPath is where data is saved on Close and loaded from on
+	// creation; persistence is disabled when empty
+	snapshotPath string
+
+	// maxSetBytes caps the total size of the artifacts passed to Set
+	maxSetBytes int
+
+	// tombstones holds when each recently deleted key was deleted. Keys are
+	// forgotten tombstoneTTL after deletion; none are kept when it is 0.
+	tombstones   map[string]time.Time
+	tombstoneTTL time.Duration
+	clock        clock.Clock
+}
+
+// NewMemoryStore creates a new in-memory store, loading the configured
+// snapshot file if there is one
+func NewMemoryStore(cfg config.DatabaseConfig) (*MemoryStore, error) {
+	s := &MemoryStore{
+		data:         make(map[string][][]byte),
+		profiles:     make(map[string]string),
+		expiries:     make(map[string]time.Time),
+		snapshotPath: cfg.Memory.SnapshotPath,
+		maxSetBytes:  cfg.MaxSetBytes,
+		tombstones:   make(map[string]time.Time),
+		tombstoneTTL: cfg.Memory.TombstoneTTL,
+		clock:        clock.Real{},
+	}
+
+	if cfg.Memory.Index {
+		s.index = &keyIndex{}
+	}
+
+	if s.snapshotPath != "" {
+		if err := s.loadSnapshot(); err != nil {
+			return nil, fmt.Errorf("failed to load snapshot: %w", err)
+		}
+	}
+
+	return s, nil
+}
+
+// WithClock makes the store time tombstones and expiries using c
+func (s *MemoryStore) WithClock(c clock.Clock) *MemoryStore {
+	s.clock = c
+	return s
+}
+
+// Get retrieves the artifacts stored under each of the keys, in the order of
+// keys. Keys with nothing stored, or whose artifacts have expired, are left
+// out; an error is only returned if none of the keys yields any artifact. It is ErrGone if any of them was
+// deleted within the tombstone TTL, ErrNoArtifacts otherwise.
+func (s *MemoryStore) Get(ctx context.Context, keys []string) ([]KeyedArtifacts, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := s.clock.Now()
+
+	var found []KeyedArtifacts
+	for _, key := range keys {
+		if artifacts := s.data[key]; len(artifacts) > 0 && !s.expiredLocked(key, now) {
+			found = append(found, KeyedArtifacts{Key: key, Artifacts: copyArtifacts(artifacts), Profile: s.profiles[key]})
+		}
+	}
+
+	if len(found) == 0 {
+		if s.anyTombstoned(keys) {
+			return nil, fmt.Errorf("%w for keys: %v", ErrGone, keys)
+		}
+		return nil, fmt.Errorf("%w for keys: %v", ErrNoArtifacts, keys)
+	}
+
+	return found, nil
+}
+
+// Set stores artifacts for a given key, without recording a profile
+func (s *MemoryStore) Set(ctx context.Context, key string, artifacts [][]byte) error {
+	_, err := s.SetWithProfile(ctx, key, "", "", time.Time{}, artifacts)
+	return err
+}
+
+// SetWithProfile stores artifacts for a given key, recording the profile
+// they were ingested under ("" if unknown) and when they expire (zero for
+// never). A key already holding the same artifacts under the same profile
+// only has its expiry updated.
+func (s *MemoryStore) SetWithProfile(ctx context.Context, key, profile, artifactType string, expiresAt time.Time, artifacts [][]byte) (SetOutcome, error) {
+	if err := checkArtifactsSize(artifacts, s.maxSetBytes); err != nil {
+		return SetUpdated, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if stored, ok := s.data[key]; ok && s.profiles[key] == profile && sameArtifacts(stored, artifacts) {
+		s.setExpiryLocked(key, expiresAt)
+		return SetUnchanged, nil
+	}
+
+	s.setLocked(key, profile, expiresAt, artifacts)
+
+	return SetUpdated, nil
+}
+
+// SetIfAbsent stores the artifacts of each entry under its key, recording
+// profile and the entry's expiry, unless any of the keys already holds
+// artifacts that haven't expired: then nothing is written and ErrExists is
+// returned
+func (s *MemoryStore) SetIfAbsent(ctx context.Context, profile string, entries []KeyedArtifacts) error {
+	for _, e := range entries {
+		if err := checkArtifactsSize(e.Artifacts, s.maxSetBytes); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+	for _, e := range entries {
+		if _, ok := s.data[e.Key]; ok && !s.expiredLocked(e.Key, now) {
+			return fmt.Errorf("%w under %s", ErrExists, e.Key)
+		}
+	}
+
+	for _, e := range entries {
+		s.setLocked(e.Key, profile, e.ExpiresAt, e.Artifacts)
+	}
+
+	return nil
+}
+
+// Append adds artifact to those stored under key, keeping its profile and
+// expiry
+func (s *MemoryStore) Append(ctx context.Context, key string, artifact []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	artifacts := append(s.data[key], artifact)
+	if err := checkArtifactsSize(artifacts, s.maxSetBytes); err != nil {
+		return err
+	}
+
+	s.setLocked(key, s.profiles[key], s.expiries[key], artifacts)
+
+	return nil
+}
+
+// Exists reports whether any of the keys holds artifacts that haven't
+// expired
+func (s *MemoryStore) Exists(ctx context.Context, keys []string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := s.clock.Now()
+	for _, key := range keys {
+		if len(s.data[key]) > 0 && !s.expiredLocked(key, now) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// setLocked stores artifacts under key; s.mu must be held
+func (s *MemoryStore) setLocked(key, profile string, expiresAt time.Time, artifacts [][]byte) {
+	if _, ok := s.data[key]; !ok && s.index != nil {
+		s.index.insert(key)
+	}
+
+	s.data[key] = copyArtifacts(artifacts)
+	delete(s.tombstones, key)
+	if profile != "" {
+		s.profiles[key] = profile
+	} else {
+		delete(s.profiles, key)
+	}
+	s.setExpiryLocked(key, expiresAt)
+}
+
+// setExpiryLocked records when the artifacts under key expire, zero for
+// never; s.mu must be held
+func (s *MemoryStore) setExpiryLocked(key string, expiresAt time.Time) {
+	if expiresAt.IsZero() {
+		delete(s.expiries, key)
+	} else {
+		s.expiries[key] = expiresAt
+	}
+}
+
+// expiredLocked reports whether the artifacts under key had expired by now.
+// The caller must hold s.mu.
+func (s *MemoryStore) expiredLocked(key string, now time.Time) bool {
+	expiresAt, ok := s.expiries[key]
+	return ok && !now.Before(expiresAt)
+}
+
+// StoredProfile returns the profile the artifacts under key were stored
+// with, or "" if none was recorded
+func (s *MemoryStore) StoredProfile(ctx context.Context, key string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.profiles[key], nil
+}
+
+// Delete removes all artifacts stored under a given key, leaving a tombstone
+// if they are enabled
+func (s *MemoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.data[key]
+	if ok && s.index != nil {
+		s.index.remove(key)
+	}
+
+	if s.tombstoneTTL > 0 {
+		now := s.clock.Now()
+		s.pruneTombstones(now)
+		if ok {
+			s.tombstones[key] = now
+		}
+	}
+
+	delete(s.data, key)
+	delete(s.profiles, key)
+	delete(s.expiries, key)
+
+	return nil
+}
+
+// DeleteByTenant removes every key of tenantID, leaving tombstones if they
+// are enabled, and returns the number of keys removed
+func (s *MemoryStore) DeleteByTenant(ctx context.Context, tenantID string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var now time.Time
+	if s.tombstoneTTL > 0 {
+		now = s.clock.Now()
+		s.pruneTombstones(now)
+	}
+
+	var n int64
+	for key := range s.data {
+		if tenantOf(key) != tenantID {
+			continue
+		}
+
+		if s.index != nil {
+			s.index.remove(key)
+		}
+		if s.tombstoneTTL > 0 {
+			s.tombstones[key] = now
+		}
+		delete(s.data, key)
+		delete(s.profiles, key)
+		delete(s.expiries, key)
+		n++
+	}
+
+	return n, nil
+}
+
+// anyTombstoned reports whether any of keys was deleted within the TTL. The
+// caller must hold s.mu.
+func (s *MemoryStore) anyTombstoned(keys []string) bool {
+	if s.tombstoneTTL <= 0 {
+		return false
+	}
+
+	now := s.clock.Now()
+	for _, key := range keys {
+		if at, ok := s.tombstones[key]; ok && now.Sub(at) < s.tombstoneTTL {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pruneTombstones forgets the keys deleted more than the TTL ago. The caller
+// must hold s.mu for writing.
+func (s *MemoryStore) pruneTombstones(now time.Time) {
+	for key, at := range s.tombstones {
+		if now.Sub(at) >= s.tombstoneTTL {
+			delete(s.tombstones, key)
+		}
+	}
+}
+
+// ListKeys returns, in lexical order, all the keys that start with prefix
+func (s *MemoryStore) ListKeys(prefix string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.index != nil {
+		return s.index.withPrefix(prefix), nil
+	}
+
+	var keys []string
+	for key := range s.data {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// IterateKeys calls fn, in lexical order, for every key that starts with
+// prefix. Iteration stops at the first error returned by fn, which is passed
+// back, or when ctx is cancelled.
+func (s *MemoryStore) IterateKeys(ctx context.Context, prefix string, fn func(key string) error) error {
+	keys, err := s.ListKeys(prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Ping always succeeds: there is nothing to reach
+func (s *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Count returns the number of keys stored
+func (s *MemoryStore) Count(ctx context.Context) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return int64(len(s.data)), nil
+}
+
+// CountByTenant returns the number of keys stored for each tenant
+func (s *MemoryStore) CountByTenant(ctx context.Context) (map[string]int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	counts := make(map[string]int64)
+	for key := range s.data {
+		counts[tenantOf(key)]++
+	}
+
+	return counts, nil
+}
+
+// Close saves the store contents to the snapshot file, if one is configured
+func (s *MemoryStore) Close() error {
+	if s.snapshotPath == "" {
+		return nil
+	}
+
+	if err := s.saveSnapshot(); err != nil {
+		return fmt.Errorf("failed to save snapshot: %w", err)
+	}
+
+	return nil
+}
+
+// loadSnapshot populates the store from the snapshot file. A missing file is
+// not an error: it is what a first start looks like.
+func (s *MemoryStore) loadSnapshot() error {
+	data, err := os.ReadFile(s.snapshotPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	var snapshot memorySnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("failed to unmarshal snapshot %s: %w", s.snapshotPath, err)
+	}
+
+	// Snapshots taken before profiles were recorded are a bare map of the
+	// artifacts
+	if snapshot.Artifacts == nil {
+		if err := json.Unmarshal(data, &snapshot.Artifacts); err != nil {
+			return fmt.Errorf("failed to unmarshal snapshot %s: %w", s.snapshotPath, err)
+		}
+	}
+
+	// Loaded as-is: the Set size limit applies to new writes, and may have
+	// been lowered since the snapshot was taken
+	for key, artifacts := range snapshot.Artifacts {
+		s.data[key] = artifacts
+		if profile := snapshot.Profiles[key]; profile != "" {
+			s.profiles[key] = profile
+		}
+		if expiresAt, ok := snapshot.Expiries[key]; ok {
+			s.expiries[key] = expiresAt
+		}
+		if s.index != nil {
+			s.index.insert(key)
+		}
+	}
+
+	return nil
+}
+
+// memorySnapshot is the layout of the snapshot file
+type memorySnapshot struct {
+	Artifacts map[string][][]byte  `json:"artifacts"`
+	Profiles  map[string]string    `json:"profiles,omitempty"`
+	Expiries  map[string]time.Time `json:"expiries,omitempty"`
+}
+
+// saveSnapshot writes the store contents to the snapshot file. The file is
+// written next to its final location and renamed into place, so a crash
+// mid-write leaves the previous snapshot intact.
+func (s *MemoryStore) saveSnapshot() error {
+	s.mu.RLock()
+	data, err := json.Marshal(memorySnapshot{Artifacts: s.data, Profiles: s.profiles, Expiries: s.expiries})
+	s.mu.RUnlock()
+	if err != nil {
+		return fmt.Errorf("failed to marshal snapshot: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.snapshotPath), filepath.Base(s.snapshotPath)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	// Flush the data to disk before renaming, lest a crash leave the new
+	// name pointing at a file that was never written out
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), s.snapshotPath); err != nil {
+		return err
+	}
+
+	// And the rename itself, recorded in the directory
+	dir, err := os.Open(filepath.Dir(s.snapshotPath))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+func copyArtifacts(artifacts [][]byte) [][]byte {
+	out := make([][]byte, len(artifacts))
+	for i, artifact := range artifacts {
+		out[i] = append([]byte(nil), artifact...)
+	}
+	return out
+}
+
+// keyIndex is a sorted set of keys. Lookups and prefix scans are a binary
+// search away; inserts and removals shift the tail of the slice, which is
+// cheap compared to a full map scan for the key counts we deal with. It is
+// not safe for concurrent use on its own: MemoryStore guards it with its lock.
+type keyIndex struct {
+	keys []string
+}
+
+func (o *keyIndex) insert(key string) {
+	i := sort.SearchStrings(o.keys, key)
+	if i < len(o.keys) && o.keys[i] == key {
+		return
+	}
+
+	o.keys = append(o.keys, "")
+	copy(o.keys[i+1:], o.keys[i:])
+	o.keys[i] = key
+}
+
+func (o *keyIndex) remove(key string) {
+	i := sort.SearchStrings(o.keys, key)
+	if i == len(o.keys) || o.keys[i] != key {
+		return
+	}
+
+	o.keys = append(o.keys[:i], o.keys[i+1:]...)
+}
+
+func (o *keyIndex) withPrefix(prefix string) []string {
+	start := sort.SearchStrings(o.keys, prefix)
+
+	end := start
+	for end < len(o.keys) && strings.HasPrefix(o.keys[end], prefix) {
+		end++
+	}
+
+	if start == end {
+		return nil
+	}
+
+	return append([]string(nil), o.keys[start:end]...)
+}
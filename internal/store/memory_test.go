@@ -0,0 +1,464 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"endorsement-distribution/internal/clock"
+	"endorsement-distribution/internal/config"
+)
+
+// newIndexedStores returns two memory stores holding the same keys, with
+// and without the key index
+func newIndexedStores(t testing.TB, keys []string) map[string]*MemoryStore {
+	t.Helper()
+
+	stores := make(map[string]*MemoryStore)
+	for name, index := range map[string]bool{"index": true, "no index": false} {
+		ms, err := NewMemoryStore(config.DatabaseConfig{Memory: config.MemoryConfig{Index: index}})
+		if err != nil {
+			t.Fatalf("NewMemoryStore: %v", err)
+		}
+		for _, key := range keys {
+			if err := ms.Set(context.Background(), key, [][]byte{[]byte("a")}); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+		}
+		stores[name] = ms
+	}
+
+	return stores
+}
+
+func TestListKeys(t *testing.T) {
+	keys := []string{"b://acme/2", "a://acme/1", "b://acme/1", "b://other/1", "b://acme"}
+
+	for name, ms := range newIndexedStores(t, keys) {
+		t.Run(name, func(t *testing.T) {
+			if err := ms.Delete("b://acme/2"); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+
+			for prefix, want := range map[string][]string{
+				"b://acme": {"b://acme", "b://acme/1"},
+				"b://":     {"b://acme", "b://acme/1", "b://other/1"},
+				"":         {"a://acme/1", "b://acme", "b://acme/1", "b://other/1"},
+				"c://":     nil,
+			} {
+				got, err := ms.ListKeys(prefix)
+				if err != nil {
+					t.Fatalf("ListKeys(%q): %v", prefix, err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("ListKeys(%q) = %v, want %v", prefix, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMemorySnapshotRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	cfg := config.DatabaseConfig{Memory: config.MemoryConfig{SnapshotPath: path, Index: true}}
+	ctx := context.Background()
+
+	ms, err := NewMemoryStore(cfg)
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	if _, err := ms.SetWithProfile(ctx, "a://acme/1", testProfile, ArtifactTypeReferenceValues, time.Time{}, [][]byte{[]byte("a"), []byte("b")}); err != nil {
+		t.Fatalf("SetWithProfile: %v", err)
+	}
+	if err := ms.Set(ctx, "a://acme/2", [][]byte{[]byte("c")}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	expired := time.Now().Add(-time.Hour)
+	if _, err := ms.SetWithProfile(ctx, "a://acme/3", testProfile, ArtifactTypeReferenceValues, expired, [][]byte{[]byte("d")}); err != nil {
+		t.Fatalf("SetWithProfile: %v", err)
+	}
+	if err := ms.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Only the snapshot is left behind, not the temporary file
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("snapshot directory holds %d files, want 1", len(entries))
+	}
+
+	loaded, err := NewMemoryStore(cfg)
+	if err != nil {
+		t.Fatalf("NewMemoryStore from the snapshot: %v", err)
+	}
+
+	// The expired key stays expired
+	found, err := loaded.Get(ctx, []string{"a://acme/1", "a://acme/2", "a://acme/3"})
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	want := []KeyedArtifacts{
+		{Key: "a://acme/1", Artifacts: [][]byte{[]byte("a"), []byte("b")}, Profile: testProfile},
+		{Key: "a://acme/2", Artifacts: [][]byte{[]byte("c")}},
+	}
+	if !reflect.DeepEqual(found, want) {
+		t.Errorf("Get after reload = %+v, want %+v", found, want)
+	}
+
+	if keys, _ := loaded.ListKeys("a://"); len(keys) != 3 {
+		t.Errorf("index after reload holds %v, want the 3 keys", keys)
+	}
+}
+
+func TestMemorySnapshotLegacyFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := os.WriteFile(path, []byte(`{"a://acme/1": ["YQ=="]}`), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	ms, err := NewMemoryStore(config.DatabaseConfig{Memory: config.MemoryConfig{SnapshotPath: path}})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+
+	found, err := ms.Get(context.Background(), []string{"a://acme/1"})
+	if err != nil || string(found[0].Artifacts[0]) != "a" {
+		t.Errorf("Get = %+v, %v, want the artifact of the bare map", found, err)
+	}
+}
+
+func BenchmarkPrefixScan(b *testing.B) {
+	// Many tenants of a few keys each: a prefix matches a sliver of them
+	var keys []string
+	for tenant := 0; tenant < 1000; tenant++ {
+		for i := 0; i < 10; i++ {
+			keys = append(keys, fmt.Sprintf("ARM_CCA://tenant-%04d/%d", tenant, i))
+		}
+	}
+
+	for name, ms := range newIndexedStores(b, keys) {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := ms.ListKeys("ARM_CCA://tenant-0500/"); err != nil {
+					b.Fatalf("ListKeys: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestTombstoneExpiry(t *testing.T) {
+	ms, err := NewMemoryStore(config.DatabaseConfig{Memory: config.MemoryConfig{TombstoneTTL: time.Minute}})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	ms.WithClock(c)
+
+	ctx := context.Background()
+	const key = "ARM_CCA://acme/1"
+	if err := ms.Set(ctx, key, [][]byte{[]byte("a")}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := ms.Delete(key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	for _, step := range []struct {
+		advance time.Duration
+		want    error
+	}{
+		{0, ErrGone},
+		{59 * time.Second, ErrGone},
+		{time.Second, ErrNoArtifacts},
+	} {
+		c.Advance(step.advance)
+		if _, err := ms.Get(ctx, []string{key}); !errors.Is(err, step.want) {
+			t.Errorf("Get %v more after the delete = %v, want %v", step.advance, err, step.want)
+		}
+	}
+}
+
+func TestMemoryStoreSetSizeLimit(t *testing.T) {
+	ms, err := NewMemoryStore(config.DatabaseConfig{MaxSetBytes: 10})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	ctx := context.Background()
+
+	if err := ms.Set(ctx, "ARM_CCA://acme/1", [][]byte{[]byte("12345"), []byte("67890")}); err != nil {
+		t.Fatalf("Set at the limit: %v", err)
+	}
+
+	if err := ms.Set(ctx, "ARM_CCA://acme/2", [][]byte{[]byte("12345"), []byte("678901")}); !errors.Is(err, ErrArtifactsTooLarge) {
+		t.Errorf("Set of 11 bytes = %v, want ErrArtifactsTooLarge", err)
+	}
+	if err := ms.Append(ctx, "ARM_CCA://acme/1", []byte("x")); !errors.Is(err, ErrArtifactsTooLarge) {
+		t.Errorf("Append past the limit = %v, want ErrArtifactsTooLarge", err)
+	}
+	err = ms.SetIfAbsent(ctx, "", []KeyedArtifacts{
+		{Key: "ARM_CCA://acme/3", Artifacts: [][]byte{[]byte("small")}},
+		{Key: "ARM_CCA://acme/4", Artifacts: [][]byte{[]byte("much too large")}},
+	})
+	if !errors.Is(err, ErrArtifactsTooLarge) {
+		t.Errorf("SetIfAbsent past the limit = %v, want ErrArtifactsTooLarge", err)
+	}
+
+	// Nothing rejected was written, in part or whole
+	for key, want := range map[string]int{"ARM_CCA://acme/1": 2, "ARM_CCA://acme/2": 0, "ARM_CCA://acme/3": 0} {
+		got, _ := ms.Get(ctx, []string{key})
+		n := 0
+		if len(got) > 0 {
+			n = len(got[0].Artifacts)
+		}
+		if n != want {
+			t.Errorf("%s holds %d artifacts, want %d", key, n, want)
+		}
+	}
+}
+
+// testAppendSizeLimit checks that s, created with a MaxSetBytes of 10,
+// applies the limit to the artifacts of a key once appended to, not to each
+// appended artifact alone
+func testAppendSizeLimit(t *testing.T, s Store) {
+	t.Helper()
+
+	ctx := context.Background()
+	const key = "ARM_CCA://acme/append"
+
+	for _, artifact := range []string{"1234", "5678"} {
+		if err := s.Append(ctx, key, []byte(artifact)); err != nil {
+			t.Fatalf("Append within the limit: %v", err)
+		}
+	}
+	if err := s.Append(ctx, key, []byte("abc")); !errors.Is(err, ErrArtifactsTooLarge) {
+		t.Errorf("Append to 11 bytes = %v, want ErrArtifactsTooLarge", err)
+	}
+	if err := s.Append(ctx, key, []byte("ab")); err != nil {
+		t.Errorf("Append up to the limit: %v", err)
+	}
+
+	found, err := s.Get(ctx, []string{key})
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if want := [][]byte{[]byte("1234"), []byte("5678"), []byte("ab")}; len(found) != 1 || !sameArtifacts(found[0].Artifacts, want) {
+		t.Errorf("Get = %q, want %q: the rejected artifact left out", found, want)
+	}
+}
+
+func TestMemoryStoreAppendSizeLimit(t *testing.T) {
+	ms, err := NewMemoryStore(config.DatabaseConfig{MaxSetBytes: 10})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+
+	testAppendSizeLimit(t, ms)
+}
+
+// testExpiry checks that s stops serving the artifacts of a key once they
+// expire, that an appended artifact expires with them, that SetIfAbsent
+// replaces them, and that writing the same artifacts again still updates
+// their expiry
+func testExpiry(t *testing.T, s Store) {
+	t.Helper()
+
+	ctx := context.Background()
+	const key = "ARM_CCA://acme/expiring"
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	artifacts := [][]byte{[]byte("c")}
+
+	served := func(what string, want bool) {
+		t.Helper()
+
+		got, err := s.Exists(ctx, []string{key})
+		if err != nil {
+			t.Fatalf("%s: Exists: %v", what, err)
+		}
+		if got != want {
+			t.Errorf("%s: Exists = %t, want %t", what, got, want)
+		}
+
+		_, err = s.Get(ctx, []string{key})
+		if want && err != nil {
+			t.Errorf("%s: Get: %v", what, err)
+		} else if !want && !errors.Is(err, ErrNoArtifacts) {
+			t.Errorf("%s: Get = %v, want ErrNoArtifacts", what, err)
+		}
+	}
+
+	if _, err := s.SetWithProfile(ctx, key, testProfile, ArtifactTypeReferenceValues, past, [][]byte{[]byte("a")}); err != nil {
+		t.Fatalf("SetWithProfile: %v", err)
+	}
+	served("expired", false)
+
+	if err := s.Append(ctx, key, []byte("b")); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	served("appended to once expired", false)
+
+	entries := []KeyedArtifacts{{Key: key, Artifacts: artifacts, ArtifactType: ArtifactTypeReferenceValues, ExpiresAt: future}}
+	if err := s.SetIfAbsent(ctx, testProfile, entries); err != nil {
+		t.Fatalf("SetIfAbsent over expired artifacts: %v", err)
+	}
+	served("replaced", true)
+	if err := s.SetIfAbsent(ctx, testProfile, entries); !errors.Is(err, ErrExists) {
+		t.Errorf("SetIfAbsent over artifacts yet to expire = %v, want ErrExists", err)
+	}
+
+	for _, tt := range []struct {
+		what      string
+		expiresAt time.Time
+		want      bool
+	}{
+		{"the same, expired", past, false},
+		{"the same, never expiring", time.Time{}, true},
+	} {
+		outcome, err := s.SetWithProfile(ctx, key, testProfile, ArtifactTypeReferenceValues, tt.expiresAt, artifacts)
+		if err != nil || outcome != SetUnchanged {
+			t.Fatalf("%s: SetWithProfile = %v, %v, want SetUnchanged", tt.what, outcome, err)
+		}
+		served(tt.what, tt.want)
+	}
+}
+
+func TestMemoryStoreExpiry(t *testing.T) {
+	ms, err := NewMemoryStore(config.DatabaseConfig{})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+
+	testExpiry(t, ms)
+}
+
+func TestMemoryStoreIterateKeys(t *testing.T) {
+	ms, err := NewMemoryStore(config.DatabaseConfig{})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	ctx := context.Background()
+	for _, key := range []string{"ARM_CCA://acme/2", "ARM_CCA://acme/1", "ARM_CCA://other/1", "ARM_CCA://acme/3"} {
+		if err := ms.Set(ctx, key, [][]byte{[]byte("a")}); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+
+	var visited []string
+	if err := ms.IterateKeys(ctx, "ARM_CCA://acme/", func(key string) error {
+		visited = append(visited, key)
+		return nil
+	}); err != nil {
+		t.Fatalf("IterateKeys: %v", err)
+	}
+	if want := []string{"ARM_CCA://acme/1", "ARM_CCA://acme/2", "ARM_CCA://acme/3"}; !slices.Equal(visited, want) {
+		t.Errorf("visited %q, want %q", visited, want)
+	}
+
+	// An error from the callback stops the iteration and is passed back
+	stop := errors.New("stop")
+	visited = nil
+	if err := ms.IterateKeys(ctx, "", func(key string) error {
+		visited = append(visited, key)
+		if len(visited) == 2 {
+			return stop
+		}
+		return nil
+	}); !errors.Is(err, stop) {
+		t.Errorf("IterateKeys = %v, want the callback's error", err)
+	}
+	if len(visited) != 2 {
+		t.Errorf("visited %d keys, want iteration to stop at the second", len(visited))
+	}
+
+	// So does cancellation
+	cancelCtx, cancel := context.WithCancel(ctx)
+	visited = nil
+	if err := ms.IterateKeys(cancelCtx, "", func(key string) error {
+		visited = append(visited, key)
+		cancel()
+		return nil
+	}); !errors.Is(err, context.Canceled) {
+		t.Errorf("IterateKeys = %v, want context.Canceled", err)
+	}
+	if len(visited) != 1 {
+		t.Errorf("visited %d keys, want iteration to stop once cancelled", len(visited))
+	}
+}
+
+func TestMemoryStoreAppend(t *testing.T) {
+	ms, err := NewMemoryStore(config.DatabaseConfig{})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	ctx := context.Background()
+	const key = "ARM_CCA://acme/1"
+
+	if err := ms.Append(ctx, key, []byte("a")); err != nil {
+		t.Fatalf("Append to a new key: %v", err)
+	}
+	if _, err := ms.SetWithProfile(ctx, key, testProfile, ArtifactTypeReferenceValues, time.Time{}, [][]byte{[]byte("a"), []byte("b")}); err != nil {
+		t.Fatalf("SetWithProfile: %v", err)
+	}
+	if err := ms.Append(ctx, key, []byte("c")); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	found, err := ms.Get(ctx, []string{key})
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got := string(bytes.Join(found[0].Artifacts, nil)); got != "abc" {
+		t.Errorf("artifacts after Append = %q, want the stored ones followed by the appended one", got)
+	}
+	if found[0].Profile != testProfile {
+		t.Errorf("profile after Append = %q, want %q kept", found[0].Profile, testProfile)
+	}
+}
+
+func TestMemoryStoreExists(t *testing.T) {
+	ms, err := NewMemoryStore(config.DatabaseConfig{})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	ctx := context.Background()
+	for _, key := range []string{"ARM_CCA://acme/1", "ARM_CCA://acme/3"} {
+		if err := ms.Set(ctx, key, [][]byte{[]byte("a")}); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	if err := ms.Delete("ARM_CCA://acme/3"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		keys []string
+		want bool
+	}{
+		{"stored", []string{"ARM_CCA://acme/1"}, true},
+		{"one of several stored", []string{"ARM_CCA://acme/2", "ARM_CCA://acme/1"}, true},
+		{"not stored", []string{"ARM_CCA://acme/2"}, false},
+		{"deleted", []string{"ARM_CCA://acme/3"}, false},
+		{"no keys", nil, false},
+	}
+
+	for _, tt := range tests {
+		got, err := ms.Exists(ctx, tt.keys)
+		if err != nil {
+			t.Fatalf("%s: Exists: %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: Exists = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package store
+
+import (
+	"context"
+	"fmt"
+)
+
+// migration is one step of the endorsements schema. Steps are applied in
+// order and recorded in schema_migrations, so each runs once per database.
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// migrations is the history of the schema. Append new steps at the end and
+// never edit applied ones. The early steps keep their IF NOT EXISTS guards
+// so that they also apply cleanly to databases set up before migrations were
+// recorded.
+var migrations = []migration{
+	{1, "create endorsements", `
+		CREATE TABLE IF NOT EXISTS endorsements (
+			kv_key text NOT NULL,
+			kv_val text NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_endorsements_key ON endorsements(kv_key);
+	`},
+	{2, "record the ingestion profile", `
+		ALTER TABLE endorsements ADD COLUMN IF NOT EXISTS kv_profile text;
+	`},
+	{3, "order the rows of a key", `
+		ALTER TABLE endorsements ADD COLUMN IF NOT EXISTS kv_seq bigserial;
+	`},
+	{4, "record tenant and artifact type", `
+		ALTER TABLE endorsements ADD COLUMN tenant_id text;
+		ALTER TABLE endorsements ADD COLUMN artifact_type text;
+		UPDATE endorsements SET tenant_id = split_part(split_part(kv_key, '://', 2), '/', 1);
+		CREATE INDEX idx_endorsements_tenant ON endorsements(tenant_id);
+		CREATE INDEX idx_endorsements_artifact_type ON endorsements(artifact_type);
+	`},
+	{5, "record when artifacts expire", `
+		ALTER TABLE endorsements ADD COLUMN expires_at timestamptz;
+	`},
+}
+
+// migrationLock is the advisory lock held while migrating, so that instances
+// starting together don't apply the same step twice
+const migrationLock = 0x656e646f7273 // "endors"
+
+// migrate brings the schema up to date, applying the pending migrations in
+// a single transaction: either all of them are applied or none is
+func (s *PostgresStore) migrate(ctx context.Context) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", migrationLock); err != nil {
+		return fmt.Errorf("failed to lock schema: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version integer PRIMARY KEY,
+			name text NOT NULL,
+			applied_at timestamptz NOT NULL DEFAULT now()
+		)`)
+	if err != nil {
+		return fmt.Errorf("failed to create migrations table: %w", err)
+	}
+
+	var current int
+	if err := tx.QueryRow(ctx, "SELECT coalesce(max(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		if _, err := tx.Exec(ctx, m.sql); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+
+		if _, err := tx.Exec(ctx,
+			"INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.version, m.name); err != nil {
+			return fmt.Errorf("failed to record migration %d: %w", m.version, err)
+		}
+
+		s.logger.Infow("Applied schema migration", "version", m.version, "name", m.name)
+	}
+
+	return tx.Commit(ctx)
+}
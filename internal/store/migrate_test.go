@@ -0,0 +1,96 @@
+package store
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Applying migrations needs a database, but their numbering can be checked
+// without one: recorded versions must keep meaning the same step
+func TestMigrationsNumbered(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("migration %d (%q) has version %d, want versions to count up from 1", i, m.name, m.version)
+		}
+		if m.name == "" || strings.TrimSpace(m.sql) == "" {
+			t.Errorf("migration %d has name %q and %d bytes of SQL, want both", m.version, m.name, len(strings.TrimSpace(m.sql)))
+		}
+	}
+}
+
+// schemaState is what migrations leave behind: the steps recorded, and the
+// columns and indexes of the endorsements table
+type schemaState struct {
+	versions []int
+	columns  []string
+	indexes  []string
+}
+
+// readSchemaState reads the schemaState of the database s is connected to
+func readSchemaState(t *testing.T, s *PostgresStore) schemaState {
+	t.Helper()
+
+	ctx := context.Background()
+	query := func(sql string) []string {
+		rows, err := s.pool.Query(ctx, sql)
+		if err != nil {
+			t.Fatalf("querying schema: %v", err)
+		}
+		out, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			t.Fatalf("reading schema: %v", err)
+		}
+		return out
+	}
+
+	rows, err := s.pool.Query(ctx, "SELECT version FROM schema_migrations ORDER BY version")
+	if err != nil {
+		t.Fatalf("querying migrations: %v", err)
+	}
+	versions, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		t.Fatalf("reading migrations: %v", err)
+	}
+
+	return schemaState{
+		versions: versions,
+		columns: query(`
+			SELECT column_name || ' ' || data_type || ' ' || is_nullable FROM information_schema.columns
+			WHERE table_schema = current_schema() AND table_name = 'endorsements'
+			ORDER BY ordinal_position`),
+		indexes: query(`
+			SELECT indexdef FROM pg_indexes
+			WHERE schemaname = current_schema() AND tablename = 'endorsements'
+			ORDER BY indexname`),
+	}
+}
+
+func TestMigrateTwice(t *testing.T) {
+	// Creating the store applies every migration
+	s := newPostgresTestStore(t, nil)
+	first := readSchemaState(t, s)
+
+	if len(first.versions) != len(migrations) || first.versions[len(first.versions)-1] != len(migrations) {
+		t.Fatalf("versions %v recorded, want the %d migrations", first.versions, len(migrations))
+	}
+
+	if err := s.Set(context.Background(), "ARM_CCA://acme/1", [][]byte{[]byte("a")}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	// As does every later start: by then there is nothing left to apply
+	if err := s.migrate(context.Background()); err != nil {
+		t.Fatalf("second migrate: %v", err)
+	}
+	if second := readSchemaState(t, s); !reflect.DeepEqual(second, first) {
+		t.Errorf("schema after a second migrate = %+v, want it unchanged from %+v", second, first)
+	}
+
+	if found, err := s.Get(context.Background(), []string{"ARM_CCA://acme/1"}); err != nil || len(found) != 1 {
+		t.Errorf("Get after a second migrate = %v, %v; want the stored key kept", found, err)
+	}
+}
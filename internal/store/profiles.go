@@ -0,0 +1,139 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"endorsement-distribution/internal/clock"
+	"endorsement-distribution/internal/config"
+
+	"go.uber.org/zap"
+)
+
+// maxProfileListBytes caps the size of a fetched profile list
+const maxProfileListBytes = 1 << 20
+
+// ProfileRefresher periodically fetches the supported profiles from a remote
+// source and swaps them into a distributor. A failed fetch leaves the last
+// list in place, so the service carries on with the list last fetched, or the
+// configured one until a fetch succeeds. The ETag of the last list is sent
+// back, so that an unchanged list costs a 304 rather than a download.
+type ProfileRefresher struct {
+	ed       *EndorsementDistributor
+	url      string
+	interval time.Duration
+	client   *http.Client
+	clock    clock.Clock
+	logger   *zap.SugaredLogger
+
+	// etag is that of the last list fetched
+	mu   sync.Mutex
+	etag string
+}
+
+// NewProfileRefresher creates a refresher of the supported profiles of ed
+// from the source cfg describes
+func NewProfileRefresher(ed *EndorsementDistributor, cfg config.ProfileSourceConfig, logger *zap.SugaredLogger) *ProfileRefresher {
+	r := &ProfileRefresher{
+		ed:       ed,
+		url:      cfg.URL,
+		interval: cfg.RefreshInterval,
+		client:   &http.Client{Timeout: cfg.Timeout},
+		clock:    clock.Real{},
+		logger:   logger,
+	}
+
+	if u, err := url.Parse(cfg.URL); err == nil {
+		r.logger = logger.With("url", u.Redacted())
+	}
+
+	if r.interval <= 0 {
+		r.interval = 5 * time.Minute
+	}
+
+	return r
+}
+
+// WithClock makes the refresher schedule its fetches using c
+func (r *ProfileRefresher) WithClock(c clock.Clock) *ProfileRefresher {
+	r.clock = c
+	return r
+}
+
+// Run fetches the list right away, then every interval until ctx is
+// cancelled
+func (r *ProfileRefresher) Run(ctx context.Context) {
+	for {
+		if err := r.Refresh(ctx); err != nil && ctx.Err() == nil {
+			r.logger.Warnw("Failed to refresh supported profiles, keeping the last list",
+				"error", err, "profiles", r.ed.SupportedProfiles())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.clock.After(r.interval):
+		}
+	}
+}
+
+// Refresh fetches the list once and, if it is usable, makes it the
+// distributor's supported profiles. A list that is empty, which would let any
+// profile through, or leaves out the default profile is refused.
+func (r *ProfileRefresher) Refresh(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if r.etag != "" {
+		req.Header.Set("If-None-Match", r.etag)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetching supported profiles: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil
+	default:
+		return fmt.Errorf("fetching supported profiles: %s", resp.Status)
+	}
+
+	var profiles []string
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxProfileListBytes)).Decode(&profiles); err != nil {
+		return fmt.Errorf("decoding supported profiles: %w", err)
+	}
+
+	switch {
+	case len(profiles) == 0:
+		return errors.New("no supported profiles listed")
+	case slices.Contains(profiles, ""):
+		return errors.New("empty profile listed")
+	case r.ed.defaultProfile != "" && !slices.Contains(profiles, r.ed.defaultProfile):
+		return fmt.Errorf("default profile %q isn't listed", r.ed.defaultProfile)
+	}
+
+	if !slices.Equal(profiles, r.ed.SupportedProfiles()) {
+		r.logger.Infow("Supported profiles updated", "profiles", profiles)
+	}
+	r.ed.SetSupportedProfiles(profiles)
+	r.etag = resp.Header.Get("ETag")
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"endorsement-distribution/internal/config"
+
+	"go.uber.org/zap"
+)
+
+// profileSource serves a profile list the test can change, with an ETag
+// derived from its version
+type profileSource struct {
+	mu          sync.Mutex
+	body        string
+	status      int
+	version     int
+	notModified int
+}
+
+func (s *profileSource) set(status int, body string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.status, s.body = status, body
+	s.version++
+}
+
+func (s *profileSource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	etag := strconv.Quote("v" + strconv.Itoa(s.version))
+	if s.status == http.StatusOK && r.Header.Get("If-None-Match") == etag {
+		s.notModified++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(s.status)
+	w.Write([]byte(s.body))
+}
+
+func TestProfileRefresher(t *testing.T) {
+	const other = "tag:example.com,2024:other"
+
+	src := &profileSource{}
+	server := httptest.NewServer(src)
+	defer server.Close()
+
+	ed := NewEndorsementDistributor(nil, config.DistributorConfig{
+		DefaultProfile:    testProfile,
+		SupportedProfiles: []string{testProfile},
+	}, zap.NewNop().Sugar())
+	r := NewProfileRefresher(ed, config.ProfileSourceConfig{
+		URL:             server.URL,
+		RefreshInterval: time.Minute,
+		Timeout:         time.Second,
+	}, zap.NewNop().Sugar())
+
+	list := func(profiles ...string) string {
+		data, err := json.Marshal(profiles)
+		if err != nil {
+			t.Fatalf("json.Marshal: %v", err)
+		}
+		return string(data)
+	}
+
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		wantErr bool
+		want    []string
+	}{
+		{"fetched", http.StatusOK, list(testProfile, other), false, []string{testProfile, other}},
+		{"changed", http.StatusOK, list(testProfile), false, []string{testProfile}},
+		{"server error keeps the last list", http.StatusInternalServerError, "", true, []string{testProfile}},
+		{"not JSON keeps the last list", http.StatusOK, "<html>", true, []string{testProfile}},
+		{"empty list refused", http.StatusOK, list(), true, []string{testProfile}},
+		{"default profile left out refused", http.StatusOK, list(other), true, []string{testProfile}},
+		{"recovered", http.StatusOK, list(other, testProfile), false, []string{other, testProfile}},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		src.set(tt.status, tt.body)
+
+		err := r.Refresh(ctx)
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("%s: Refresh = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if got := ed.SupportedProfiles(); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: supported profiles = %v, want %v", tt.name, got, tt.want)
+		}
+		if got := ed.Capabilities().SupportedProfiles; !slices.Equal(got, tt.want) {
+			t.Errorf("%s: capabilities list %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// The list hasn't changed since: it isn't downloaded again
+	if err := r.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh of the unchanged list: %v", err)
+	}
+	if src.notModified != 1 {
+		t.Errorf("%d not-modified answers, want the unchanged list revalidated by its ETag", src.notModified)
+	}
+	if got := ed.SupportedProfiles(); !slices.Equal(got, []string{other, testProfile}) {
+		t.Errorf("supported profiles after revalidation = %v, want them unchanged", got)
+	}
+}
+
+func TestSupportedProfilesCopied(t *testing.T) {
+	profiles := []string{testProfile}
+	ed := NewEndorsementDistributor(nil, config.DistributorConfig{SupportedProfiles: profiles}, zap.NewNop().Sugar())
+
+	profiles[0] = "tag:example.com,2024:changed"
+	if got := ed.SupportedProfiles(); !slices.Equal(got, []string{testProfile}) {
+		t.Errorf("supported profiles = %v, want them unaffected by the caller's slice", got)
+	}
+}
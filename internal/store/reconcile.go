@@ -0,0 +1,277 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"endorsement-distribution/internal/clock"
+	"endorsement-distribution/internal/config"
+
+	"go.uber.org/zap"
+)
+
+// Reconciler periodically scans the endorsements table for rows whose value
+// can't be decoded, so that damaged data (e.g. written by an older, buggy
+// encoder) is noticed before a client trips over it
+type Reconciler struct {
+	store       *PostgresStore
+	interval    time.Duration
+	batchSize   int
+	batchDelay  time.Duration
+	parallelism int
+	clock       clock.Clock
+	logger      *zap.SugaredLogger
+
+	// malformed is the number of rows flagged by the last completed scan
+	malformed atomic.Int64
+
+	// resumed is closed by Resume; it is nil while the reconciler runs
+	mu      sync.Mutex
+	resumed chan struct{}
+}
+
+// NewReconciler creates a new reconciler for the given store
+func NewReconciler(store *PostgresStore, cfg config.ReconcilerConfig, logger *zap.SugaredLogger) *Reconciler {
+	r := &Reconciler{
+		store:       store,
+		interval:    cfg.Interval,
+		batchSize:   cfg.BatchSize,
+		batchDelay:  cfg.BatchDelay,
+		parallelism: cfg.Parallelism,
+		clock:       clock.Real{},
+		logger:      logger,
+	}
+
+	if r.interval <= 0 {
+		r.interval = time.Hour
+	}
+
+	if r.batchSize <= 0 {
+		r.batchSize = 500
+	}
+
+	if r.parallelism <= 0 {
+		r.parallelism = 1
+	}
+
+	return r
+}
+
+// WithClock makes the reconciler schedule its scans using c
+func (r *Reconciler) WithClock(c clock.Clock) *Reconciler {
+	r.clock = c
+	return r
+}
+
+// Run scans the table every interval until ctx is cancelled
+func (r *Reconciler) Run(ctx context.Context) {
+	for {
+		if err := r.waitIfPaused(ctx); err != nil {
+			return
+		}
+
+		if _, err := r.Scan(ctx); err != nil && ctx.Err() == nil {
+			r.logger.Errorw("Integrity scan failed", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.clock.After(r.interval):
+		}
+	}
+}
+
+// Pause stops scans at the end of their current batch until Resume is
+// called, e.g. during peak traffic
+func (r *Reconciler) Pause() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.resumed == nil {
+		r.resumed = make(chan struct{})
+		r.logger.Info("Integrity scan paused")
+	}
+}
+
+// Resume lets paused scans carry on
+func (r *Reconciler) Resume() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.resumed != nil {
+		close(r.resumed)
+		r.resumed = nil
+		r.logger.Info("Integrity scan resumed")
+	}
+}
+
+// Paused reports whether scans are paused
+func (r *Reconciler) Paused() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.resumed != nil
+}
+
+// waitIfPaused blocks while the reconciler is paused
+func (r *Reconciler) waitIfPaused(ctx context.Context) error {
+	r.mu.Lock()
+	resumed := r.resumed
+	r.mu.Unlock()
+
+	if resumed == nil {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-resumed:
+		return nil
+	}
+}
+
+// Malformed returns the number of malformed rows found by the last completed
+// scan
+func (r *Reconciler) Malformed() int64 {
+	return r.malformed.Load()
+}
+
+// Scan reads the whole table in batches, tries to decode every row, and logs
+// those that fail. It returns the number of malformed rows found. The table
+// is split into as many ranges of pages as there are workers, each scanned
+// by one of them.
+func (r *Reconciler) Scan(ctx context.Context) (int, error) {
+	var pages int64
+	err := r.store.pool.QueryRow(ctx,
+		"SELECT pg_relation_size('endorsements') / current_setting('block_size')::bigint").Scan(&pages)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get table size: %w", err)
+	}
+
+	ranges := pageRanges(pages, r.parallelism)
+	workers := len(ranges)
+
+	var (
+		wg        sync.WaitGroup
+		scanned   = make([]int, workers)
+		malformed = make([]int, workers)
+		errs      = make([]error, workers)
+	)
+	for i, pr := range ranges {
+		wg.Add(1)
+		go func(i int, from, to int64) {
+			defer wg.Done()
+			scanned[i], malformed[i], errs[i] = r.scanRange(ctx, from, to)
+		}(i, pr.from, pr.to)
+	}
+	wg.Wait()
+
+	total, bad := 0, 0
+	for i := range scanned {
+		total += scanned[i]
+		bad += malformed[i]
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return bad, err
+	}
+
+	r.malformed.Store(int64(bad))
+	r.logger.Infow("Integrity scan completed", "rows", total, "malformed", bad, "workers", workers)
+
+	return bad, nil
+}
+
+// pageRange is the pages [from, to) of the table, or those from page from
+// onwards if to is negative
+type pageRange struct {
+	from, to int64
+}
+
+// pageRanges splits a table of pages into one contiguous range per worker,
+// or a single range if there are fewer pages than workers. The last range is
+// open-ended, taking in rows added since the size was read.
+func pageRanges(pages int64, workers int) []pageRange {
+	n := int64(workers)
+	if n < 1 || pages < n {
+		n = 1
+	}
+
+	ranges := make([]pageRange, n)
+	for i := int64(0); i < n; i++ {
+		ranges[i] = pageRange{from: i * pages / n, to: (i + 1) * pages / n}
+	}
+	ranges[n-1].to = -1
+
+	return ranges
+}
+
+// scanRange scans the rows in pages [from, to) of the table, or from page
+// from onwards if to is negative, returning the number of rows scanned and
+// of malformed ones
+func (r *Reconciler) scanRange(ctx context.Context, from, to int64) (int, int, error) {
+	// Rows are walked in physical order, resuming after the last ctid seen,
+	// which unlike kv_key is unique even when a key spans several rows
+	query := `
+		SELECT ctid::text, kv_key, kv_val FROM endorsements
+		WHERE ctid > $1::tid AND ($3::bigint < 0 OR ctid < format('(%s,0)', $3::bigint)::tid)
+		ORDER BY ctid
+		LIMIT $2
+	`
+
+	var (
+		last      = fmt.Sprintf("(%d,0)", from)
+		scanned   int
+		malformed int
+	)
+
+	for {
+		rows, err := r.store.pool.Query(ctx, query, last, r.batchSize, to)
+		if err != nil {
+			return scanned, malformed, fmt.Errorf("failed to query database: %w", err)
+		}
+
+		n := 0
+		for rows.Next() {
+			var key, val string
+			if err := rows.Scan(&last, &key, &val); err != nil {
+				rows.Close()
+				return scanned, malformed, fmt.Errorf("failed to scan row: %w", err)
+			}
+			n++
+
+			if _, err := r.store.decodeValue(val); err != nil {
+				malformed++
+				r.logger.Warnw("Malformed endorsement row", "key", key, "ctid", last, "error", err)
+			}
+		}
+		rows.Close()
+
+		if err := rows.Err(); err != nil {
+			return scanned, malformed, fmt.Errorf("failed to read rows: %w", err)
+		}
+
+		scanned += n
+		if n < r.batchSize {
+			return scanned, malformed, nil
+		}
+
+		if r.batchDelay > 0 {
+			select {
+			case <-ctx.Done():
+				return scanned, malformed, ctx.Err()
+			case <-r.clock.After(r.batchDelay):
+			}
+		}
+
+		if err := r.waitIfPaused(ctx); err != nil {
+			return scanned, malformed, err
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package store
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"endorsement-distribution/internal/config"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// The scan needs a database to walk, but which rows it flags is decided by
+// decodeValue alone
+func TestDecodeValueFlagsMalformedRows(t *testing.T) {
+	s := &PostgresStore{}
+	artifact := base64.StdEncoding.EncodeToString([]byte("artifact"))
+
+	encoded, err := s.encodeValue([][]byte{[]byte("artifact")})
+	if err != nil {
+		t.Fatalf("encodeValue: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		val       string
+		malformed bool
+	}{
+		{"current format", string(encoded), false},
+		{"version 1 array", `["` + artifact + `"]`, false},
+		{"hex instead of base64", `{"v":2,"artifacts":["6172746966616374zz"]}`, true},
+		{"not JSON", "artifact", true},
+		{"truncated", `{"v":2,"artifacts":["` + artifact, true},
+		{"newer format", `{"v":3,"artifacts":[]}`, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.decodeValue(tt.val)
+			if got := err != nil; got != tt.malformed {
+				t.Errorf("decodeValue(%q) = %v, want malformed %v", tt.val, err, tt.malformed)
+			}
+		})
+	}
+
+	if _, err := s.decodeValue(`{"v":3,"artifacts":[]}`); !errors.Is(err, ErrUnsupportedValueFormat) {
+		t.Errorf("decodeValue of a newer format = %v, want ErrUnsupportedValueFormat", err)
+	}
+}
+
+func TestPageRanges(t *testing.T) {
+	tests := []struct {
+		pages   int64
+		workers int
+		want    []pageRange
+	}{
+		{0, 1, []pageRange{{0, -1}}},
+		{10, 1, []pageRange{{0, -1}}},
+		{10, 3, []pageRange{{0, 3}, {3, 6}, {6, -1}}},
+		{12, 4, []pageRange{{0, 3}, {3, 6}, {6, 9}, {9, -1}}},
+		{2, 4, []pageRange{{0, -1}}},
+		{10, 0, []pageRange{{0, -1}}},
+	}
+
+	for _, tt := range tests {
+		if got := pageRanges(tt.pages, tt.workers); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("pageRanges(%d, %d) = %v, want %v", tt.pages, tt.workers, got, tt.want)
+		}
+	}
+}
+
+func TestReconcilerPause(t *testing.T) {
+	r := NewReconciler(nil, config.ReconcilerConfig{}, zap.NewNop().Sugar())
+	ctx := context.Background()
+
+	if err := r.waitIfPaused(ctx); err != nil {
+		t.Fatalf("waitIfPaused while running: %v", err)
+	}
+
+	r.Pause()
+	r.Pause()
+	if !r.Paused() {
+		t.Fatal("Paused = false after Pause")
+	}
+
+	waited := make(chan error, 1)
+	go func() { waited <- r.waitIfPaused(ctx) }()
+
+	select {
+	case err := <-waited:
+		t.Fatalf("waitIfPaused returned %v while paused", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	r.Resume()
+	select {
+	case err := <-waited:
+		if err != nil {
+			t.Errorf("waitIfPaused after Resume: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waitIfPaused still blocked after Resume")
+	}
+	if r.Paused() {
+		t.Error("Paused = true after Resume")
+	}
+
+	// A paused wait gives up when its context is cancelled, e.g. on shutdown
+	r.Pause()
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := r.waitIfPaused(cancelled); !errors.Is(err, context.Canceled) {
+		t.Errorf("waitIfPaused with a cancelled context = %v, want context.Canceled", err)
+	}
+}
+
+func TestNewReconcilerDefaults(t *testing.T) {
+	r := NewReconciler(nil, config.ReconcilerConfig{}, zap.NewNop().Sugar())
+	if r.interval != time.Hour || r.batchSize != 500 || r.parallelism != 1 {
+		t.Errorf("defaults = interval %v, batch size %d, parallelism %d; want 1h, 500, 1",
+			r.interval, r.batchSize, r.parallelism)
+	}
+
+	r = NewReconciler(nil, config.ReconcilerConfig{Interval: time.Minute, BatchSize: 10, BatchDelay: time.Second, Parallelism: 4},
+		zap.NewNop().Sugar())
+	if r.interval != time.Minute || r.batchSize != 10 || r.batchDelay != time.Second || r.parallelism != 4 {
+		t.Errorf("configured = interval %v, batch size %d, delay %v, parallelism %d; want 1m, 10, 1s, 4",
+			r.interval, r.batchSize, r.batchDelay, r.parallelism)
+	}
+}
+
+func TestReconcilerScan(t *testing.T) {
+	s := newPostgresTestStore(t, nil)
+	ctx := context.Background()
+
+	for _, key := range []string{"ARM_CCA://acme/1", "ARM_CCA://acme/2"} {
+		if err := s.Set(ctx, key, [][]byte{[]byte("artifact")}); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	// What the hex encoder of old wrote, and a value cut short
+	insertRow(t, s, "ARM_CCA://acme/hex", `["6172746966616374zz"]`)
+	insertRow(t, s, "ARM_CCA://acme/cut", `{"v":2,"artifacts":["YXJ0`)
+
+	for _, parallelism := range []int{1, 3} {
+		r := NewReconciler(s, config.ReconcilerConfig{BatchSize: 1, Parallelism: parallelism}, zap.NewNop().Sugar())
+
+		n, err := r.Scan(ctx)
+		if err != nil {
+			t.Fatalf("parallelism %d: Scan: %v", parallelism, err)
+		}
+		if n != 2 || r.Malformed() != 2 {
+			t.Errorf("parallelism %d: Scan = %d, Malformed = %d; want the 2 malformed rows", parallelism, n, r.Malformed())
+		}
+	}
+}
+
+// delayClock is a clock whose waits are over at once, counting those of the
+// inter-batch delay
+type delayClock struct {
+	delay time.Duration
+
+	mu    sync.Mutex
+	waits int
+}
+
+func (c *delayClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c *delayClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	if d == c.delay {
+		c.waits++
+	}
+	c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	ch <- time.Now()
+	return ch
+}
+
+func TestReconcilerBatchSize(t *testing.T) {
+	s := newPostgresTestStore(t, nil)
+	ctx := context.Background()
+
+	const rows, batchSize = 7, 3
+	for i := 0; i < rows; i++ {
+		if err := s.Set(ctx, fmt.Sprintf("ARM_CCA://acme/%d", i), [][]byte{[]byte("artifact")}); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+
+	core, logs := observer.New(zap.InfoLevel)
+	clock := &delayClock{delay: time.Second}
+	r := NewReconciler(s, config.ReconcilerConfig{BatchSize: batchSize, BatchDelay: clock.delay},
+		zap.New(core).Sugar()).WithClock(clock)
+
+	if _, err := r.Scan(ctx); err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+
+	// Batches of 3, 3 and 1 rows, with a delay after each full one
+	if clock.waits != 2 {
+		t.Errorf("%d inter-batch delays scanning %d rows by %d, want 2", clock.waits, rows, batchSize)
+	}
+
+	completed := logs.FilterMessage("Integrity scan completed").All()
+	if len(completed) != 1 {
+		t.Fatalf("%d scan completions logged, want 1", len(completed))
+	}
+	if scanned := completed[0].ContextMap()["rows"]; scanned != int64(rows) {
+		t.Errorf("%v rows scanned, want all %d", scanned, rows)
+	}
+}
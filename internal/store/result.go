@@ -0,0 +1,170 @@
+package store
+
+import (
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/veraison/corim/comid"
+	"github.com/veraison/corim/coserv"
+)
+
+// Result encodings select how stored artifacts are framed in a CoSERV result
+const (
+	// ResultEncodingCoserv decodes each artifact as the CoRIM triple matching
+	// the query's artifact type and returns them in the CoSERV result set
+	ResultEncodingCoserv = "coserv"
+
+	// ResultEncodingRaw returns the stored artifacts untouched, as a CBOR
+	// array of byte strings. This suits trust anchors stored as plain keys or
+	// certificates rather than as key triples.
+	ResultEncodingRaw = "raw"
+)
+
+// resultEncodingFor returns the encoding configured for an artifact type
+func (ed *EndorsementDistributor) resultEncodingFor(t coserv.ArtifactType) string {
+	if t == coserv.ArtifactTypeTrustAnchors && ed.taResultEncoding != "" {
+		return ed.taResultEncoding
+	}
+
+	if ed.resultEncoding != "" {
+		return ed.resultEncoding
+	}
+
+	return ResultEncodingCoserv
+}
+
+// Result is the outcome of a query before it is encoded for the wire
+type Result struct {
+	// Coserv is the CoSERV result holding the decoded triples. It is nil
+	// when the query's artifact type is configured with the raw encoding.
+	Coserv *coserv.Coserv
+
+	// Artifacts are the stored artifacts the result was built from
+	Artifacts [][]byte
+
+	// Groups holds the same artifacts, nested under the lookup key of the
+	// environment (class or instance) of the query they were found for. An
+	// artifact shared by several environments appears under each of them.
+	Groups []KeyedArtifacts
+
+	// Requested is the number of lookup keys synthesized for the query, one
+	// per environment and scheme; len(Groups) of them matched
+	Requested int
+
+	// Total is the number of artifacts matching the query, of which
+	// Artifacts is the page asked for. NextOffset is the offset of the next
+	// page, or 0 if there is none.
+	Total      int
+	NextOffset int
+
+	encoding string
+}
+
+// flattenGroups lists the artifacts of all groups, dropping duplicates (the
+// same artifact may have been stored under more than one scheme)
+func flattenGroups(groups []KeyedArtifacts) [][]byte {
+	seen := make(map[string]struct{})
+
+	var artifacts [][]byte
+	for _, g := range groups {
+		artifacts = append(artifacts, dedupeArtifacts(g.Artifacts, seen)...)
+	}
+
+	return artifacts
+}
+
+// retainInGroups drops from the groups the artifacts not in keep, and the
+// groups left empty
+func retainInGroups(groups []KeyedArtifacts, keep [][]byte) []KeyedArtifacts {
+	kept := make(map[string]struct{}, len(keep))
+	for _, artifact := range keep {
+		kept[string(artifact)] = struct{}{}
+	}
+
+	var out []KeyedArtifacts
+	for _, g := range groups {
+		var artifacts [][]byte
+		for _, artifact := range g.Artifacts {
+			if _, ok := kept[string(artifact)]; ok {
+				artifacts = append(artifacts, artifact)
+			}
+		}
+
+		if len(artifacts) > 0 {
+			out = append(out, KeyedArtifacts{Key: g.Key, Artifacts: artifacts, Profile: g.Profile})
+		}
+	}
+
+	return out
+}
+
+// Encode serializes the result to CBOR in its configured encoding
+func (r *Result) Encode() ([]byte, error) {
+	switch r.encoding {
+	case ResultEncodingCoserv:
+		return r.Coserv.ToCBOR()
+	case ResultEncodingRaw:
+		return cbor.Marshal(r.Artifacts)
+	default:
+		return nil, fmt.Errorf("unsupported result encoding %q", r.encoding)
+	}
+}
+
+// newResult packages the artifacts fetched for a query into a result using
+// the encoding configured for the query's artifact type
+func (ed *EndorsementDistributor) newResult(profile string, query coserv.Query, artifacts [][]byte) (*Result, error) {
+	r := &Result{
+		Artifacts: artifacts,
+		encoding:  ed.resultEncodingFor(query.ArtifactType),
+	}
+
+	switch r.encoding {
+	case ResultEncodingCoserv:
+		result, err := newCoservResult(profile, query, artifacts)
+		if err != nil {
+			return nil, err
+		}
+		r.Coserv = result
+	case ResultEncodingRaw:
+	default:
+		return nil, fmt.Errorf("unsupported result encoding %q", r.encoding)
+	}
+
+	return r, nil
+}
+
+// newCoservResult echoes the query back with a result set holding the
+// artifacts decoded as the triples matching the query's artifact type
+func newCoservResult(profile string, query coserv.Query, artifacts [][]byte) (*coserv.Coserv, error) {
+	result, err := coserv.NewCoserv(profile, query)
+	if err != nil {
+		return nil, fmt.Errorf("creating result: %w", err)
+	}
+
+	rs := coserv.NewResultSet()
+
+	for i, artifact := range artifacts {
+		switch query.ArtifactType {
+		case coserv.ArtifactTypeReferenceValues:
+			var rv comid.ValueTriple
+			if err := cbor.Unmarshal(artifact, &rv); err != nil {
+				return nil, fmt.Errorf("decoding artifact[%d] as reference value: %w", i, err)
+			}
+			rs.AddReferenceValues(rv)
+		case coserv.ArtifactTypeTrustAnchors:
+			var ak comid.KeyTriple
+			if err := cbor.Unmarshal(artifact, &ak); err != nil {
+				return nil, fmt.Errorf("decoding artifact[%d] as trust anchor: %w", i, err)
+			}
+			rs.AddAttestationKeys(ak)
+		default:
+			return nil, fmt.Errorf("unsupported artifact type %d", query.ArtifactType)
+		}
+	}
+
+	if err := result.AddResults(*rs); err != nil {
+		return nil, fmt.Errorf("adding results: %w", err)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,97 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"endorsement-distribution/internal/config"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/veraison/corim/comid"
+	"github.com/veraison/corim/coserv"
+	"go.uber.org/zap"
+)
+
+func TestResultEncodingFor(t *testing.T) {
+	tests := []struct {
+		name             string
+		cfg              config.DistributorConfig
+		wantRefVals      string
+		wantTrustAnchors string
+	}{
+		{"defaults", config.DistributorConfig{}, ResultEncodingCoserv, ResultEncodingCoserv},
+		{"raw everywhere", config.DistributorConfig{ResultEncoding: ResultEncodingRaw}, ResultEncodingRaw, ResultEncodingRaw},
+		{"raw trust anchors", config.DistributorConfig{TrustAnchorResultEncoding: ResultEncodingRaw},
+			ResultEncodingCoserv, ResultEncodingRaw},
+		{"coserv trust anchors", config.DistributorConfig{ResultEncoding: ResultEncodingRaw, TrustAnchorResultEncoding: ResultEncodingCoserv},
+			ResultEncodingRaw, ResultEncodingCoserv},
+	}
+
+	for _, tt := range tests {
+		ed := NewEndorsementDistributor(nil, tt.cfg, zap.NewNop().Sugar())
+		if got := ed.resultEncodingFor(coserv.ArtifactTypeReferenceValues); got != tt.wantRefVals {
+			t.Errorf("%s: reference values encoded %q, want %q", tt.name, got, tt.wantRefVals)
+		}
+		if got := ed.resultEncodingFor(coserv.ArtifactTypeTrustAnchors); got != tt.wantTrustAnchors {
+			t.Errorf("%s: trust anchors encoded %q, want %q", tt.name, got, tt.wantTrustAnchors)
+		}
+	}
+}
+
+func TestTrustAnchorResultEncoding(t *testing.T) {
+	ms, err := NewMemoryStore(config.DatabaseConfig{})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	ed := NewEndorsementDistributor(ms, config.DistributorConfig{TrustAnchorResultEncoding: ResultEncodingRaw},
+		zap.NewNop().Sugar())
+	ctx := context.Background()
+
+	rv, err := cbor.Marshal(comid.ValueTriple{
+		Environment:  comid.Environment{Class: comid.NewClassImplID(comid.TestImplID)},
+		Measurements: *comid.NewMeasurements().Add(comid.MustNewUintMeasurement(uint64(1)).SetSVN(1)),
+	})
+	if err != nil {
+		t.Fatalf("cbor.Marshal: %v", err)
+	}
+	ta := []byte("-----BEGIN PUBLIC KEY-----")
+
+	rvQuery, taQ := refValQuery(t), taQuery(t)
+	for query, artifact := range map[string][]byte{rvQuery: rv, taQ: ta} {
+		for _, key := range queryKeys(t, "acme", query) {
+			if err := ms.Set(ctx, key, [][]byte{artifact}); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+		}
+	}
+
+	// Reference values stay in a CoSERV result set
+	result, err := ed.GetEndorsementsResult(ctx, "acme", rvQuery, "application/coserv+cbor", QueryOptions{})
+	if err != nil {
+		t.Fatalf("GetEndorsementsResult(reference values): %v", err)
+	}
+	if result.Coserv == nil {
+		t.Error("reference values not framed as a CoSERV result")
+	}
+
+	// Trust anchors come back as they were stored
+	result, err = ed.GetEndorsementsResult(ctx, "acme", taQ, "application/coserv+cbor", QueryOptions{})
+	if err != nil {
+		t.Fatalf("GetEndorsementsResult(trust anchors): %v", err)
+	}
+	if result.Coserv != nil {
+		t.Error("trust anchors framed as a CoSERV result, want them raw")
+	}
+	body, err := result.Encode()
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	var got [][]byte
+	if err := cbor.Unmarshal(body, &got); err != nil {
+		t.Fatalf("decoding the raw result: %v", err)
+	}
+	if len(got) != 1 || !bytes.Equal(got[0], ta) {
+		t.Errorf("raw result = %q, want the stored trust anchor", got)
+	}
+}
@@ -0,0 +1,205 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// maxShadowReads bounds the shadow reads in flight at once; reads beyond it
+// are skipped rather than queued, so a slow shadow can't pile up goroutines
+const maxShadowReads = 64
+
+// ShadowStore serves everything from a primary store, and repeats each Get
+// against a shadow store in the background to check that both agree. It is
+// meant for validating a new backend before switching over to it: nothing
+// read from the shadow is ever served, and writes only go to the primary.
+type ShadowStore struct {
+	primary Store
+	shadow  Store
+	logger  *zap.SugaredLogger
+
+	inflight   chan struct{}
+	wg         sync.WaitGroup
+	mismatches atomic.Int64
+	skipped    atomic.Int64
+}
+
+// NewShadowStore creates a store serving from primary and comparing against
+// shadow
+func NewShadowStore(primary, shadow Store, logger *zap.SugaredLogger) *ShadowStore {
+	return &ShadowStore{
+		primary:  primary,
+		shadow:   shadow,
+		logger:   logger,
+		inflight: make(chan struct{}, maxShadowReads),
+	}
+}
+
+// Get retrieves artifacts for the given keys from the primary, and schedules
+// the comparison with the shadow. A primary read cut short by the request
+// being cancelled or timing out says nothing of what the primary holds, so
+// it isn't compared.
+func (s *ShadowStore) Get(ctx context.Context, keys []string) ([]KeyedArtifacts, error) {
+	found, err := s.primary.Get(ctx, keys)
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		s.skipped.Add(1)
+		return found, err
+	}
+
+	select {
+	case s.inflight <- struct{}{}:
+		s.wg.Add(1)
+		go s.compare(append([]string(nil), keys...), copyKeyedArtifacts(found), err)
+	default:
+		s.skipped.Add(1)
+	}
+
+	return found, err
+}
+
+// compare reads keys from the shadow and records whether it agrees with
+// what the primary returned. It outlives the request, so it isn't bound to
+// the request's context.
+func (s *ShadowStore) compare(keys []string, want []KeyedArtifacts, wantErr error) {
+	defer func() {
+		<-s.inflight
+		s.wg.Done()
+	}()
+
+	got, gotErr := s.shadow.Get(context.Background(), keys)
+
+	switch {
+	case (wantErr == nil) != (gotErr == nil):
+		s.mismatches.Add(1)
+		s.logger.Warnw("Shadow store disagrees on whether keys exist",
+			"keys", keys, "primaryError", wantErr, "shadowError", gotErr)
+	case wantErr == nil && !sameKeyedArtifacts(want, got):
+		s.mismatches.Add(1)
+		s.logger.Warnw("Shadow store returned different artifacts",
+			"keys", keys, "primaryKeys", len(want), "shadowKeys", len(got))
+	}
+}
+
+// Set stores artifacts in the primary only
+func (s *ShadowStore) Set(ctx context.Context, key string, artifacts [][]byte) error {
+	return s.primary.Set(ctx, key, artifacts)
+}
+
+// SetWithProfile stores artifacts and their profile in the primary only
+func (s *ShadowStore) SetWithProfile(ctx context.Context, key, profile, artifactType string, expiresAt time.Time, artifacts [][]byte) (SetOutcome, error) {
+	return s.primary.SetWithProfile(ctx, key, profile, artifactType, expiresAt, artifacts)
+}
+
+// SetIfAbsent stores artifacts in the primary only, unless it already holds
+// any of the keys
+func (s *ShadowStore) SetIfAbsent(ctx context.Context, profile string, entries []KeyedArtifacts) error {
+	return s.primary.SetIfAbsent(ctx, profile, entries)
+}
+
+// Append adds an artifact in the primary only
+func (s *ShadowStore) Append(ctx context.Context, key string, artifact []byte) error {
+	return s.primary.Append(ctx, key, artifact)
+}
+
+// Exists reports whether any of the keys holds artifacts in the primary
+func (s *ShadowStore) Exists(ctx context.Context, keys []string) (bool, error) {
+	return s.primary.Exists(ctx, keys)
+}
+
+// StoredProfile returns the profile recorded for key in the primary
+func (s *ShadowStore) StoredProfile(ctx context.Context, key string) (string, error) {
+	return s.primary.StoredProfile(ctx, key)
+}
+
+// DeleteByTenant removes a tenant's keys from the primary only
+func (s *ShadowStore) DeleteByTenant(ctx context.Context, tenantID string) (int64, error) {
+	return s.primary.DeleteByTenant(ctx, tenantID)
+}
+
+// Count returns the number of keys in the primary
+func (s *ShadowStore) Count(ctx context.Context) (int64, error) {
+	return s.primary.Count(ctx)
+}
+
+// CountByTenant returns the number of keys per tenant in the primary
+func (s *ShadowStore) CountByTenant(ctx context.Context) (map[string]int64, error) {
+	return s.primary.CountByTenant(ctx)
+}
+
+// Ping checks that the primary can be reached. The shadow is not served
+// from, so its health doesn't make the service unready.
+func (s *ShadowStore) Ping(ctx context.Context) error {
+	return s.primary.Ping(ctx)
+}
+
+// Mismatches returns the number of shadow reads that disagreed with the
+// primary so far
+func (s *ShadowStore) Mismatches() int64 {
+	return s.mismatches.Load()
+}
+
+// Skipped returns the number of shadow reads dropped because too many were
+// already in flight, or because the primary read was cancelled
+func (s *ShadowStore) Skipped() int64 {
+	return s.skipped.Load()
+}
+
+// Close waits for pending shadow reads, then closes both stores
+func (s *ShadowStore) Close() error {
+	s.wg.Wait()
+
+	shadowErr := s.shadow.Close()
+	if err := s.primary.Close(); err != nil {
+		return err
+	}
+
+	return shadowErr
+}
+
+// copyKeyedArtifacts deep-copies the artifacts returned by a Get
+func copyKeyedArtifacts(found []KeyedArtifacts) []KeyedArtifacts {
+	out := make([]KeyedArtifacts, len(found))
+	for i, ka := range found {
+		out[i] = KeyedArtifacts{Key: ka.Key, Artifacts: copyArtifacts(ka.Artifacts), Profile: ka.Profile}
+	}
+	return out
+}
+
+// sameKeyedArtifacts reports whether a and b hold the same keys, with the
+// same artifacts stored under the same profile, in the same order
+func sameKeyedArtifacts(a, b []KeyedArtifacts) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].Key != b[i].Key || a[i].Profile != b[i].Profile || !sameArtifacts(a[i].Artifacts, b[i].Artifacts) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sameArtifacts reports whether a and b hold the same artifacts in the same
+// order
+func sameArtifacts(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,128 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"endorsement-distribution/internal/config"
+
+	"go.uber.org/zap"
+)
+
+// newShadowTestStore returns a ShadowStore over two memory stores holding
+// primaryVal and shadowVal under key k; a nil value leaves the store empty
+func newShadowTestStore(t *testing.T, primaryVal, shadowVal []byte) *ShadowStore {
+	t.Helper()
+
+	var stores [2]*MemoryStore
+	for i, val := range [][]byte{primaryVal, shadowVal} {
+		ms, err := NewMemoryStore(config.DatabaseConfig{})
+		if err != nil {
+			t.Fatalf("NewMemoryStore: %v", err)
+		}
+		if val != nil {
+			if err := ms.Set(context.Background(), "k", [][]byte{val}); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+		}
+		stores[i] = ms
+	}
+
+	return NewShadowStore(stores[0], stores[1], zap.NewNop().Sugar())
+}
+
+func TestShadowStore(t *testing.T) {
+	tests := []struct {
+		name           string
+		primary        []byte
+		shadow         []byte
+		wantMismatches int64
+	}{
+		{"agree", []byte("a"), []byte("a"), 0},
+		{"different artifacts", []byte("a"), []byte("b"), 1},
+		{"missing from the shadow", []byte("a"), nil, 1},
+		{"only in the shadow", nil, []byte("a"), 1},
+		{"missing from both", nil, nil, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newShadowTestStore(t, tt.primary, tt.shadow)
+
+			found, err := s.Get(context.Background(), []string{"k"})
+			if tt.primary == nil {
+				if !errors.Is(err, ErrNoArtifacts) {
+					t.Errorf("Get = %v, want the primary's ErrNoArtifacts", err)
+				}
+			} else if err != nil || len(found) != 1 || string(found[0].Artifacts[0]) != string(tt.primary) {
+				t.Errorf("Get = %+v, %v, want the primary's artifact", found, err)
+			}
+
+			// Close waits for the comparison
+			if err := s.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+			if got := s.Mismatches(); got != tt.wantMismatches {
+				t.Errorf("Mismatches = %d, want %d", got, tt.wantMismatches)
+			}
+		})
+	}
+}
+
+func TestShadowStoreWritesPrimaryOnly(t *testing.T) {
+	s := newShadowTestStore(t, nil, nil)
+	ctx := context.Background()
+
+	if err := s.Set(ctx, "k", [][]byte{[]byte("a")}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	if ok, _ := s.primary.Exists(ctx, []string{"k"}); !ok {
+		t.Errorf("Set didn't write to the primary")
+	}
+	if ok, _ := s.shadow.Exists(ctx, []string{"k"}); ok {
+		t.Errorf("Set wrote to the shadow")
+	}
+}
+
+// contextStore is a store whose Get fails once its context is done, as the
+// PostgreSQL store does
+type contextStore struct {
+	Store
+}
+
+func (s contextStore) Get(ctx context.Context, keys []string) ([]KeyedArtifacts, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Store.Get(ctx, keys)
+}
+
+func TestShadowStoreCancelledRead(t *testing.T) {
+	s := newShadowTestStore(t, []byte("a"), []byte("a"))
+	s.primary = contextStore{Store: s.primary}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.Get(ctx, []string{"k"}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Get = %v, want the primary's context.Canceled", err)
+	}
+
+	expired, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	if _, err := s.Get(expired, []string{"k"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Get = %v, want the primary's context.DeadlineExceeded", err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if got := s.Mismatches(); got != 0 {
+		t.Errorf("Mismatches = %d, want cancelled reads not compared", got)
+	}
+	if got := s.Skipped(); got != 2 {
+		t.Errorf("Skipped = %d, want the 2 cancelled reads", got)
+	}
+}
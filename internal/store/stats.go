@@ -0,0 +1,68 @@
+package store
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stats summarizes the contents of the store
+type Stats struct {
+	TotalKeys int64            `json:"totalKeys"`
+	Tenants   map[string]int64 `json:"tenants"`
+}
+
+// statsCache keeps the last computed Stats for a short while, so that
+// dashboards polling the stats endpoint don't each trigger a table scan
+type statsCache struct {
+	mu      sync.Mutex
+	stats   *Stats
+	expires time.Time
+}
+
+// Stats returns the number of keys stored, in total and per tenant. Results
+// are cached for the configured stats TTL.
+func (ed *EndorsementDistributor) Stats(ctx context.Context) (*Stats, error) {
+	done, err := ed.track()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	ed.stats.mu.Lock()
+	defer ed.stats.mu.Unlock()
+
+	now := ed.clock.Now()
+	if ed.stats.stats != nil && now.Before(ed.stats.expires) {
+		return ed.stats.stats, nil
+	}
+
+	total, err := ed.store.Count(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tenants, err := ed.store.CountByTenant(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ed.stats.stats = &Stats{TotalKeys: total, Tenants: tenants}
+	ed.stats.expires = now.Add(ed.statsTTL)
+
+	return ed.stats.stats, nil
+}
+
+// tenantOf returns the tenant a lookup key belongs to: keys are URIs of the
+// form scheme://tenant/... and the tenant is their authority
+func tenantOf(key string) string {
+	_, rest, found := strings.Cut(key, "://")
+	if !found {
+		return ""
+	}
+
+	tenant, _, _ := strings.Cut(rest, "/")
+
+	return tenant
+}
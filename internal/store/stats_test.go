@@ -0,0 +1,95 @@
+package store
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"endorsement-distribution/internal/clock"
+	"endorsement-distribution/internal/config"
+
+	"go.uber.org/zap"
+)
+
+// countCountingStore counts the Count calls made to it
+type countCountingStore struct {
+	Store
+	counts int
+}
+
+func (s *countCountingStore) Count(ctx context.Context) (int64, error) {
+	s.counts++
+	return s.Store.Count(ctx)
+}
+
+func TestStatsCacheExpiry(t *testing.T) {
+	ms, err := NewMemoryStore(config.DatabaseConfig{})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	s := &countCountingStore{Store: ms}
+
+	c := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	ed := NewEndorsementDistributor(s, config.DistributorConfig{StatsCacheTTL: 10 * time.Second}, zap.NewNop().Sugar()).
+		WithClock(c)
+	ctx := context.Background()
+
+	for _, step := range []struct {
+		advance    time.Duration
+		wantCounts int
+	}{
+		{0, 1},
+		{9 * time.Second, 1},
+		{time.Second, 2},
+		{5 * time.Second, 2},
+	} {
+		c.Advance(step.advance)
+		if _, err := ed.Stats(ctx); err != nil {
+			t.Fatalf("Stats: %v", err)
+		}
+		if s.counts != step.wantCounts {
+			t.Errorf("after %v more: %d counts, want %d", step.advance, s.counts, step.wantCounts)
+		}
+	}
+}
+
+func TestStatsReflectInsertsAndDeletes(t *testing.T) {
+	ms, err := NewMemoryStore(config.DatabaseConfig{})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	ed := NewEndorsementDistributor(ms, config.DistributorConfig{}, zap.NewNop().Sugar())
+	ctx := context.Background()
+
+	want := func(total int64, tenants map[string]int64) {
+		t.Helper()
+
+		stats, err := ed.Stats(ctx)
+		if err != nil {
+			t.Fatalf("Stats: %v", err)
+		}
+		if stats.TotalKeys != total || !reflect.DeepEqual(stats.Tenants, tenants) {
+			t.Errorf("Stats = %d keys, per tenant %v; want %d, %v", stats.TotalKeys, stats.Tenants, total, tenants)
+		}
+	}
+
+	want(0, map[string]int64{})
+
+	for _, key := range []string{"ARM_CCA://acme/1", "ARM_CCA://acme/2", "ARM_CCA://other/1"} {
+		if err := ms.Set(ctx, key, [][]byte{[]byte("a")}); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	want(3, map[string]int64{"acme": 2, "other": 1})
+
+	if err := ms.Delete("ARM_CCA://acme/1"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	want(2, map[string]int64{"acme": 1, "other": 1})
+
+	if _, err := ed.DeleteTenant(ctx, "other"); err != nil {
+		t.Fatalf("DeleteTenant: %v", err)
+	}
+	want(1, map[string]int64{"acme": 1})
+}
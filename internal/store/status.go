@@ -0,0 +1,84 @@
+package store
+
+// StatusReporter is implemented by the store decorators whose state is worth
+// showing operators at a glance, e.g. on the readiness probe
+type StatusReporter interface {
+	// StatusName is the name the status is reported under
+	StatusName() string
+
+	// Status returns the current state of the decorator, to be encoded as
+	// JSON
+	Status() any
+}
+
+// CacheStatus is the status of a CachingStore
+type CacheStatus struct {
+	CacheStats
+
+	// HitRatio is the share of the keys looked up that were served from
+	// the cache, 0 before any lookup
+	HitRatio float64 `json:"hitRatio"`
+}
+
+// ShadowStatus is the status of a ShadowStore
+type ShadowStatus struct {
+	Mismatches int64 `json:"mismatches"`
+	Skipped    int64 `json:"skipped"`
+}
+
+// StatusName is "cache"
+func (s *CachingStore) StatusName() string {
+	return "cache"
+}
+
+// Status returns the hits and misses of the cache so far, and their ratio
+func (s *CachingStore) Status() any {
+	status := CacheStatus{CacheStats: CacheStats{Hits: s.Hits(), Misses: s.Misses()}}
+	if lookups := status.Hits + status.Misses; lookups > 0 {
+		status.HitRatio = float64(status.Hits) / float64(lookups)
+	}
+
+	return status
+}
+
+// Unwrap returns the store behind the cache
+func (s *CachingStore) Unwrap() Store {
+	return s.inner
+}
+
+// StatusName is "shadow"
+func (s *ShadowStore) StatusName() string {
+	return "shadow"
+}
+
+// Status returns the shadow reads that disagreed with the primary so far,
+// and those skipped
+func (s *ShadowStore) Status() any {
+	return ShadowStatus{Mismatches: s.Mismatches(), Skipped: s.Skipped()}
+}
+
+// Unwrap returns the primary store, the one served from
+func (s *ShadowStore) Unwrap() Store {
+	return s.primary
+}
+
+// StoreStatus returns the status of each StatusReporter among the store of
+// the distributor and the stores it decorates, by name. It is empty if none
+// reports one.
+func (ed *EndorsementDistributor) StoreStatus() map[string]any {
+	statuses := make(map[string]any)
+
+	for s := ed.store; s != nil; {
+		if r, ok := s.(StatusReporter); ok {
+			statuses[r.StatusName()] = r.Status()
+		}
+
+		u, ok := s.(interface{ Unwrap() Store })
+		if !ok {
+			break
+		}
+		s = u.Unwrap()
+	}
+
+	return statuses
+}
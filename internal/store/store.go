@@ -2,44 +2,190 @@ package store
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"endorsement-distribution/internal/clock"
 	"endorsement-distribution/internal/config"
 	"errors"
 	"fmt"
+	"mime"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/fxamacker/cbor/v2"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/veraison/corim/comid"
 	"github.com/veraison/corim/coserv"
 	"github.com/veraison/services/scheme/common/arm"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
-// Store interface for database operations
+// tracer creates the spans of the distributor and the stores
+var tracer = otel.Tracer("endorsement-distribution/internal/store")
+
+// endSpan records err, if any, on span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Store interface for database operations. Every call is bound to ctx, so
+// that a cancelled request or a shutdown deadline aborts it.
 type Store interface {
-	Get(key string) ([][]byte, error)
-	Set(key string, artifacts [][]byte) error
+	Get(ctx context.Context, keys []string) ([]KeyedArtifacts, error)
+	Set(ctx context.Context, key string, artifacts [][]byte) error
+	SetWithProfile(ctx context.Context, key, profile, artifactType string, expiresAt time.Time, artifacts [][]byte) (SetOutcome, error)
+	SetIfAbsent(ctx context.Context, profile string, entries []KeyedArtifacts) error
+	Append(ctx context.Context, key string, artifact []byte) error
+	Exists(ctx context.Context, keys []string) (bool, error)
+	StoredProfile(ctx context.Context, key string) (string, error)
+	DeleteByTenant(ctx context.Context, tenantID string) (int64, error)
+	Count(ctx context.Context) (int64, error)
+	CountByTenant(ctx context.Context) (map[string]int64, error)
+	Ping(ctx context.Context) error
 	Close() error
 }
 
+// SetOutcome tells whether SetWithProfile wrote anything
+type SetOutcome int
+
+const (
+	// SetUpdated is for artifacts written, replacing any stored before
+	SetUpdated SetOutcome = iota
+	// SetUnchanged is for a key that already held the same artifacts,
+	// profile and artifact type, and so wasn't written to but for its
+	// expiry
+	SetUnchanged
+)
+
+// KeyedArtifacts holds the artifacts stored under one key
+type KeyedArtifacts struct {
+	Key       string
+	Artifacts [][]byte
+
+	// ArtifactType is recorded by SetIfAbsent ("" if unknown), and
+	// ExpiresAt is when it stops serving the artifacts (zero for never).
+	// Get leaves them empty.
+	ArtifactType string
+	ExpiresAt    time.Time
+
+	// Profile is the profile Get found the artifacts stored under ("" if
+	// none was recorded)
+	Profile string
+}
+
+// Artifact type names recorded with stored artifacts
+const (
+	ArtifactTypeReferenceValues = "reference-values"
+	ArtifactTypeTrustAnchors    = "trust-anchors"
+)
+
+// ErrNoArtifacts is returned when nothing is stored for a query's keys, or
+// nothing is left once the query's filters are applied
+var ErrNoArtifacts = errors.New("no artifacts found")
+
+// ErrGone is returned when nothing is stored for a query's keys, but some of
+// them were deleted recently enough to still be remembered
+var ErrGone = errors.New("artifacts deleted")
+
+// ErrExists is returned by SetIfAbsent when a key already holds artifacts
+var ErrExists = errors.New("artifacts already stored")
+
+// ErrArtifactsTooLarge is returned by Set when the artifacts for a key add up
+// to more bytes than the configured limit
+var ErrArtifactsTooLarge = errors.New("artifacts too large")
+
+// ErrStoredProfileMismatch is returned by GetEndorsements when the artifacts
+// stored for a query were ingested under a profile other than the query's
+var ErrStoredProfileMismatch = errors.New("profile not supported by stored data")
+
+// ErrProfileMismatch is returned by GetEndorsements when the profile asked for
+// in the media type contradicts the profile carried by the CoSERV query
+var ErrProfileMismatch = errors.New("profile mismatch")
+
+// ErrMalformedQuery is returned when a CoSERV query is not base64url, or
+// doesn't decode to well-formed CBOR
+var ErrMalformedQuery = errors.New("malformed CoSERV query")
+
+// ErrInvalidQuery is returned when a CoSERV query is well-formed CBOR but not
+// a valid CoSERV query. It wraps ErrMalformedQuery: either way the client
+// sent something that can't be answered.
+var ErrInvalidQuery = fmt.Errorf("%w: not a valid CoSERV query", ErrMalformedQuery)
+
+// ErrQueryTooBroad is returned by GetEndorsements when a query resolves to
+// more lookup keys than configured
+var ErrQueryTooBroad = errors.New("query too broad")
+
+// ErrUnsupportedArtifactType is returned by GetEndorsements for queries of
+// an artifact type this distributor doesn't serve
+var ErrUnsupportedArtifactType = errors.New("unsupported artifact type")
+
+// ErrUnsupportedProfile is returned by GetEndorsements for queries of a
+// profile outside the configured supported profiles
+var ErrUnsupportedProfile = errors.New("unsupported profile")
+
 // PostgresStore implements Store interface using PostgreSQL
 type PostgresStore struct {
 	pool   *pgxpool.Pool
 	logger *zap.SugaredLogger
+
+	// maxValueBytes caps the size of a kv_val accepted by Get (0 disables)
+	maxValueBytes int
+
+	// maxSetBytes caps the total size of the artifacts passed to Set
+	maxSetBytes int
+
+	// writeSlots holds a token per write transaction in flight; it is nil
+	// when their number is not limited
+	writeSlots chan struct{}
 }
 
 // NewPostgresStore creates a new PostgreSQL store
-func NewPostgresStore(cfg config.DatabaseConfig) (*PostgresStore, error) {
+func NewPostgresStore(cfg config.DatabaseConfig, logger *zap.SugaredLogger) (*PostgresStore, error) {
 	dsn := fmt.Sprintf("postgresql://%s:%s@%s:%d/%s?sslmode=%s",
 		cfg.User, cfg.Password, cfg.Host, cfg.Port, cfg.Name, cfg.SSLMode)
 
-	pool, err := pgxpool.New(context.Background(), dsn)
+	poolCfg, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse connection string: %w", err)
+	}
+
+	if cfg.MaxConns > 0 {
+		poolCfg.MaxConns = int32(cfg.MaxConns)
+	}
+	if cfg.MinConns > 0 {
+		poolCfg.MinConns = int32(cfg.MinConns)
+	}
+	if cfg.MaxConnLifetime > 0 {
+		poolCfg.MaxConnLifetime = cfg.MaxConnLifetime
+	}
+
+	pool, err := pgxpool.NewWithConfig(context.Background(), poolCfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create connection pool: %w", err)
 	}
 
 	store := &PostgresStore{
-		pool: pool,
+		pool:          pool,
+		logger:        logger,
+		maxValueBytes: cfg.MaxValueBytes,
+		maxSetBytes:   cfg.MaxSetBytes,
+	}
+
+	if cfg.MaxConcurrentWrites > 0 {
+		store.writeSlots = make(chan struct{}, cfg.MaxConcurrentWrites)
 	}
 
 	// Test connection
@@ -48,226 +194,1450 @@ func NewPostgresStore(cfg config.DatabaseConfig) (*PostgresStore, error) {
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	// Setup table if it doesn't exist
-	if err := store.setupTable(); err != nil {
+	// Bring the schema up to date
+	if err := store.migrate(context.Background()); err != nil {
 		pool.Close()
-		return nil, fmt.Errorf("failed to setup table: %w", err)
+		return nil, fmt.Errorf("failed to migrate schema: %w", err)
 	}
 
 	return store, nil
 }
 
-// setupTable creates the endorsements table if it doesn't exist
-func (s *PostgresStore) setupTable() error {
+// Get retrieves the artifacts stored under each of the keys, in a single
+// query. Results come back in the order of keys; keys with nothing stored,
+// whose artifacts have expired, or whose value is too large or can't be
+// decoded, are left out. An error is
+// only returned if none of the keys yields any artifact.
+func (s *PostgresStore) Get(ctx context.Context, keys []string) ([]KeyedArtifacts, error) {
+	ctx, span := tracer.Start(ctx, "PostgresStore.Get", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.system", "postgresql"), attribute.Int("keys", len(keys))))
+	defer span.End()
+
+	// Oversized values are not shipped back: only their length is, so that
+	// a runaway row can't make us allocate a huge buffer
 	query := `
-		CREATE TABLE IF NOT EXISTS endorsements (
-			kv_key text NOT NULL,
-			kv_val text NOT NULL
-		);
-		CREATE INDEX IF NOT EXISTS idx_endorsements_key ON endorsements(kv_key);
+		SELECT kv_key, octet_length(kv_val),
+		       CASE WHEN $2 <= 0 OR octet_length(kv_val) <= $2 THEN kv_val ELSE '' END,
+		       COALESCE(kv_profile, '')
+		FROM endorsements
+		WHERE kv_key = ANY($1::text[]) AND (expires_at IS NULL OR expires_at > now())
+		ORDER BY array_position($1::text[], kv_key), kv_seq
 	`
 
-	_, err := s.pool.Exec(context.Background(), query)
-	return err
-}
-
-// Get retrieves artifacts for a given key
-func (s *PostgresStore) Get(key string) ([][]byte, error) {
-	query := `SELECT kv_val FROM endorsements WHERE kv_key = $1`
-
-	rows, err := s.pool.Query(context.Background(), query, key)
+	rows, err := s.pool.Query(ctx, query, keys, s.maxValueBytes)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query database: %w", err)
 	}
 	defer rows.Close()
 
-	var artifacts [][]byte
+	var (
+		found   []KeyedArtifacts
+		failed  = make(map[string]bool)
+		lastErr error
+	)
 	for rows.Next() {
-		var val string
-		if err := rows.Scan(&val); err != nil {
+		var (
+			key     string
+			size    int
+			val     string
+			profile string
+		)
+		if err := rows.Scan(&key, &size, &val, &profile); err != nil {
 			return nil, fmt.Errorf("failed to scan row: %w", err)
 		}
 
-		// Parse JSON array of artifacts
-		var artifactArray []string
-		if err := json.Unmarshal([]byte(val), &artifactArray); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal artifacts: %w", err)
+		if failed[key] {
+			continue
 		}
 
-		// Convert base64 strings to bytes
-		for _, artifactStr := range artifactArray {
-			artifact, err := s.decodeArtifact(artifactStr)
-			if err != nil {
-				return nil, fmt.Errorf("failed to decode artifact: %w", err)
+		artifacts, err := s.decodeRow(key, size, val)
+		if err != nil {
+			s.logger.Debugw("Skipping key with unusable value", "key", key, "error", err)
+			failed[key] = true
+			lastErr = err
+			continue
+		}
+
+		// Rows are ordered by key, so those of the same key are adjacent,
+		// and then in the order they were written
+		if n := len(found); n > 0 && found[n-1].Key == key {
+			ka := &found[n-1]
+			if ka.Profile != "" && profile != "" && ka.Profile != profile {
+				return nil, fmt.Errorf("conflicting profiles stored for key %s: %q and %q", key, ka.Profile, profile)
 			}
-			artifacts = append(artifacts, artifact)
+			ka.Artifacts = append(ka.Artifacts, artifacts...)
+			if ka.Profile == "" {
+				ka.Profile = profile
+			}
+		} else {
+			found = append(found, KeyedArtifacts{Key: key, Artifacts: artifacts, Profile: profile})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read rows: %w", err)
+	}
+
+	// Drop keys a later row of which turned out to be unusable
+	var result []KeyedArtifacts
+	for _, ka := range found {
+		if !failed[ka.Key] && len(ka.Artifacts) > 0 {
+			result = append(result, ka)
 		}
 	}
 
-	if len(artifacts) == 0 {
-		return nil, fmt.Errorf("no artifacts found for key: %s", key)
+	if len(result) == 0 {
+		if lastErr != nil {
+			return nil, lastErr
+		}
+		return nil, fmt.Errorf("%w for keys: %v", ErrNoArtifacts, keys)
 	}
 
-	return artifacts, nil
+	return result, nil
 }
 
-// Set stores artifacts for a given key
-func (s *PostgresStore) Set(key string, artifacts [][]byte) error {
-	// Convert artifacts to base64 strings
-	var artifactStrings []string
-	for _, artifact := range artifacts {
-		artifactStr := s.encodeArtifact(artifact)
-		artifactStrings = append(artifactStrings, artifactStr)
+// decodeRow checks the size of a stored value and decodes it
+func (s *PostgresStore) decodeRow(key string, size int, val string) ([][]byte, error) {
+	if s.maxValueBytes > 0 && size > s.maxValueBytes {
+		s.logger.Warnw("Stored value exceeds size limit", "key", key, "size", size, "limit", s.maxValueBytes)
+		return nil, fmt.Errorf("stored value too large: %d bytes (limit %d)", size, s.maxValueBytes)
+	}
+
+	artifacts, err := s.decodeValue(val)
+	if errors.Is(err, ErrUnsupportedValueFormat) {
+		s.logger.Warnw("Stored value is in an unknown format", "key", key, "error", err)
+	}
+
+	return artifacts, err
+}
+
+// Set stores artifacts for a given key, without recording a profile or
+// artifact type
+func (s *PostgresStore) Set(ctx context.Context, key string, artifacts [][]byte) error {
+	_, err := s.SetWithProfile(ctx, key, "", "", time.Time{}, artifacts)
+	return err
+}
+
+// SetWithProfile stores artifacts for a given key, recording the profile
+// and artifact type they were ingested under ("" if unknown) and when they
+// expire (zero for never). The tenant is recorded from the key. A key
+// already holding the same is left alone but for its expiry, and
+// SetUnchanged returned.
+func (s *PostgresStore) SetWithProfile(ctx context.Context, key, profile, artifactType string, expiresAt time.Time, artifacts [][]byte) (SetOutcome, error) {
+	if err := checkArtifactsSize(artifacts, s.maxSetBytes); err != nil {
+		return SetUpdated, err
 	}
 
-	// Convert to JSON
-	val, err := json.Marshal(artifactStrings)
+	val, err := s.encodeValue(artifacts)
 	if err != nil {
-		return fmt.Errorf("failed to marshal artifacts: %w", err)
+		return SetUpdated, err
 	}
 
+	// Wait for a write slot before taking a connection from the pool
+	release, err := s.acquireWriteSlot(ctx)
+	if err != nil {
+		return SetUpdated, err
+	}
+	defer release()
+
 	// Delete existing entries and insert new one
-	tx, err := s.pool.Begin(context.Background())
+	tx, err := s.pool.Begin(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
+		return SetUpdated, fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer tx.Rollback(context.Background())
 
+	if err := lockKeys(ctx, tx, []string{key}); err != nil {
+		return SetUpdated, err
+	}
+
+	// Skip the write if the key already holds exactly this value. The rows
+	// are locked so a concurrent Set can't slip in between the comparison
+	// and the rewrite.
+	unchanged, err := s.isUnchanged(ctx, tx, key, profile, artifactType, val)
+	if err != nil {
+		return SetUpdated, err
+	}
+	if unchanged {
+		s.logger.Debugw("Skipping write of unchanged artifacts", "key", key)
+
+		// Ingesting the same artifacts again still renews them
+		_, err := tx.Exec(ctx, `
+			UPDATE endorsements SET expires_at = $2
+			WHERE kv_key = $1 AND expires_at IS DISTINCT FROM $2`,
+			key, expiryParam(expiresAt))
+		if err != nil {
+			return SetUpdated, fmt.Errorf("failed to update expiry: %w", err)
+		}
+
+		return SetUnchanged, tx.Commit(ctx)
+	}
+
 	// Delete existing
-	_, err = tx.Exec(context.Background(), "DELETE FROM endorsements WHERE kv_key = $1", key)
+	_, err = tx.Exec(ctx, "DELETE FROM endorsements WHERE kv_key = $1", key)
 	if err != nil {
-		return fmt.Errorf("failed to delete existing artifacts: %w", err)
+		return SetUpdated, fmt.Errorf("failed to delete existing artifacts: %w", err)
 	}
 
 	// Insert new
-	_, err = tx.Exec(context.Background(), "INSERT INTO endorsements (kv_key, kv_val) VALUES ($1, $2)", key, string(val))
+	_, err = tx.Exec(ctx, insertQuery, key, string(val), profile, tenantOf(key), artifactType, expiryParam(expiresAt))
 	if err != nil {
-		return fmt.Errorf("failed to insert artifacts: %w", err)
+		return SetUpdated, fmt.Errorf("failed to insert artifacts: %w", err)
 	}
 
-	return tx.Commit(context.Background())
+	return SetUpdated, tx.Commit(ctx)
 }
 
-// Close closes the database connection
-func (s *PostgresStore) Close() error {
-	s.pool.Close()
-	return nil
+// insertQuery writes one row of a key; empty strings are recorded as NULL
+const insertQuery = `
+	INSERT INTO endorsements (kv_key, kv_val, kv_profile, tenant_id, artifact_type, expires_at)
+	VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), NULLIF($5, ''), $6)`
+
+// expiryParam returns expiresAt as an expires_at parameter: NULL if it is
+// zero, for artifacts that never expire
+func expiryParam(expiresAt time.Time) *time.Time {
+	if expiresAt.IsZero() {
+		return nil
+	}
+	return &expiresAt
 }
 
-// encodeArtifact encodes artifact data to base64
-func (s *PostgresStore) encodeArtifact(data []byte) string {
-	// In a real implementation, you might use a more sophisticated encoding
-	// For now, we'll use base64
-	return fmt.Sprintf("%x", data) // Simple hex encoding for demo
+// SetIfAbsent stores the artifacts of each entry under its key, recording
+// profile and the entry's artifact type and expiry, unless any of the keys
+// already holds artifacts that haven't expired: then nothing is written and
+// ErrExists is returned
+func (s *PostgresStore) SetIfAbsent(ctx context.Context, profile string, entries []KeyedArtifacts) error {
+	vals := make([][]byte, len(entries))
+	keys := make([]string, len(entries))
+	for i, e := range entries {
+		if err := checkArtifactsSize(e.Artifacts, s.maxSetBytes); err != nil {
+			return err
+		}
+
+		val, err := s.encodeValue(e.Artifacts)
+		if err != nil {
+			return err
+		}
+		vals[i], keys[i] = val, e.Key
+	}
+
+	release, err := s.acquireWriteSlot(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	// Absent keys have no rows to lock, so the check is made under the key
+	// locks Set also takes
+	if err := lockKeys(ctx, tx, keys); err != nil {
+		return err
+	}
+
+	for i, key := range keys {
+		var exists bool
+		err := tx.QueryRow(ctx, `
+			SELECT EXISTS (
+				SELECT 1 FROM endorsements
+				WHERE kv_key = $1 AND (expires_at IS NULL OR expires_at > now())
+			)`, key).Scan(&exists)
+		if err != nil {
+			return fmt.Errorf("failed to check for existing artifacts: %w", err)
+		}
+		if exists {
+			return fmt.Errorf("%w under %s", ErrExists, key)
+		}
+
+		// Expired artifacts are no longer there as far as readers can
+		// tell, so they are replaced
+		_, err = tx.Exec(ctx, "DELETE FROM endorsements WHERE kv_key = $1", key)
+		if err != nil {
+			return fmt.Errorf("failed to delete expired artifacts: %w", err)
+		}
+
+		_, err = tx.Exec(ctx, insertQuery, key, string(vals[i]), profile, tenantOf(key),
+			entries[i].ArtifactType, expiryParam(entries[i].ExpiresAt))
+		if err != nil {
+			return fmt.Errorf("failed to insert artifacts: %w", err)
+		}
+	}
+
+	return tx.Commit(ctx)
 }
 
-// decodeArtifact decodes artifact data from base64
-func (s *PostgresStore) decodeArtifact(encoded string) ([]byte, error) {
-	// In a real implementation, you'd decode from the actual encoding used
-	// For now, we'll assume hex encoding
-	return []byte(encoded), nil // Simplified for demo
+// Append adds artifact to those stored under key, as a row of its own, so
+// that the existing artifacts are neither read back nor rewritten. The size
+// limit applies to the stored artifacts and the appended one together; the
+// stored ones are sized in the database, from the length of their base64.
+func (s *PostgresStore) Append(ctx context.Context, key string, artifact []byte) error {
+	if err := checkArtifactsSize([][]byte{artifact}, s.maxSetBytes); err != nil {
+		return err
+	}
+
+	val, err := s.encodeValue([][]byte{artifact})
+	if err != nil {
+		return err
+	}
+
+	release, err := s.acquireWriteSlot(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	// Under the key lock, a concurrent Set either replaces the set before
+	// the append or includes it in what it deletes
+	if err := lockKeys(ctx, tx, []string{key}); err != nil {
+		return err
+	}
+
+	if s.maxSetBytes > 0 {
+		stored, err := storedSize(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+		if err := checkSize(stored+int64(len(artifact)), s.maxSetBytes); err != nil {
+			return err
+		}
+	}
+
+	// The new row carries the key's profile, artifact type and expiry, so
+	// that StoredProfile keeps seeing a single one and the key expires as a
+	// whole
+	_, err = tx.Exec(ctx, `
+		INSERT INTO endorsements (kv_key, kv_val, kv_profile, tenant_id, artifact_type, expires_at)
+		SELECT $1, $2, max(kv_profile), NULLIF($3, ''), max(artifact_type), max(expires_at)
+		FROM endorsements WHERE kv_key = $1`,
+		key, string(val), tenantOf(key))
+	if err != nil {
+		return fmt.Errorf("failed to append artifact: %w", err)
+	}
+
+	return tx.Commit(ctx)
 }
 
-// EndorsementDistributor handles endorsement distribution logic
-type EndorsementDistributor struct {
-	store  Store
-	logger *zap.SugaredLogger
+// DeleteByTenant removes everything stored for tenantID, e.g. when it is
+// offboarded, and returns the number of keys removed. Rows written before
+// the tenant was recorded are matched on their key.
+func (s *PostgresStore) DeleteByTenant(ctx context.Context, tenantID string) (int64, error) {
+	release, err := s.acquireWriteSlot(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	var n int64
+	err = s.pool.QueryRow(ctx, `
+		WITH deleted AS (
+			DELETE FROM endorsements
+			WHERE tenant_id = $1
+			   OR (tenant_id IS NULL AND split_part(split_part(kv_key, '://', 2), '/', 1) = $1)
+			RETURNING kv_key
+		)
+		SELECT count(DISTINCT kv_key) FROM deleted`, tenantID).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete tenant artifacts: %w", err)
+	}
+
+	return n, nil
 }
 
-type SynthCoservQueryKeysArgs struct {
-	TenantID string
-	Query    string
+// acquireWriteSlot waits for one of the MaxConcurrentWrites slots, unless
+// ctx is done first. The returned function gives the slot back.
+func (s *PostgresStore) acquireWriteSlot(ctx context.Context) (func(), error) {
+	if s.writeSlots == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case s.writeSlots <- struct{}{}:
+		return func() { <-s.writeSlots }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for a write slot: %w", ctx.Err())
+	}
 }
 
-// NewEndorsementDistributor creates a new endorsement distributor
-func NewEndorsementDistributor(store Store, logger *zap.SugaredLogger) *EndorsementDistributor {
-	return &EndorsementDistributor{
-		store:  store,
-		logger: logger,
+// lockKeys takes transaction-scoped advisory locks on keys, in a fixed order
+// so that concurrent writers of overlapping keys can't deadlock
+func lockKeys(ctx context.Context, tx pgx.Tx, keys []string) error {
+	sorted := slices.Clone(keys)
+	slices.Sort(sorted)
+
+	for _, key := range slices.Compact(sorted) {
+		if _, err := tx.Exec(ctx,
+			"SELECT pg_advisory_xact_lock(hashtextextended($1, 0))", key); err != nil {
+			return fmt.Errorf("failed to lock key: %w", err)
+		}
 	}
+
+	return nil
 }
 
-// GetEndorsements retrieves endorsements for a CoSERV query
-func (ed *EndorsementDistributor) GetEndorsements(tenantID, coservQuery, mediaType string) ([]byte, error) {
-	// Parse CoSERV query
-	var coserv coserv.Coserv
-	if err := coserv.FromBase64Url(coservQuery); err != nil {
-		return nil, fmt.Errorf("failed to parse CoSERV query: %w", err)
+// storedSize returns the total size of the artifacts stored under key, as
+// decoded from their base64, in either value format
+func storedSize(ctx context.Context, tx pgx.Tx, key string) (int64, error) {
+	query := `
+		SELECT coalesce(sum(length(a.artifact) / 4 * 3 - (length(a.artifact) - length(rtrim(a.artifact, '=')))), 0)
+		FROM endorsements,
+		     jsonb_array_elements_text(CASE WHEN jsonb_typeof(kv_val::jsonb) = 'array'
+		                                    THEN kv_val::jsonb ELSE kv_val::jsonb -> 'artifacts' END) AS a(artifact)
+		WHERE kv_key = $1
+	`
+
+	var size int64
+	if err := tx.QueryRow(ctx, query, key).Scan(&size); err != nil {
+		return 0, fmt.Errorf("failed to size stored artifacts: %w", err)
 	}
 
-	// Generate database key
-	key, err := GenerateKey(tenantID, coservQuery)
+	return size, nil
+}
+
+// isUnchanged reports whether key is stored as a single row with the given
+// profile and artifact type, and whose value has the same digest as val.
+// Only digests are read back, not the values.
+func (s *PostgresStore) isUnchanged(ctx context.Context, tx pgx.Tx, key, profile, artifactType string, val []byte) (bool, error) {
+	query := `
+		SELECT encode(sha256(convert_to(kv_val, 'UTF8')), 'hex'), coalesce(kv_profile, ''),
+		       coalesce(artifact_type, '')
+		FROM endorsements WHERE kv_key = $1
+		FOR UPDATE
+	`
+
+	rows, err := tx.Query(ctx, query, key)
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate key: %w", err)
+		return false, fmt.Errorf("failed to query stored digest: %w", err)
 	}
 
-	ed.logger.Infow("Fetching endorsements", "key", key)
+	type stored struct {
+		Digest       string
+		Profile      string
+		ArtifactType string
+	}
 
-	// Get artifacts from database
-	artifacts, err := ed.store.Get(key)
+	existing, err := pgx.CollectRows(rows, pgx.RowToStructByPos[stored])
 	if err != nil {
-		return nil, fmt.Errorf("failed to get artifacts: %w", err)
+		return false, fmt.Errorf("failed to read stored digest: %w", err)
 	}
 
-	// Get profile for result
-	profile, err := GetProfile()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get profile: %w", err)
+	if len(existing) != 1 || existing[0].Profile != profile || existing[0].ArtifactType != artifactType {
+		return false, nil
 	}
 
-	// Create CoSERV result
-	result := coserv.CreateResult(profile, coserv.Query.ArtifactType, artifacts)
+	digest := sha256.Sum256(val)
+
+	return existing[0].Digest == hex.EncodeToString(digest[:]), nil
+}
+
+// Exists reports whether any of the keys holds artifacts that haven't
+// expired, without reading them
+func (s *PostgresStore) Exists(ctx context.Context, keys []string) (bool, error) {
+	query := `
+		SELECT 1 FROM endorsements
+		WHERE kv_key = ANY($1::text[]) AND (expires_at IS NULL OR expires_at > now())
+		LIMIT 1`
+
+	var one int
+	if err := s.pool.QueryRow(ctx, query, keys).Scan(&one); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to query database: %w", err)
+	}
 
-	// Convert to CBOR
-	resultData, err := result.ToCBOR()
+	return true, nil
+}
+
+// StoredProfile returns the profile the artifacts under key were ingested
+// with, or "" if none was recorded (e.g. for rows written before profiles
+// were)
+func (s *PostgresStore) StoredProfile(ctx context.Context, key string) (string, error) {
+	query := `
+		SELECT DISTINCT kv_profile FROM endorsements
+		WHERE kv_key = $1 AND kv_profile IS NOT NULL
+	`
+
+	rows, err := s.pool.Query(ctx, query, key)
 	if err != nil {
-		return nil, fmt.Errorf("failed to encode result: %w", err)
+		return "", fmt.Errorf("failed to query stored profile: %w", err)
 	}
 
-	return resultData, nil
+	profiles, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return "", fmt.Errorf("failed to read stored profile: %w", err)
+	}
+
+	switch len(profiles) {
+	case 0:
+		return "", nil
+	case 1:
+		return profiles[0], nil
+	default:
+		return "", fmt.Errorf("conflicting profiles stored for key %s: %v", key, profiles)
+	}
 }
 
-// GenerateKey generates lookup keys for a given tenant and CoSERV query.
-// It synthesizes keys based on the artifact type and environment selector.
-func GenerateKey(tenantID string, query string) ([]string, error) {
-	var q coserv.Coserv
-	if err := q.FromBase64Url(query); err != nil {
-		return nil, err
+// Count returns the number of distinct keys stored
+func (s *PostgresStore) Count(ctx context.Context) (int64, error) {
+	var n int64
+	if err := s.pool.QueryRow(ctx, `SELECT count(DISTINCT kv_key) FROM endorsements`).Scan(&n); err != nil {
+		return 0, fmt.Errorf("failed to count keys: %w", err)
 	}
 
-	var keys []string
+	return n, nil
+}
 
-	switch q.Query.ArtifactType {
-	case coserv.ArtifactTypeReferenceValues:
-		s := q.Query.EnvironmentSelector
+// CountByTenant returns the number of distinct keys stored for each tenant.
+// The tenant is the authority part of the key (scheme://tenant/...).
+func (s *PostgresStore) CountByTenant(ctx context.Context) (map[string]int64, error) {
+	query := `
+		SELECT coalesce(tenant_id, split_part(split_part(kv_key, '://', 2), '/', 1)) AS tenant,
+		       count(DISTINCT kv_key)
+		FROM endorsements
+		GROUP BY tenant
+	`
 
-		if s.Classes != nil {
-			for i, v := range *s.Classes {
-				implID, err := extractImplID(v)
-				if err != nil {
-					return nil, fmt.Errorf("creating lookup key for class[%d]: %w", i, err)
-				}
+	rows, err := s.pool.Query(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count keys by tenant: %w", err)
+	}
+	defer rows.Close()
 
-				keys = append(keys, arm.RefValLookupKey(SchemeName, tenantID, implID))
-			}
-			fmt.Println("Ref Val - synthesized Keys are :", keys)
+	counts := make(map[string]int64)
+	for rows.Next() {
+		var (
+			tenant string
+			n      int64
+		)
+		if err := rows.Scan(&tenant, &n); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
 		}
-	case coserv.ArtifactTypeTrustAnchors:
-		s := q.Query.EnvironmentSelector
+		counts[tenant] = n
+	}
 
-		if s.Instances != nil {
-			for i, v := range *s.Instances {
-				instID, err := extractInstID(v)
-				if err != nil {
-					return nil, fmt.Errorf("creating lookup key for instance[%d]: %w", i, err)
-				}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read rows: %w", err)
+	}
+
+	return counts, nil
+}
+
+// iterateBatch is how many keys IterateKeys fetches from its cursor at once
+const iterateBatch = 500
 
-				keys = append(keys, arm.TaCoservLookupKey(SchemeName, tenantID, instID))
+// IterateKeys calls fn, in lexical order, for every distinct key that starts
+// with prefix. Keys are streamed from a server-side cursor, so memory use
+// doesn't grow with the table. Iteration stops at the first error returned
+// by fn, which is passed back, or when ctx is cancelled.
+func (s *PostgresStore) IterateKeys(ctx context.Context, prefix string, fn func(key string) error) error {
+	// Cursors only live within a transaction
+	tx, err := s.pool.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	// DECLARE takes no bind parameters, so the prefix is interpolated (and
+	// escaped) client side by the simple protocol
+	_, err = tx.Exec(ctx, `
+		DECLARE key_cursor NO SCROLL CURSOR FOR
+		SELECT DISTINCT kv_key FROM endorsements
+		WHERE starts_with(kv_key, $1)
+		ORDER BY kv_key
+	`, pgx.QueryExecModeSimpleProtocol, prefix)
+	if err != nil {
+		return fmt.Errorf("failed to declare cursor: %w", err)
+	}
+
+	fetch := fmt.Sprintf("FETCH %d FROM key_cursor", iterateBatch)
+
+	for {
+		rows, err := tx.Query(ctx, fetch)
+		if err != nil {
+			return fmt.Errorf("failed to fetch keys: %w", err)
+		}
+
+		// The whole batch is read before calling fn, so that a slow
+		// callback doesn't hold the rows open
+		keys, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			return fmt.Errorf("failed to read keys: %w", err)
+		}
+
+		for _, key := range keys {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := fn(key); err != nil {
+				return err
 			}
-			fmt.Println("Trust Anchor - synthesized Keys are :", keys)
 		}
-	case coserv.ArtifactTypeEndorsedValues:
-		return nil, fmt.Errorf("CCA does not implement endorsed value queries")
+
+		if len(keys) < iterateBatch {
+			return nil
+		}
+	}
+}
+
+// Ping checks that the database can be reached
+func (s *PostgresStore) Ping(ctx context.Context) error {
+	return s.pool.Ping(ctx)
+}
+
+// Close closes the database connection
+func (s *PostgresStore) Close() error {
+	s.pool.Close()
+	return nil
+}
+
+// checkArtifactsSize returns ErrArtifactsTooLarge if the artifacts add up to
+// more than limit bytes. A limit of 0 disables the check.
+func checkArtifactsSize(artifacts [][]byte, limit int) error {
+	if limit <= 0 {
+		return nil
+	}
+
+	var total int64
+	for _, artifact := range artifacts {
+		total += int64(len(artifact))
+	}
+
+	return checkSize(total, limit)
+}
+
+// checkSize returns ErrArtifactsTooLarge if total is more than limit bytes. A
+// limit of 0 disables the check.
+func checkSize(total int64, limit int) error {
+	if limit > 0 && total > int64(limit) {
+		return fmt.Errorf("%w: %d bytes exceeds the limit of %d", ErrArtifactsTooLarge, total, limit)
+	}
+
+	return nil
+}
+
+// valueFormatVersion is the format version SetWithProfile writes kv_val in.
+// Version 1 is the bare JSON array of base64 artifacts written before a
+// version was recorded; version 2 wraps that array in an object carrying the
+// version, so that values in later formats can be told apart.
+const valueFormatVersion = 2
+
+// ErrUnsupportedValueFormat is returned when a stored value was written in a
+// format version this build doesn't know how to read
+var ErrUnsupportedValueFormat = errors.New("unsupported stored value format")
+
+// storedValue is the versioned form of kv_val
+type storedValue struct {
+	Version   int      `json:"v"`
+	Artifacts []string `json:"artifacts"`
+}
+
+// encodeValue encodes artifacts into a kv_val of the current format version
+func (s *PostgresStore) encodeValue(artifacts [][]byte) ([]byte, error) {
+	// Convert artifacts to base64 strings
+	artifactStrings := make([]string, 0, len(artifacts))
+	for _, artifact := range artifacts {
+		artifactStrings = append(artifactStrings, s.encodeArtifact(artifact))
+	}
+
+	val, err := json.Marshal(storedValue{Version: valueFormatVersion, Artifacts: artifactStrings})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal artifacts: %w", err)
+	}
+
+	return val, nil
+}
+
+// decodeValue decodes a stored kv_val into the artifacts it holds, in any of
+// the format versions known
+func (s *PostgresStore) decodeValue(val string) ([][]byte, error) {
+	var artifactArray []string
+
+	if strings.HasPrefix(strings.TrimSpace(val), "[") {
+		// Version 1: a bare JSON array
+		if err := json.Unmarshal([]byte(val), &artifactArray); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal artifacts: %w", err)
+		}
+	} else {
+		var sv storedValue
+		if err := json.Unmarshal([]byte(val), &sv); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal artifacts: %w", err)
+		}
+
+		switch sv.Version {
+		case 2:
+			artifactArray = sv.Artifacts
+		default:
+			return nil, fmt.Errorf("%w: version %d (this build reads up to %d)",
+				ErrUnsupportedValueFormat, sv.Version, valueFormatVersion)
+		}
+	}
+
+	// Convert base64 strings to bytes
+	artifacts := make([][]byte, 0, len(artifactArray))
+	for _, artifactStr := range artifactArray {
+		artifact, err := s.decodeArtifact(artifactStr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode artifact: %w", err)
+		}
+		artifacts = append(artifacts, artifact)
+	}
+
+	return artifacts, nil
+}
+
+// encodeArtifact encodes artifact data to base64
+func (s *PostgresStore) encodeArtifact(data []byte) string {
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// decodeArtifact decodes artifact data from base64
+func (s *PostgresStore) decodeArtifact(encoded string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("decoding base64: %w", err)
+	}
+
+	return data, nil
+}
+
+// SchemeName is the attestation scheme lookup keys are synthesized for when
+// no scheme list is configured for the query's profile
+const SchemeName = "ARM_CCA"
+
+// EndorsementDistributor handles endorsement distribution logic
+type EndorsementDistributor struct {
+	store   Store
+	schemes map[string][]string
+	logger  *zap.SugaredLogger
+
+	resultEncoding   string
+	taResultEncoding string
+
+	// strictProfileMatch rejects, rather than just logs, queries whose
+	// profile contradicts the one in the requested media type
+	strictProfileMatch bool
+
+	// strictQueryFields fails queries carrying CBOR fields the CoSERV
+	// structures don't define, rather than ignoring them
+	strictQueryFields bool
+
+	// skipInvalidArtifacts makes ingestion leave out, rather than fail on,
+	// triples that don't decode as valid artifacts of their type
+	skipInvalidArtifacts bool
+
+	// filterStoredProfiles leaves out, rather than fails on, artifacts
+	// stored under a profile other than the query's
+	filterStoredProfiles bool
+
+	// egressRules strip measurement fields from results
+	egressRules []egressRule
+
+	// maxKeys caps the lookup keys fetched for a query (0 disables)
+	maxKeys int
+
+	// decoders interpret the stored artifacts of some profiles
+	decoders map[string]ArtifactDecoder
+
+	// defaultProfile tags results when neither the query nor the stored
+	// artifacts carry a profile
+	defaultProfile string
+
+	// supportedProfiles are the profiles queries may carry or ask for; any
+	// is accepted when empty. It is swapped whole when a ProfileRefresher
+	// fetches a new list.
+	supportedProfiles atomic.Pointer[[]string]
+
+	// ingestTTLs are how long ingested artifacts are served, per artifact
+	// type, unless the ingestion says otherwise
+	ingestTTLs config.IngestTTLConfig
+
+	clock    clock.Clock
+	stats    statsCache
+	statsTTL time.Duration
+
+	// getFailures counts store lookups that failed for a reason other than
+	// there being nothing stored
+	getFailures atomic.Int64
+
+	// drain tracks the operations in flight, for shutdown to wait on
+	drain drainer
+}
+
+type SynthCoservQueryKeysArgs struct {
+	TenantID string
+	Query    string
+}
+
+// NewEndorsementDistributor creates a new endorsement distributor
+func NewEndorsementDistributor(store Store, cfg config.DistributorConfig, logger *zap.SugaredLogger) *EndorsementDistributor {
+	schemes := make(map[string][]string, len(cfg.ProfileSchemes))
+	for _, ps := range cfg.ProfileSchemes {
+		schemes[ps.Profile] = ps.Schemes
+	}
+
+	ed := &EndorsementDistributor{
+		store:                store,
+		schemes:              schemes,
+		logger:               logger,
+		resultEncoding:       cfg.ResultEncoding,
+		taResultEncoding:     cfg.TrustAnchorResultEncoding,
+		strictProfileMatch:   cfg.StrictProfileMatch,
+		filterStoredProfiles: cfg.StoredProfileMismatch == "filter",
+		strictQueryFields:    cfg.UnknownQueryFields == "reject",
+		skipInvalidArtifacts: cfg.InvalidArtifacts == "skip",
+		ingestTTLs:           cfg.IngestTTLs,
+		egressRules:          newEgressRules(cfg.EgressStrip, logger),
+		maxKeys:              cfg.MaxKeysPerQuery,
+		defaultProfile:       cfg.DefaultProfile,
+		clock:                clock.Real{},
+		statsTTL:             cfg.StatsCacheTTL,
+	}
+	ed.SetSupportedProfiles(cfg.SupportedProfiles)
+
+	return ed
+}
+
+// WithClock makes the distributor tell the time using c
+func (ed *EndorsementDistributor) WithClock(c clock.Clock) *EndorsementDistributor {
+	ed.clock = c
+	return ed
+}
+
+// requestLogger returns the distributor's logger, tagged with requestID if
+// there is one
+func (ed *EndorsementDistributor) requestLogger(requestID string) *zap.SugaredLogger {
+	if requestID == "" {
+		return ed.logger
+	}
+	return ed.logger.With("requestID", requestID)
+}
+
+// Ping checks that the store can be reached. It fails once draining has
+// begun, so that the service is taken out of rotation.
+func (ed *EndorsementDistributor) Ping(ctx context.Context) error {
+	done, err := ed.track()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return ed.store.Ping(ctx)
+}
+
+// DeleteTenant removes everything stored for tenantID and returns the
+// number of keys removed
+func (ed *EndorsementDistributor) DeleteTenant(ctx context.Context, tenantID string) (int64, error) {
+	done, err := ed.track()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	return ed.store.DeleteByTenant(ctx, tenantID)
+}
+
+// StoreGetFailures returns the number of store lookups that failed so far,
+// not counting those that just found nothing
+func (ed *EndorsementDistributor) StoreGetFailures() int64 {
+	return ed.getFailures.Load()
+}
+
+// CacheStats counts the keys a CachingStore served from its cache, and those
+// it had to look up in the store behind it
+type CacheStats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+// CacheStats returns the hits and misses of the distributor's store so far,
+// and false if it doesn't cache
+func (ed *EndorsementDistributor) CacheStats() (CacheStats, bool) {
+	cs, ok := ed.store.(*CachingStore)
+	if !ok {
+		return CacheStats{}, false
+	}
+
+	return CacheStats{Hits: cs.Hits(), Misses: cs.Misses()}, true
+}
+
+// GetEndorsements retrieves endorsements for a CoSERV query
+func (ed *EndorsementDistributor) GetEndorsements(ctx context.Context, tenantID, coservQuery, mediaType string, opts QueryOptions) ([]byte, error) {
+	result, err := ed.GetEndorsementsResult(ctx, tenantID, coservQuery, mediaType, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert the result to CBOR
+	_, span := tracer.Start(ctx, "encode_result")
+	resultData, err := result.Encode()
+	endSpan(span, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode result: %w", err)
+	}
+
+	return resultData, nil
+}
+
+// GetEndorsementsResult retrieves endorsements for a CoSERV query like
+// GetEndorsements, but returns the result before it is encoded, for
+// in-process callers that would otherwise have to decode it again
+func (ed *EndorsementDistributor) GetEndorsementsResult(ctx context.Context, tenantID, coservQuery, mediaType string, opts QueryOptions) (*Result, error) {
+	done, err := ed.track()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	logger := ed.requestLogger(opts.RequestID)
+
+	q, requestedProfile, keys, err := ed.lookupKeys(ctx, logger, tenantID, coservQuery, mediaType)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Debugw("Fetching endorsements", "keys", keys)
+
+	// Get artifacts from database
+	groups, err := ed.fetchArtifacts(ctx, keys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get artifacts: %w", err)
+	}
+
+	groups, err = ed.checkStoredProfiles(logger, q, groups)
+	if err != nil {
+		return nil, err
+	}
+
+	queryProfile, _ := q.Profile.Get()
+	groups, err = ed.decodeArtifacts(queryProfile, groups)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode artifacts: %w", err)
+	}
+
+	artifacts := flattenGroups(groups)
+
+	if opts.HashAlgorithm != "" {
+		artifacts, err = filterByHashAlgorithm(q.Query.ArtifactType, artifacts, opts.HashAlgorithm)
+		if err != nil {
+			return nil, fmt.Errorf("failed to filter artifacts: %w", err)
+		}
+		groups = retainInGroups(groups, artifacts)
+	}
+
+	// Remove the fields this tenant or profile must not receive
+	if fields := ed.egressFields(tenantID, queryProfile); len(fields) > 0 {
+		groups, err = stripFields(q.Query.ArtifactType, groups, fields)
+		if err != nil {
+			return nil, fmt.Errorf("failed to strip artifacts: %w", err)
+		}
+		artifacts = flattenGroups(groups)
+	}
+
+	// Select the page asked for, once nothing else will be dropped
+	total := len(artifacts)
+	nextOffset := 0
+	if opts.Offset > 0 || opts.Limit > 0 {
+		artifacts, nextOffset = paginate(artifacts, opts.Offset, opts.Limit)
+		groups = retainInGroups(groups, artifacts)
+	}
+
+	// Get profile for result
+	profile, err := ed.resultProfile(q, requestedProfile, groups)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get profile: %w", err)
+	}
+
+	// Create CoSERV result
+	result, err := ed.newResult(profile, q.Query, artifacts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create result: %w", err)
+	}
+	result.Groups = groups
+	result.Requested = len(keys)
+	result.Total = total
+	result.NextOffset = nextOffset
+
+	return result, nil
+}
+
+// EndorsementsExist reports whether anything is stored under the lookup keys
+// of a CoSERV query, without fetching it. The query is checked as for
+// GetEndorsementsResult, but the filters applied to what is stored are not:
+// a query can exist and still yield an empty result once filtered.
+func (ed *EndorsementDistributor) EndorsementsExist(ctx context.Context, tenantID, coservQuery, mediaType string, opts QueryOptions) (bool, error) {
+	done, err := ed.track()
+	if err != nil {
+		return false, err
+	}
+	defer done()
+
+	logger := ed.requestLogger(opts.RequestID)
+
+	_, _, keys, err := ed.lookupKeys(ctx, logger, tenantID, coservQuery, mediaType)
+	if err != nil {
+		return false, err
+	}
+
+	logger.Debugw("Checking endorsements exist", "keys", keys)
+
+	return ed.store.Exists(ctx, keys)
+}
+
+// lookupKeys parses and checks a CoSERV query, returning it with the profile
+// it asks for and the keys to look up for it
+func (ed *EndorsementDistributor) lookupKeys(ctx context.Context, logger *zap.SugaredLogger, tenantID, coservQuery, mediaType string) (coserv.Coserv, string, []string, error) {
+	// Parse CoSERV query
+	q, err := parseQuery(coservQuery, ed.strictQueryFields)
+	if err != nil {
+		return coserv.Coserv{}, "", nil, fmt.Errorf("failed to parse CoSERV query: %w", err)
+	}
+
+	if err := checkArtifactType(q.Query.ArtifactType); err != nil {
+		return coserv.Coserv{}, "", nil, err
+	}
+
+	requestedProfile, err := ed.checkProfile(logger, q, mediaType)
+	if err != nil {
+		return coserv.Coserv{}, "", nil, err
+	}
+
+	if err := ed.checkSupportedProfile(q, requestedProfile); err != nil {
+		return coserv.Coserv{}, "", nil, err
+	}
+
+	keys, err := ed.synthesizeKeys(ctx, tenantID, q)
+	if err != nil {
+		return coserv.Coserv{}, "", nil, err
+	}
+
+	if ed.maxKeys > 0 && len(keys) > ed.maxKeys {
+		return coserv.Coserv{}, "", nil, fmt.Errorf("%w: it resolves to %d lookup keys, more than the %d allowed; narrow your query",
+			ErrQueryTooBroad, len(keys), ed.maxKeys)
+	}
+
+	return q, requestedProfile, keys, nil
+}
+
+// synthesizeKeys generates the lookup keys of a query for every scheme its
+// profile maps to
+func (ed *EndorsementDistributor) synthesizeKeys(ctx context.Context, tenantID string, q coserv.Coserv) (keys []string, err error) {
+	_, span := tracer.Start(ctx, "synthesize_keys")
+	defer func() { endSpan(span, err) }()
+
+	for _, scheme := range ed.schemesFor(q) {
+		schemeKeys, err := generateKeys(scheme, tenantID, q)
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to generate key: %v", ErrInvalidQuery, err)
+		}
+		keys = append(keys, schemeKeys...)
+	}
+
+	// Schemes may share key formats, so keys can repeat across them too
+	keys = dedupeKeys(keys)
+	span.SetAttributes(attribute.Int("keys", len(keys)))
+
+	return keys, nil
+}
+
+// checkArtifactType rejects the artifact types there is no key synthesis
+// for, before anything is looked up
+func checkArtifactType(t coserv.ArtifactType) error {
+	switch t {
+	case coserv.ArtifactTypeReferenceValues, coserv.ArtifactTypeTrustAnchors:
+		return nil
+	case coserv.ArtifactTypeEndorsedValues:
+		return fmt.Errorf("%w: endorsed values are not served, only reference values and trust anchors",
+			ErrUnsupportedArtifactType)
+	default:
+		return fmt.Errorf("%w: unknown artifact type %d", ErrUnsupportedArtifactType, t)
+	}
+}
+
+// checkProfile verifies that the profile parameter of the negotiated media
+// type, if any, agrees with the profile carried by the query, and returns
+// it ("" if there is none)
+func (ed *EndorsementDistributor) checkProfile(logger *zap.SugaredLogger, q coserv.Coserv, mediaType string) (string, error) {
+	_, params, err := mime.ParseMediaType(mediaType)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse media type %q: %w", mediaType, err)
+	}
+
+	wanted, ok := params["profile"]
+	if !ok {
+		return "", nil
+	}
+
+	got, err := q.Profile.Get()
+	if err != nil || got == "" {
+		// Nothing in the query to contradict
+		return wanted, nil
+	}
+
+	if wanted == got {
+		return wanted, nil
+	}
+
+	if !ed.strictProfileMatch {
+		logger.Warnw("Query profile differs from requested profile",
+			"queryProfile", got, "requestedProfile", wanted)
+		return wanted, nil
+	}
+
+	return "", fmt.Errorf("%w: query carries profile %q but %q was requested",
+		ErrProfileMismatch, got, wanted)
+}
+
+// SupportedProfiles returns the profiles queries may carry or ask for, or
+// nil if any is accepted
+func (ed *EndorsementDistributor) SupportedProfiles() []string {
+	return *ed.supportedProfiles.Load()
+}
+
+// SetSupportedProfiles replaces the profiles queries may carry or ask for;
+// queries already past the check aren't affected
+func (ed *EndorsementDistributor) SetSupportedProfiles(profiles []string) {
+	profiles = slices.Clone(profiles)
+	ed.supportedProfiles.Store(&profiles)
+}
+
+// checkSupportedProfile fails queries whose profile, or the one requested in
+// the media type, isn't one of the supported profiles. Queries carrying
+// neither are tagged with the default profile, so they pass.
+func (ed *EndorsementDistributor) checkSupportedProfile(q coserv.Coserv, requested string) error {
+	supported := ed.SupportedProfiles()
+	if len(supported) == 0 {
+		return nil
+	}
+
+	for _, profile := range []string{requested, queryProfile(q)} {
+		if profile != "" && !slices.Contains(supported, profile) {
+			return fmt.Errorf("%w %q: supported profiles are %s",
+				ErrUnsupportedProfile, profile, strings.Join(supported, ", "))
+		}
+	}
+
+	return nil
+}
+
+// queryProfile returns the profile a query carries, or "" if none
+func queryProfile(q coserv.Coserv) string {
+	profile, err := q.Profile.Get()
+	if err != nil {
+		return ""
+	}
+	return profile
+}
+
+// resultProfile picks the profile a result is tagged with: the query's,
+// else the one requested in the media type, else the one all the found
+// artifacts were stored under, else the configured default
+func (ed *EndorsementDistributor) resultProfile(q coserv.Coserv, requested string, groups []KeyedArtifacts) (string, error) {
+	if profile, err := q.Profile.Get(); err == nil && profile != "" {
+		return profile, nil
+	}
+
+	if requested != "" {
+		return requested, nil
+	}
+
+	if stored := commonStoredProfile(groups); stored != "" {
+		return stored, nil
+	}
+
+	if ed.defaultProfile == "" {
+		return "", errors.New("no profile in the query or stored artifacts, and no default profile configured")
+	}
+
+	return ed.defaultProfile, nil
+}
+
+// commonStoredProfile returns the profile the groups were stored under, or
+// "" if none was recorded or they disagree. Groups stored without a profile
+// have no say either way.
+func commonStoredProfile(groups []KeyedArtifacts) string {
+	common := ""
+	for _, g := range groups {
+		if g.Profile == "" {
+			continue
+		}
+		if common != "" && g.Profile != common {
+			return ""
+		}
+		common = g.Profile
+	}
+
+	return common
+}
+
+// schemesFor returns the schemes whose stored artifacts may answer a query
+// carrying the given profile. During a migration a profile can map to more
+// than one scheme prefix.
+func (ed *EndorsementDistributor) schemesFor(q coserv.Coserv) []string {
+	profile, err := q.Profile.Get()
+	if err != nil {
+		return []string{SchemeName}
+	}
+
+	return ed.schemesForProfile(profile)
+}
+
+// schemesForProfile returns the schemes configured for a profile, or the
+// default scheme if there are none
+func (ed *EndorsementDistributor) schemesForProfile(profile string) []string {
+	if schemes, ok := ed.schemes[profile]; ok && len(schemes) > 0 {
+		return schemes
+	}
+
+	return []string{SchemeName}
+}
+
+// checkStoredProfiles verifies that the artifacts in each group were stored
+// under the query's profile, or under none. Depending on configuration a
+// mismatch either fails the query or drops the group.
+func (ed *EndorsementDistributor) checkStoredProfiles(logger *zap.SugaredLogger, q coserv.Coserv, groups []KeyedArtifacts) ([]KeyedArtifacts, error) {
+	want, err := q.Profile.Get()
+	if err != nil {
+		// Nothing to compare against
+		return groups, nil
+	}
+
+	var kept []KeyedArtifacts
+	for _, g := range groups {
+		got := g.Profile
+		if got == "" || got == want {
+			kept = append(kept, g)
+			continue
+		}
+
+		if !ed.filterStoredProfiles {
+			return nil, fmt.Errorf("%w: %s stored under %q, queried as %q",
+				ErrStoredProfileMismatch, g.Key, got, want)
+		}
+
+		logger.Debugw("Leaving out artifacts stored under another profile",
+			"key", g.Key, "storedProfile", got, "queryProfile", want)
+	}
+
+	if len(kept) == 0 {
+		return nil, fmt.Errorf("%w for profile %q", ErrNoArtifacts, want)
+	}
+
+	return kept, nil
+}
+
+// fetchArtifacts gets the artifacts stored under each of the keys, grouped
+// by key. Keys with nothing stored are skipped; an error is only returned if
+// none of the keys yields any artifact.
+func (ed *EndorsementDistributor) fetchArtifacts(ctx context.Context, keys []string) ([]KeyedArtifacts, error) {
+	ctx, span := tracer.Start(ctx, "store_get", trace.WithAttributes(attribute.Int("keys", len(keys))))
+	found, err := ed.store.Get(ctx, keys)
+	if errors.Is(err, ErrNoArtifacts) {
+		// Nothing stored is an answer, not a failure
+		span.End()
+	} else {
+		endSpan(span, err)
+	}
+	if err != nil {
+		// A client going away is no fault of the store
+		if !errors.Is(err, ErrNoArtifacts) && !errors.Is(err, ErrGone) && !errors.Is(err, context.Canceled) {
+			ed.getFailures.Add(1)
+		}
+		return nil, err
+	}
+
+	groups := make([]KeyedArtifacts, 0, len(found))
+	for _, ka := range found {
+		groups = append(groups, KeyedArtifacts{Key: ka.Key, Artifacts: dedupeArtifacts(ka.Artifacts, nil), Profile: ka.Profile})
+	}
+
+	return groups, nil
+}
+
+// dedupeArtifacts returns the artifacts that aren't duplicates of an earlier
+// one, nor of those in seen; seen may be nil when not tracking across calls
+func dedupeArtifacts(artifacts [][]byte, seen map[string]struct{}) [][]byte {
+	if seen == nil {
+		seen = make(map[string]struct{})
+	}
+
+	var out [][]byte
+	for _, artifact := range artifacts {
+		if _, ok := seen[string(artifact)]; ok {
+			continue
+		}
+		seen[string(artifact)] = struct{}{}
+		out = append(out, artifact)
+	}
+
+	return out
+}
+
+// GenerateKey generates lookup keys for a given tenant and CoSERV query.
+// It synthesizes keys based on the artifact type and environment selector.
+func GenerateKey(tenantID string, query string) ([]string, error) {
+	q, err := parseQuery(query, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return generateKeys(SchemeName, tenantID, q)
+}
+
+// queryPreviewBytes is how many leading bytes of an undecodable query are
+// quoted back in the error
+const queryPreviewBytes = 8
+
+// strictQueryDecMode decodes queries rejecting unknown fields
+var strictQueryDecMode = func() cbor.DecMode {
+	dm, err := cbor.DecOptions{ExtraReturnErrors: cbor.ExtraDecErrorUnknownField}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	return dm
+}()
+
+// ParseQuery decodes a base64url-encoded CoSERV query, ignoring unknown
+// fields
+func ParseQuery(query string) (coserv.Coserv, error) {
+	return parseQuery(query, false)
+}
+
+// parseQuery decodes a base64url-encoded CoSERV query. The base64url and CBOR
+// layers are decoded separately so that a client sending the wrong encoding
+// (e.g. base64url-encoded JSON) is told so, rather than getting an opaque
+// decoder error; both failures wrap ErrMalformedQuery, and CBOR that isn't a
+// CoSERV query wraps ErrInvalidQuery as well. Padding is optional.
+// With strict set, fields unknown to the CoSERV structures are an error
+// instead of being ignored.
+func parseQuery(query string, strict bool) (coserv.Coserv, error) {
+	var q coserv.Coserv
+
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(query, "="))
+	if err != nil {
+		return q, fmt.Errorf("%w: decoding base64url: %v", ErrMalformedQuery, err)
+	}
+
+	if err := cbor.Wellformed(data); err != nil {
+		preview := data
+		if len(preview) > queryPreviewBytes {
+			preview = preview[:queryPreviewBytes]
+		}
+
+		return q, fmt.Errorf("%w: decoded bytes are not valid CBOR (%d bytes, starting with 0x%x): %v",
+			ErrMalformedQuery, len(data), preview, err)
+	}
+
+	if !strict {
+		if err := q.FromCBOR(data); err != nil {
+			return q, fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+		}
+		return q, nil
+	}
+
+	if err := strictQueryDecMode.Unmarshal(data, &q); err != nil {
+		return q, fmt.Errorf("%w: decoding CoSERV from CBOR: %v", ErrInvalidQuery, err)
+	}
+
+	if err := q.Valid(); err != nil {
+		return q, fmt.Errorf("%w: validating CoSERV: %v", ErrInvalidQuery, err)
+	}
+
+	return q, nil
+}
+
+// generateKeys synthesizes the lookup keys of a parsed CoSERV query for the
+// given scheme and tenant
+func generateKeys(scheme, tenantID string, q coserv.Coserv) ([]string, error) {
+	var keys []string
+
+	switch q.Query.ArtifactType {
+	case coserv.ArtifactTypeReferenceValues:
+		s := q.Query.EnvironmentSelector
+
+		if s.Classes != nil {
+			for i, v := range *s.Classes {
+				implID, err := extractImplID(v)
+				if err != nil {
+					return nil, fmt.Errorf("creating lookup key for class[%d]: %w", i, err)
+				}
+
+				keys = append(keys, arm.RefValLookupKey(scheme, tenantID, implID))
+			}
+		}
+	case coserv.ArtifactTypeTrustAnchors:
+		s := q.Query.EnvironmentSelector
+
+		if s.Instances != nil {
+			for i, v := range *s.Instances {
+				instID, err := extractInstID(v)
+				if err != nil {
+					return nil, fmt.Errorf("creating lookup key for instance[%d]: %w", i, err)
+				}
+
+				keys = append(keys, arm.TaCoservLookupKey(scheme, tenantID, instID))
+			}
+		} else if s.Classes != nil {
+			// Deployments provisioning trust anchors per class key them by
+			// implementation ID where the instance ID would otherwise go
+			for i, v := range *s.Classes {
+				implID, err := extractImplID(v)
+				if err != nil {
+					return nil, fmt.Errorf("creating lookup key for class[%d]: %w", i, err)
+				}
+
+				keys = append(keys, arm.TaCoservLookupKey(scheme, tenantID, implID))
+			}
+		} else {
+			return nil, errors.New("trust anchor queries need instances or classes in the environment selector")
+		}
+	case coserv.ArtifactTypeEndorsedValues:
+		return nil, fmt.Errorf("CCA does not implement endorsed value queries")
+	}
+
+	// Repeated or overlapping selectors yield the same key more than once
+	return dedupeKeys(keys), nil
+}
+
+// dedupeKeys drops the repeats of keys, keeping the first of each in place
+func dedupeKeys(keys []string) []string {
+	seen := make(map[string]struct{}, len(keys))
+
+	out := keys[:0]
+	for _, key := range keys {
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		out = append(out, key)
+	}
+
+	return out
+}
+
+// ValidateQuery parses and validates a base64url-encoded CoSERV query and
+// returns the lookup keys it synthesizes for the given tenant, without
+// touching the store. It lets producers check that their queries resolve.
+func ValidateQuery(tenantID, query string) ([]string, error) {
+	if tenantID == "" {
+		return nil, errors.New("missing tenant ID")
+	}
+
+	keys, err := GenerateKey(tenantID, query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CoSERV query: %w", err)
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("invalid CoSERV query: no lookup keys synthesized from environment selector")
 	}
 
 	return keys, nil
@@ -0,0 +1,791 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"mime"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"endorsement-distribution/internal/config"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/veraison/corim/comid"
+	"github.com/veraison/corim/coserv"
+	"github.com/veraison/services/scheme/common/arm"
+	"github.com/veraison/swid"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+const testProfile = "tag:arm.com,2023:cca_platform#1.0.0"
+
+// encodeQuery returns the base64url encoding of a CoSERV query of profile
+// for the artifacts of type t matching selector
+func encodeQuery(t *testing.T, profile string, at coserv.ArtifactType, selector *coserv.EnvironmentSelector) string {
+	t.Helper()
+
+	q, err := coserv.NewQuery(at, *selector)
+	if err != nil {
+		t.Fatalf("NewQuery: %v", err)
+	}
+
+	c, err := coserv.NewCoserv(profile, *q)
+	if err != nil {
+		t.Fatalf("NewCoserv: %v", err)
+	}
+
+	s, err := c.ToBase64Url()
+	if err != nil {
+		t.Fatalf("ToBase64Url: %v", err)
+	}
+
+	return s
+}
+
+// refValQuery returns a reference value query for the class of
+// comid.TestImplID
+func refValQuery(t *testing.T) string {
+	t.Helper()
+
+	selector := coserv.NewEnvironmentSelector().AddClass(*comid.NewClassImplID(comid.TestImplID))
+	return encodeQuery(t, testProfile, coserv.ArtifactTypeReferenceValues, selector)
+}
+
+// taQuery returns a trust anchor query for the instance of comid.TestUEID
+func taQuery(t *testing.T) string {
+	t.Helper()
+
+	instance, err := comid.NewUEIDInstance(comid.TestUEID)
+	if err != nil {
+		t.Fatalf("NewUEIDInstance: %v", err)
+	}
+
+	selector := coserv.NewEnvironmentSelector().AddInstance(*instance)
+	return encodeQuery(t, testProfile, coserv.ArtifactTypeTrustAnchors, selector)
+}
+
+// queryKeys returns the lookup keys of query for tenant
+func queryKeys(t *testing.T, tenant, query string) []string {
+	t.Helper()
+
+	keys, err := GenerateKey(tenant, query)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	return keys
+}
+
+func TestParseQueryPadding(t *testing.T) {
+	query := refValQuery(t)
+
+	// Encoders that pad produce the same query with up to two '=' appended
+	data, err := base64.RawURLEncoding.DecodeString(query)
+	if err != nil {
+		t.Fatalf("decoding the test query: %v", err)
+	}
+	padded := base64.URLEncoding.EncodeToString(data)
+
+	for _, s := range []string{query, padded} {
+		q, err := ParseQuery(s)
+		if err != nil {
+			t.Fatalf("ParseQuery(%q): %v", s, err)
+		}
+		if q.Query.ArtifactType != coserv.ArtifactTypeReferenceValues {
+			t.Errorf("ParseQuery(%q) artifact type = %v, want reference values", s, q.Query.ArtifactType)
+		}
+	}
+}
+
+func TestParseQueryMalformed(t *testing.T) {
+	query := refValQuery(t)
+
+	notCoserv, err := cbor.Marshal(map[string]int{"a": 1})
+	if err != nil {
+		t.Fatalf("cbor.Marshal: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		query   string
+		invalid bool
+	}{
+		{"not base64", "not*base64!", false},
+		{"standard alphabet", strings.NewReplacer("-", "+", "_", "/").Replace(query) + "+/", false},
+		{"truncated", query[:len(query)/2], false},
+		{"JSON", base64.RawURLEncoding.EncodeToString([]byte(`{"0":"x"}`)), false},
+		{"CBOR that isn't CoSERV", base64.RawURLEncoding.EncodeToString(notCoserv), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseQuery(tt.query)
+			if !errors.Is(err, ErrMalformedQuery) {
+				t.Fatalf("ParseQuery(%q) = %v, want ErrMalformedQuery", tt.query, err)
+			}
+			if got := errors.Is(err, ErrInvalidQuery); got != tt.invalid {
+				t.Errorf("errors.Is(%v, ErrInvalidQuery) = %v, want %v", err, got, tt.invalid)
+			}
+		})
+	}
+}
+
+func TestParseQueryNotCBOR(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"JSON", `{"profile":"x"}`, "(15 bytes, starting with 0x7b2270726f66696c)"},
+		{"short", `{}`, "(2 bytes, starting with 0x7b7d)"},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseQuery(base64.RawURLEncoding.EncodeToString([]byte(tt.data)))
+		if !errors.Is(err, ErrMalformedQuery) {
+			t.Fatalf("%s: ParseQuery = %v, want ErrMalformedQuery", tt.name, err)
+		}
+		if msg := err.Error(); !strings.Contains(msg, "decoded bytes are not valid CBOR") || !strings.Contains(msg, tt.want) {
+			t.Errorf("%s: ParseQuery error %q, want it to say the bytes aren't CBOR %s", tt.name, msg, tt.want)
+		}
+	}
+}
+
+// withUnknownField returns query with a field 9, unknown to CoSERV, added to
+// its top-level map
+func withUnknownField(t *testing.T, query string) string {
+	t.Helper()
+
+	data, err := base64.RawURLEncoding.DecodeString(query)
+	if err != nil {
+		t.Fatalf("decoding the test query: %v", err)
+	}
+
+	var m map[int]cbor.RawMessage
+	if err := cbor.Unmarshal(data, &m); err != nil {
+		t.Fatalf("cbor.Unmarshal: %v", err)
+	}
+	m[9] = cbor.RawMessage{0x01}
+	extended, err := cbor.Marshal(m)
+	if err != nil {
+		t.Fatalf("cbor.Marshal: %v", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(extended)
+}
+
+func TestParseQueryStrictUnknownField(t *testing.T) {
+	query := withUnknownField(t, refValQuery(t))
+
+	if _, err := parseQuery(query, false); err != nil {
+		t.Errorf("lenient parseQuery: %v", err)
+	}
+
+	if _, err := parseQuery(query, true); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("strict parseQuery = %v, want ErrInvalidQuery", err)
+	}
+}
+
+func TestUnknownQueryFieldsPolicy(t *testing.T) {
+	ms, err := NewMemoryStore(config.DatabaseConfig{})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	ctx := context.Background()
+	for _, key := range queryKeys(t, "acme", refValQuery(t)) {
+		if err := ms.Set(ctx, key, [][]byte{[]byte("artifact")}); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	query := withUnknownField(t, refValQuery(t))
+
+	for _, tt := range []struct {
+		policy  string
+		wantErr error
+	}{
+		{"", nil},
+		{"ignore", nil},
+		{"reject", ErrInvalidQuery},
+	} {
+		ed := NewEndorsementDistributor(ms, config.DistributorConfig{
+			ResultEncoding:     "raw",
+			UnknownQueryFields: tt.policy,
+		}, zap.NewNop().Sugar())
+
+		result, err := ed.GetEndorsementsResult(ctx, "acme", query, "application/coserv+cbor", QueryOptions{})
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("policy %q: GetEndorsementsResult = %v, want %v", tt.policy, err, tt.wantErr)
+		}
+		if tt.wantErr == nil && err == nil && len(result.Artifacts) != 1 {
+			t.Errorf("policy %q: %d artifacts, want the stored one", tt.policy, len(result.Artifacts))
+		}
+	}
+}
+
+func TestResultProfileFallback(t *testing.T) {
+	const (
+		stored         = "tag:example.com,2024:stored"
+		defaultProfile = "tag:example.com,2024:default"
+	)
+
+	ed := NewEndorsementDistributor(nil, config.DistributorConfig{DefaultProfile: defaultProfile}, zap.NewNop().Sugar())
+
+	q, err := ParseQuery(refValQuery(t))
+	if err != nil {
+		t.Fatalf("ParseQuery: %v", err)
+	}
+	noProfile := coserv.Coserv{Query: q.Query}
+
+	tests := []struct {
+		name      string
+		q         coserv.Coserv
+		requested string
+		groups    []KeyedArtifacts
+		want      string
+	}{
+		{"query", q, "tag:example.com,2024:requested", []KeyedArtifacts{{Profile: stored}}, testProfile},
+		{"requested", noProfile, "tag:example.com,2024:requested", []KeyedArtifacts{{Profile: stored}}, "tag:example.com,2024:requested"},
+		{"stored", noProfile, "", []KeyedArtifacts{{Profile: stored}, {}}, stored},
+		{"stored profiles disagree", noProfile, "", []KeyedArtifacts{{Profile: stored}, {Profile: "tag:example.com,2024:other"}}, defaultProfile},
+		{"none stored", noProfile, "", []KeyedArtifacts{{}}, defaultProfile},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ed.resultProfile(tt.q, tt.requested, tt.groups)
+			if err != nil {
+				t.Fatalf("resultProfile: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("resultProfile = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// profileCountingStore counts the StoredProfile calls made to it
+type profileCountingStore struct {
+	Store
+	calls int
+}
+
+func (s *profileCountingStore) StoredProfile(ctx context.Context, key string) (string, error) {
+	s.calls++
+	return s.Store.StoredProfile(ctx, key)
+}
+
+func TestGetChecksStoredProfileWithoutExtraLookups(t *testing.T) {
+	ms, err := NewMemoryStore(config.DatabaseConfig{})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	s := &profileCountingStore{Store: ms}
+
+	query := refValQuery(t)
+	ctx := context.Background()
+	for _, key := range queryKeys(t, "acme", query) {
+		if _, err := ms.SetWithProfile(ctx, key, "tag:example.com,2024:other", ArtifactTypeReferenceValues, time.Time{}, [][]byte{[]byte("artifact")}); err != nil {
+			t.Fatalf("SetWithProfile: %v", err)
+		}
+	}
+
+	ed := NewEndorsementDistributor(s, config.DistributorConfig{ResultEncoding: "raw"}, zap.NewNop().Sugar())
+	if _, err := ed.GetEndorsementsResult(ctx, "acme", query, "application/coserv+cbor", QueryOptions{}); !errors.Is(err, ErrStoredProfileMismatch) {
+		t.Errorf("GetEndorsementsResult = %v, want ErrStoredProfileMismatch", err)
+	}
+	if s.calls != 0 {
+		t.Errorf("StoredProfile called %d times, want the profile to come with Get", s.calls)
+	}
+}
+
+func TestGetEndorsementsAgreesWithResult(t *testing.T) {
+	query := refValQuery(t)
+	ctx := context.Background()
+
+	for _, encoding := range []string{ResultEncodingCoserv, ResultEncodingRaw} {
+		ms, err := NewMemoryStore(config.DatabaseConfig{})
+		if err != nil {
+			t.Fatalf("NewMemoryStore: %v", err)
+		}
+		artifact := digestArtifact(t, swid.Sha256, 32)
+		for _, key := range queryKeys(t, "acme", query) {
+			if err := ms.Set(ctx, key, [][]byte{artifact}); err != nil {
+				t.Fatalf("Set: %v", err)
+			}
+		}
+
+		ed := NewEndorsementDistributor(ms, config.DistributorConfig{ResultEncoding: encoding}, zap.NewNop().Sugar())
+
+		data, err := ed.GetEndorsements(ctx, "acme", query, "application/coserv+cbor", QueryOptions{})
+		if err != nil {
+			t.Fatalf("%s: GetEndorsements: %v", encoding, err)
+		}
+		result, err := ed.GetEndorsementsResult(ctx, "acme", query, "application/coserv+cbor", QueryOptions{})
+		if err != nil {
+			t.Fatalf("%s: GetEndorsementsResult: %v", encoding, err)
+		}
+
+		if len(result.Artifacts) != 1 || !bytes.Equal(result.Artifacts[0], artifact) {
+			t.Errorf("%s: result holds %d artifacts, want the one stored", encoding, len(result.Artifacts))
+		}
+		if (result.Coserv != nil) != (encoding == ResultEncodingCoserv) {
+			t.Errorf("%s: result carries a CoSERV result %v, want one only for the coserv encoding", encoding, result.Coserv != nil)
+		}
+
+		encoded, err := result.Encode()
+		if err != nil {
+			t.Fatalf("%s: Encode: %v", encoding, err)
+		}
+		if !bytes.Equal(encoded, data) {
+			t.Errorf("%s: GetEndorsements returned %x, want the encoded result %x", encoding, data, encoded)
+		}
+	}
+}
+
+func TestStoredProfileMismatch(t *testing.T) {
+	const other = "tag:example.com,2024:other"
+
+	selector := coserv.NewEnvironmentSelector()
+	for _, id := range []comid.ImplID{comid.TestImplID, {1}, {2}} {
+		selector.AddClass(*comid.NewClassImplID(id))
+	}
+	query := encodeQuery(t, testProfile, coserv.ArtifactTypeReferenceValues, selector)
+	keys := queryKeys(t, "acme", query)
+
+	// Stored under the query's profile, another one and none
+	newStore := func(t *testing.T, profiles ...string) *MemoryStore {
+		ms, err := NewMemoryStore(config.DatabaseConfig{})
+		if err != nil {
+			t.Fatalf("NewMemoryStore: %v", err)
+		}
+		for i, profile := range profiles {
+			artifacts := [][]byte{[]byte(keys[i])}
+			if profile == "" {
+				err = ms.Set(context.Background(), keys[i], artifacts)
+			} else {
+				_, err = ms.SetWithProfile(context.Background(), keys[i], profile, ArtifactTypeReferenceValues, time.Time{}, artifacts)
+			}
+			if err != nil {
+				t.Fatalf("storing %s: %v", keys[i], err)
+			}
+		}
+		return ms
+	}
+
+	tests := []struct {
+		name     string
+		policy   string
+		profiles []string
+		want     []string
+		wantErr  error
+	}{
+		{"error", "error", []string{testProfile, other, ""}, nil, ErrStoredProfileMismatch},
+		{"error by default", "", []string{testProfile, other, ""}, nil, ErrStoredProfileMismatch},
+		{"filter", "filter", []string{testProfile, other, ""}, []string{keys[0], keys[2]}, nil},
+		{"filter leaving nothing", "filter", []string{other}, nil, ErrNoArtifacts},
+		{"no mismatch", "error", []string{testProfile, "", testProfile}, keys, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ed := NewEndorsementDistributor(newStore(t, tt.profiles...), config.DistributorConfig{
+				ResultEncoding:        "raw",
+				StoredProfileMismatch: tt.policy,
+			}, zap.NewNop().Sugar())
+
+			result, err := ed.GetEndorsementsResult(context.Background(), "acme", query, "application/coserv+cbor", QueryOptions{})
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("GetEndorsementsResult = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetEndorsementsResult: %v", err)
+			}
+
+			var got []string
+			for _, a := range result.Artifacts {
+				got = append(got, string(a))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("artifacts = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSupportedProfileAllowlist(t *testing.T) {
+	const other = "tag:example.com,2024:other"
+
+	ms, err := NewMemoryStore(config.DatabaseConfig{})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	ctx := context.Background()
+	for _, key := range queryKeys(t, "acme", refValQuery(t)) {
+		if err := ms.Set(ctx, key, [][]byte{[]byte("artifact")}); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+
+	selector := coserv.NewEnvironmentSelector().AddClass(*comid.NewClassImplID(comid.TestImplID))
+	otherQuery := encodeQuery(t, other, coserv.ArtifactTypeReferenceValues, selector)
+	requestingOther := mime.FormatMediaType("application/coserv+cbor", map[string]string{"profile": other})
+
+	tests := []struct {
+		name      string
+		supported []string
+		query     string
+		mediaType string
+		wantErr   error
+	}{
+		{"listed", []string{testProfile}, refValQuery(t), "application/coserv+cbor", nil},
+		{"query profile not listed", []string{testProfile}, otherQuery, "application/coserv+cbor", ErrUnsupportedProfile},
+		{"requested profile not listed", []string{testProfile}, refValQuery(t), requestingOther, ErrUnsupportedProfile},
+		{"no allowlist", nil, otherQuery, "application/coserv+cbor", nil},
+	}
+
+	for _, tt := range tests {
+		ed := NewEndorsementDistributor(ms, config.DistributorConfig{
+			ResultEncoding:    "raw",
+			SupportedProfiles: tt.supported,
+		}, zap.NewNop().Sugar())
+
+		_, err := ed.GetEndorsementsResult(ctx, "acme", tt.query, tt.mediaType, QueryOptions{})
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: GetEndorsementsResult = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestGenerateKeyDropsRepeats(t *testing.T) {
+	selector := coserv.NewEnvironmentSelector()
+	for _, id := range []comid.ImplID{comid.TestImplID, {1}, comid.TestImplID, {1}} {
+		selector.AddClass(*comid.NewClassImplID(id))
+	}
+	query := encodeQuery(t, testProfile, coserv.ArtifactTypeReferenceValues, selector)
+
+	want := queryKeys(t, "acme", encodeQuery(t, testProfile, coserv.ArtifactTypeReferenceValues,
+		coserv.NewEnvironmentSelector().
+			AddClass(*comid.NewClassImplID(comid.TestImplID)).
+			AddClass(*comid.NewClassImplID(comid.ImplID{1}))))
+
+	if got := queryKeys(t, "acme", query); !slices.Equal(got, want) {
+		t.Errorf("GenerateKey = %q, want each key once, in order: %q", got, want)
+	}
+	if got := dedupeKeys([]string{"a", "b", "a", "c", "b"}); !slices.Equal(got, []string{"a", "b", "c"}) {
+		t.Errorf("dedupeKeys = %q, want a, b, c", got)
+	}
+}
+
+func TestValidateQuery(t *testing.T) {
+	instance, err := comid.NewUEIDInstance(comid.TestUEID)
+	if err != nil {
+		t.Fatalf("NewUEIDInstance: %v", err)
+	}
+	instID, err := extractInstID(*instance)
+	if err != nil {
+		t.Fatalf("extractInstID: %v", err)
+	}
+
+	twoClasses := coserv.NewEnvironmentSelector().
+		AddClass(*comid.NewClassImplID(comid.TestImplID)).
+		AddClass(*comid.NewClassImplID(comid.ImplID{1}))
+
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{"reference values", refValQuery(t),
+			[]string{arm.RefValLookupKey(SchemeName, "acme", comid.TestImplID.String())}},
+		{"trust anchors", taQuery(t),
+			[]string{arm.TaCoservLookupKey(SchemeName, "acme", instID)}},
+		{"several classes", encodeQuery(t, testProfile, coserv.ArtifactTypeReferenceValues, twoClasses),
+			[]string{
+				arm.RefValLookupKey(SchemeName, "acme", comid.TestImplID.String()),
+				arm.RefValLookupKey(SchemeName, "acme", comid.ImplID{1}.String()),
+			}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ValidateQuery("acme", tt.query)
+			if err != nil {
+				t.Fatalf("ValidateQuery: %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("ValidateQuery = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateQueryInvalid(t *testing.T) {
+	vendor := "ACME"
+	noClassID := coserv.NewEnvironmentSelector().AddClass(comid.Class{Vendor: &vendor})
+
+	tests := []struct {
+		name      string
+		tenant    string
+		query     string
+		wantIs    error
+		wantInErr string
+	}{
+		{"no tenant", "", refValQuery(t), nil, "missing tenant ID"},
+		{"not base64url", "acme", "not*base64!", ErrMalformedQuery, "decoding base64url"},
+		{"CBOR that isn't CoSERV", "acme", base64.RawURLEncoding.EncodeToString([]byte{0x01}), ErrInvalidQuery, ""},
+		{"class without class-id", "acme",
+			encodeQuery(t, testProfile, coserv.ArtifactTypeReferenceValues, noClassID), nil, "missing class-id"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := ValidateQuery(tt.tenant, tt.query)
+			if err == nil {
+				t.Fatalf("ValidateQuery = %q, want an error", keys)
+			}
+			if tt.wantIs != nil && !errors.Is(err, tt.wantIs) {
+				t.Errorf("ValidateQuery = %v, want %v", err, tt.wantIs)
+			}
+			if !strings.Contains(err.Error(), tt.wantInErr) {
+				t.Errorf("ValidateQuery = %v, want an error containing %q", err, tt.wantInErr)
+			}
+		})
+	}
+}
+
+func TestMultiSchemeMerge(t *testing.T) {
+	ms, err := NewMemoryStore(config.DatabaseConfig{})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	ed := NewEndorsementDistributor(ms, config.DistributorConfig{
+		ResultEncoding: ResultEncodingRaw,
+		ProfileSchemes: []config.ProfileSchemesConfig{{Profile: testProfile, Schemes: []string{"ARM_CCA_V1", SchemeName}}},
+	}, zap.NewNop().Sugar())
+
+	ctx := context.Background()
+	implID := comid.TestImplID.String()
+	for scheme, artifacts := range map[string][]string{
+		"ARM_CCA_V1": {"a", "b"},
+		SchemeName:   {"b", "c"},
+	} {
+		var data [][]byte
+		for _, a := range artifacts {
+			data = append(data, []byte(a))
+		}
+		if err := ms.Set(ctx, arm.RefValLookupKey(scheme, "acme", implID), data); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+
+	result, err := ed.GetEndorsementsResult(ctx, "acme", refValQuery(t), "application/coserv+cbor", QueryOptions{})
+	if err != nil {
+		t.Fatalf("GetEndorsementsResult: %v", err)
+	}
+
+	// Artifacts come in the order of the schemes, each only once
+	var got []string
+	for _, a := range result.Artifacts {
+		got = append(got, string(a))
+	}
+	if want := []string{"a", "b", "c"}; !slices.Equal(got, want) {
+		t.Errorf("artifacts = %q, want %q", got, want)
+	}
+	if result.Requested != 2 || len(result.Groups) != 2 {
+		t.Errorf("result = %d keys requested, %d groups; want 2 of each", result.Requested, len(result.Groups))
+	}
+}
+
+func TestResultGroupedByEnvironment(t *testing.T) {
+	ms, err := NewMemoryStore(config.DatabaseConfig{})
+	if err != nil {
+		t.Fatalf("NewMemoryStore: %v", err)
+	}
+	ed := NewEndorsementDistributor(ms, config.DistributorConfig{ResultEncoding: "raw"}, zap.NewNop().Sugar())
+
+	// The third environment has nothing stored
+	selector := coserv.NewEnvironmentSelector()
+	for _, id := range []comid.ImplID{comid.TestImplID, {1}, {2}} {
+		selector.AddClass(*comid.NewClassImplID(id))
+	}
+	query := encodeQuery(t, testProfile, coserv.ArtifactTypeReferenceValues, selector)
+
+	keys := queryKeys(t, "acme", query)
+	if len(keys) != 3 {
+		t.Fatalf("%d lookup keys, want one per environment", len(keys))
+	}
+
+	ctx := context.Background()
+	stored := map[string][]string{
+		keys[0]: {"a", "shared"},
+		keys[1]: {"b", "shared"},
+	}
+	for key, artifacts := range stored {
+		var data [][]byte
+		for _, a := range artifacts {
+			data = append(data, []byte(a))
+		}
+		if err := ms.Set(ctx, key, data); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+
+	strs := func(artifacts [][]byte) []string {
+		var out []string
+		for _, a := range artifacts {
+			out = append(out, string(a))
+		}
+		return out
+	}
+
+	tests := []struct {
+		name          string
+		opts          QueryOptions
+		wantArtifacts []string
+		wantGroups    map[string][]string
+	}{
+		{"all", QueryOptions{}, []string{"a", "shared", "b"}, stored},
+		{"first page", QueryOptions{Limit: 1}, []string{"a"}, map[string][]string{keys[0]: {"a"}}},
+	}
+
+	for _, tt := range tests {
+		result, err := ed.GetEndorsementsResult(ctx, "acme", query, "application/coserv+cbor", tt.opts)
+		if err != nil {
+			t.Fatalf("%s: GetEndorsementsResult: %v", tt.name, err)
+		}
+
+		if got := strs(result.Artifacts); !slices.Equal(got, tt.wantArtifacts) {
+			t.Errorf("%s: artifacts = %q, want %q", tt.name, got, tt.wantArtifacts)
+		}
+		if result.Requested != 3 {
+			t.Errorf("%s: %d environments requested, want 3", tt.name, result.Requested)
+		}
+
+		if len(result.Groups) != len(tt.wantGroups) {
+			t.Errorf("%s: %d groups, want %d", tt.name, len(result.Groups), len(tt.wantGroups))
+		}
+		for _, g := range result.Groups {
+			if got, want := strs(g.Artifacts), tt.wantGroups[g.Key]; !slices.Equal(got, want) {
+				t.Errorf("%s: group %s holds %q, want %q", tt.name, g.Key, got, want)
+			}
+		}
+	}
+}
+
+func TestValueFormatVersions(t *testing.T) {
+	s := &PostgresStore{}
+	artifacts := [][]byte{[]byte("a"), {0x00, 0xff}}
+
+	encoded, err := s.encodeValue(artifacts)
+	if err != nil {
+		t.Fatalf("encodeValue: %v", err)
+	}
+
+	var sv storedValue
+	if err := json.Unmarshal(encoded, &sv); err != nil {
+		t.Fatalf("decoding the stored value: %v", err)
+	}
+	if sv.Version != valueFormatVersion {
+		t.Errorf("encodeValue wrote version %d, want %d", sv.Version, valueFormatVersion)
+	}
+
+	// Values written before the format was versioned read the same
+	for name, val := range map[string]string{
+		"current":   string(encoded),
+		"version 1": `["YQ==", "AP8="]`,
+	} {
+		got, err := s.decodeValue(val)
+		if err != nil {
+			t.Fatalf("%s: decodeValue: %v", name, err)
+		}
+		if !reflect.DeepEqual(got, artifacts) {
+			t.Errorf("%s: decodeValue = %q, want %q", name, got, artifacts)
+		}
+	}
+}
+
+func TestDecodeRowSizeGuard(t *testing.T) {
+	core, logs := observer.New(zap.WarnLevel)
+	s := &PostgresStore{maxValueBytes: 64, logger: zap.New(core).Sugar()}
+
+	val, err := s.encodeValue([][]byte{[]byte("artifact")})
+	if err != nil {
+		t.Fatalf("encodeValue: %v", err)
+	}
+
+	if _, err := s.decodeRow("ARM_CCA://acme/small", len(val), string(val)); err != nil {
+		t.Errorf("decodeRow of a value within the limit: %v", err)
+	}
+
+	// Get doesn't read oversized values, so only their size reaches
+	// decodeRow
+	_, err = s.decodeRow("ARM_CCA://acme/big", 65, "")
+	if err == nil || !strings.Contains(err.Error(), "stored value too large") {
+		t.Errorf("decodeRow of an oversized value = %v, want stored value too large", err)
+	}
+
+	entries := logs.FilterMessage("Stored value exceeds size limit").All()
+	if len(entries) != 1 || entries[0].ContextMap()["key"] != "ARM_CCA://acme/big" {
+		t.Errorf("logged %v, want one warning naming the oversized key", entries)
+	}
+
+	s.maxValueBytes = 0
+	if _, err := s.decodeRow("ARM_CCA://acme/small", len(val), string(val)); err != nil {
+		t.Errorf("decodeRow without a limit: %v", err)
+	}
+}
+
+func TestCheckProfile(t *testing.T) {
+	const other = "tag:example.com,2024:other"
+
+	q, err := ParseQuery(refValQuery(t))
+	if err != nil {
+		t.Fatalf("ParseQuery: %v", err)
+	}
+	noProfile := coserv.Coserv{Query: q.Query}
+	withProfile := func(p string) string {
+		return mime.FormatMediaType("application/coserv+cbor", map[string]string{"profile": p})
+	}
+
+	tests := []struct {
+		name      string
+		strict    bool
+		q         coserv.Coserv
+		mediaType string
+		want      string
+		wantErr   bool
+	}{
+		{"no profile requested", true, q, "application/coserv+cbor", "", false},
+		{"same profile", true, q, withProfile(testProfile), testProfile, false},
+		{"query carries none", true, noProfile, withProfile(other), other, false},
+		{"mismatch, strict", true, q, withProfile(other), "", true},
+		{"mismatch, lenient", false, q, withProfile(other), other, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ed := NewEndorsementDistributor(nil, config.DistributorConfig{StrictProfileMatch: tt.strict}, zap.NewNop().Sugar())
+
+			got, err := ed.checkProfile(ed.logger, tt.q, tt.mediaType)
+			if tt.wantErr {
+				if !errors.Is(err, ErrProfileMismatch) {
+					t.Errorf("checkProfile = %q, %v; want ErrProfileMismatch", got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("checkProfile = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}